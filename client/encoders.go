@@ -17,25 +17,34 @@ package client
 
 import (
 	"code.google.com/p/goprotobuf/proto"
-	"crypto/hmac"
-	"crypto/md5"
-	"crypto/sha1"
 	"encoding/json"
+	"fmt"
 	"github.com/mozilla-services/heka/message"
-	"hash"
 )
 
 type Encoder interface {
 	EncodeMessage(msg *message.Message) ([]byte, error)
 	EncodeMessageStream(msg *message.Message, outBytes *[]byte) error
+	SetCompression(compression message.Header_Compression)
+}
+
+// Stream framing settings shared by the encoders.
+type framing struct {
+	signer      *message.MessageSigningConfig
+	compression message.Header_Compression
+}
+
+// Compresses each encoded message w/ `compression` when framing it.
+func (self *framing) SetCompression(compression message.Header_Compression) {
+	self.compression = compression
 }
 
 type JsonEncoder struct {
-	signer *message.MessageSigningConfig
+	framing
 }
 
 func NewJsonEncoder(signer *message.MessageSigningConfig) *JsonEncoder {
-	return &JsonEncoder{signer}
+	return &JsonEncoder{framing{signer: signer}}
 }
 
 func (self *JsonEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
@@ -45,17 +54,18 @@ func (self *JsonEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
 func (self *JsonEncoder) EncodeMessageStream(msg *message.Message, outBytes *[]byte) (err error) {
 	msgBytes, err := self.EncodeMessage(msg)
 	if err == nil {
-		err = createStream(msgBytes, message.Header_JSON, outBytes, self.signer)
+		err = createStream(msgBytes, message.Header_JSON, false, outBytes,
+			&self.framing)
 	}
 	return
 }
 
 type ProtobufEncoder struct {
-	signer *message.MessageSigningConfig
+	framing
 }
 
 func NewProtobufEncoder(signer *message.MessageSigningConfig) *ProtobufEncoder {
-	return &ProtobufEncoder{signer}
+	return &ProtobufEncoder{framing{signer: signer}}
 }
 
 func (self *ProtobufEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
@@ -65,33 +75,96 @@ func (self *ProtobufEncoder) EncodeMessage(msg *message.Message) ([]byte, error)
 func (self *ProtobufEncoder) EncodeMessageStream(msg *message.Message, outBytes *[]byte) (err error) {
 	msgBytes, err := self.EncodeMessage(msg) // TODO if we compute the size of the header first this can be marshaled directly to outBytes
 	if err == nil {
-		err = createStream(msgBytes, message.Header_PROTOCOL_BUFFER, outBytes, self.signer)
+		err = createStream(msgBytes, message.Header_PROTOCOL_BUFFER, false, outBytes,
+			&self.framing)
+	}
+	return
+}
+
+type MsgPackEncoder struct {
+	framing
+}
+
+func NewMsgPackEncoder(signer *message.MessageSigningConfig) *MsgPackEncoder {
+	return &MsgPackEncoder{framing{signer: signer}}
+}
+
+func (self *MsgPackEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
+	return msg.MarshalMsgpack()
+}
+
+func (self *MsgPackEncoder) EncodeMessageStream(msg *message.Message, outBytes *[]byte) (err error) {
+	msgBytes, err := self.EncodeMessage(msg)
+	if err == nil {
+		err = createStream(msgBytes, message.Header_MSGPACK, false, outBytes,
+			&self.framing)
 	}
 	return
 }
 
+type CborEncoder struct {
+	framing
+}
+
+func NewCborEncoder(signer *message.MessageSigningConfig) *CborEncoder {
+	return &CborEncoder{framing{signer: signer}}
+}
+
+func (self *CborEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
+	return msg.MarshalCbor()
+}
+
+func (self *CborEncoder) EncodeMessageStream(msg *message.Message, outBytes *[]byte) (err error) {
+	msgBytes, err := self.EncodeMessage(msg)
+	if err == nil {
+		err = createStream(msgBytes, message.Header_CBOR, false, outBytes,
+			&self.framing)
+	}
+	return
+}
+
+// Wraps `records`, a stream of framed messages as produced by
+// EncodeMessageStream, in a single frame compressed w/ `compression`.
+// Compressing a batch of similar messages together usually does much better
+// than compressing each one on its own.
+func CreateBatchStream(records []byte, compression message.Header_Compression,
+	outBytes *[]byte, signer *message.MessageSigningConfig) error {
+
+	if len(records) > message.MAX_BATCH_SIZE {
+		return fmt.Errorf("batch exceeds the maximum size (bytes): %d",
+			message.MAX_BATCH_SIZE)
+	}
+	f := &framing{signer: signer, compression: compression}
+	return createStream(records, message.Default_Header_MessageEncoding, true,
+		outBytes, f)
+}
+
 func createStream(msgBytes []byte, encoding message.Header_MessageEncoding,
-	outBytes *[]byte, msc *message.MessageSigningConfig) error {
+	batch bool, outBytes *[]byte, f *framing) (err error) {
 	h := &message.Header{}
-	h.SetMessageLength(uint32(len(msgBytes)))
 	if encoding != message.Default_Header_MessageEncoding {
 		h.SetMessageEncoding(encoding)
 	}
-	if msc != nil {
-		h.SetHmacSigner(msc.Name)
-		h.SetHmacKeyVersion(msc.Version)
-		var hm hash.Hash
-		switch msc.Hash {
-		case "sha1":
-			hm = hmac.New(sha1.New, []byte(msc.Key))
-			h.SetHmacHashFunction(message.Header_SHA1)
-		default:
-			hm = hmac.New(md5.New, []byte(msc.Key))
+	if batch {
+		h.SetBatch(true)
+	}
+	if f.signer != nil {
+		// The signature covers the uncompressed message.
+		if err = f.signer.Sign(h, msgBytes); err != nil {
+			return
 		}
-
-		hm.Write(msgBytes)
-		h.SetHmac(hm.Sum(nil))
 	}
+	if f.compression != message.Header_NONE {
+		if msgBytes, err = message.Compress(f.compression, nil, msgBytes); err != nil {
+			return
+		}
+		h.SetCompression(f.compression)
+	}
+	if len(msgBytes) > message.MAX_MESSAGE_SIZE {
+		return fmt.Errorf("message exceeds the maximum length (bytes): %d",
+			message.MAX_MESSAGE_SIZE)
+	}
+	h.SetMessageLength(uint32(len(msgBytes)))
 	headerSize := uint8(proto.Size(h))
 	requiredSize := int(3 + headerSize)
 	if cap(*outBytes) < requiredSize {
@@ -102,7 +175,7 @@ func createStream(msgBytes []byte, encoding message.Header_MessageEncoding,
 	(*outBytes)[0] = message.RECORD_SEPARATOR
 	(*outBytes)[1] = uint8(headerSize)
 	pbuf := proto.NewBuffer((*outBytes)[2:2])
-	err := pbuf.Marshal(h)
+	err = pbuf.Marshal(h)
 	if err != nil {
 		return err
 	}
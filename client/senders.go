@@ -16,7 +16,10 @@
 package client
 
 import (
+	"crypto/tls"
+	"math/rand"
 	"net"
+	"time"
 )
 
 type Sender interface {
@@ -24,23 +27,116 @@ type Sender interface {
 	Close()
 }
 
+// Backoff generates the delays between successive attempts at a failing
+// operation. Each delay is chosen at random from the upper half of the
+// current interval, which doubles after every attempt up to `Max`.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	current time.Duration
+}
+
+func NewBackoff(initial, max time.Duration) *Backoff {
+	return &Backoff{Initial: initial, Max: max}
+}
+
+// Returns how long to wait before the next attempt.
+func (self *Backoff) Next() (delay time.Duration) {
+	if self.current == 0 {
+		self.current = self.Initial
+	}
+	half := int64(self.current / 2)
+	delay = time.Duration(half + rand.Int63n(half+1))
+	if self.current *= 2; self.current > self.Max {
+		self.current = self.Max
+	}
+	return
+}
+
+// Starts the delays over from `Initial`, to be called after a success.
+func (self *Backoff) Reset() {
+	self.current = 0
+}
+
+const (
+	// Number of times a NetworkSender will redial and resend a message
+	// before returning the write error.
+	DefaultMaxRetries = 5
+)
+
 type NetworkSender struct {
 	connection net.Conn
+	proto      string
+	addr       string
+	tlsConfig  *tls.Config
+	backoff    *Backoff
+	// Maximum number of times to redial and resend a message after a
+	// failed write. A negative value means retry until the write succeeds.
+	MaxRetries int
 }
 
 func NewNetworkSender(proto, addr string) (self *NetworkSender, err error) {
-	conn, err := net.Dial(proto, addr)
-	if err == nil {
-		self = &(NetworkSender{conn})
+	return newNetworkSender(proto, addr, nil)
+}
+
+// Returns a NetworkSender that encrypts its connection w/ TLS.
+func NewTlsSender(proto, addr string, config *tls.Config) (self *NetworkSender,
+	err error) {
+	return newNetworkSender(proto, addr, config)
+}
+
+func newNetworkSender(proto, addr string, config *tls.Config) (
+	self *NetworkSender, err error) {
+	self = &NetworkSender{
+		proto:      proto,
+		addr:       addr,
+		tlsConfig:  config,
+		backoff:    NewBackoff(100*time.Millisecond, 10*time.Second),
+		MaxRetries: DefaultMaxRetries,
+	}
+	if self.connection, err = self.dial(); err != nil {
+		self = nil
 	}
 	return
 }
 
-func (self *NetworkSender) SendMessage(outBytes []byte) (err error) {
-	_, err = self.connection.Write(outBytes)
+func (self *NetworkSender) dial() (conn net.Conn, err error) {
+	if self.tlsConfig == nil {
+		return net.Dial(self.proto, self.addr)
+	}
+	var tlsConn *tls.Conn
+	if tlsConn, err = tls.Dial(self.proto, self.addr, self.tlsConfig); err == nil {
+		conn = tlsConn
+	}
 	return
 }
 
+// Writes the message to the connection. A failed write closes the
+// connection, which is then redialed so the same bytes can be resent.
+func (self *NetworkSender) SendMessage(outBytes []byte) (err error) {
+	for attempt := 0; ; attempt++ {
+		if self.connection == nil {
+			self.connection, err = self.dial()
+		}
+		if err == nil {
+			if _, err = self.connection.Write(outBytes); err == nil {
+				self.backoff.Reset()
+				return
+			}
+			self.connection.Close()
+			self.connection = nil
+		} else {
+			self.connection = nil
+		}
+		if self.MaxRetries >= 0 && attempt >= self.MaxRetries {
+			return
+		}
+		time.Sleep(self.backoff.Next())
+	}
+}
+
 func (self *NetworkSender) Close() {
-	self.connection.Close()
+	if self.connection != nil {
+		self.connection.Close()
+	}
 }
@@ -56,6 +56,7 @@ type FloodTest struct {
 	SignedPercentage     float64                      `toml:"signed_percentage"`
 	VariableSizeMessages bool                         `toml:"variable_size_messages"`
 	StaticMessageSize    uint64                       `toml:"static_message_size"`
+	Compression          string                       `toml:"compression"`
 }
 
 type FloodConfig map[string]FloodTest
@@ -253,7 +254,21 @@ func main() {
 	case "protobuf":
 		unsignedEncoder = client.NewProtobufEncoder(nil)
 		signedEncoder = client.NewProtobufEncoder(&test.Signer)
+	case "msgpack":
+		unsignedEncoder = client.NewMsgPackEncoder(nil)
+		signedEncoder = client.NewMsgPackEncoder(&test.Signer)
+	case "cbor":
+		unsignedEncoder = client.NewCborEncoder(nil)
+		signedEncoder = client.NewCborEncoder(&test.Signer)
+	default:
+		log.Fatalf("Unsupported encoder: '%s'\n", test.Encoder)
 	}
+	compression, err := message.CompressionByName(test.Compression)
+	if err != nil {
+		log.Fatalf("Error creating encoder: %s\n", err.Error())
+	}
+	unsignedEncoder.SetCompression(compression)
+	signedEncoder.SetCompression(compression)
 
 	var numTestMessages = 1
 	var unsignedMessages [][]byte
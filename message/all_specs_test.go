@@ -29,6 +29,10 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(MessageFieldsSpec)
 	r.AddSpec(MessageEqualsSpec)
 	r.AddSpec(MatcherSpecificationSpec)
+	r.AddSpec(MatcherSetSpec)
+	r.AddSpec(EncodingsSpec)
+	r.AddSpec(CompressionSpec)
+	r.AddSpec(SigningSpec)
 	gospec.MainGoTest(r, t)
 }
 
@@ -0,0 +1,335 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR major types, see RFC 7049.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborString = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+// Serializes the message w/ CBOR, see RFC 7049.
+func (m *Message) MarshalCbor() ([]byte, error) {
+	w := &cborWriter{make([]byte, 0, 256)}
+	writeMessage(w, m)
+	return w.buf, nil
+}
+
+// Replaces the message contents w/ the CBOR serialized message in `data`.
+// Tags are accepted but ignored.
+func (m *Message) UnmarshalCbor(data []byte) (err error) {
+	m.Reset()
+	r := &cborReader{data: data}
+	var value interface{}
+	if value, err = r.readValue(0); err != nil {
+		return fmt.Errorf("cbor: %s", err)
+	}
+	if r.pos != len(data) {
+		return errors.New("cbor: trailing data")
+	}
+	if err = readMessage(value, m); err != nil {
+		return fmt.Errorf("cbor: %s", err)
+	}
+	return
+}
+
+type cborWriter struct {
+	buf []byte
+}
+
+func (w *cborWriter) writeUint(initial byte, n uint64, size int) {
+	w.buf = append(w.buf, initial)
+	for shift := uint(8 * (size - 1)); size > 0; size-- {
+		w.buf = append(w.buf, byte(n>>shift))
+		shift -= 8
+	}
+}
+
+// Writes an item head, w/ `n` in the shortest form that holds it.
+func (w *cborWriter) writeHead(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		w.buf = append(w.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		w.writeUint(major|24, n, 1)
+	case n <= math.MaxUint16:
+		w.writeUint(major|25, n, 2)
+	case n <= math.MaxUint32:
+		w.writeUint(major|26, n, 4)
+	default:
+		w.writeUint(major|27, n, 8)
+	}
+}
+
+func (w *cborWriter) writeMapHeader(n int) {
+	w.writeHead(cborMap, uint64(n))
+}
+
+func (w *cborWriter) writeArrayHeader(n int) {
+	w.writeHead(cborArray, uint64(n))
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.writeHead(cborString, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.writeHead(cborBytes, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *cborWriter) writeInt(i int64) {
+	if i >= 0 {
+		w.writeHead(cborUint, uint64(i))
+	} else {
+		w.writeHead(cborNegInt, uint64(-1-i))
+	}
+}
+
+func (w *cborWriter) writeFloat(f float64) {
+	w.writeUint(cborSimple<<5|27, math.Float64bits(f), 8)
+}
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, cborSimple<<5|21)
+	} else {
+		w.buf = append(w.buf, cborSimple<<5|20)
+	}
+}
+
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+// Reads an item head, returning its major type, its additional info and
+// the argument that follows. An additional info of cborIndefinite marks the
+// indefinite length form.
+func (r *cborReader) readHead() (major, info byte, n uint64, err error) {
+	if r.pos >= len(r.data) {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	b := r.data[r.pos]
+	r.pos++
+	major, info = b>>5, b&0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		n, err = readUint(r.data, &r.pos, 1<<(info-24))
+	case info != cborIndefinite:
+		err = fmt.Errorf("invalid additional info %d", info)
+	}
+	return
+}
+
+// Reports whether the next byte ends an indefinite length item, consuming
+// it if so.
+func (r *cborReader) atBreak() bool {
+	if r.pos < len(r.data) && r.data[r.pos] == cborBreak {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+// Reads the next value as a nil, bool, int64, float64, string, []byte,
+// []interface{} or map[string]interface{}.
+func (r *cborReader) readValue(depth int) (value interface{}, err error) {
+	if depth > maxEncodingDepth {
+		return nil, errors.New("nested too deeply")
+	}
+	major, info, n, err := r.readHead()
+	if err != nil {
+		return
+	}
+	indefinite := info == cborIndefinite
+	if indefinite && (major == cborUint || major == cborNegInt ||
+		major == cborTag) {
+		return nil, fmt.Errorf("major type %d can't be indefinite", major)
+	}
+
+	switch major {
+	case cborUint:
+		value, err = uintToInt64(n)
+	case cborNegInt:
+		var i int64
+		if i, err = uintToInt64(n); err == nil {
+			value = -1 - i
+		}
+	case cborBytes:
+		value, err = r.readBody(major, n, indefinite)
+	case cborString:
+		var body []byte
+		if body, err = r.readBody(major, n, indefinite); err == nil {
+			value = string(body)
+		}
+	case cborArray:
+		value, err = r.readArray(n, indefinite, depth)
+	case cborMap:
+		value, err = r.readMap(n, indefinite, depth)
+	case cborTag:
+		value, err = r.readValue(depth + 1)
+	case cborSimple:
+		value, err = readSimple(info, n)
+	}
+	return
+}
+
+// Reads a byte or text string body, concatenating the chunks of an
+// indefinite length one.
+func (r *cborReader) readBody(major byte, n uint64, indefinite bool) (
+	body []byte, err error) {
+
+	if !indefinite {
+		return readBody(r.data, &r.pos, n)
+	}
+	body = make([]byte, 0)
+	var (
+		chunkMajor, info byte
+		chunk            []byte
+	)
+	for !r.atBreak() {
+		if chunkMajor, info, n, err = r.readHead(); err != nil {
+			return
+		}
+		if chunkMajor != major || info == cborIndefinite {
+			return nil, errors.New("invalid indefinite length string chunk")
+		}
+		if chunk, err = readBody(r.data, &r.pos, n); err != nil {
+			return
+		}
+		body = append(body, chunk...)
+	}
+	return
+}
+
+func (r *cborReader) readArray(n uint64, indefinite bool, depth int) (
+	array interface{}, err error) {
+
+	var values []interface{}
+	if indefinite {
+		values = make([]interface{}, 0)
+	} else {
+		if err = checkItemCount(r.data, r.pos, n); err != nil {
+			return
+		}
+		values = make([]interface{}, 0, n)
+	}
+	var value interface{}
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && r.atBreak() {
+			break
+		}
+		if value, err = r.readValue(depth + 1); err != nil {
+			return
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r *cborReader) readMap(n uint64, indefinite bool, depth int) (
+	m interface{}, err error) {
+
+	if !indefinite {
+		if err = checkItemCount(r.data, r.pos, n); err != nil {
+			return
+		}
+	}
+	values := make(map[string]interface{})
+	var key, value interface{}
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && r.atBreak() {
+			break
+		}
+		if key, err = r.readValue(depth + 1); err != nil {
+			return
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key %v isn't a string", key)
+		}
+		if value, err = r.readValue(depth + 1); err != nil {
+			return
+		}
+		values[keyString] = value
+	}
+	return values, nil
+}
+
+// Converts a major type 7 item, `n` being the simple value or the float
+// bits, depending on the additional info.
+func readSimple(info byte, n uint64) (value interface{}, err error) {
+	switch {
+	case info == 25:
+		value = halfToFloat64(uint16(n))
+	case info == 26:
+		value = float64(math.Float32frombits(uint32(n)))
+	case info == 27:
+		value = math.Float64frombits(n)
+	case info == cborIndefinite:
+		err = errors.New("unexpected break")
+	case n == 20:
+		value = false
+	case n == 21:
+		value = true
+	case n == 22 || n == 23: // null, undefined
+		value = nil
+	default:
+		err = fmt.Errorf("unsupported simple value %d", n)
+	}
+	return
+}
+
+// Converts IEEE 754 half precision float bits.
+func halfToFloat64(h uint16) (f float64) {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return
+}
@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"bytes"
+	"code.google.com/p/snappy-go/snappy"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	lz4 "github.com/bkaradzic/go-lz4"
+	"io"
+	"strings"
+)
+
+// Looks up a Header_Compression by its case insensitive name, an empty name
+// meaning NONE.
+func CompressionByName(name string) (compression Header_Compression, err error) {
+	if name == "" {
+		return Header_NONE, nil
+	}
+	value, ok := Header_Compression_value[strings.ToUpper(name)]
+	if !ok {
+		return Header_NONE, fmt.Errorf("unsupported compression: %s", name)
+	}
+	return Header_Compression(value), nil
+}
+
+// Compresses `src`, returning the result in `dst` if it's big enough.
+func Compress(compression Header_Compression, dst, src []byte) (out []byte,
+	err error) {
+
+	switch compression {
+	case Header_NONE:
+		out = append(dst[:0], src...)
+	case Header_GZIP:
+		buf := bytes.NewBuffer(dst[:0])
+		w := gzip.NewWriter(buf)
+		if _, err = w.Write(src); err == nil {
+			err = w.Close()
+		}
+		out = buf.Bytes()
+	case Header_SNAPPY:
+		out, err = snappy.Encode(dst[:cap(dst)], src)
+	case Header_LZ4:
+		out, err = lz4.Encode(dst[:cap(dst)], src)
+	default:
+		err = fmt.Errorf("unsupported compression: %d", compression)
+	}
+	return
+}
+
+// Decompresses `src`, returning the result in `dst` if it's big enough.
+// Fails w/o decompressing anything if the result would be bigger than
+// `maxSize`, so a small record can't be made to allocate a huge buffer.
+func Decompress(compression Header_Compression, dst, src []byte,
+	maxSize int) (out []byte, err error) {
+
+	var size int
+	switch compression {
+	case Header_NONE:
+		if len(src) > maxSize {
+			return nil, fmt.Errorf("decompressed size exceeds %d bytes", maxSize)
+		}
+		out = append(dst[:0], src...)
+	case Header_GZIP:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(src)); err != nil {
+			return
+		}
+		buf := bytes.NewBuffer(dst[:0])
+		if _, err = buf.ReadFrom(io.LimitReader(r, int64(maxSize)+1)); err != nil {
+			return
+		}
+		if buf.Len() > maxSize {
+			return nil, fmt.Errorf("decompressed size exceeds %d bytes", maxSize)
+		}
+		out = buf.Bytes()
+	case Header_SNAPPY:
+		if size, err = snappy.DecodedLen(src); err != nil {
+			return
+		}
+		if size > maxSize {
+			return nil, fmt.Errorf("decompressed size exceeds %d bytes", maxSize)
+		}
+		out, err = snappy.Decode(dst[:cap(dst)], src)
+	case Header_LZ4:
+		// The block is prefixed w/ its little-endian decompressed size.
+		if len(src) < 4 {
+			return nil, fmt.Errorf("lz4 block too short")
+		}
+		if size = int(binary.LittleEndian.Uint32(src)); size > maxSize {
+			return nil, fmt.Errorf("decompressed size exceeds %d bytes", maxSize)
+		}
+		out, err = lz4.Decode(dst[:cap(dst)], src)
+	default:
+		err = fmt.Errorf("unsupported compression: %d", compression)
+	}
+	return
+}
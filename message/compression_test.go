@@ -0,0 +1,69 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func CompressionSpec(c gospec.Context) {
+	src := []byte(strings.Repeat("compress me, ", 1000))
+
+	c.Specify("looks up compressions by name", func() {
+		compression, err := CompressionByName("Snappy")
+		c.Expect(err, gs.IsNil)
+		c.Expect(compression, gs.Equals, Header_SNAPPY)
+		compression, err = CompressionByName("")
+		c.Expect(err, gs.IsNil)
+		c.Expect(compression, gs.Equals, Header_NONE)
+		_, err = CompressionByName("bzip2")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	for _, compression := range []Header_Compression{Header_NONE, Header_GZIP,
+		Header_SNAPPY, Header_LZ4} {
+
+		compression := compression
+		c.Specify(compression.String(), func() {
+			compressed, err := Compress(compression, nil, src)
+			c.Assume(err, gs.IsNil)
+			if compression != Header_NONE {
+				c.Expect(len(compressed) < len(src), gs.IsTrue)
+			}
+
+			c.Specify("round trips", func() {
+				out, err := Decompress(compression, nil, compressed, len(src))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(out), gs.Equals, string(src))
+			})
+
+			c.Specify("won't decompress more than the maximum size", func() {
+				_, err := Decompress(compression, nil, compressed, len(src)-1)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+	}
+
+	c.Specify("rejects corrupt data", func() {
+		for _, compression := range []Header_Compression{Header_GZIP,
+			Header_SNAPPY, Header_LZ4} {
+			_, err := Decompress(compression, nil, []byte{1, 2, 3, 4, 5},
+				MAX_MESSAGE_SIZE)
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+	})
+}
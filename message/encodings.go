@@ -0,0 +1,394 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// The MessagePack and CBOR message encodings. Both serialize a Message as a
+// map using the same keys as the JSON encoding, so any of the three can be
+// produced or consumed by a generic library in the client's language.
+
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Nesting a Message never goes deeper than this, anything deeper is garbage.
+const maxEncodingDepth = 8
+
+// The primitives shared by the MessagePack and CBOR writers.
+type valueWriter interface {
+	writeMapHeader(n int)
+	writeArrayHeader(n int)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeInt(i int64)
+	writeFloat(f float64)
+	writeBool(b bool)
+}
+
+func writeMessage(w valueWriter, m *Message) {
+	n := len(m.Fields)
+	if n > 0 {
+		n = 1
+	}
+	for _, set := range []bool{m.Uuid != nil, m.Timestamp != nil,
+		m.Type != nil, m.Logger != nil, m.Severity != nil, m.Payload != nil,
+		m.EnvVersion != nil, m.Pid != nil, m.Hostname != nil} {
+		if set {
+			n++
+		}
+	}
+	w.writeMapHeader(n)
+	if m.Uuid != nil {
+		w.writeString("uuid")
+		w.writeBytes(m.Uuid)
+	}
+	if m.Timestamp != nil {
+		w.writeString("timestamp")
+		w.writeInt(*m.Timestamp)
+	}
+	writeStringKey(w, "type", m.Type)
+	writeStringKey(w, "logger", m.Logger)
+	if m.Severity != nil {
+		w.writeString("severity")
+		w.writeInt(int64(*m.Severity))
+	}
+	writeStringKey(w, "payload", m.Payload)
+	writeStringKey(w, "env_version", m.EnvVersion)
+	if m.Pid != nil {
+		w.writeString("pid")
+		w.writeInt(int64(*m.Pid))
+	}
+	writeStringKey(w, "hostname", m.Hostname)
+	if len(m.Fields) > 0 {
+		w.writeString("fields")
+		w.writeArrayHeader(len(m.Fields))
+		for _, f := range m.Fields {
+			writeField(w, f)
+		}
+	}
+}
+
+func writeStringKey(w valueWriter, key string, value *string) {
+	if value != nil {
+		w.writeString(key)
+		w.writeString(*value)
+	}
+}
+
+func writeField(w valueWriter, f *Field) {
+	n := 0
+	for _, set := range []bool{f.Name != nil, f.ValueType != nil,
+		f.ValueFormat != nil, len(f.ValueString) > 0, len(f.ValueBytes) > 0,
+		len(f.ValueInteger) > 0, len(f.ValueDouble) > 0, len(f.ValueBool) > 0} {
+		if set {
+			n++
+		}
+	}
+	w.writeMapHeader(n)
+	writeStringKey(w, "name", f.Name)
+	if f.ValueType != nil {
+		w.writeString("value_type")
+		w.writeInt(int64(*f.ValueType))
+	}
+	if f.ValueFormat != nil {
+		w.writeString("value_format")
+		w.writeInt(int64(*f.ValueFormat))
+	}
+	if len(f.ValueString) > 0 {
+		w.writeString("value_string")
+		w.writeArrayHeader(len(f.ValueString))
+		for _, v := range f.ValueString {
+			w.writeString(v)
+		}
+	}
+	if len(f.ValueBytes) > 0 {
+		w.writeString("value_bytes")
+		w.writeArrayHeader(len(f.ValueBytes))
+		for _, v := range f.ValueBytes {
+			w.writeBytes(v)
+		}
+	}
+	if len(f.ValueInteger) > 0 {
+		w.writeString("value_integer")
+		w.writeArrayHeader(len(f.ValueInteger))
+		for _, v := range f.ValueInteger {
+			w.writeInt(v)
+		}
+	}
+	if len(f.ValueDouble) > 0 {
+		w.writeString("value_double")
+		w.writeArrayHeader(len(f.ValueDouble))
+		for _, v := range f.ValueDouble {
+			w.writeFloat(v)
+		}
+	}
+	if len(f.ValueBool) > 0 {
+		w.writeString("value_bool")
+		w.writeArrayHeader(len(f.ValueBool))
+		for _, v := range f.ValueBool {
+			w.writeBool(v)
+		}
+	}
+}
+
+// Fills `m` from a decoded map, as produced by the MessagePack and CBOR
+// readers. Unknown keys are ignored, the same as w/ JSON.
+func readMessage(value interface{}, m *Message) (err error) {
+	msgMap, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("message isn't a map")
+	}
+	var (
+		s string
+		i int64
+	)
+	for key, v := range msgMap {
+		switch key {
+		case "uuid":
+			m.Uuid, err = toBytes(v)
+		case "timestamp":
+			if i, err = toInt64(v); err == nil {
+				m.SetTimestamp(i)
+			}
+		case "type":
+			if s, err = toString(v); err == nil {
+				m.SetType(s)
+			}
+		case "logger":
+			if s, err = toString(v); err == nil {
+				m.SetLogger(s)
+			}
+		case "severity":
+			if i, err = toInt32(v); err == nil {
+				m.SetSeverity(int32(i))
+			}
+		case "payload":
+			if s, err = toString(v); err == nil {
+				m.SetPayload(s)
+			}
+		case "env_version":
+			if s, err = toString(v); err == nil {
+				m.SetEnvVersion(s)
+			}
+		case "pid":
+			if i, err = toInt32(v); err == nil {
+				m.SetPid(int32(i))
+			}
+		case "hostname":
+			if s, err = toString(v); err == nil {
+				m.SetHostname(s)
+			}
+		case "fields":
+			err = readFields(v, m)
+		}
+		if err != nil {
+			return fmt.Errorf("message %s: %s", key, err)
+		}
+	}
+	return
+}
+
+func readFields(value interface{}, m *Message) (err error) {
+	fields, ok := value.([]interface{})
+	if !ok {
+		return errors.New("not an array")
+	}
+	m.Fields = make([]*Field, 0, len(fields))
+	for _, v := range fields {
+		f := new(Field)
+		if err = readField(v, f); err != nil {
+			return
+		}
+		m.Fields = append(m.Fields, f)
+	}
+	return
+}
+
+func readField(value interface{}, f *Field) (err error) {
+	fieldMap, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("field isn't a map")
+	}
+	var (
+		s      string
+		i      int64
+		values []interface{}
+	)
+	for key, v := range fieldMap {
+		switch key {
+		case "name":
+			if s, err = toString(v); err == nil {
+				f.Name = &s
+			}
+		case "value_type":
+			if i, err = toInt32(v); err == nil {
+				if _, ok = Field_ValueType_name[int32(i)]; !ok {
+					err = fmt.Errorf("unknown value type %d", i)
+				} else {
+					f.ValueType = Field_ValueType(i).Enum()
+				}
+			}
+		case "value_format":
+			if i, err = toInt32(v); err == nil {
+				if _, ok = Field_ValueFormat_name[int32(i)]; !ok {
+					err = fmt.Errorf("unknown value format %d", i)
+				} else {
+					f.ValueFormat = Field_ValueFormat(i).Enum()
+				}
+			}
+		case "value_string", "value_bytes", "value_integer", "value_double",
+			"value_bool":
+			if values, ok = v.([]interface{}); !ok {
+				err = errors.New("not an array")
+				break
+			}
+			err = readFieldValues(key, values, f)
+		}
+		if err != nil {
+			return fmt.Errorf("field %s: %s", key, err)
+		}
+	}
+	return
+}
+
+func readFieldValues(key string, values []interface{}, f *Field) (err error) {
+	for _, v := range values {
+		switch key {
+		case "value_string":
+			var s string
+			if s, err = toString(v); err == nil {
+				f.ValueString = append(f.ValueString, s)
+			}
+		case "value_bytes":
+			var b []byte
+			if b, err = toBytes(v); err == nil {
+				f.ValueBytes = append(f.ValueBytes, b)
+			}
+		case "value_integer":
+			var i int64
+			if i, err = toInt64(v); err == nil {
+				f.ValueInteger = append(f.ValueInteger, i)
+			}
+		case "value_double":
+			var d float64
+			if d, err = toFloat64(v); err == nil {
+				f.ValueDouble = append(f.ValueDouble, d)
+			}
+		case "value_bool":
+			if b, ok := v.(bool); ok {
+				f.ValueBool = append(f.ValueBool, b)
+			} else {
+				err = fmt.Errorf("%v isn't a bool", v)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func toString(v interface{}) (s string, err error) {
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		err = fmt.Errorf("%v isn't a string", v)
+	}
+	return
+}
+
+func toBytes(v interface{}) (b []byte, err error) {
+	switch v := v.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		err = fmt.Errorf("%v isn't a byte string", v)
+	}
+	return
+}
+
+func toInt64(v interface{}) (i int64, err error) {
+	var ok bool
+	if i, ok = v.(int64); !ok {
+		err = fmt.Errorf("%v isn't an integer", v)
+	}
+	return
+}
+
+func toInt32(v interface{}) (i int64, err error) {
+	if i, err = toInt64(v); err == nil && (i < math.MinInt32 || i > math.MaxInt32) {
+		err = fmt.Errorf("%d overflows a 32 bit integer", i)
+	}
+	return
+}
+
+// Encoders are free to write whole numbered doubles as integers.
+func toFloat64(v interface{}) (f float64, err error) {
+	switch v := v.(type) {
+	case float64:
+		f = v
+	case int64:
+		f = float64(v)
+	default:
+		err = fmt.Errorf("%v isn't a number", v)
+	}
+	return
+}
+
+// Reads a fixed size big-endian length or value that must fit in the data.
+func readUint(data []byte, pos *int, size int) (n uint64, err error) {
+	if len(data)-*pos < size {
+		return 0, errors.New("unexpected end of data")
+	}
+	for _, b := range data[*pos : *pos+size] {
+		n = n<<8 | uint64(b)
+	}
+	*pos += size
+	return
+}
+
+// Reads `n` bytes, a string or byte string body.
+func readBody(data []byte, pos *int, n uint64) (body []byte, err error) {
+	if uint64(len(data)-*pos) < n {
+		return nil, errors.New("unexpected end of data")
+	}
+	body = make([]byte, n)
+	copy(body, data[*pos:])
+	*pos += int(n)
+	return
+}
+
+// Every item takes at least a byte, so no valid array or map has more
+// items than there are bytes left. Checking keeps garbage lengths from
+// allocating huge slices.
+func checkItemCount(data []byte, pos int, n uint64) (err error) {
+	if uint64(len(data)-pos) < n {
+		err = errors.New("unexpected end of data")
+	}
+	return
+}
+
+func uintToInt64(n uint64) (i int64, err error) {
+	if n > math.MaxInt64 {
+		return 0, fmt.Errorf("%d overflows a 64 bit integer", n)
+	}
+	return int64(n), nil
+}
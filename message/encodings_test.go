@@ -0,0 +1,139 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"math"
+	"strings"
+)
+
+func EncodingsSpec(c gospec.Context) {
+	msg := getTestMessage()
+	ints := NewFieldInit("ints", Field_INTEGER, Field_RAW)
+	for _, i := range []int64{math.MinInt64, -40000, -129, -33, -1, 0, 200,
+		70000, 1 << 40, math.MaxInt64} {
+		ints.AddValue(i)
+	}
+	msg.AddField(ints)
+	doubles, _ := NewField("doubles", 1.5, Field_RAW)
+	doubles.AddValue(-0.25)
+	msg.AddField(doubles)
+	flags, _ := NewField("flags", true, Field_RAW)
+	flags.AddValue(false)
+	msg.AddField(flags)
+	data, _ := NewField("data", make([]byte, 300), Field_RAW)
+	msg.AddField(data)
+	long, _ := NewField("long", strings.Repeat("x", 70000), Field_RAW)
+	msg.AddField(long)
+
+	c.Specify("MessagePack", func() {
+		c.Specify("round trips a message", func() {
+			encoded, err := msg.MarshalMsgpack()
+			c.Assume(err, gs.IsNil)
+			decoded := new(Message)
+			err = decoded.UnmarshalMsgpack(encoded)
+			c.Expect(err, gs.IsNil)
+			c.Expect(decoded, gs.Equals, msg)
+		})
+
+		c.Specify("decodes the forms it doesn't write", func() {
+			encoded := []byte{0x83,
+				0xa4, 't', 'y', 'p', 'e', 0xd9, 0x01, 'x',
+				0xa8, 's', 'e', 'v', 'e', 'r', 'i', 't', 'y', 0xd0, 0xfe,
+				0xa6, 'f', 'i', 'e', 'l', 'd', 's', 0x91, 0x83,
+				0xa4, 'n', 'a', 'm', 'e', 0xa1, 'd',
+				0xaa, 'v', 'a', 'l', 'u', 'e', '_', 't', 'y', 'p', 'e', 0x03,
+				0xac, 'v', 'a', 'l', 'u', 'e', '_', 'd', 'o', 'u', 'b', 'l', 'e',
+				0x91, 0xca, 0x3f, 0xc0, 0x00, 0x00}
+			decoded := new(Message)
+			err := decoded.UnmarshalMsgpack(encoded)
+			c.Expect(err, gs.IsNil)
+			c.Expect(decoded.GetType(), gs.Equals, "x")
+			c.Expect(decoded.GetSeverity(), gs.Equals, int32(-2))
+			v, ok := decoded.GetFieldValue("d")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, 1.5)
+		})
+
+		c.Specify("rejects bad data", func() {
+			decoded := new(Message)
+			// Truncated.
+			err := decoded.UnmarshalMsgpack([]byte{0x81, 0xa4, 't', 'y'})
+			c.Expect(err, gs.Not(gs.IsNil))
+			// An array claiming more items than there are bytes.
+			err = decoded.UnmarshalMsgpack([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+			c.Expect(err, gs.Not(gs.IsNil))
+			// Not a map.
+			err = decoded.UnmarshalMsgpack([]byte{0x01})
+			c.Expect(err, gs.Not(gs.IsNil))
+			// A string timestamp.
+			err = decoded.UnmarshalMsgpack([]byte{0x81,
+				0xa9, 't', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p', 0xa1, '1'})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("CBOR", func() {
+		c.Specify("round trips a message", func() {
+			encoded, err := msg.MarshalCbor()
+			c.Assume(err, gs.IsNil)
+			decoded := new(Message)
+			err = decoded.UnmarshalCbor(encoded)
+			c.Expect(err, gs.IsNil)
+			c.Expect(decoded, gs.Equals, msg)
+		})
+
+		c.Specify("decodes indefinite lengths, tags and half floats", func() {
+			encoded := []byte{0xbf,
+				0x64, 't', 'y', 'p', 'e', 0x7f, 0x61, 'a', 0x61, 'b', 0xff,
+				0x69, 't', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p', 0xc1, 0x01,
+				0x66, 'f', 'i', 'e', 'l', 'd', 's', 0x9f, 0xa3,
+				0x64, 'n', 'a', 'm', 'e', 0x61, 'd',
+				0x6a, 'v', 'a', 'l', 'u', 'e', '_', 't', 'y', 'p', 'e', 0x03,
+				0x6c, 'v', 'a', 'l', 'u', 'e', '_', 'd', 'o', 'u', 'b', 'l', 'e',
+				0x81, 0xf9, 0x3e, 0x00, 0xff,
+				0xff}
+			decoded := new(Message)
+			err := decoded.UnmarshalCbor(encoded)
+			c.Expect(err, gs.IsNil)
+			c.Expect(decoded.GetType(), gs.Equals, "ab")
+			c.Expect(decoded.GetTimestamp(), gs.Equals, int64(1))
+			v, ok := decoded.GetFieldValue("d")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, 1.5)
+		})
+
+		c.Specify("rejects bad data", func() {
+			decoded := new(Message)
+			// Missing the break.
+			err := decoded.UnmarshalCbor([]byte{0xbf})
+			c.Expect(err, gs.Not(gs.IsNil))
+			// An array claiming more items than there are bytes.
+			err = decoded.UnmarshalCbor([]byte{0x9b, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff})
+			c.Expect(err, gs.Not(gs.IsNil))
+			// A negative integer too big for an int64.
+			err = decoded.UnmarshalCbor([]byte{0xa1,
+				0x63, 'p', 'i', 'd', 0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff})
+			c.Expect(err, gs.Not(gs.IsNil))
+			// Trailing data.
+			err = decoded.UnmarshalCbor([]byte{0xa0, 0x00})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,217 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MatcherSet tests a message against a number of MatcherSpecifications at
+// once. The specifications are compiled into a single graph in which
+// identical sub-expressions, e.g. a Type == 'x' test common to many of them,
+// are shared, so each is evaluated at most once per message. A MatcherSet
+// isn't safe for concurrent use.
+type MatcherSet struct {
+	specs      []*MatcherSpecification // Indexed by slot, nil if free.
+	roots      []int                   // Root node of each slot's spec.
+	nodes      []setNode
+	ids        map[string]int // Key of each node -> its index.
+	results    []bool
+	evaluated  []uint32 // Generation in which each node was last evaluated.
+	generation uint32
+	matched    []bool
+}
+
+// A node of the graph, a leaf test if left is -1, else an && or ||.
+type setNode struct {
+	stmt        *Statement
+	left, right int
+}
+
+func NewMatcherSet() *MatcherSet {
+	return &MatcherSet{ids: make(map[string]int)}
+}
+
+// Adds a spec to the set, returning the slot its results are reported in.
+// Slots freed by Remove are reused.
+func (s *MatcherSet) Add(spec *MatcherSpecification) (slot int) {
+	root := s.compile(spec.vm)
+	for slot = range s.specs {
+		if s.specs[slot] == nil {
+			s.specs[slot] = spec
+			s.roots[slot] = root
+			return
+		}
+	}
+	s.specs = append(s.specs, spec)
+	s.roots = append(s.roots, root)
+	s.matched = append(s.matched, false)
+	return len(s.specs) - 1
+}
+
+// Removes the spec in a slot, recompiling the rest so nodes only it used
+// are dropped.
+func (s *MatcherSet) Remove(slot int) {
+	s.specs[slot] = nil
+	s.matched[slot] = false
+	s.nodes = s.nodes[:0]
+	s.results = s.results[:0]
+	s.evaluated = s.evaluated[:0]
+	s.ids = make(map[string]int)
+	for i, spec := range s.specs {
+		if spec != nil {
+			s.roots[i] = s.compile(spec.vm)
+		}
+	}
+}
+
+// Tests a message against every spec in the set. The result for each slot
+// is only valid until the next call.
+func (s *MatcherSet) Match(msg *Message) []bool {
+	s.generation++
+	if s.generation == 0 {
+		for i := range s.evaluated {
+			s.evaluated[i] = 0
+		}
+		s.generation = 1
+	}
+	for slot, spec := range s.specs {
+		if spec != nil {
+			s.matched[slot] = s.eval(s.roots[slot], msg)
+		}
+	}
+	return s.matched
+}
+
+// Evaluates a node, short circuiting the same as evalMatcherSpecification,
+// unless it's already been evaluated for this message.
+func (s *MatcherSet) eval(i int, msg *Message) (b bool) {
+	if i < 0 {
+		return false
+	}
+	if s.evaluated[i] == s.generation {
+		return s.results[i]
+	}
+	node := &s.nodes[i]
+	if node.left < 0 {
+		b = testExpr(msg, node.stmt, nil)
+	} else {
+		b = s.eval(node.left, msg)
+		if b != (node.stmt.op.tokenId == OP_OR) {
+			b = s.eval(node.right, msg)
+		}
+	}
+	s.evaluated[i] = s.generation
+	s.results[i] = b
+	return
+}
+
+// Returns the captures of the spec in a slot for the message last passed to
+// Match. The spec's sample() tests have the outcome they had in Match rather
+// than being rolled again.
+func (s *MatcherSet) Captures(slot int, msg *Message) (
+	captures map[string]string) {
+	if spec := s.specs[slot]; spec.numCapture > 0 {
+		captures = make(map[string]string, spec.numCapture)
+		s.capture(s.roots[slot], msg, captures)
+	}
+	return
+}
+
+// Evaluates a node the same as eval, running each test again for its captures
+// except sample(), which was recorded by Match if it was run at all.
+func (s *MatcherSet) capture(i int, msg *Message,
+	captures map[string]string) (b bool) {
+	if i < 0 {
+		return false
+	}
+	node := &s.nodes[i]
+	if node.left < 0 {
+		if node.stmt.op.tokenId == FN_SAMPLE {
+			return s.evaluated[i] == s.generation && s.results[i]
+		}
+		return testExpr(msg, node.stmt, captures)
+	}
+	b = s.capture(node.left, msg, captures)
+	if b != (node.stmt.op.tokenId == OP_OR) {
+		b = s.capture(node.right, msg, captures)
+	}
+	return
+}
+
+// Adds a tree's nodes to the graph, returning the index of its root. A
+// sub-expression that's already in the graph is reused.
+func (s *MatcherSet) compile(t *tree) int {
+	if t == nil {
+		return -1
+	}
+	node := setNode{stmt: t.stmt, left: -1, right: -1}
+	var key string
+	if t.left == nil {
+		key = statementKey(t.stmt)
+	} else {
+		node.left = s.compile(t.left)
+		node.right = s.compile(t.right)
+		key = fmt.Sprintf("(%d %d %d)", t.stmt.op.tokenId, node.left,
+			node.right)
+	}
+	if i, ok := s.ids[key]; ok {
+		return i
+	}
+	s.ids[key] = len(s.nodes)
+	s.nodes = append(s.nodes, node)
+	s.results = append(s.results, false)
+	s.evaluated = append(s.evaluated, 0)
+	return len(s.nodes) - 1
+}
+
+// Returns a key that's the same for any two statements that test the same
+// thing. Each unkeyed sample is a test of its own, so specs sampling at the
+// same rate don't all pick the same messages.
+func statementKey(stmt *Statement) string {
+	if stmt.op.tokenId == FN_SAMPLE && stmt.field.tokenId == 0 {
+		return fmt.Sprintf("%p", stmt)
+	}
+	field := fmt.Sprintf("%d", stmt.field.tokenId)
+	if stmt.field.tokenId == VAR_FIELDS {
+		field = fmt.Sprintf("%d[%q][%d][%d]", VAR_FIELDS, stmt.field.token,
+			stmt.field.fieldIndex, stmt.field.arrayIndex)
+	}
+	var value string
+	switch {
+	case stmt.value.strings != nil:
+		set := make([]string, 0, len(stmt.value.strings))
+		for v := range stmt.value.strings {
+			set = append(set, fmt.Sprintf("%q", v))
+		}
+		sort.Strings(set)
+		value = "[" + strings.Join(set, ",") + "]"
+	case stmt.value.numbers != nil:
+		set := make([]float64, 0, len(stmt.value.numbers))
+		for v := range stmt.value.numbers {
+			set = append(set, v)
+		}
+		sort.Float64s(set)
+		value = fmt.Sprint(set)
+	case stmt.value.tokenId == NUMERIC_VALUE, stmt.value.tokenId == FN_NOW:
+		value = fmt.Sprint(stmt.value.double)
+	default:
+		value = fmt.Sprintf("%q", stmt.value.token)
+	}
+	return fmt.Sprintf("%s %d %d %s", field, stmt.op.tokenId,
+		stmt.value.tokenId, value)
+}
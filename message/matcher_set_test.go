@@ -0,0 +1,186 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"testing"
+)
+
+func MatcherSetSpec(c gospec.Context) {
+	msg := getTestMessage()
+	other := getTestMessage()
+	other.SetType("OTHER")
+	other.SetSeverity(3)
+
+	specs := []string{
+		"TRUE",
+		"FALSE",
+		"Type == 'TEST'",
+		"Type == 'TEST' && Severity == 6",
+		"Type == 'TEST' && Severity == 3",
+		"Type == \"TEST\" && Severity == 6.0",
+		"Type == 'TEST' || Severity < 4",
+		"Severity < 4 || Type == 'TEST'",
+		"(Type == 'TEST' && Severity == 6) || Fields[foo] == 'bar'",
+		"Fields[foo] == 'bar' && Payload =~ /(?P<pl>Payload)/",
+		"Fields[foo][0] == 'bar'",
+		"Fields[foo][1] == 'bar'",
+		"Fields[number] in [64, 128]",
+		"Fields[number] in [128, 64]",
+		"Type in ['OTHER', 'TEST'] && Fields[missing] == NIL",
+		"Type !~ /^TE/",
+	}
+
+	compile := func() (set *MatcherSet, matchers []*MatcherSpecification) {
+		set = NewMatcherSet()
+		for i, spec := range specs {
+			ms, err := CreateMatcherSpecification(spec)
+			c.Assume(err, gs.IsNil)
+			c.Assume(set.Add(ms), gs.Equals, i)
+			matchers = append(matchers, ms)
+		}
+		return
+	}
+
+	c.Specify("A MatcherSet", func() {
+		set, matchers := compile()
+
+		c.Specify("matches the same as each spec alone", func() {
+			for _, m := range []*Message{msg, other} {
+				matched := set.Match(m)
+				c.Expect(len(matched), gs.Equals, len(specs))
+				for i, ms := range matchers {
+					match, _ := ms.Match(m)
+					c.Expect(matched[i], gs.Equals, match)
+				}
+			}
+		})
+
+		c.Specify("shares identical sub-expressions", func() {
+			var nodes int
+			for _, ms := range matchers {
+				nodes += countNodes(ms.vm)
+			}
+			// Only the distinct tests and operators are compiled, e.g. the
+			// Type == 'TEST' test is shared by seven specs.
+			c.Expect(len(set.nodes), gs.Equals, 20)
+			c.Expect(len(set.nodes) < nodes, gs.IsTrue)
+		})
+
+		c.Specify("doesn't share samples picked at random", func() {
+			set := NewMatcherSet()
+			for _, spec := range []string{"sample(0.5)", "sample(0.5)",
+				"sample(0.5, Uuid)", "sample(0.5, Uuid)"} {
+				ms, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.IsNil)
+				set.Add(ms)
+			}
+			c.Expect(len(set.nodes), gs.Equals, 3)
+		})
+
+		c.Specify("captures w/ the outcome of each sample", func() {
+			set := NewMatcherSet()
+			for _, spec := range []string{
+				"sample(0) || Payload =~ /(?P<word>Test)/",
+				"sample(1) || Payload =~ /(?P<word>Test)/",
+				"sample(1) && Payload =~ /(?P<word>Test)/",
+			} {
+				ms, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.IsNil)
+				set.Add(ms)
+			}
+			matched := set.Match(msg)
+			c.Expect(matched[0], gs.IsTrue)
+			c.Expect(set.Captures(0, msg)["word"], gs.Equals, "Test")
+			// The sample picked the message, so the regexp never ran.
+			c.Expect(matched[1], gs.IsTrue)
+			c.Expect(len(set.Captures(1, msg)), gs.Equals, 0)
+			c.Expect(matched[2], gs.IsTrue)
+			c.Expect(set.Captures(2, msg)["word"], gs.Equals, "Test")
+		})
+
+		c.Specify("reuses the slot of a removed spec", func() {
+			nodes := len(set.nodes)
+			set.Remove(3)
+			set.Remove(15)
+			c.Expect(len(set.nodes), gs.Equals, nodes-1)
+			c.Expect(len(set.results), gs.Equals, len(set.nodes))
+			c.Expect(len(set.evaluated), gs.Equals, len(set.nodes))
+			matched := set.Match(msg)
+			c.Expect(matched[3], gs.IsFalse)
+			c.Expect(matched[2], gs.IsTrue)
+			c.Expect(matched[5], gs.IsTrue)
+
+			ms, err := CreateMatcherSpecification("Type == 'OTHER'")
+			c.Assume(err, gs.IsNil)
+			c.Expect(set.Add(ms), gs.Equals, 3)
+			c.Expect(set.Match(msg)[3], gs.IsFalse)
+			c.Expect(set.Match(other)[3], gs.IsTrue)
+		})
+	})
+}
+
+func countNodes(t *tree) int {
+	if t == nil {
+		return 0
+	}
+	return 1 + countNodes(t.left) + countNodes(t.right)
+}
+
+// Specs like those of many sandbox filters, each picking out one type of
+// message from one of a few loggers.
+func benchmarkSpecs() (specs []string) {
+	for i := 0; i < 200; i++ {
+		specs = append(specs, fmt.Sprintf(
+			"Logger == 'logger%d' && Type == 'type%d' && Severity <= 6",
+			i%4, i))
+	}
+	return
+}
+
+func BenchmarkMatcherSpecifications(b *testing.B) {
+	b.StopTimer()
+	var matchers []*MatcherSpecification
+	for _, spec := range benchmarkSpecs() {
+		ms, _ := CreateMatcherSpecification(spec)
+		matchers = append(matchers, ms)
+	}
+	msg := getTestMessage()
+	msg.SetLogger("logger0")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ms := range matchers {
+			ms.Match(msg)
+		}
+	}
+}
+
+func BenchmarkMatcherSet(b *testing.B) {
+	b.StopTimer()
+	set := NewMatcherSet()
+	for _, spec := range benchmarkSpecs() {
+		ms, _ := CreateMatcherSpecification(spec)
+		set.Add(ms)
+	}
+	msg := getTestMessage()
+	msg.SetLogger("logger0")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		set.Match(msg)
+	}
+}
@@ -26,11 +26,13 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sync/atomic"
 )
 
 const (
 	MAX_HEADER_SIZE  = 255
 	MAX_MESSAGE_SIZE = 64 * 1024
+	MAX_BATCH_SIZE   = 16 * MAX_MESSAGE_SIZE // uncompressed
 	RECORD_SEPARATOR = uint8(0x1e)
 	UNIT_SEPARATOR   = uint8(0x1f)
 	UUID_SIZE        = 16
@@ -41,6 +43,12 @@ type MessageSigningConfig struct {
 	Hash    string `toml:"hmac_hash"`
 	Key     string `toml:"hmac_key"`
 	Version uint32 `toml:"version"`
+	// Base64 encoded Ed25519 private key or seed, used instead of Key when
+	// Hash is "ed25519".
+	PrivateKey string `toml:"private_key"`
+	// A *signingKey, parsed from the above when a message is signed after
+	// they've changed.
+	key atomic.Value
 }
 
 func (h *Header) SetMessageEncoding(v Header_MessageEncoding) {
@@ -94,6 +102,21 @@ func (h *Header) SetHmac(v []byte) {
 	}
 }
 
+func (h *Header) SetCompression(v Header_Compression) {
+	if h != nil {
+		if h.Compression == nil {
+			h.Compression = new(Header_Compression)
+		}
+		*h.Compression = v
+	}
+}
+
+func (h *Header) SetBatch(v bool) {
+	if h != nil {
+		h.Batch = &v
+	}
+}
+
 func (m *Message) SetUuid(v []byte) {
 	if m != nil {
 		if cap(m.Uuid) != UUID_SIZE {
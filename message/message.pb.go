@@ -18,15 +18,21 @@ type Header_MessageEncoding int32
 const (
 	Header_PROTOCOL_BUFFER Header_MessageEncoding = 0
 	Header_JSON            Header_MessageEncoding = 1
+	Header_MSGPACK         Header_MessageEncoding = 2
+	Header_CBOR            Header_MessageEncoding = 3
 )
 
 var Header_MessageEncoding_name = map[int32]string{
 	0: "PROTOCOL_BUFFER",
 	1: "JSON",
+	2: "MSGPACK",
+	3: "CBOR",
 }
 var Header_MessageEncoding_value = map[string]int32{
 	"PROTOCOL_BUFFER": 0,
 	"JSON":            1,
+	"MSGPACK":         2,
+	"CBOR":            3,
 }
 
 func (x Header_MessageEncoding) Enum() *Header_MessageEncoding {
@@ -52,17 +58,26 @@ func (x *Header_MessageEncoding) UnmarshalJSON(data []byte) error {
 type Header_HmacHashFunction int32
 
 const (
-	Header_MD5  Header_HmacHashFunction = 0
-	Header_SHA1 Header_HmacHashFunction = 1
+	Header_MD5     Header_HmacHashFunction = 0
+	Header_SHA1    Header_HmacHashFunction = 1
+	Header_SHA256  Header_HmacHashFunction = 2
+	Header_SHA512  Header_HmacHashFunction = 3
+	Header_ED25519 Header_HmacHashFunction = 4
 )
 
 var Header_HmacHashFunction_name = map[int32]string{
 	0: "MD5",
 	1: "SHA1",
+	2: "SHA256",
+	3: "SHA512",
+	4: "ED25519",
 }
 var Header_HmacHashFunction_value = map[string]int32{
-	"MD5":  0,
-	"SHA1": 1,
+	"MD5":     0,
+	"SHA1":    1,
+	"SHA256":  2,
+	"SHA512":  3,
+	"ED25519": 4,
 }
 
 func (x Header_HmacHashFunction) Enum() *Header_HmacHashFunction {
@@ -85,6 +100,48 @@ func (x *Header_HmacHashFunction) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type Header_Compression int32
+
+const (
+	Header_NONE   Header_Compression = 0
+	Header_GZIP   Header_Compression = 1
+	Header_SNAPPY Header_Compression = 2
+	Header_LZ4    Header_Compression = 3
+)
+
+var Header_Compression_name = map[int32]string{
+	0: "NONE",
+	1: "GZIP",
+	2: "SNAPPY",
+	3: "LZ4",
+}
+var Header_Compression_value = map[string]int32{
+	"NONE":   0,
+	"GZIP":   1,
+	"SNAPPY": 2,
+	"LZ4":    3,
+}
+
+func (x Header_Compression) Enum() *Header_Compression {
+	p := new(Header_Compression)
+	*p = x
+	return p
+}
+func (x Header_Compression) String() string {
+	return proto.EnumName(Header_Compression_name, int32(x))
+}
+func (x Header_Compression) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+func (x *Header_Compression) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Header_Compression_value, data, "Header_Compression")
+	if err != nil {
+		return err
+	}
+	*x = Header_Compression(value)
+	return nil
+}
+
 type Field_ValueType int32
 
 const (
@@ -179,6 +236,8 @@ type Header struct {
 	HmacSigner       *string                  `protobuf:"bytes,4,opt,name=hmac_signer" json:"hmac_signer,omitempty"`
 	HmacKeyVersion   *uint32                  `protobuf:"varint,5,opt,name=hmac_key_version" json:"hmac_key_version,omitempty"`
 	Hmac             []byte                   `protobuf:"bytes,6,opt,name=hmac" json:"hmac,omitempty"`
+	Compression      *Header_Compression      `protobuf:"varint,7,opt,name=compression,enum=message.Header_Compression,def=0" json:"compression,omitempty"`
+	Batch            *bool                    `protobuf:"varint,8,opt,name=batch,def=0" json:"batch,omitempty"`
 	XXX_unrecognized []byte                   `json:"-"`
 }
 
@@ -188,6 +247,8 @@ func (*Header) ProtoMessage()       {}
 
 const Default_Header_MessageEncoding Header_MessageEncoding = Header_PROTOCOL_BUFFER
 const Default_Header_HmacHashFunction Header_HmacHashFunction = Header_MD5
+const Default_Header_Compression Header_Compression = Header_NONE
+const Default_Header_Batch bool = false
 
 func (this *Header) GetMessageLength() uint32 {
 	if this != nil && this.MessageLength != nil {
@@ -231,6 +292,20 @@ func (this *Header) GetHmac() []byte {
 	return nil
 }
 
+func (this *Header) GetCompression() Header_Compression {
+	if this != nil && this.Compression != nil {
+		return *this.Compression
+	}
+	return Default_Header_Compression
+}
+
+func (this *Header) GetBatch() bool {
+	if this != nil && this.Batch != nil {
+		return *this.Batch
+	}
+	return Default_Header_Batch
+}
+
 type Field struct {
 	Name             *string            `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
 	ValueType        *Field_ValueType   `protobuf:"varint,2,opt,name=value_type,enum=message.Field_ValueType,def=0" json:"value_type,omitempty"`
@@ -355,6 +430,7 @@ func (this *Message) GetHostname() string {
 func init() {
 	proto.RegisterEnum("message.Header_MessageEncoding", Header_MessageEncoding_name, Header_MessageEncoding_value)
 	proto.RegisterEnum("message.Header_HmacHashFunction", Header_HmacHashFunction_name, Header_HmacHashFunction_value)
+	proto.RegisterEnum("message.Header_Compression", Header_Compression_name, Header_Compression_value)
 	proto.RegisterEnum("message.Field_ValueType", Field_ValueType_name, Field_ValueType_value)
 	proto.RegisterEnum("message.Field_ValueFormat", Field_ValueFormat_name, Field_ValueFormat_value)
 }
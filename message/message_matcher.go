@@ -14,7 +14,14 @@
 
 package message
 
-import "fmt"
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // MatcherSpecification used by the message router to distribute messages
 type MatcherSpecification struct {
@@ -49,6 +56,12 @@ func (m *MatcherSpecification) Match(message *Message) (match bool,
 	return
 }
 
+// HasCaptures returns whether the spec's regular expressions have capture
+// groups
+func (m *MatcherSpecification) HasCaptures() bool {
+	return m.numCapture > 0
+}
+
 // String outputs the spec as text
 func (m *MatcherSpecification) String() string {
 	return m.spec
@@ -109,7 +122,7 @@ func getNumericValue(msg *Message, stmt *Statement) float64 {
 }
 
 func regexpTest(s string, stmt *Statement, captures map[string]string) bool {
-	if stmt.value.regexp.NumSubexp() == 0 {
+	if captures == nil || stmt.value.regexp.NumSubexp() == 0 {
 		return stmt.value.regexp.MatchString(s)
 	} else {
 		findResults := stmt.value.regexp.FindStringSubmatch(s)
@@ -154,34 +167,200 @@ func stringTest(s string, stmt *Statement, captures map[string]string) bool {
 		return regexpTest(s, stmt, captures)
 	case OP_NRE:
 		return !stmt.value.regexp.MatchString(s)
+	case OP_IN:
+		return stmt.value.strings[s]
+	case OP_STARTSWITH:
+		return strings.HasPrefix(s, stmt.value.token)
+	case OP_ENDSWITH:
+		return strings.HasSuffix(s, stmt.value.token)
+	case OP_CIDR:
+		return cidrTest(s, stmt)
+	}
+	return false
+}
+
+// Tests whether s is an IP address in one of the statement's networks.
+func cidrTest(s string, stmt *Statement) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, network := range stmt.value.networks {
+		if network.Contains(ip) {
+			return true
+		}
 	}
 	return false
 }
 
 func numericTest(f float64, stmt *Statement) bool {
+	v := stmt.value.double
+	if stmt.value.tokenId == FN_NOW {
+		v += float64(time.Now().UnixNano())
+	}
 	switch stmt.op.tokenId {
 	case OP_EQ:
-		return (f == stmt.value.double)
+		return (f == v)
 	case OP_NE:
-		return (f != stmt.value.double)
+		return (f != v)
 	case OP_LT:
-		return (f < stmt.value.double)
+		return (f < v)
 	case OP_LTE:
-		return (f <= stmt.value.double)
+		return (f <= v)
 	case OP_GT:
-		return (f > stmt.value.double)
+		return (f > v)
 	case OP_GTE:
-		return (f >= stmt.value.double)
+		return (f >= v)
+	case OP_IN:
+		return stmt.value.numbers[f]
+	}
+	return false
+}
+
+func booleanTest(b bool, stmt *Statement) bool {
+	switch stmt.op.tokenId {
+	case OP_EQ:
+		return (b == (stmt.value.tokenId == TRUE))
+	case OP_NE:
+		return (b != (stmt.value.tokenId == TRUE))
+	}
+	return false
+}
+
+// getField returns the field a Fields[name][fieldIndex][arrayIndex]
+// statement refers to, or nil if the message doesn't have it or its array
+// is too short.
+func getField(msg *Message, stmt *Statement) *Field {
+	fi := stmt.field.fieldIndex
+	var field *Field
+	if fi != 0 {
+		fields := msg.FindAllFields(stmt.field.token)
+		if fi >= len(fields) {
+			return nil
+		}
+		field = fields[fi]
+	} else if field = msg.FindFirstField(stmt.field.token); field == nil {
+		return nil
+	}
+
+	var length int
+	switch field.GetValueType() {
+	case Field_STRING:
+		length = len(field.ValueString)
+	case Field_BYTES:
+		length = len(field.ValueBytes)
+	case Field_INTEGER:
+		length = len(field.ValueInteger)
+	case Field_DOUBLE:
+		length = len(field.ValueDouble)
+	case Field_BOOL:
+		length = len(field.ValueBool)
+	}
+	if stmt.field.arrayIndex >= length {
+		return nil
+	}
+	return field
+}
+
+// fieldTest compares a field value w/ a value of the same type, so strings
+// and regexps only match STRING and BYTES fields, numbers INTEGER and
+// DOUBLE fields, and TRUE/FALSE BOOL fields. NIL tests whether the value
+// exists.
+func fieldTest(msg *Message, stmt *Statement, captures map[string]string) bool {
+	field := getField(msg, stmt)
+	if stmt.value.tokenId == NIL {
+		return ((field == nil) == (stmt.op.tokenId == OP_EQ))
+	}
+	if field == nil {
+		return false
+	}
+	ai := stmt.field.arrayIndex
+	switch stmt.value.tokenId {
+	case STRING_VALUE, REGEXP_VALUE:
+		switch field.GetValueType() {
+		case Field_STRING:
+			return stringTest(field.ValueString[ai], stmt, captures)
+		case Field_BYTES:
+			return stringTest(string(field.ValueBytes[ai]), stmt, captures)
+		}
+	case NUMERIC_VALUE:
+		switch field.GetValueType() {
+		case Field_INTEGER:
+			return numericTest(float64(field.ValueInteger[ai]), stmt)
+		case Field_DOUBLE:
+			return numericTest(field.ValueDouble[ai], stmt)
+		}
+	case TRUE, FALSE:
+		if field.GetValueType() == Field_BOOL {
+			return booleanTest(field.ValueBool[ai], stmt)
+		}
 	}
 	return false
 }
 
+// Returns the text of the value a sample is keyed on, and whether the
+// message has it.
+func getSampleKey(msg *Message, stmt *Statement) (string, bool) {
+	switch stmt.field.tokenId {
+	case VAR_UUID:
+		return string(msg.GetUuid()), true
+	case VAR_TYPE, VAR_LOGGER, VAR_PAYLOAD, VAR_ENVVERSION, VAR_HOSTNAME:
+		return getStringValue(msg, stmt), true
+	case VAR_TIMESTAMP, VAR_SEVERITY, VAR_PID:
+		return strconv.FormatFloat(getNumericValue(msg, stmt), 'g', -1, 64), true
+	case VAR_FIELDS:
+		field := getField(msg, stmt)
+		if field == nil {
+			return "", false
+		}
+		ai := stmt.field.arrayIndex
+		switch field.GetValueType() {
+		case Field_STRING:
+			return field.ValueString[ai], true
+		case Field_BYTES:
+			return string(field.ValueBytes[ai]), true
+		case Field_INTEGER:
+			return strconv.FormatInt(field.ValueInteger[ai], 10), true
+		case Field_DOUBLE:
+			return strconv.FormatFloat(field.ValueDouble[ai], 'g', -1, 64), true
+		case Field_BOOL:
+			return strconv.FormatBool(field.ValueBool[ai]), true
+		}
+	}
+	return "", false
+}
+
+// Picks a message at random w/ the sample rate, or if the sample is keyed
+// by a hash of the key so every message w/ the same key is picked or not.
+// Messages w/o the key are never picked.
+func sampleTest(msg *Message, stmt *Statement) bool {
+	if stmt.field.tokenId == 0 {
+		return rand.Float64() < stmt.value.double
+	}
+	key, ok := getSampleKey(msg, stmt)
+	if !ok {
+		return false
+	}
+	// FNV-1a, w/ a final mix so the high bits depend on every byte.
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return float64(h>>11)/(1<<53) < stmt.value.double
+}
+
 func testExpr(msg *Message, stmt *Statement, captures map[string]string) bool {
 	switch stmt.op.tokenId {
 	case TRUE:
 		return true
 	case FALSE:
 		return false
+	case FN_SAMPLE:
+		return sampleTest(msg, stmt)
 	default:
 		switch stmt.field.tokenId {
 		case VAR_UUID, VAR_TYPE, VAR_LOGGER, VAR_PAYLOAD,
@@ -190,53 +369,7 @@ func testExpr(msg *Message, stmt *Statement, captures map[string]string) bool {
 		case VAR_TIMESTAMP, VAR_SEVERITY, VAR_PID:
 			return numericTest(getNumericValue(msg, stmt), stmt)
 		case VAR_FIELDS:
-			fi := stmt.field.fieldIndex
-			ai := stmt.field.arrayIndex
-			var field *Field
-
-			if fi != 0 {
-				fields := msg.FindAllFields(stmt.field.token)
-				if fi >= len(fields) {
-					return false
-				}
-				field = fields[fi]
-			} else {
-				if field = msg.FindFirstField(stmt.field.token); field == nil {
-					return false
-				}
-			}
-			switch field.GetValueType() {
-			case Field_STRING:
-				if ai >= len(field.ValueString) {
-					return false
-				}
-				return stringTest(field.ValueString[ai], stmt, captures)
-			case Field_BYTES:
-				if ai >= len(field.ValueBytes) {
-					return false
-				}
-				return stringTest(string(field.ValueBytes[ai]), stmt, captures)
-			case Field_INTEGER:
-				if ai >= len(field.ValueInteger) {
-					return false
-				}
-				return numericTest(float64(field.ValueInteger[ai]), stmt)
-			case Field_DOUBLE:
-				if ai >= len(field.ValueDouble) {
-					return false
-				}
-				return numericTest(field.ValueDouble[ai], stmt)
-			case Field_BOOL:
-				if ai >= len(field.ValueBool) {
-					return false
-				}
-				b := field.ValueBool[ai]
-				if stmt.value.tokenId == TRUE {
-					return (b == true)
-				} else {
-					return (b == false)
-				}
-			}
+			return fieldTest(msg, stmt, captures)
 		}
 	}
 	return false
@@ -1,15 +1,20 @@
+// Code generated by goyacc -o message_matcher_parser.go -v /tmp/y.output message_matcher_parser.y. DO NOT EDIT.
+
 //line message_matcher_parser.y:2
 package message
 
 import __yyfmt__ "fmt"
 
 //line message_matcher_parser.y:2
+
 import (
 	"fmt"
 	"log"
+	"net"
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -25,7 +30,16 @@ var variables = map[string]int{
 	"Pid":        VAR_PID,
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
-	"FALSE":      FALSE}
+	"FALSE":      FALSE,
+	"NIL":        NIL}
+
+var keywords = map[string]int{
+	"in":         OP_IN,
+	"startswith": OP_STARTSWITH,
+	"endswith":   OP_ENDSWITH,
+	"cidr":       OP_CIDR,
+	"sample":     FN_SAMPLE,
+	"now":        FN_NOW}
 
 var parseLock sync.Mutex
 
@@ -65,7 +79,7 @@ func (s *stack) pop() (node *tree) {
 
 var nodes []*tree
 
-//line message_matcher_parser.y:67
+//line message_matcher_parser.y:78
 type yySymType struct {
 	yys        int
 	tokenId    int
@@ -74,6 +88,9 @@ type yySymType struct {
 	fieldIndex int
 	arrayIndex int
 	regexp     *regexp.Regexp
+	strings    map[string]bool
+	numbers    map[float64]bool
+	networks   []*net.IPNet
 }
 
 const OP_EQ = 57346
@@ -86,23 +103,35 @@ const OP_RE = 57352
 const OP_NRE = 57353
 const OP_OR = 57354
 const OP_AND = 57355
-const VAR_UUID = 57356
-const VAR_TYPE = 57357
-const VAR_LOGGER = 57358
-const VAR_PAYLOAD = 57359
-const VAR_ENVVERSION = 57360
-const VAR_HOSTNAME = 57361
-const VAR_TIMESTAMP = 57362
-const VAR_SEVERITY = 57363
-const VAR_PID = 57364
-const VAR_FIELDS = 57365
-const STRING_VALUE = 57366
-const NUMERIC_VALUE = 57367
-const REGEXP_VALUE = 57368
-const TRUE = 57369
-const FALSE = 57370
-
-var yyToknames = []string{
+const OP_IN = 57356
+const OP_STARTSWITH = 57357
+const OP_ENDSWITH = 57358
+const OP_CIDR = 57359
+const VAR_UUID = 57360
+const VAR_TYPE = 57361
+const VAR_LOGGER = 57362
+const VAR_PAYLOAD = 57363
+const VAR_ENVVERSION = 57364
+const VAR_HOSTNAME = 57365
+const VAR_TIMESTAMP = 57366
+const VAR_SEVERITY = 57367
+const VAR_PID = 57368
+const VAR_FIELDS = 57369
+const STRING_VALUE = 57370
+const NUMERIC_VALUE = 57371
+const REGEXP_VALUE = 57372
+const TRUE = 57373
+const FALSE = 57374
+const NIL = 57375
+const FN_SAMPLE = 57376
+const FN_NOW = 57377
+const DURATION_VALUE = 57378
+const INVALID_TOKEN = 57379
+
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"OP_EQ",
 	"OP_NE",
 	"OP_GT",
@@ -113,6 +142,10 @@ var yyToknames = []string{
 	"OP_NRE",
 	"OP_OR",
 	"OP_AND",
+	"OP_IN",
+	"OP_STARTSWITH",
+	"OP_ENDSWITH",
+	"OP_CIDR",
 	"VAR_UUID",
 	"VAR_TYPE",
 	"VAR_LOGGER",
@@ -128,14 +161,28 @@ var yyToknames = []string{
 	"REGEXP_VALUE",
 	"TRUE",
 	"FALSE",
+	"NIL",
+	"FN_SAMPLE",
+	"FN_NOW",
+	"DURATION_VALUE",
+	"INVALID_TOKEN",
+	"','",
+	"'['",
+	"']'",
+	"'('",
+	"')'",
+	"'+'",
+	"'-'",
 }
-var yyStatenames = []string{}
+
+var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
+const yyInitialStackSize = 16
+
+//line message_matcher_parser.y:308
 
-//line message_matcher_parser.y:177
 type MatcherSpecificationParser struct {
 	spec     string
 	sym      string
@@ -160,6 +207,9 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 				if node.stmt.op.tokenId == OP_RE { // no capture for negated regex
 					ms.numCapture += node.stmt.value.regexp.NumSubexp()
 				}
+				if err := checkStatement(node.stmt); err != nil {
+					return err
+				}
 				s.push(node)
 			} else {
 				node.right = s.pop()
@@ -173,6 +223,42 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 	return fmt.Errorf("syntax error: last token: %s pos: %d", msp.sym, msp.lexPos)
 }
 
+// Checks what the grammar can't, and parses the networks of a cidr test.
+func checkStatement(stmt *Statement) error {
+	switch {
+	case stmt.op.tokenId == OP_CIDR:
+		return parseNetworks(&stmt.value)
+	case stmt.op.tokenId == FN_SAMPLE:
+		if stmt.value.double < 0 || stmt.value.double > 1 {
+			return fmt.Errorf("sample rate must be between 0 and 1: %s",
+				stmt.value.token)
+		}
+	case stmt.value.tokenId == FN_NOW:
+		if stmt.field.tokenId != VAR_TIMESTAMP {
+			return fmt.Errorf("now() can only be compared w/ Timestamp")
+		}
+	}
+	return nil
+}
+
+// Parses the CIDR network, or set of networks, a cidr operator compares
+// against.
+func parseNetworks(value *yySymType) error {
+	cidrs := value.strings
+	if cidrs == nil {
+		cidrs = map[string]bool{value.token: true}
+	}
+	value.networks = make([]*net.IPNet, 0, len(cidrs))
+	for cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR network: %s", cidr)
+		}
+		value.networks = append(value.networks, network)
+	}
+	return nil
+}
+
 func (m *MatcherSpecificationParser) Error(s string) {
 	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
 }
@@ -189,6 +275,9 @@ loop:
 	if c >= 'A' && c <= 'Z' {
 		goto variable
 	}
+	if c >= 'a' && c <= 'z' {
+		goto keyword
+	}
 	if (c >= '0' && c <= '9') || c == '.' {
 		goto number
 	}
@@ -278,18 +367,18 @@ variable:
 	yylval.tokenId = variables[m.sym]
 	if yylval.tokenId == VAR_FIELDS {
 		if c != '[' {
-			return 0
+			return INVALID_TOKEN
 		}
 		var bracketCount int
 		var idx [3]string
 		for {
 			c = m.getrune()
 			if c == 0 {
-				return 0
+				return INVALID_TOKEN
 			}
 			if c == ']' { // a closing bracket in the variable name will fail validation
 				if len(idx[bracketCount]) == 0 {
-					return 0
+					return INVALID_TOKEN
 				}
 				bracketCount++
 				m.peekrune = m.getrune()
@@ -306,7 +395,7 @@ variable:
 					if ddigit(c) {
 						idx[bracketCount] += string(c)
 					} else {
-						return 0
+						return INVALID_TOKEN
 					}
 				}
 			}
@@ -321,15 +410,35 @@ variable:
 		yylval.token = idx[0]
 		yylval.fieldIndex, err = strconv.Atoi(idx[1])
 		if err != nil {
-			return 0
+			return INVALID_TOKEN
 		}
 		yylval.arrayIndex, err = strconv.Atoi(idx[2])
 		if err != nil {
-			return 0
+			return INVALID_TOKEN
 		}
 	} else {
 		yylval.token = m.sym
 		m.peekrune = c
+		if yylval.tokenId == 0 {
+			return INVALID_TOKEN
+		}
+	}
+	return yylval.tokenId
+
+keyword:
+	m.sym = ""
+	for {
+		m.sym += string(c)
+		c = m.getrune()
+		if !rvariable(c) {
+			break
+		}
+	}
+	m.peekrune = c
+	yylval.token = m.sym
+	yylval.tokenId = keywords[m.sym]
+	if yylval.tokenId == 0 {
+		return INVALID_TOKEN
 	}
 	return yylval.tokenId
 
@@ -342,6 +451,9 @@ number:
 			break
 		}
 	}
+	if c >= 'a' && c <= 'z' || c == 'µ' {
+		goto duration
+	}
 	m.peekrune = c
 	yylval.double, err = strconv.ParseFloat(m.sym, 64)
 	if err != nil {
@@ -352,13 +464,28 @@ number:
 	yylval.tokenId = NUMERIC_VALUE
 	return yylval.tokenId
 
+duration:
+	for rvariable(c) || ddigit(c) || c == '.' || c == 'µ' {
+		m.sym += string(c)
+		c = m.getrune()
+	}
+	m.peekrune = c
+	if d, err := time.ParseDuration(m.sym); err == nil {
+		yylval.double = float64(d)
+	} else {
+		return INVALID_TOKEN
+	}
+	yylval.token = m.sym
+	yylval.tokenId = DURATION_VALUE
+	return yylval.tokenId
+
 quotestring:
 	tmp = c
 	m.sym = ""
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return INVALID_TOKEN
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -385,7 +512,7 @@ regexpstring:
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return INVALID_TOKEN
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -414,7 +541,7 @@ regexpstring:
 	yylval.regexp, err = regexp.Compile(m.sym)
 	if err != nil {
 		log.Printf("invalid regexp %v\n", m.sym)
-		return 0
+		return INVALID_TOKEN
 	}
 	yylval.token = m.sym
 	yylval.tokenId = REGEXP_VALUE
@@ -461,107 +588,175 @@ func (m *MatcherSpecificationParser) getrune() rune {
 }
 
 //line yacctab:1
-var yyExca = []int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
+	-1, 51,
+	28, 3,
+	29, 3,
+	-2, 9,
+	-1, 52,
+	28, 4,
+	29, 4,
+	-2, 10,
 }
 
-const yyNprod = 36
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 77
-
-var yyAct = []int{
-
-	13, 14, 15, 16, 17, 18, 19, 20, 21, 10,
-	7, 24, 23, 11, 12, 3, 11, 12, 2, 49,
-	22, 44, 25, 45, 47, 46, 43, 24, 23, 42,
-	38, 29, 30, 31, 32, 33, 34, 35, 23, 6,
-	5, 4, 40, 41, 9, 8, 1, 0, 0, 48,
-	28, 29, 30, 31, 32, 33, 34, 35, 28, 29,
-	30, 31, 32, 33, 26, 27, 0, 0, 0, 0,
-	0, 0, 0, 0, 36, 37, 39,
+const yyLast = 137
+
+var yyAct = [...]int8{
+	10, 9, 14, 15, 16, 17, 18, 19, 20, 21,
+	22, 11, 62, 64, 7, 12, 13, 68, 8, 98,
+	99, 25, 24, 81, 96, 3, 63, 80, 93, 94,
+	91, 95, 92, 74, 84, 27, 77, 60, 69, 60,
+	102, 101, 65, 97, 59, 12, 13, 73, 67, 83,
+	86, 55, 71, 70, 83, 58, 100, 86, 56, 78,
+	61, 72, 75, 79, 57, 24, 76, 14, 15, 16,
+	17, 18, 19, 20, 21, 22, 90, 2, 6, 23,
+	31, 26, 89, 88, 51, 52, 35, 36, 37, 38,
+	39, 40, 49, 5, 48, 41, 42, 50, 25, 24,
+	4, 28, 53, 54, 33, 34, 35, 36, 37, 38,
+	39, 40, 43, 45, 30, 41, 42, 32, 33, 34,
+	35, 36, 37, 38, 29, 87, 66, 85, 44, 82,
+	46, 1, 0, 0, 0, 0, 47,
 }
-var yyPact = []int{
 
-	-14, -14, 15, -14, -1000, -1000, -1000, -1000, 46, 54,
-	26, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, -1000, 15, -14, -14, -1, 2, -5, -1000, -1000,
-	-1000, -1000, -1000, -1000, -1000, -1000, -2, 0, -11, -7,
-	-1000, 25, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+var yyPact = [...]int16{
+	-16, -16, 86, -16, -1000, -1000, -1000, -1000, -6, 100,
+	114, 80, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, 86, -16, -16, 9, 29, 36, 25,
+	0, 32, -2, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, 13, -1, 24, 14, 3, -3, 31,
+	-2, -1000, -1000, -1000, 52, -1000, -15, -1000, -1000, -1000,
+	26, -1000, -1000, -1000, -1000, -1000, -1000, -7, -1000, 28,
+	-1000, -1000, -1000, -1000, -1000, -1000, -1000, 21, -1000, -1000,
+	-1000, 49, -8, -1000, -14, -9, -1000, -18, -1000, -1000,
+	-1000, 15, -1000, -24, 27, -1000, -1000, -1000, 5, 4,
+	-1000, -1000, -1000,
 }
-var yyPgo = []int{
 
-	0, 46, 18, 64, 65, 45, 44, 41, 40, 39,
-	10,
+var yyPgo = [...]uint8{
+	0, 131, 77, 101, 130, 124, 80, 129, 127, 13,
+	17, 12, 1, 0, 126, 125, 100, 93, 78, 14,
 }
-var yyR1 = []int{
 
+var yyR1 = [...]int8{
 	0, 1, 1, 3, 3, 3, 3, 3, 3, 4,
-	4, 5, 5, 5, 5, 5, 5, 6, 6, 6,
-	7, 7, 8, 9, 9, 9, 9, 10, 10, 2,
+	4, 5, 5, 6, 6, 7, 7, 8, 8, 9,
+	10, 11, 11, 12, 12, 12, 12, 12, 12, 13,
+	13, 13, 14, 14, 14, 15, 15, 15, 16, 16,
+	16, 16, 16, 17, 17, 17, 18, 18, 18, 18,
+	18, 18, 18, 18, 18, 19, 19, 2, 2, 2,
 	2, 2, 2, 2, 2, 2,
 }
-var yyR2 = []int{
 
+var yyR2 = [...]int8{
 	0, 1, 2, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
-	3, 3, 3, 3, 3, 3, 3, 1, 1, 3,
-	3, 3, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 3, 1, 3, 3,
+	3, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 3, 5, 5, 1, 1, 1, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 1, 1, 3, 3, 3,
+	1, 1, 1, 1, 4, 6,
 }
-var yyChk = []int{
 
-	-1000, -1, -2, 29, -7, -8, -9, -10, -5, -6,
-	23, 27, 28, 14, 15, 16, 17, 18, 19, 20,
-	21, 22, -2, 13, 12, -2, -3, -4, 4, 5,
-	6, 7, 8, 9, 10, 11, -3, -3, 4, -4,
-	-2, -2, 30, 24, 26, 25, 25, 24, -10, 26,
+var yyChk = [...]int16{
+	-1000, -1, -2, 41, -16, -17, -18, -19, 34, -12,
+	-13, 27, 31, 32, 18, 19, 20, 21, 22, 23,
+	24, 25, 26, -2, 13, 12, -2, 41, -3, -5,
+	14, -6, 17, 4, 5, 6, 7, 8, 9, 10,
+	11, 15, 16, -3, 14, -3, -4, -5, 14, -6,
+	17, 4, 5, -2, -2, 42, 29, 28, 30, -9,
+	39, 28, -11, 28, -9, 29, -14, 35, -10, 39,
+	29, 28, -19, 33, 30, -9, -10, 39, 28, -11,
+	42, 38, -7, 28, 41, -8, 29, -15, -12, -13,
+	27, 38, 40, 42, 38, 40, 42, 28, 43, 44,
+	29, 36, 36,
 }
-var yyDef = []int{
 
-	0, -2, 1, 0, 32, 33, 34, 35, 0, 0,
-	0, 27, 28, 11, 12, 13, 14, 15, 16, 17,
-	18, 19, 2, 0, 0, 0, 0, 0, 3, 4,
-	5, 6, 7, 8, 9, 10, 0, 0, 3, 0,
-	30, 31, 29, 20, 21, 22, 23, 24, 25, 26,
+var yyDef = [...]int8{
+	0, -2, 1, 0, 60, 61, 62, 63, 0, 0,
+	0, 0, 55, 56, 23, 24, 25, 26, 27, 28,
+	29, 30, 31, 2, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 3, 4, 5, 6, 7, 8, 11,
+	12, 13, 14, 0, 0, 0, 0, 0, 0, 0,
+	0, -2, -2, 58, 59, 57, 0, 38, 39, 40,
+	0, 41, 42, 21, 22, 43, 45, 0, 44, 0,
+	46, 47, 48, 49, 50, 51, 52, 0, 53, 54,
+	64, 0, 0, 15, 0, 0, 17, 0, 35, 36,
+	37, 0, 19, 32, 0, 20, 65, 16, 0, 0,
+	18, 33, 34,
 }
-var yyTok1 = []int{
 
+var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	29, 30,
+	41, 42, 3, 43, 38, 44, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 39, 3, 40,
 }
-var yyTok2 = []int{
 
+var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
-	22, 23, 24, 25, 26, 27, 28,
+	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+	32, 33, 34, 35, 36, 37,
 }
-var yyTok3 = []int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var yyDebug = 0
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
 
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
 const yyFlag = -1000
 
 func yyTokname(c int) string {
-	if c > 0 && c <= len(yyToknames) {
+	if c >= 1 && c-1 < len(yyToknames) {
 		if yyToknames[c-1] != "" {
 			return yyToknames[c-1]
 		}
@@ -578,51 +773,127 @@ func yyStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func yylex1(lex yyLexer, lval *yySymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		c = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			c = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		c = yyTok3[i+0]
-		if c == char {
-			c = yyTok3[i+1]
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = yyTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("lex %U %s\n", uint(char), yyTokname(c))
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, yyMaxDepth)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -635,7 +906,7 @@ ret1:
 yystack:
 	/* put a state and value onto the stack */
 	if yyDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", yyTokname(yychar), yyStatname(yystate))
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
 	}
 
 	yyp++
@@ -648,21 +919,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	yyn += yychar
+	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yychar { /* valid shift */
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -672,27 +944,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
-			if yyn < 0 || yyn == yychar {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -701,11 +973,11 @@ yydefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			yylex.Error("syntax error")
+			yylex.Error(yyErrorMessage(yystate, yytoken))
 			Nerrs++
 			if yyDebug >= 1 {
 				__yyfmt__.Printf("%s", yyStatname(yystate))
-				__yyfmt__.Printf("saw %s\n", yyTokname(yychar))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
 			fallthrough
 
@@ -714,10 +986,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -733,12 +1005,13 @@ yydefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
@@ -752,89 +1025,245 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
+	case 15:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:127
+		{
+			yyVAL.strings = map[string]bool{yyDollar[1].token: true}
+		}
+	case 16:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:131
+		{
+			yyVAL.strings[yyDollar[3].token] = true
+		}
+	case 17:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:136
+		{
+			yyVAL.numbers = map[float64]bool{yyDollar[1].double: true}
+		}
+	case 18:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:140
+		{
+			yyVAL.numbers[yyDollar[3].double] = true
+		}
+	case 19:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:145
+		{
+			yyVAL = yyDollar[2]
+		}
 	case 20:
-		//line message_matcher_parser.y:115
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:150
+		{
+			yyVAL = yyDollar[2]
+		}
+	case 32:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:169
+		{
+			yyVAL.double = 0
+		}
+	case 33:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:173
+		{
+			yyVAL.double = yyDollar[5].double
+		}
+	case 34:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:177
+		{
+			yyVAL.double = -yyDollar[5].double
+		}
+	case 38:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:186
 		{
 			//fmt.Println("string_test", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 21:
-		//line message_matcher_parser.y:120
+	case 39:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:191
 		{
 			//fmt.Println("string_test regexp", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 22:
-		//line message_matcher_parser.y:126
+	case 40:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:196
+		{
+			//fmt.Println("string_test in", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 41:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:201
+		{
+			//fmt.Println("string_test affix", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 42:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:206
+		{
+			//fmt.Println("string_test cidr", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 43:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:212
 		{
 			//fmt.Println("numeric_test", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 23:
-		//line message_matcher_parser.y:132
+	case 44:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:217
+		{
+			//fmt.Println("numeric_test in", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 45:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:222
+		{
+			//fmt.Println("numeric_test time", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 46:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:228
 		{
 			//fmt.Println("field_test numeric", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 24:
-		//line message_matcher_parser.y:137
+	case 47:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:233
 		{
 			//fmt.Println("field_test string", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 25:
-		//line message_matcher_parser.y:142
+	case 48:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:238
 		{
 			//fmt.Println("field_test boolean", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 49:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:243
+		{
+			//fmt.Println("field_test nil", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 26:
-		//line message_matcher_parser.y:147
+	case 50:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:248
 		{
 			//fmt.Println("field_test regexp", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 51:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:253
+		{
+			//fmt.Println("field_test string in", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 52:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:258
+		{
+			//fmt.Println("field_test numeric in", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 29:
-		//line message_matcher_parser.y:154
+	case 53:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:263
 		{
-			yyVAL = yyS[yypt-1]
+			//fmt.Println("field_test affix", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
 		}
-	case 30:
-		//line message_matcher_parser.y:158
+	case 54:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:268
+		{
+			//fmt.Println("field_test cidr", $1, $2, $3)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 57:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:275
+		{
+			yyVAL = yyDollar[2]
+		}
+	case 58:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:279
 		{
 			//fmt.Println("and", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{op: yyS[yypt-1]}})
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[2]}})
 		}
-	case 31:
-		//line message_matcher_parser.y:163
+	case 59:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:284
 		{
 			//fmt.Println("or", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{op: yyS[yypt-1]}})
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[2]}})
 		}
-	case 35:
-		//line message_matcher_parser.y:171
+	case 63:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:292
 		{
 			//fmt.Println("boolean", $1)
-			nodes = append(nodes, &tree{stmt: &Statement{op: yyS[yypt-0]}})
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[1]}})
+		}
+	case 64:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line message_matcher_parser.y:297
+		{
+			//fmt.Println("sample", $3)
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[1], value: yyDollar[3]}})
+		}
+	case 65:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line message_matcher_parser.y:302
+		{
+			//fmt.Println("sample", $3, $5)
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[5], yyDollar[1], yyDollar[3]}})
 		}
 	}
 	goto yystack /* stack new state and value */
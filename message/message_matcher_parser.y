@@ -4,9 +4,11 @@ package message
 import (
 	"fmt"
 	"log"
+	"net"
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -22,7 +24,16 @@ var variables = map[string]int{
 	"Pid":        VAR_PID,
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
-	"FALSE":      FALSE}
+	"FALSE":      FALSE,
+	"NIL":        NIL}
+
+var keywords = map[string]int{
+	"in":         OP_IN,
+	"startswith": OP_STARTSWITH,
+	"endswith":   OP_ENDSWITH,
+	"cidr":       OP_CIDR,
+	"sample":     FN_SAMPLE,
+	"now":        FN_NOW}
 
 var parseLock sync.Mutex
 
@@ -71,15 +82,21 @@ var nodes []*tree
    fieldIndex  int
    arrayIndex  int
    regexp      *regexp.Regexp
+   strings     map[string]bool
+   numbers     map[float64]bool
+   networks    []*net.IPNet
 }
 
 %token OP_EQ OP_NE OP_GT OP_GTE OP_LT OP_LTE OP_RE OP_NRE
 %token OP_OR OP_AND
+%token OP_IN OP_STARTSWITH OP_ENDSWITH OP_CIDR
 %token VAR_UUID VAR_TYPE VAR_LOGGER VAR_PAYLOAD VAR_ENVVERSION VAR_HOSTNAME
 %token VAR_TIMESTAMP VAR_SEVERITY VAR_PID
 %token VAR_FIELDS
 %token STRING_VALUE NUMERIC_VALUE REGEXP_VALUE
-%token TRUE FALSE
+%token TRUE FALSE NIL
+%token FN_SAMPLE FN_NOW DURATION_VALUE
+%token INVALID_TOKEN
 
 %start spec
 %left OP_OR
@@ -97,9 +114,46 @@ relational : OP_EQ
    | OP_LT
    | OP_LTE
 ;
+equality : OP_EQ
+   | OP_NE
+;
 regexp : OP_RE
    | OP_NRE
 ;
+affix : OP_STARTSWITH
+   | OP_ENDSWITH
+;
+string_list : STRING_VALUE
+      {
+      $$.strings = map[string]bool{$1.token: true}
+      }
+   | string_list ',' STRING_VALUE
+      {
+      $$.strings[$3.token] = true
+      }
+;
+numeric_list : NUMERIC_VALUE
+      {
+      $$.numbers = map[float64]bool{$1.double: true}
+      }
+   | numeric_list ',' NUMERIC_VALUE
+      {
+      $$.numbers[$3.double] = true
+      }
+;
+string_set : '[' string_list ']'
+      {
+      $$ = $2
+      }
+;
+numeric_set : '[' numeric_list ']'
+      {
+      $$ = $2
+      }
+;
+networks : STRING_VALUE
+   | string_set
+;
 string_vars : VAR_UUID
    | VAR_TYPE
    | VAR_LOGGER
@@ -111,6 +165,23 @@ numeric_vars : VAR_TIMESTAMP
    | VAR_SEVERITY
    | VAR_PID
 ;
+time_value : FN_NOW '(' ')'
+      {
+      $$.double = 0
+      }
+   | FN_NOW '(' ')' '+' DURATION_VALUE
+      {
+      $$.double = $5.double
+      }
+   | FN_NOW '(' ')' '-' DURATION_VALUE
+      {
+      $$.double = -$5.double
+      }
+;
+sample_key : string_vars
+   | numeric_vars
+   | VAR_FIELDS
+;
 string_test : string_vars relational STRING_VALUE
        {
        //fmt.Println("string_test", $1, $2, $3)
@@ -121,12 +192,37 @@ string_test : string_vars relational STRING_VALUE
        //fmt.Println("string_test regexp", $1, $2, $3)
        nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
        }
+   |   string_vars OP_IN string_set
+       {
+       //fmt.Println("string_test in", $1, $2, $3)
+       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       }
+   |   string_vars affix STRING_VALUE
+       {
+       //fmt.Println("string_test affix", $1, $2, $3)
+       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       }
+   |   string_vars OP_CIDR networks
+       {
+       //fmt.Println("string_test cidr", $1, $2, $3)
+       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       }
 ;
 numeric_test : numeric_vars relational NUMERIC_VALUE
    {
    //fmt.Println("numeric_test", $1, $2, $3)
    nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
    }
+   | numeric_vars OP_IN numeric_set
+   {
+   //fmt.Println("numeric_test in", $1, $2, $3)
+   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   }
+   | numeric_vars relational time_value
+   {
+   //fmt.Println("numeric_test time", $1, $2, $3)
+   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   }
 ;
 field_test : VAR_FIELDS relational NUMERIC_VALUE
       {
@@ -138,16 +234,41 @@ field_test : VAR_FIELDS relational NUMERIC_VALUE
       //fmt.Println("field_test string", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
-   | VAR_FIELDS OP_EQ boolean
+   | VAR_FIELDS equality boolean
       {
       //fmt.Println("field_test boolean", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
+   | VAR_FIELDS equality NIL
+      {
+      //fmt.Println("field_test nil", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
    | VAR_FIELDS regexp REGEXP_VALUE
       {
       //fmt.Println("field_test regexp", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
+   | VAR_FIELDS OP_IN string_set
+      {
+      //fmt.Println("field_test string in", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS OP_IN numeric_set
+      {
+      //fmt.Println("field_test numeric in", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS affix STRING_VALUE
+      {
+      //fmt.Println("field_test affix", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS OP_CIDR networks
+      {
+      //fmt.Println("field_test cidr", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
 ;
 boolean : TRUE | FALSE
 expr : '(' expr ')'
@@ -172,6 +293,16 @@ expr : '(' expr ')'
          //fmt.Println("boolean", $1)
          nodes = append(nodes, &tree{stmt:&Statement{op:$1}})
       }
+   | FN_SAMPLE '(' NUMERIC_VALUE ')'
+      {
+         //fmt.Println("sample", $3)
+         nodes = append(nodes, &tree{stmt:&Statement{op:$1, value:$3}})
+      }
+   | FN_SAMPLE '(' NUMERIC_VALUE ',' sample_key ')'
+      {
+         //fmt.Println("sample", $3, $5)
+         nodes = append(nodes, &tree{stmt:&Statement{$5, $1, $3}})
+      }
 ;
 
 %%
@@ -200,6 +331,9 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
     			if node.stmt.op.tokenId == OP_RE { // no capture for negated regex
                     ms.numCapture += node.stmt.value.regexp.NumSubexp()
                 }
+				if err := checkStatement(node.stmt); err != nil {
+					return err
+				}
 				s.push(node)
 			} else {
 				node.right = s.pop()
@@ -213,6 +347,42 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 	return fmt.Errorf("syntax error: last token: %s pos: %d", msp.sym, msp.lexPos)
 }
 
+// Checks what the grammar can't, and parses the networks of a cidr test.
+func checkStatement(stmt *Statement) error {
+	switch {
+	case stmt.op.tokenId == OP_CIDR:
+		return parseNetworks(&stmt.value)
+	case stmt.op.tokenId == FN_SAMPLE:
+		if stmt.value.double < 0 || stmt.value.double > 1 {
+			return fmt.Errorf("sample rate must be between 0 and 1: %s",
+				stmt.value.token)
+		}
+	case stmt.value.tokenId == FN_NOW:
+		if stmt.field.tokenId != VAR_TIMESTAMP {
+			return fmt.Errorf("now() can only be compared w/ Timestamp")
+		}
+	}
+	return nil
+}
+
+// Parses the CIDR network, or set of networks, a cidr operator compares
+// against.
+func parseNetworks(value *yySymType) error {
+	cidrs := value.strings
+	if cidrs == nil {
+		cidrs = map[string]bool{value.token: true}
+	}
+	value.networks = make([]*net.IPNet, 0, len(cidrs))
+	for cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR network: %s", cidr)
+		}
+		value.networks = append(value.networks, network)
+	}
+	return nil
+}
+
 func (m *MatcherSpecificationParser) Error(s string) {
 	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
 }
@@ -229,6 +399,9 @@ loop:
 	if c >= 'A' && c <= 'Z' {
 		goto variable
 	}
+	if c >= 'a' && c <= 'z' {
+		goto keyword
+	}
 	if (c >= '0' && c <= '9') || c == '.' {
 		goto number
 	}
@@ -318,18 +491,18 @@ variable:
 	yylval.tokenId = variables[m.sym]
 	if yylval.tokenId == VAR_FIELDS {
 		if c != '[' {
-			return 0
+			return INVALID_TOKEN
 		}
 		var bracketCount int
 		var idx [3]string
 		for {
 			c = m.getrune()
 			if c == 0 {
-				return 0
+				return INVALID_TOKEN
 			}
 			if c == ']' { // a closing bracket in the variable name will fail validation
 				if len(idx[bracketCount]) == 0 {
-					return 0
+					return INVALID_TOKEN
 				}
 				bracketCount++
 				m.peekrune = m.getrune()
@@ -346,7 +519,7 @@ variable:
 					if ddigit(c) {
 						idx[bracketCount] += string(c)
 					} else {
-						return 0
+						return INVALID_TOKEN
 					}
 				}
 			}
@@ -361,15 +534,35 @@ variable:
 		yylval.token = idx[0]
 		yylval.fieldIndex, err = strconv.Atoi(idx[1])
 		if err != nil {
-			return 0
+			return INVALID_TOKEN
 		}
 		yylval.arrayIndex, err = strconv.Atoi(idx[2])
 		if err != nil {
-			return 0
+			return INVALID_TOKEN
 		}
 	} else {
 		yylval.token = m.sym
 		m.peekrune = c
+		if yylval.tokenId == 0 {
+			return INVALID_TOKEN
+		}
+	}
+	return yylval.tokenId
+
+keyword:
+	m.sym = ""
+	for {
+		m.sym += string(c)
+		c = m.getrune()
+		if !rvariable(c) {
+			break
+		}
+	}
+	m.peekrune = c
+	yylval.token = m.sym
+	yylval.tokenId = keywords[m.sym]
+	if yylval.tokenId == 0 {
+		return INVALID_TOKEN
 	}
 	return yylval.tokenId
 
@@ -382,6 +575,9 @@ number:
 			break
 		}
 	}
+	if c >= 'a' && c <= 'z' || c == 'µ' {
+		goto duration
+	}
 	m.peekrune = c
 	yylval.double, err = strconv.ParseFloat(m.sym, 64)
 	if err != nil {
@@ -392,13 +588,28 @@ number:
 	yylval.tokenId = NUMERIC_VALUE
 	return yylval.tokenId
 
+duration:
+	for rvariable(c) || ddigit(c) || c == '.' || c == 'µ' {
+		m.sym += string(c)
+		c = m.getrune()
+	}
+	m.peekrune = c
+	if d, err := time.ParseDuration(m.sym); err == nil {
+		yylval.double = float64(d)
+	} else {
+		return INVALID_TOKEN
+	}
+	yylval.token = m.sym
+	yylval.tokenId = DURATION_VALUE
+	return yylval.tokenId
+
 quotestring:
 	tmp = c
 	m.sym = ""
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return INVALID_TOKEN
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -425,7 +636,7 @@ regexpstring:
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return INVALID_TOKEN
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -454,7 +665,7 @@ regexpstring:
 	yylval.regexp, err = regexp.Compile(m.sym)
 	if err != nil {
 		log.Printf("invalid regexp %v\n", m.sym)
-		return 0
+		return INVALID_TOKEN
 	}
 	yylval.token = m.sym
 	yylval.tokenId = REGEXP_VALUE
@@ -41,6 +41,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	field5, _ := NewField("foo", "alternate", Field_RAW)
 	field6, _ := NewField("Payload", "name=test;type=web;", Field_RAW)
 	field7, _ := NewField("Timestamp", date, Field_RAW)
+	field8, _ := NewField("addr", "10.1.2.3", Field_RAW)
 	msg.AddField(field1)
 	msg.AddField(field2)
 	msg.AddField(field3)
@@ -48,6 +49,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	msg.AddField(field5)
 	msg.AddField(field6)
 	msg.AddField(field7)
+	msg.AddField(field8)
 
 	c.Specify("A MatcherSpecification", func() {
 		malformed := []string{
@@ -72,6 +74,42 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /\\ytest/",                                           // invalid escape character
 			"Type != 'test\"",                                             // mis matched quote types
 			"Pid =~ 6",                                                    // number instead of regexp
+			"NIL",                                                         // nil isn't an expression
+			"Type != NIL",                                                 // nil only tests fields
+			"Severity == NIL",                                             // nil only tests fields
+			"Fields[foo] > NIL",                                           // nil only tests equality
+			"Fields[foo] =~ NIL",                                          // nil instead of regexp
+			"Fields[bool] < TRUE",                                         // booleans only test equality
+			"Type in 'TEST'",                                              // set must be bracketed
+			"Type in []",                                                  // empty set
+			"Type in ['TEST',]",                                           // trailing comma
+			"Type in ['TEST', 6]",                                         // mixed set types
+			"Severity in ['6']",                                           // Severity is not a string
+			"Type startswith /TE/",                                        // regexp instead of string
+			"Severity endswith '6'",                                       // Severity is not a string
+			"Fields[foo] startswith ['b']",                                // prefix must be a string
+			"Fields[addr] cidr '10.0.0.0'",                                // missing prefix length
+			"Fields[addr] cidr ['10.0.0.0/8', 'bogus']",                   // invalid network
+			"Pid cidr '10.0.0.0/8'",                                       // Pid is not a string
+			"Type contains 'TEST'",                                        // unknown operator
+			"sample()",                                                    // missing rate
+			"sample(1.5)",                                                 // rate over 1
+			"sample(-0.5)",                                                // negative rate
+			"sample(0.1, 'foo')",                                          // key must be a variable
+			"sample(0.1, Fields[foo]",                                     // missing paren
+			"sample == 0.1",                                               // sample isn't a variable
+			"Severity > now()",                                            // now() only compares w/ Timestamp
+			"Fields[foo] > now()",                                         // now() only compares w/ Timestamp
+			"Timestamp > now",                                             // missing parens
+			"Timestamp > now() - 5",                                       // missing duration unit
+			"Timestamp > now() - 5y",                                      // unknown duration unit
+			"Timestamp > now() * 5m",                                      // unsupported arithmetic
+			"Timestamp > 5m",                                              // duration w/o now()
+			"Type == 'x' and Type == 'y'",                                 // unknown keyword
+			"Type == 'x' || Type == 'y' zzz",                              // trailing unknown keyword
+			"Type == 'x' || Type == 'y' Zzz",                              // trailing unknown variable
+			"Type == 'x' || Type == 'y' Fields[a][b]",                     // trailing bad field index
+			"Type == 'x' || Timestamp > now() - 5y",                       // unknown duration unit
 		}
 
 		negative := []string{
@@ -99,6 +137,40 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type == \"te'st\"",
 			"Type == 'te\"st'",
 			"Fields[int] =~ /999/",
+			"Fields[int] == '999'",
+			"Fields[foo] != 6",
+			"Fields[bool] != TRUE",
+			"Fields[bool] == 1",
+			"Fields[double] == TRUE",
+			"Fields[bytes] > 0",
+			"Fields[foo] == NIL",
+			"Fields[missing] != NIL",
+			"Fields[missing] != 'bar'",
+			"Fields[foo][2] != NIL",
+			"Fields[int][0][2] != NIL",
+			"Fields[int][0][2] != 0",
+			"Type in ['test', 'foo']",
+			"Severity in [5, 7]",
+			"Fields[foo] in ['baz', 'qux']",
+			"Fields[int] in [1024]",
+			"Fields[int] in ['999']",
+			"Fields[foo] in [6]",
+			"Type startswith 'ES'",
+			"Type endswith 'TES'",
+			"Payload startswith 'Test Payload '",
+			"Fields[foo] endswith 'baz'",
+			"Fields[int] startswith '9'",
+			"Fields[addr] cidr '10.2.0.0/16'",
+			"Fields[addr] cidr ['192.168.0.0/16', 'fd00::/8']",
+			"Fields[foo] cidr '0.0.0.0/0'",
+			"Fields[missing] cidr '0.0.0.0/0'",
+			"Hostname cidr '::/0' && Hostname cidr '0.0.0.0/0'",
+			"sample(0)",
+			"sample(0, Uuid)",
+			"sample(1, Fields[missing])",
+			"Timestamp < now() - 1h",
+			"Timestamp > now() + 1m",
+			"Timestamp >= now()+10s",
 		}
 
 		positive := []string{
@@ -143,6 +215,44 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /TEST/ && Payload =~ /Payload/",
 			"Fields[foo][1] =~ /alt/",
 			"Fields[Payload] =~ /name=\\w+/",
+			"Fields[bool] != FALSE",
+			"Fields[int] > 998 && Fields[int][0][1] >= 1024",
+			"Fields[int] != 1024",
+			"Fields[double] < 100",
+			"Fields[bytes] != 'date'",
+			"Fields[missing] == NIL",
+			"Fields[foo] != NIL",
+			"Fields[foo][1] != NIL",
+			"Fields[foo][2] == NIL",
+			"Fields[int][0][1] != NIL",
+			"Fields[int][0][2] == NIL",
+			"Type in ['TEST']",
+			"Type in ['foo', 'bar', 'TEST']",
+			"Severity in [1, 6, 7]",
+			"Fields[foo] in ['bar', 'baz']",
+			"Fields[foo][1] in ['alternate']",
+			"Fields[int][0][1] in [1024, 2048]",
+			"Fields[double] in [99.9]",
+			"Fields[bytes] in ['data']",
+			"Type startswith 'TE'",
+			"Type startswith ''",
+			"Type endswith 'ST'",
+			"Payload startswith 'Test' && Payload endswith 'Payload'",
+			"Fields[foo] startswith 'b'",
+			"Fields[Payload] endswith 'type=web;'",
+			"Fields[bytes] startswith 'da'",
+			"Fields[addr] cidr '10.0.0.0/8'",
+			"Fields[addr] cidr '10.1.2.3/32'",
+			"Fields[addr] cidr ['192.168.0.0/16', '10.1.0.0/16']",
+			"sample(1)",
+			"sample(1.0, Uuid)",
+			"sample(1, Fields[foo]) && Type == 'TEST'",
+			"sample(0) || Severity == 6",
+			"Timestamp > now() - 1h",
+			"Timestamp > now()-1h30m",
+			"Timestamp >= now() - 1.5h",
+			"Timestamp <= now()",
+			"Timestamp < now() + 500ms",
 		}
 
 		type captureTest struct {
@@ -196,6 +306,45 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			}
 		})
 
+		c.Specify("samples a share of the messages", func() {
+			count := func(spec string, users int) (picked map[int]bool) {
+				ms, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.IsNil)
+				picked = make(map[int]bool)
+				for i := 0; i < 1000; i++ {
+					sampled := getTestMessage()
+					field, _ := NewField("user", i%users, Field_RAW)
+					sampled.AddField(field)
+					if match, _ := ms.Match(sampled); match {
+						picked[i] = true
+					}
+				}
+				return
+			}
+
+			c.Specify("at random", func() {
+				picked := count("sample(0.5)", 1000)
+				c.Expect(len(picked) > 400 && len(picked) < 600, gs.IsTrue)
+			})
+
+			c.Specify("by the hash of a key", func() {
+				picked := count("sample(0.5, Fields[user])", 1000)
+				c.Expect(len(picked) > 400 && len(picked) < 600, gs.IsTrue)
+				// The same keys are always picked, and a lower rate picks
+				// a subset of them.
+				c.Expect(len(count("sample(0.5, Fields[user])", 1000)),
+					gs.Equals, len(picked))
+				for i := range count("sample(0.1, Fields[user])", 1000) {
+					c.Expect(picked[i], gs.IsTrue)
+				}
+				// Every message from a user is picked or none are.
+				picked = count("sample(0.5, Fields[user])", 10)
+				for i := range picked {
+					c.Expect(picked[i%10], gs.IsTrue)
+				}
+			})
+		})
+
 		c.Specify("positive matcher tests with capture", func() {
 			for _, v := range capture {
 				ms, err := CreateMatcherSpecification(v.spec)
@@ -282,3 +431,186 @@ func BenchmarkMatcherFieldNumeric(b *testing.B) {
 		ms.Match(msg)
 	}
 }
+
+func BenchmarkMatcherFieldBool(b *testing.B) {
+	b.StopTimer()
+	s := "Fields[bool] != FALSE && Severity == 6"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	field, _ := NewField("bool", true, Field_RAW)
+	msg.AddField(field)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherFieldArrayIndex(b *testing.B) {
+	b.StopTimer()
+	s := "Fields[number][0][1] == 128 && Severity == 6"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	msg.FindFirstField("number").AddValue(128)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherFieldNil(b *testing.B) {
+	b.StopTimer()
+	s := "Fields[missing] == NIL && Severity == 6"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherOrChain(b *testing.B) {
+	b.StopTimer()
+	s := "Type == 'a' || Type == 'b' || Type == 'c' || Type == 'd' || Type == 'e' || Type == 'f' || Type == 'g' || Type == 'TEST'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherIn(b *testing.B) {
+	b.StopTimer()
+	s := "Type in ['a', 'b', 'c', 'd', 'e', 'f', 'g', 'TEST']"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherNumericOrChain(b *testing.B) {
+	b.StopTimer()
+	s := "Severity == 0 || Severity == 1 || Severity == 2 || Severity == 3 || Severity == 6"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherNumericIn(b *testing.B) {
+	b.StopTimer()
+	s := "Severity in [0, 1, 2, 3, 6]"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherStartsWithRegex(b *testing.B) {
+	b.StopTimer()
+	s := "Payload =~ /^Test/"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherStartsWith(b *testing.B) {
+	b.StopTimer()
+	s := "Payload startswith 'Test'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherEndsWithRegex(b *testing.B) {
+	b.StopTimer()
+	s := "Payload =~ /Payload$/"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherEndsWith(b *testing.B) {
+	b.StopTimer()
+	s := "Payload endswith 'Payload'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherCidrRegex(b *testing.B) {
+	b.StopTimer()
+	s := "Fields[addr] =~ /^10\\.1\\.\\d{1,3}\\.\\d{1,3}$/"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	field, _ := NewField("addr", "10.1.2.3", Field_RAW)
+	msg.AddField(field)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherSample(b *testing.B) {
+	b.StopTimer()
+	s := "sample(0.01) && Type == 'TEST'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherSampleKeyed(b *testing.B) {
+	b.StopTimer()
+	s := "sample(0.01, Uuid) && Type == 'TEST'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherTimestampNow(b *testing.B) {
+	b.StopTimer()
+	s := "Timestamp > now() - 5m && Type == 'TEST'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
+
+func BenchmarkMatcherCidr(b *testing.B) {
+	b.StopTimer()
+	s := "Fields[addr] cidr '10.1.0.0/16'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	field, _ := NewField("addr", "10.1.2.3", Field_RAW)
+	msg.AddField(field)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
@@ -0,0 +1,262 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Serializes the message w/ MessagePack, see http://msgpack.org/.
+func (m *Message) MarshalMsgpack() ([]byte, error) {
+	w := &msgpackWriter{make([]byte, 0, 256)}
+	writeMessage(w, m)
+	return w.buf, nil
+}
+
+// Replaces the message contents w/ the MessagePack serialized message in
+// `data`. Extension types aren't supported.
+func (m *Message) UnmarshalMsgpack(data []byte) (err error) {
+	m.Reset()
+	r := &msgpackReader{data: data}
+	var value interface{}
+	if value, err = r.readValue(0); err != nil {
+		return fmt.Errorf("msgpack: %s", err)
+	}
+	if r.pos != len(data) {
+		return errors.New("msgpack: trailing data")
+	}
+	if err = readMessage(value, m); err != nil {
+		return fmt.Errorf("msgpack: %s", err)
+	}
+	return
+}
+
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) writeUint(prefix byte, n uint64, size int) {
+	w.buf = append(w.buf, prefix)
+	for shift := uint(8 * (size - 1)); size > 0; size-- {
+		w.buf = append(w.buf, byte(n>>shift))
+		shift -= 8
+	}
+}
+
+// Writes the header of a map, array, string or binary, choosing the
+// smallest of the fixed, 8, 16 and 32 bit forms the format offers.
+func (w *msgpackWriter) writeHeader(n int, fixPrefix byte, fixMax int,
+	prefixes [3]byte) {
+
+	switch {
+	case n <= fixMax:
+		w.buf = append(w.buf, fixPrefix|byte(n))
+	case n <= math.MaxUint8 && prefixes[0] != 0:
+		w.writeUint(prefixes[0], uint64(n), 1)
+	case n <= math.MaxUint16:
+		w.writeUint(prefixes[1], uint64(n), 2)
+	default:
+		w.writeUint(prefixes[2], uint64(n), 4)
+	}
+}
+
+func (w *msgpackWriter) writeMapHeader(n int) {
+	w.writeHeader(n, 0x80, 15, [3]byte{0, 0xde, 0xdf})
+}
+
+func (w *msgpackWriter) writeArrayHeader(n int) {
+	w.writeHeader(n, 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	w.writeHeader(len(s), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb})
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	// Binaries have no fixed form, -1 disables it.
+	w.writeHeader(len(b), 0, -1, [3]byte{0xc4, 0xc5, 0xc6})
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgpackWriter) writeInt(i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		w.buf = append(w.buf, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		w.writeUint(0xcc, uint64(i), 1)
+	case i >= 0 && i <= math.MaxUint16:
+		w.writeUint(0xcd, uint64(i), 2)
+	case i >= 0 && i <= math.MaxUint32:
+		w.writeUint(0xce, uint64(i), 4)
+	case i >= 0:
+		w.writeUint(0xcf, uint64(i), 8)
+	case i >= -32:
+		w.buf = append(w.buf, byte(i))
+	case i >= math.MinInt8:
+		w.writeUint(0xd0, uint64(i), 1)
+	case i >= math.MinInt16:
+		w.writeUint(0xd1, uint64(i), 2)
+	case i >= math.MinInt32:
+		w.writeUint(0xd2, uint64(i), 4)
+	default:
+		w.writeUint(0xd3, uint64(i), 8)
+	}
+}
+
+func (w *msgpackWriter) writeFloat(f float64) {
+	w.writeUint(0xcb, math.Float64bits(f), 8)
+}
+
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+// Reads the next value as a nil, bool, int64, float64, string, []byte,
+// []interface{} or map[string]interface{}.
+func (r *msgpackReader) readValue(depth int) (value interface{}, err error) {
+	if depth > maxEncodingDepth {
+		return nil, errors.New("nested too deeply")
+	}
+	if r.pos >= len(r.data) {
+		return nil, errors.New("unexpected end of data")
+	}
+	b := r.data[r.pos]
+	r.pos++
+
+	var n uint64
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return r.readMap(uint64(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return r.readArray(uint64(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		return r.readString(uint64(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		if n, err = readUint(r.data, &r.pos, 1<<(b-0xc4)); err == nil {
+			value, err = readBody(r.data, &r.pos, n)
+		}
+	case 0xca:
+		if n, err = readUint(r.data, &r.pos, 4); err == nil {
+			value = float64(math.Float32frombits(uint32(n)))
+		}
+	case 0xcb:
+		if n, err = readUint(r.data, &r.pos, 8); err == nil {
+			value = math.Float64frombits(n)
+		}
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if n, err = readUint(r.data, &r.pos, 1<<(b-0xcc)); err == nil {
+			value, err = uintToInt64(n)
+		}
+	case 0xd0:
+		if n, err = readUint(r.data, &r.pos, 1); err == nil {
+			value = int64(int8(n))
+		}
+	case 0xd1:
+		if n, err = readUint(r.data, &r.pos, 2); err == nil {
+			value = int64(int16(n))
+		}
+	case 0xd2:
+		if n, err = readUint(r.data, &r.pos, 4); err == nil {
+			value = int64(int32(n))
+		}
+	case 0xd3:
+		if n, err = readUint(r.data, &r.pos, 8); err == nil {
+			value = int64(n)
+		}
+	case 0xd9, 0xda, 0xdb:
+		if n, err = readUint(r.data, &r.pos, 1<<(b-0xd9)); err == nil {
+			value, err = r.readString(n)
+		}
+	case 0xdc, 0xdd:
+		if n, err = readUint(r.data, &r.pos, 2<<(b-0xdc)); err == nil {
+			value, err = r.readArray(n, depth)
+		}
+	case 0xde, 0xdf:
+		if n, err = readUint(r.data, &r.pos, 2<<(b-0xde)); err == nil {
+			value, err = r.readMap(n, depth)
+		}
+	default:
+		err = fmt.Errorf("unsupported type 0x%x", b)
+	}
+	return
+}
+
+func (r *msgpackReader) readString(n uint64) (s interface{}, err error) {
+	var body []byte
+	if body, err = readBody(r.data, &r.pos, n); err == nil {
+		s = string(body)
+	}
+	return
+}
+
+func (r *msgpackReader) readArray(n uint64, depth int) (array interface{}, err error) {
+	if err = checkItemCount(r.data, r.pos, n); err != nil {
+		return
+	}
+	values := make([]interface{}, n)
+	for i := range values {
+		if values[i], err = r.readValue(depth + 1); err != nil {
+			return
+		}
+	}
+	return values, nil
+}
+
+func (r *msgpackReader) readMap(n uint64, depth int) (m interface{}, err error) {
+	if err = checkItemCount(r.data, r.pos, n); err != nil {
+		return
+	}
+	values := make(map[string]interface{}, n)
+	var key, value interface{}
+	for i := uint64(0); i < n; i++ {
+		if key, err = r.readValue(depth + 1); err != nil {
+			return
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key %v isn't a string", key)
+		}
+		if value, err = r.readValue(depth + 1); err != nil {
+			return
+		}
+		values[keyString] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,144 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Looks up a Header_HmacHashFunction by its case insensitive name, an empty
+// name meaning MD5.
+func HmacHashFunctionByName(name string) (function Header_HmacHashFunction,
+	err error) {
+
+	if name == "" {
+		return Header_MD5, nil
+	}
+	value, ok := Header_HmacHashFunction_value[strings.ToUpper(name)]
+	if !ok {
+		return Header_MD5, fmt.Errorf("unsupported hmac hash function: %s", name)
+	}
+	return Header_HmacHashFunction(value), nil
+}
+
+// Returns an HMAC using `function` keyed w/ `key`, or nil if `function`
+// isn't an HMAC hash function.
+func NewHmac(function Header_HmacHashFunction, key []byte) hash.Hash {
+	switch function {
+	case Header_MD5:
+		return hmac.New(md5.New, key)
+	case Header_SHA1:
+		return hmac.New(sha1.New, key)
+	case Header_SHA256:
+		return hmac.New(sha256.New, key)
+	case Header_SHA512:
+		return hmac.New(sha512.New, key)
+	}
+	return nil
+}
+
+// Decodes a base64 encoded Ed25519 public key.
+func ParseEd25519PublicKey(encoded string) (key ed25519.PublicKey, err error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 public key: %s", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Ed25519 public key must be %d bytes, not %d",
+			ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Decodes a base64 encoded Ed25519 private key, or the seed it's derived
+// from.
+func ParseEd25519PrivateKey(encoded string) (key ed25519.PrivateKey, err error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 private key: %s", err)
+	}
+	switch len(raw) {
+	case ed25519.PrivateKeySize:
+		key = ed25519.PrivateKey(raw)
+	case ed25519.SeedSize:
+		key = ed25519.NewKeyFromSeed(raw)
+	default:
+		err = fmt.Errorf("Ed25519 private key must be %d or %d bytes, not %d",
+			ed25519.PrivateKeySize, ed25519.SeedSize, len(raw))
+	}
+	return
+}
+
+// A MessageSigningConfig's hash function and, for Ed25519, private key,
+// w/ the settings they were parsed from.
+type signingKey struct {
+	hash       string
+	encodedKey string
+	function   Header_HmacHashFunction
+	privateKey ed25519.PrivateKey
+	err        error
+}
+
+// Parses the hash function and private key, reusing the last ones parsed
+// unless the Hash or PrivateKey setting has changed since. The other
+// settings are used as they are on each call to Sign.
+func (msc *MessageSigningConfig) parseKey() (key *signingKey) {
+	key, _ = msc.key.Load().(*signingKey)
+	if key != nil && key.hash == msc.Hash && key.encodedKey == msc.PrivateKey {
+		return
+	}
+	key = &signingKey{hash: msc.Hash, encodedKey: msc.PrivateKey}
+	key.function, key.err = HmacHashFunctionByName(msc.Hash)
+	if key.err == nil && key.function == Header_ED25519 {
+		key.privateKey, key.err = ParseEd25519PrivateKey(msc.PrivateKey)
+	}
+	msc.key.Store(key)
+	return
+}
+
+// Signs `msgBytes` w/ the configured HMAC key or Ed25519 private key,
+// recording the signer, key version, hash function and signature in
+// `header`.
+func (msc *MessageSigningConfig) Sign(header *Header, msgBytes []byte) (err error) {
+	key := msc.parseKey()
+	if err = key.err; err != nil {
+		return
+	}
+	function := key.function
+	var signature []byte
+	if function == Header_ED25519 {
+		signature = ed25519.Sign(key.privateKey, msgBytes)
+	} else {
+		hm := NewHmac(function, []byte(msc.Key))
+		hm.Write(msgBytes)
+		signature = hm.Sum(nil)
+	}
+	header.SetHmacSigner(msc.Name)
+	header.SetHmacKeyVersion(msc.Version)
+	if function != Header_MD5 {
+		header.SetHmacHashFunction(function)
+	}
+	header.SetHmac(signature)
+	return
+}
@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SigningSpec(c gospec.Context) {
+	msgBytes := []byte("sign me")
+	header := new(Header)
+	msc := &MessageSigningConfig{Name: "test", Key: "testkey", Version: 2}
+
+	c.Specify("signs w/ an HMAC", func() {
+		msc.Hash = "sha512"
+		err := msc.Sign(header, msgBytes)
+		c.Expect(err, gs.IsNil)
+		c.Expect(header.GetHmacSigner(), gs.Equals, "test")
+		c.Expect(header.GetHmacKeyVersion(), gs.Equals, uint32(2))
+		c.Expect(header.GetHmacHashFunction(), gs.Equals, Header_SHA512)
+		hm := hmac.New(sha512.New, []byte("testkey"))
+		hm.Write(msgBytes)
+		c.Expect(hmac.Equal(header.GetHmac(), hm.Sum(nil)), gs.IsTrue)
+	})
+
+	c.Specify("defaults to MD5", func() {
+		err := msc.Sign(header, msgBytes)
+		c.Expect(err, gs.IsNil)
+		c.Expect(header.HmacHashFunction, gs.IsNil)
+		hm := NewHmac(Header_MD5, []byte("testkey"))
+		hm.Write(msgBytes)
+		c.Expect(hmac.Equal(header.GetHmac(), hm.Sum(nil)), gs.IsTrue)
+	})
+
+	c.Specify("signs w/ an Ed25519 key", func() {
+		key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+		msc.Hash = "ed25519"
+
+		c.Specify("or its seed", func() {
+			for _, encoded := range [][]byte{key, key.Seed()} {
+				msc.PrivateKey = base64.StdEncoding.EncodeToString(encoded)
+				err := msc.Sign(header, msgBytes)
+				c.Expect(err, gs.IsNil)
+				c.Expect(header.GetHmacHashFunction(), gs.Equals, Header_ED25519)
+				publicKey := key.Public().(ed25519.PublicKey)
+				c.Expect(ed25519.Verify(publicKey, msgBytes, header.GetHmac()),
+					gs.IsTrue)
+			}
+		})
+
+		c.Specify("parsed again when the config changes", func() {
+			msc.PrivateKey = base64.StdEncoding.EncodeToString(key)
+			c.Expect(msc.Sign(header, msgBytes), gs.IsNil)
+			msc.PrivateKey = "not base64!"
+			c.Expect(msc.Sign(header, msgBytes), gs.Not(gs.IsNil))
+
+			seed := make([]byte, ed25519.SeedSize)
+			seed[0] = 1
+			other := ed25519.NewKeyFromSeed(seed)
+			msc.PrivateKey = base64.StdEncoding.EncodeToString(other)
+			c.Expect(msc.Sign(header, msgBytes), gs.IsNil)
+			publicKey := other.Public().(ed25519.PublicKey)
+			c.Expect(ed25519.Verify(publicKey, msgBytes, header.GetHmac()),
+				gs.IsTrue)
+
+			msc.Hash = "sha256"
+			c.Expect(msc.Sign(header, msgBytes), gs.IsNil)
+			c.Expect(header.GetHmacHashFunction(), gs.Equals, Header_SHA256)
+		})
+
+		c.Specify("but not a malformed one", func() {
+			msc.PrivateKey = base64.StdEncoding.EncodeToString(key[:10])
+			err := msc.Sign(header, msgBytes)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("rejects unknown hash functions", func() {
+		msc.Hash = "crc32"
+		err := msc.Sign(header, msgBytes)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(NewHmac(Header_ED25519, []byte("testkey")), gs.IsNil)
+	})
+
+	c.Specify("parses public keys", func() {
+		key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+		publicKey := key.Public().(ed25519.PublicKey)
+		parsed, err := ParseEd25519PublicKey(
+			base64.StdEncoding.EncodeToString(publicKey))
+		c.Expect(err, gs.IsNil)
+		c.Expect(parsed.Equal(publicKey), gs.IsTrue)
+		_, err = ParseEd25519PublicKey("not base64!")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = ParseEd25519PublicKey(base64.StdEncoding.EncodeToString(key))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
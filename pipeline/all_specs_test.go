@@ -40,12 +40,23 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 	r.AddSpec(DecodersSpec)
+	r.AddSpec(GrokDecoderSpec)
 	r.AddSpec(InputsSpec)
+	r.AddSpec(LogfileInputSpec)
+	r.AddSpec(SyslogInputSpec)
+	r.AddSpec(HttpInputSpec)
 	r.AddSpec(OutputsSpec)
+	r.AddSpec(HttpOutputSpec)
+	r.AddSpec(ElasticSearchOutputSpec)
+	r.AddSpec(KafkaSpec)
+	r.AddSpec(AmqpSpec)
 	r.AddSpec(LoadFromConfigSpec)
 	r.AddSpec(WhisperRunnerSpec)
 	r.AddSpec(WhisperOutputSpec)
 	r.AddSpec(ReportSpec)
+	r.AddSpec(MatchRunnerSpec)
+	r.AddSpec(MessageRouterSpec)
+	r.AddSpec(ManagementSpec)
 	gospec.MainGoTest(r, t)
 }
 
@@ -0,0 +1,749 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/gomock/gomock"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"fmt"
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A decoder configured in place of a default one, which sets the payload to
+// its config.
+type amqpTestDecoder struct {
+	payload string
+}
+
+func (d *amqpTestDecoder) Init(config interface{}) error {
+	d.payload = config.(string)
+	return nil
+}
+
+func (d *amqpTestDecoder) Decode(pack *PipelinePack) error {
+	pack.Message.SetPayload(d.payload)
+	return nil
+}
+
+type amqpStandInMessage struct {
+	key         string
+	contentType string
+	persistent  bool
+	body        []byte
+}
+
+type amqpBinding struct {
+	exchange string
+	key      string
+	queue    string
+}
+
+// An AMQP server that keeps its exchanges and queues in memory. It only
+// routes on exact routing keys, or the "#" binding key for every message.
+type amqpStandIn struct {
+	listener  net.Listener
+	exchanges map[string]bool
+	queues    map[string][]amqpStandInMessage
+	bindings  []amqpBinding
+	conns     map[net.Conn]bool
+	acked     int
+	rejected  int
+	// How the next publishes fail, by closing the "channel" or the
+	// "connection".
+	publishFailures []string
+	// Number of channels to close w/o a reason.
+	channelCloses int
+	queueCount    int
+	lock          sync.Mutex
+}
+
+func newAmqpStandIn() (s *amqpStandIn, err error) {
+	s = &amqpStandIn{
+		exchanges: make(map[string]bool),
+		queues:    make(map[string][]amqpStandInMessage),
+		conns:     make(map[net.Conn]bool),
+	}
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns[conn] = true
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return
+}
+
+func (s *amqpStandIn) Url() string {
+	return "amqp://guest:guest@" + s.listener.Addr().String() + "/"
+}
+
+func (s *amqpStandIn) Close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+func (s *amqpStandIn) dropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *amqpStandIn) enqueue(queue string, msg amqpStandInMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queues[queue] = append(s.queues[queue], msg)
+}
+
+func (s *amqpStandIn) messages(queue string) []amqpStandInMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]amqpStandInMessage(nil), s.queues[queue]...)
+}
+
+func (s *amqpStandIn) counts() (acked, rejected int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.acked, s.rejected
+}
+
+// A connection's state.
+type amqpStandInConn struct {
+	conn       net.Conn
+	channel    bool
+	confirms   bool
+	publishTag uint64
+	// Publish waiting for its content.
+	publishing *amqpStandInMessage
+	exchange   string
+	size       uint64
+	// Consumer's queue, prefetch count and unacknowledged deliveries.
+	queue      string
+	prefetch   int
+	deliverTag uint64
+	unacked    map[uint64]amqpStandInMessage
+}
+
+func (c *amqpStandInConn) send(channel uint16, method uint32,
+	args *amqpEncoder) error {
+
+	e := new(amqpEncoder)
+	e.putLong(method)
+	if args != nil {
+		e.buf = append(e.buf, args.buf...)
+	}
+	return writeAmqpFrame(c.conn, &amqpFrame{Type: amqpMethodFrame,
+		Channel: channel, Payload: e.buf})
+}
+
+func (s *amqpStandIn) serve(conn net.Conn) {
+	c := &amqpStandInConn{conn: conn, unacked: make(map[uint64]amqpStandInMessage)}
+	defer func() {
+		conn.Close()
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		s.requeue(c)
+	}()
+	reader := bufio.NewReader(conn)
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	frames := make(chan *amqpFrame)
+	go func() {
+		defer close(frames)
+		for {
+			f, err := readAmqpFrame(reader, amqpFrameMax)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	args := new(amqpEncoder)
+	args.putOctet(0)
+	args.putOctet(9)
+	args.putTable(map[string]string{"product": "stand-in"})
+	args.putLongStr("AMQPLAIN PLAIN")
+	args.putLongStr("en_US")
+	c.send(0, amqpConnectionStart, args)
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case f, ok := <-frames:
+			if !ok || !s.handle(c, f) {
+				return
+			}
+		case <-ticker.C:
+			if !s.tick(c) {
+				return
+			}
+		}
+	}
+}
+
+// Handles a frame from the client, returning false once the connection
+// should be closed.
+func (s *amqpStandIn) handle(c *amqpStandInConn, f *amqpFrame) bool {
+	switch f.Type {
+	case amqpHeartbeatFrame:
+		return true
+	case amqpHeaderFrame:
+		d := &amqpDecoder{buf: f.Payload}
+		d.getShort()
+		d.getShort()
+		c.size = d.getLongLong()
+		flags := d.getShort()
+		if flags&amqpContentTypeFlag != 0 {
+			c.publishing.contentType = d.getShortStr()
+		}
+		if flags&amqpDeliveryModeFlag != 0 {
+			c.publishing.persistent = d.getOctet() == 2
+		}
+		if c.size == 0 {
+			return s.published(c)
+		}
+		return true
+	case amqpBodyFrame:
+		c.publishing.body = append(c.publishing.body, f.Payload...)
+		if uint64(len(c.publishing.body)) >= c.size {
+			return s.published(c)
+		}
+		return true
+	}
+
+	d := &amqpDecoder{buf: f.Payload}
+	method := d.getLong()
+	args := new(amqpEncoder)
+	switch method {
+	case amqpConnectionStartOk:
+		d.getLongStr()
+		d.getShortStr()
+		if d.getLongStr() != "\x00guest\x00guest" {
+			args.putShort(403)
+			args.putShortStr("ACCESS_REFUSED")
+			args.putLong(0)
+			c.send(0, amqpConnectionClose, args)
+			return false
+		}
+		args.putShort(0)
+		args.putLong(amqpFrameMax)
+		args.putShort(0)
+		c.send(0, amqpConnectionTune, args)
+	case amqpConnectionTuneOk:
+	case amqpConnectionOpen:
+		args.putShortStr("")
+		c.send(0, amqpConnectionOpenOk, args)
+	case amqpConnectionClose:
+		c.send(0, amqpConnectionCloseOk, nil)
+		return false
+	case amqpChannelOpen:
+		c.channel = true
+		c.confirms = false
+		c.publishTag = 0
+		c.deliverTag = 0
+		args.putLongStr("")
+		c.send(f.Channel, amqpChannelOpenOk, args)
+	case amqpChannelClose:
+		s.closed(c)
+		c.send(f.Channel, amqpChannelCloseOk, nil)
+	case amqpChannelCloseOk:
+	case amqpExchangeDeclare:
+		d.getShort()
+		s.lock.Lock()
+		s.exchanges[d.getShortStr()] = true
+		s.lock.Unlock()
+		c.send(f.Channel, amqpExchangeDeclareOk, nil)
+	case amqpQueueDeclare:
+		d.getShort()
+		queue := d.getShortStr()
+		s.lock.Lock()
+		if queue == "" {
+			s.queueCount++
+			queue = fmt.Sprintf("amq.gen-%d", s.queueCount)
+		}
+		if _, ok := s.queues[queue]; !ok {
+			s.queues[queue] = nil
+		}
+		s.lock.Unlock()
+		args.putShortStr(queue)
+		args.putLong(0)
+		args.putLong(0)
+		c.send(f.Channel, amqpQueueDeclareOk, args)
+	case amqpQueueBind:
+		d.getShort()
+		b := amqpBinding{queue: d.getShortStr(), exchange: d.getShortStr(),
+			key: d.getShortStr()}
+		s.lock.Lock()
+		s.bindings = append(s.bindings, b)
+		s.lock.Unlock()
+		c.send(f.Channel, amqpQueueBindOk, nil)
+	case amqpBasicQos:
+		d.getLong()
+		c.prefetch = int(d.getShort())
+		c.send(f.Channel, amqpBasicQosOk, nil)
+	case amqpBasicConsume:
+		d.getShort()
+		c.queue = d.getShortStr()
+		args.putShortStr("ctag")
+		c.send(f.Channel, amqpBasicConsumeOk, args)
+	case amqpBasicAck, amqpBasicReject:
+		tag := d.getLongLong()
+		requeue := d.getOctet()&1 == 1 && method == amqpBasicReject
+		s.lock.Lock()
+		msg := c.unacked[tag]
+		delete(c.unacked, tag)
+		if method == amqpBasicAck {
+			s.acked++
+		} else {
+			s.rejected++
+		}
+		if requeue {
+			s.queues[c.queue] = append(s.queues[c.queue], msg)
+		}
+		s.lock.Unlock()
+	case amqpConfirmSelect:
+		c.confirms = true
+		c.send(f.Channel, amqpConfirmSelectOk, nil)
+	case amqpBasicPublish:
+		d.getShort()
+		c.exchange = d.getShortStr()
+		c.publishing = &amqpStandInMessage{key: d.getShortStr()}
+	default:
+		return false
+	}
+	return d.err == nil
+}
+
+// Routes a message once its content has arrived.
+func (s *amqpStandIn) published(c *amqpStandInConn) bool {
+	msg := *c.publishing
+	c.publishing = nil
+	s.lock.Lock()
+	var failure string
+	if len(s.publishFailures) > 0 {
+		failure = s.publishFailures[0]
+		s.publishFailures = s.publishFailures[1:]
+	}
+	_, exists := s.exchanges[c.exchange]
+	if failure == "" && exists {
+		for _, b := range s.bindings {
+			if b.exchange == c.exchange && (b.key == msg.key || b.key == "#") {
+				s.queues[b.queue] = append(s.queues[b.queue], msg)
+			}
+		}
+	} else if failure == "" && c.exchange == "" {
+		if _, ok := s.queues[msg.key]; ok {
+			s.queues[msg.key] = append(s.queues[msg.key], msg)
+		}
+	}
+	s.lock.Unlock()
+
+	switch {
+	case failure == "connection":
+		return false
+	case failure == "channel" || (!exists && c.exchange != ""):
+		s.closeChannel(c, 404, "NOT_FOUND")
+		return true
+	}
+	if c.confirms {
+		c.publishTag++
+		args := new(amqpEncoder)
+		args.putLongLong(c.publishTag)
+		args.putOctet(0)
+		c.send(amqpChannel, amqpBasicAck, args)
+	}
+	return true
+}
+
+func (s *amqpStandIn) closeChannel(c *amqpStandInConn, code uint16,
+	text string) {
+
+	s.closed(c)
+	args := new(amqpEncoder)
+	args.putShort(code)
+	args.putShortStr(text)
+	args.putLong(0)
+	c.send(amqpChannel, amqpChannelClose, args)
+}
+
+// Forgets a closed channel's consumer, requeueing its unacknowledged
+// messages.
+func (s *amqpStandIn) closed(c *amqpStandInConn) {
+	c.channel = false
+	s.requeue(c)
+	c.queue = ""
+}
+
+func (s *amqpStandIn) requeue(c *amqpStandInConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, msg := range c.unacked {
+		s.queues[c.queue] = append([]amqpStandInMessage{msg}, s.queues[c.queue]...)
+	}
+	c.unacked = make(map[uint64]amqpStandInMessage)
+}
+
+// Closes the channel if asked to, and delivers the queue's messages to the
+// consumer up to its prefetch count.
+func (s *amqpStandIn) tick(c *amqpStandInConn) bool {
+	s.lock.Lock()
+	closeChannel := c.channel && s.channelCloses > 0
+	if closeChannel {
+		s.channelCloses--
+	}
+	s.lock.Unlock()
+	if closeChannel {
+		s.closeChannel(c, 320, "CONNECTION_FORCED")
+		return true
+	}
+	for c.queue != "" && len(c.unacked) < c.prefetch {
+		s.lock.Lock()
+		msgs := s.queues[c.queue]
+		if len(msgs) == 0 {
+			s.lock.Unlock()
+			break
+		}
+		msg := msgs[0]
+		s.queues[c.queue] = msgs[1:]
+		c.deliverTag++
+		c.unacked[c.deliverTag] = msg
+		s.lock.Unlock()
+
+		args := new(amqpEncoder)
+		args.putShortStr("ctag")
+		args.putLongLong(c.deliverTag)
+		args.putOctet(0)
+		args.putShortStr("")
+		args.putShortStr(msg.key)
+		header := new(amqpEncoder)
+		header.putShort(amqpBasicClass)
+		header.putShort(0)
+		header.putLongLong(uint64(len(msg.body)))
+		if msg.contentType != "" {
+			header.putShort(amqpContentTypeFlag)
+			header.putShortStr(msg.contentType)
+		} else {
+			header.putShort(0)
+		}
+		if c.send(amqpChannel, amqpBasicDeliver, args) != nil ||
+			writeAmqpFrame(c.conn, &amqpFrame{Type: amqpHeaderFrame,
+				Channel: amqpChannel, Payload: header.buf}) != nil ||
+			writeAmqpFrame(c.conn, &amqpFrame{Type: amqpBodyFrame,
+				Channel: amqpChannel, Payload: msg.body}) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func AmqpSpec(c gs.Context) {
+	t := new(ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	broker, err := newAmqpStandIn()
+	c.Assume(err, gs.IsNil)
+	defer broker.Close()
+
+	c.Specify("An AMQP URL", func() {
+		c.Specify("defaults to the guest user and / vhost", func() {
+			u, err := parseAmqpUrl("amqp://mq.example.com", false)
+			c.Expect(err, gs.IsNil)
+			c.Expect(u.Addr, gs.Equals, "mq.example.com:5672")
+			c.Expect(u.Username, gs.Equals, "guest")
+			c.Expect(u.Vhost, gs.Equals, "/")
+		})
+
+		c.Specify("names the user and vhost", func() {
+			u, err := parseAmqpUrl("amqp://heka:secret@mq:5673/logs", true)
+			c.Expect(err, gs.IsNil)
+			c.Expect(u.Addr, gs.Equals, "mq:5673")
+			c.Expect(u.Password, gs.Equals, "secret")
+			c.Expect(u.Vhost, gs.Equals, "logs")
+		})
+
+		c.Specify("must use the amqp scheme", func() {
+			_, err := parseAmqpUrl("http://mq/", false)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An AmqpOutput", func() {
+		broker.exchanges["logs"] = true
+		broker.queues["test"] = nil
+		broker.bindings = []amqpBinding{{"logs", "TEST.GoSpec", "test"}}
+
+		oth := NewOutputTestHelper(ctrl)
+		inChan := make(chan *PipelineCapture, 3)
+		oth.MockOutputRunner.EXPECT().InChan().Return(inChan).AnyTimes()
+		output := new(AmqpOutput)
+		config := output.ConfigStruct().(*AmqpOutputConfig)
+		config.Url = broker.Url()
+		config.Exchange = "logs"
+		config.RoutingKey = "@Type.@Logger"
+		config.RetryDelay = 1
+
+		// Runs the output over `msgs` until they've all been confirmed.
+		run := func(msgs ...*message.Message) {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			done := make(chan bool)
+			go func() {
+				output.Run(oth.MockOutputRunner, oth.MockHelper)
+				close(done)
+			}()
+			for _, msg := range msgs {
+				pack := NewPipelinePack(make(chan *PipelinePack, 1))
+				pack.Message = msg
+				inChan <- &PipelineCapture{Pack: pack}
+			}
+			close(inChan)
+			<-done
+		}
+		decode := func(msg amqpStandInMessage) *message.Message {
+			m := new(message.Message)
+			c.Expect(proto.Unmarshal(msg.body, m), gs.IsNil)
+			return m
+		}
+
+		c.Specify("publishes messages w/ an interpolated routing key", func() {
+			other := getTestMessage()
+			other.SetLogger("other")
+			run(getTestMessage(), other, getTestMessage())
+			msgs := broker.messages("test")
+			c.Expect(len(msgs), gs.Equals, 2)
+			c.Expect(msgs[0].key, gs.Equals, "TEST.GoSpec")
+			c.Expect(msgs[0].contentType, gs.Equals, "application/x-protobuf")
+			c.Expect(msgs[0].persistent, gs.IsTrue)
+			c.Expect(decode(msgs[0]).GetPayload(), gs.Equals,
+				getTestMessage().GetPayload())
+
+			msg := getTestMessage()
+			output.ReportMsg(msg)
+			published, _ := msg.GetFieldValue("PublishedMessages")
+			c.Expect(published, gs.Equals, int64(3))
+		})
+
+		c.Specify("encodes messages as JSON", func() {
+			config.Encoding = "json"
+			config.Persistent = false
+			run(getTestMessage())
+			msgs := broker.messages("test")
+			c.Expect(len(msgs), gs.Equals, 1)
+			c.Expect(msgs[0].contentType, gs.Equals, "application/json")
+			c.Expect(msgs[0].persistent, gs.IsFalse)
+			msg := new(message.Message)
+			c.Expect(json.Unmarshal(msgs[0].body, msg), gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "TEST")
+		})
+
+		c.Specify("republishes after the server closes the channel", func() {
+			broker.publishFailures = []string{"channel"}
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+			run(getTestMessage())
+			c.Expect(len(broker.messages("test")), gs.Equals, 1)
+
+			msg := getTestMessage()
+			output.ReportMsg(msg)
+			reconnects, _ := msg.GetFieldValue("Reconnects")
+			c.Expect(reconnects, gs.Equals, int64(1))
+		})
+
+		c.Specify("republishes after the connection drops", func() {
+			broker.publishFailures = []string{"connection"}
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+			run(getTestMessage(), getTestMessage())
+			c.Expect(len(broker.messages("test")), gs.Equals, 2)
+		})
+
+		c.Specify("rejects an unknown encoding", func() {
+			config.Encoding = "xml"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An AmqpInput", func() {
+		ir := NewMockInputRunner(ctrl)
+		h := NewMockPluginHelper(ctrl)
+		packSupply := make(chan *PipelinePack, 4)
+		for i := 0; i < 4; i++ {
+			packSupply <- NewPipelinePack(packSupply)
+		}
+		injected := make(chan *PipelinePack, 4)
+		ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+		ir.EXPECT().Inject(gomock.Any()).Do(func(pack *PipelinePack) {
+			injected <- pack
+		}).AnyTimes()
+		pipeConfig := NewPipelineConfig(nil)
+		var decoders ConfigFile
+		_, err := toml.Decode(defaultDecoderTOML, &decoders)
+		c.Assume(err, gs.IsNil)
+		for name, conf := range decoders {
+			c.Assume(pipeConfig.loadSection(name, conf), gs.Equals, uint(0))
+		}
+		h.EXPECT().PipelineConfig().Return(pipeConfig).AnyTimes()
+
+		input := new(AmqpInput)
+		config := input.ConfigStruct().(*AmqpInputConfig)
+		config.Url = broker.Url()
+		config.Exchange = "logs"
+		config.Queue = "test"
+		config.BindingKey = "#"
+		config.RetryDelay = 1
+
+		enqueue := func(payload string) {
+			msg := getTestMessage()
+			msg.SetPayload(payload)
+			body, err := proto.Marshal(msg)
+			c.Assume(err, gs.IsNil)
+			broker.enqueue("test", amqpStandInMessage{body: body})
+		}
+		// Waits for the next injected message's payload.
+		next := func() string {
+			select {
+			case pack := <-injected:
+				c.Expect(pack.Decoded, gs.IsTrue)
+				return pack.Message.GetPayload()
+			case <-time.After(time.Second):
+			}
+			return "timed out"
+		}
+		err = input.Init(config)
+		c.Assume(err, gs.IsNil)
+		done := make(chan bool)
+		start := func() {
+			go func() {
+				input.Run(ir, h)
+				close(done)
+			}()
+		}
+		stop := func() {
+			input.Stop()
+			<-done
+		}
+
+		c.Specify("consumes and acknowledges messages", func() {
+			enqueue("one")
+			enqueue("two")
+			start()
+			c.Expect(next(), gs.Equals, "one")
+			c.Expect(next(), gs.Equals, "two")
+			stop()
+			acked, _ := broker.counts()
+			c.Expect(acked, gs.Equals, 2)
+			c.Expect(len(broker.messages("test")), gs.Equals, 0)
+			c.Expect(broker.bindings[0].exchange, gs.Equals, "logs")
+		})
+
+		c.Specify("decodes messages by content type", func() {
+			broker.enqueue("test", amqpStandInMessage{
+				contentType: "application/json",
+				body:        []byte(`{"payload": "json"}`),
+			})
+			start()
+			c.Expect(next(), gs.Equals, "json")
+			stop()
+		})
+
+		c.Specify("uses the configured decoders", func() {
+			pipeConfig.DecoderWrappers["JsonDecoder"] = &PluginWrapper{
+				name:          "JsonDecoder",
+				configCreator: func() interface{} { return "configured" },
+				pluginCreator: func() interface{} { return new(amqpTestDecoder) },
+			}
+			broker.enqueue("test", amqpStandInMessage{
+				contentType: "application/json",
+				body:        []byte(`{"payload": "json"}`),
+			})
+			start()
+			c.Expect(next(), gs.Equals, "configured")
+			stop()
+		})
+
+		c.Specify("rejects messages it can't decode", func() {
+			ir.EXPECT().LogError(gomock.Any()).Times(2)
+			broker.enqueue("test", amqpStandInMessage{
+				contentType: "text/plain",
+				body:        []byte("hello"),
+			})
+			broker.enqueue("test", amqpStandInMessage{
+				contentType: "application/json",
+				body:        []byte("{"),
+			})
+			enqueue("good")
+			start()
+			c.Expect(next(), gs.Equals, "good")
+			stop()
+			acked, rejected := broker.counts()
+			c.Expect(acked, gs.Equals, 1)
+			c.Expect(rejected, gs.Equals, 2)
+		})
+
+		c.Specify("reconnects after the connection drops", func() {
+			ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+			enqueue("one")
+			start()
+			c.Expect(next(), gs.Equals, "one")
+			// Wait for the ack, or "one" is delivered again.
+			for acked, _ := broker.counts(); acked == 0; acked, _ = broker.counts() {
+				time.Sleep(time.Millisecond)
+			}
+			broker.dropConnections()
+			enqueue("two")
+			c.Expect(next(), gs.Equals, "two")
+			stop()
+		})
+
+		c.Specify("reopens the channel after the server closes it", func() {
+			ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+			start()
+			broker.lock.Lock()
+			broker.channelCloses = 1
+			broker.lock.Unlock()
+			enqueue("one")
+			c.Expect(next(), gs.Equals, "one")
+			stop()
+			c.Expect(broker.channelCloses, gs.Equals, 0)
+		})
+
+		c.Specify("rejects a URL w/ the wrong scheme", func() {
+			config.Url = "amqps://localhost/"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -22,6 +22,7 @@ import (
 	. "github.com/mozilla-services/heka/message"
 	"log"
 	"os"
+	"reflect"
 	"regexp"
 	"sync"
 	"time"
@@ -68,10 +69,22 @@ type PipelineConfig struct {
 	inputRecycleChan  chan *PipelinePack
 	injectRecycleChan chan *PipelinePack // need a separate pool for message injection to avoid a deadlock with input
 	logMsgs           []string
+	inputsLock        sync.Mutex
+	inputsWg          sync.WaitGroup
 	filtersLock       sync.Mutex
 	filtersWg         sync.WaitGroup
+	outputsLock       sync.Mutex
+	outputsWg         sync.WaitGroup
 	decodersWg        sync.WaitGroup
 	decodersChan      chan DecoderSet
+	runnerWgs         map[string]*sync.WaitGroup
+	runnerWgsLock     sync.Mutex
+	configFilename    string
+	configSections    ConfigFile
+	controlLock       sync.Mutex // Serializes reloads, management requests and shutdown.
+	management        *ManagementConfig
+	running           int32
+	reloading         int32 // 1 while a SIGHUP reload is in progress.
 	hostname          string
 	pid               int32
 }
@@ -97,6 +110,7 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	config.injectRecycleChan = make(chan *PipelinePack, globals.PoolSize)
 	config.logMsgs = make([]string, 0, 4)
 	config.decodersChan = make(chan DecoderSet, globals.DecoderPoolSize)
+	config.runnerWgs = make(map[string]*sync.WaitGroup)
 	config.hostname, _ = os.Hostname()
 	config.pid = int32(os.Getpid())
 
@@ -139,14 +153,86 @@ func (self *PipelineConfig) Filter(name string) (fRunner FilterRunner, ok bool)
 	return
 }
 
+// Starts a plugin runner w/ a WaitGroup of its own so it can be waited on by
+// name once it's been told to stop, while still counting toward `groupWg` so
+// shutdown can wait for all of the runners of a given kind.
+func (self *PipelineConfig) startRunner(name string, groupWg *sync.WaitGroup,
+	start func(wg *sync.WaitGroup) error) (err error) {
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	groupWg.Add(1)
+	if err = start(wg); err != nil {
+		groupWg.Done()
+		return
+	}
+	self.runnerWgsLock.Lock()
+	self.runnerWgs[name] = wg
+	self.runnerWgsLock.Unlock()
+	go func() {
+		wg.Wait()
+		self.runnerWgsLock.Lock()
+		if self.runnerWgs[name] == wg {
+			delete(self.runnerWgs, name)
+		}
+		self.runnerWgsLock.Unlock()
+		groupWg.Done()
+	}()
+	return
+}
+
+// Blocks until the named plugin's runner has exited.
+func (self *PipelineConfig) waitForRunner(name string) {
+	self.runnerWgsLock.Lock()
+	wg, ok := self.runnerWgs[name]
+	self.runnerWgsLock.Unlock()
+	if ok {
+		wg.Wait()
+	}
+}
+
+// Adds the specified InputRunner to the configuration and starts it
+func (self *PipelineConfig) AddInputRunner(iRunner InputRunner) error {
+	self.inputsLock.Lock()
+	defer self.inputsLock.Unlock()
+	self.InputRunners[iRunner.Name()] = iRunner
+	err := self.startRunner(iRunner.Name(), &self.inputsWg,
+		func(wg *sync.WaitGroup) error {
+			return iRunner.Start(self, wg)
+		})
+	if err != nil {
+		return fmt.Errorf("AddInputRunner '%s' failed to start: %s",
+			iRunner.Name(), err)
+	}
+	return nil
+}
+
+// Stops the specified InputRunner, waits for it to exit and removes it from
+// the configuration
+func (self *PipelineConfig) RemoveInputRunner(name string) bool {
+	self.inputsLock.Lock()
+	iRunner, ok := self.InputRunners[name]
+	if ok {
+		iRunner.Input().Stop()
+		delete(self.InputRunners, name)
+	}
+	self.inputsLock.Unlock()
+	if ok {
+		self.waitForRunner(name)
+	}
+	return ok
+}
+
 // Adds the specified FilterRunner to the configuration
 func (self *PipelineConfig) AddFilterRunner(fRunner FilterRunner) error {
 	self.filtersLock.Lock()
 	defer self.filtersLock.Unlock()
 	self.FilterRunners[fRunner.Name()] = fRunner
-	self.filtersWg.Add(1)
-	if err := fRunner.Start(self, &self.filtersWg); err != nil {
-		self.filtersWg.Done()
+	err := self.startRunner(fRunner.Name(), &self.filtersWg,
+		func(wg *sync.WaitGroup) error {
+			return fRunner.Start(self, wg)
+		})
+	if err != nil {
 		return fmt.Errorf("AddFilterRunner '%s' failed to start: %s",
 			fRunner.Name(), err)
 	} else {
@@ -172,6 +258,42 @@ func (self *PipelineConfig) RemoveFilterRunner(name string) bool {
 	return false
 }
 
+// Adds the specified OutputRunner to the configuration and starts it
+func (self *PipelineConfig) AddOutputRunner(oRunner OutputRunner) error {
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
+	self.OutputRunners[oRunner.Name()] = oRunner
+	err := self.startRunner(oRunner.Name(), &self.outputsWg,
+		func(wg *sync.WaitGroup) error {
+			return oRunner.Start(self, wg)
+		})
+	if err != nil {
+		return fmt.Errorf("AddOutputRunner '%s' failed to start: %s",
+			oRunner.Name(), err)
+	}
+	self.router.OMrChan() <- oRunner.MatchRunner()
+	return nil
+}
+
+// Removes the specified OutputRunner from the configuration and waits for it
+// and its MatchRunner to finish processing the messages already delivered to
+// them
+func (self *PipelineConfig) RemoveOutputRunner(name string) bool {
+	self.outputsLock.Lock()
+	oRunner, ok := self.OutputRunners[name]
+	if ok {
+		self.router.OMrChan() <- oRunner.MatchRunner()
+		close(oRunner.InChan())
+		delete(self.OutputRunners, name)
+	}
+	self.outputsLock.Unlock()
+	if ok {
+		self.waitForRunner(name)
+		oRunner.MatchRunner().Wait()
+	}
+	return ok
+}
+
 // The TOML config file spec
 type ConfigFile PluginConfig
 type PluginGlobals struct {
@@ -180,6 +302,10 @@ type PluginGlobals struct {
 	Encoding string  `toml:"encoding_name"`
 	Matcher  string  `toml:"message_matcher"`
 	Signer   string  `toml:"message_signer"`
+	// What to do w/ matched messages when the plugin falls behind, and
+	// where to put them for the "spill" policy.
+	OverflowPolicy string `toml:"overflow_policy"`
+	OverflowDir    string `toml:"overflow_dir"`
 }
 
 // Default Decoders
@@ -189,6 +315,12 @@ encoding_name = "JSON"
 
 [ProtobufDecoder]
 encoding_name = "PROTOCOL_BUFFER"
+
+[MsgPackDecoder]
+encoding_name = "MSGPACK"
+
+[CborDecoder]
+encoding_name = "CBOR"
 `
 
 // A helper function to simplify plugin creation
@@ -404,25 +536,57 @@ func (self *PipelineConfig) loadSection(sectionName string,
 			errcnt++
 			return
 		}
+		if err = matcher.SetOverflowPolicy(pluginGlobals.OverflowPolicy,
+			pluginGlobals.OverflowDir); err != nil {
+			self.log(fmt.Sprintf("Can't set overflow policy for '%s': %s",
+				wrapper.name, err))
+			errcnt++
+			return
+		}
 		runner.matcher = matcher
 	}
 
+	// The router learns about the matchers when the runners are started.
 	switch pluginCategory {
 	case "Filter":
-		if matcher != nil {
-			self.router.fMatchers = append(self.router.fMatchers, matcher)
-		}
 		self.FilterRunners[runner.name] = runner
 	case "Output":
-		if matcher != nil {
-			self.router.oMatchers = append(self.router.oMatchers, matcher)
-		}
 		self.OutputRunners[runner.name] = runner
 	}
 
 	return
 }
 
+// Decodes a TOML configuration file, adding the default decoders if they
+// aren't configured. The management section, which doesn't configure a
+// plugin, is taken out of the returned sections and decoded separately.
+func readConfigFile(filename string) (configFile ConfigFile,
+	management *ManagementConfig, err error) {
+
+	if _, err = toml.DecodeFile(filename, &configFile); err != nil {
+		return nil, nil, fmt.Errorf("Error decoding config file: %s", err)
+	}
+	if configFile == nil {
+		configFile = make(ConfigFile)
+	}
+	if conf, ok := configFile[MANAGEMENT_SECTION]; ok {
+		delete(configFile, MANAGEMENT_SECTION)
+		management = new(ManagementConfig)
+		if err = toml.PrimitiveDecode(conf, management); err != nil {
+			return nil, nil, fmt.Errorf("Error decoding %s section: %s",
+				MANAGEMENT_SECTION, err)
+		}
+	}
+	var configDefault ConfigFile
+	toml.Decode(defaultDecoderTOML, &configDefault)
+	for name, conf := range configDefault {
+		if _, ok := configFile[name]; !ok {
+			configFile[name] = conf
+		}
+	}
+	return
+}
+
 // LoadFromConfigFile loads a TOML configuration file and stores the
 // result in the value pointed to by config. The maps in the config
 // will be initialized as needed.
@@ -431,51 +595,300 @@ func (self *PipelineConfig) loadSection(sectionName string,
 // its Init function.
 func (self *PipelineConfig) LoadFromConfigFile(filename string) (err error) {
 	var configFile ConfigFile
-	if _, err = toml.DecodeFile(filename, &configFile); err != nil {
-		return fmt.Errorf("Error decoding config file: %s", err)
+	if configFile, self.management, err = readConfigFile(filename); err != nil {
+		return
 	}
+	self.configFilename = filename
+	self.configSections = make(ConfigFile)
 
 	// Load all the plugins
-	var errcnt uint
+	var errcnt, sectionErrs uint
 	for name, conf := range configFile {
 		log.Println("Loading: ", name)
-		errcnt += self.loadSection(name, conf)
+		if sectionErrs = self.loadSection(name, conf); sectionErrs == 0 {
+			self.configSections[name] = conf
+		}
+		errcnt += sectionErrs
 	}
 
-	// Add JSON/PROTOCOL_BUFFER decoders if none were configured
-	var configDefault ConfigFile
-	toml.Decode(defaultDecoderTOML, &configDefault)
-	dWrappers := self.DecoderWrappers
+	errcnt += self.startDecoderSets()
 
-	if _, ok := dWrappers["JsonDecoder"]; !ok {
-		log.Println("Loading: JsonDecoder")
-		errcnt += self.loadSection("JsonDecoder", configDefault["JsonDecoder"])
-	}
-	if _, ok := dWrappers["ProtobufDecoder"]; !ok {
-		log.Println("Loading: ProtobufDecoder")
-		errcnt += self.loadSection("ProtobufDecoder", configDefault["ProtobufDecoder"])
+	if errcnt != 0 {
+		return fmt.Errorf("%d errors loading plugins", errcnt)
 	}
 
-	// Create / prep the DecoderSet pool
-	var dRunner DecoderRunner
+	return
+}
+
+// Creates and starts the DecoderSet pool from the DecoderWrappers.
+func (self *PipelineConfig) startDecoderSets() (errcnt uint) {
+	var (
+		ds  *decoderSet
+		err error
+	)
 	for i := 0; i < Globals().DecoderPoolSize; i++ {
-		if self.DecoderSets[i], err = newDecoderSet(dWrappers); err != nil {
+		if ds, err = newDecoderSet(self.DecoderWrappers); err != nil {
 			log.Println(err)
-			errcnt += 1
+			errcnt++
+			continue
 		}
-		for _, dRunner = range self.DecoderSets[i].AllByName() {
+		self.DecoderSets[i] = ds
+		for _, dRunner := range ds.AllByName() {
+			self.decodersWg.Add(1)
 			dRunner.Start(self, &self.decodersWg)
 		}
-		self.decodersChan <- self.DecoderSets[i]
+		self.decodersChan <- ds
+	}
+	return
+}
+
+// Takes the DecoderSets out of the pool and stops all of their decoders once
+// the messages already handed to them have been decoded. Nothing may be
+// using the pool, i.e. the inputs must already be stopped.
+func (self *PipelineConfig) stopDecoderSets() {
+	for len(self.decodersChan) > 0 {
+		ds := <-self.decodersChan
+		for _, dRunner := range ds.AllByName() {
+			close(dRunner.InChan())
+		}
+	}
+	self.decodersWg.Wait()
+}
+
+// Returns the plugin category (i.e. "Input", "Decoder", "Filter" or "Output")
+// of a config section, or an empty string if it can't be determined.
+func sectionCategory(name string, conf toml.Primitive) string {
+	var pluginGlobals PluginGlobals
+	if err := toml.PrimitiveDecode(conf, &pluginGlobals); err != nil {
+		return ""
+	}
+	pluginType := pluginGlobals.Typ
+	if pluginType == "" {
+		pluginType = name
+	}
+	if cats := PluginTypeRegex.FindStringSubmatch(pluginType); len(cats) > 1 {
+		return cats[1]
+	}
+	return ""
+}
+
+// Checks a config section as far as is possible w/o initializing its
+// plugin, since Init may need something, e.g. a listening address, that the
+// plugin it's replacing still holds.
+func checkSection(name string, conf toml.Primitive) (err error) {
+	var pluginGlobals PluginGlobals
+	if err = toml.PrimitiveDecode(conf, &pluginGlobals); err != nil {
+		return fmt.Errorf("Unable to decode config for plugin: %s, error: %s",
+			name, err)
+	}
+	pluginType := pluginGlobals.Typ
+	if pluginType == "" {
+		pluginType = name
+	}
+	pluginCreator, ok := AvailablePlugins[pluginType]
+	if !ok {
+		return fmt.Errorf("No such plugin: %s", name)
+	}
+	if sectionCategory(name, conf) == "" {
+		return fmt.Errorf("Type doesn't contain valid plugin name: %s",
+			pluginType)
+	}
+	if _, err = LoadConfigStruct(conf, pluginCreator()); err != nil {
+		return fmt.Errorf("Can't load config for '%s': %s", name, err)
+	}
+	if pluginGlobals.Matcher != "" {
+		if _, err = CreateMatcherSpecification(pluginGlobals.Matcher); err != nil {
+			return fmt.Errorf("Can't create message matcher for '%s': %s",
+				name, err)
+		}
+	}
+	return
+}
+
+// Reloads the configuration file most recently passed to LoadFromConfigFile
+// and applies the differences to the running pipeline. Plugins no longer in
+// the file are stopped, new ones are started, and those whose config has
+// changed are stopped and restarted w/ the new config. Plugins that haven't
+// changed keep running undisturbed, except that any change to the decoders
+// restarts all of the inputs, since every input holds on to a DecoderSet.
+// The new config of every section is checked before anything is stopped, a
+// plugin whose new config is bad keeps running w/ its old one. If a plugin
+// still fails to initialize w/ its new config it's restarted w/ the old.
+func (self *PipelineConfig) Reload() (err error) {
+	self.controlLock.Lock()
+	defer self.controlLock.Unlock()
+	if Globals().Stopping {
+		return fmt.Errorf("shutting down")
+	}
+
+	// The management API keeps its original settings.
+	var configFile ConfigFile
+	if configFile, _, err = readConfigFile(self.configFilename); err != nil {
+		return
+	}
+
+	// A section whose new config is bad is treated as if it hadn't changed.
+	var errcnt, sectionErrs uint
+	for name, conf := range configFile {
+		oldConf, ok := self.configSections[name]
+		if ok && reflect.DeepEqual(conf, oldConf) {
+			continue
+		}
+		if e := checkSection(name, conf); e != nil {
+			log.Printf("Reload: not loading '%s': %s", name, e)
+			errcnt++
+			if ok {
+				configFile[name] = oldConf
+			} else {
+				delete(configFile, name)
+			}
+		}
+	}
+
+	// Sections to stop and sections to (re)load, w/ their categories.
+	stale := make(map[string]string)
+	fresh := make(map[string]string)
+	var decodersChanged bool
+	for name, conf := range self.configSections {
+		if newConf, ok := configFile[name]; !ok || !reflect.DeepEqual(conf, newConf) {
+			stale[name] = sectionCategory(name, conf)
+			if stale[name] == "Decoder" {
+				decodersChanged = true
+			}
+		}
+	}
+	for name, conf := range configFile {
+		if oldConf, ok := self.configSections[name]; !ok || !reflect.DeepEqual(conf, oldConf) {
+			fresh[name] = sectionCategory(name, conf)
+			if fresh[name] == "Decoder" {
+				decodersChanged = true
+			}
+		}
+	}
+	if decodersChanged {
+		for name, conf := range self.configSections {
+			if sectionCategory(name, conf) == "Input" {
+				stale[name] = "Input"
+				if newConf, ok := configFile[name]; ok {
+					fresh[name] = sectionCategory(name, newConf)
+				}
+			}
+		}
+	}
+	if len(stale) == 0 && len(fresh) == 0 {
+		if errcnt != 0 {
+			return fmt.Errorf("%d errors reloading plugins", errcnt)
+		}
+		log.Println("Reload: no configuration changes")
+		return
+	}
+
+	// Stop in the same order as a shutdown, so messages already in the
+	// pipeline can still reach the outputs.
+	replaced := make(map[string]toml.Primitive)
+	for _, category := range []string{"Input", "Decoder", "Filter", "Output"} {
+		if category == "Decoder" && decodersChanged {
+			self.stopDecoderSets()
+		}
+		for name, cat := range stale {
+			if cat != category {
+				continue
+			}
+			log.Printf("Reload: stopping '%s'", name)
+			self.stopSection(name, category)
+			if _, ok := fresh[name]; ok {
+				replaced[name] = self.configSections[name]
+			}
+			delete(self.configSections, name)
+		}
+	}
+
+	// Start in the same order as `Run`, so everything downstream of a plugin
+	// is running before it is.
+	for _, category := range []string{"Decoder", "Output", "Filter", "Input"} {
+		for name, cat := range fresh {
+			if cat != category {
+				continue
+			}
+			log.Printf("Reload: loading '%s'", name)
+			conf := configFile[name]
+			if sectionErrs = self.loadSection(name, conf); sectionErrs != 0 {
+				errcnt += sectionErrs
+				oldConf, ok := replaced[name]
+				if !ok || sectionCategory(name, oldConf) != category ||
+					self.loadSection(name, oldConf) != 0 {
+					continue
+				}
+				log.Printf("Reload: restarting '%s' w/ its old config", name)
+				conf = oldConf
+			}
+			self.configSections[name] = conf
+			if err = self.startSection(name, category); err != nil {
+				log.Println(err)
+				errcnt++
+			}
+		}
+		if category == "Decoder" && decodersChanged {
+			errcnt += self.startDecoderSets()
+		}
 	}
 
 	if errcnt != 0 {
-		return fmt.Errorf("%d errors loading plugins", errcnt)
+		return fmt.Errorf("%d errors reloading plugins", errcnt)
 	}
+	return nil
+}
+
+// Stops the runner of a loaded config section and removes it from the
+// configuration. Decoders are only taken out of the DecoderWrappers, the
+// DecoderSet pool must be rebuilt for that to take effect.
+func (self *PipelineConfig) stopSection(name, category string) (ok bool) {
+	switch category {
+	case "Input":
+		ok = self.RemoveInputRunner(name)
+	case "Decoder":
+		_, ok = self.DecoderWrappers[name]
+		self.removeDecoder(name, self.configSections[name])
+	case "Filter":
+		self.filtersLock.Lock()
+		fRunner := self.FilterRunners[name]
+		self.filtersLock.Unlock()
+		if ok = self.RemoveFilterRunner(name); ok {
+			self.waitForRunner(name)
+			fRunner.MatchRunner().Wait()
+		}
+	case "Output":
+		ok = self.RemoveOutputRunner(name)
+	}
+	return
+}
 
+// Starts the runner created by `loadSection` for a config section.
+func (self *PipelineConfig) startSection(name, category string) (err error) {
+	switch category {
+	case "Output":
+		err = self.AddOutputRunner(self.OutputRunners[name])
+	case "Filter":
+		err = self.AddFilterRunner(self.FilterRunners[name])
+	case "Input":
+		err = self.AddInputRunner(self.InputRunners[name])
+	}
 	return
 }
 
+// Removes a decoder's wrapper and its encoding registration, so it's left
+// out of the next DecoderSet pool.
+func (self *PipelineConfig) removeDecoder(name string, conf toml.Primitive) {
+	delete(self.DecoderWrappers, name)
+	var pluginGlobals PluginGlobals
+	toml.PrimitiveDecode(conf, &pluginGlobals)
+	for encoding, decoderName := range DecodersByEncoding {
+		if decoderName == name || decoderName == pluginGlobals.Typ {
+			delete(DecodersByEncoding, encoding)
+		}
+	}
+}
+
 func init() {
 	RegisterPlugin("UdpInput", func() interface{} {
 		return new(UdpInput)
@@ -483,12 +896,33 @@ func init() {
 	RegisterPlugin("TcpInput", func() interface{} {
 		return new(TcpInput)
 	})
+	RegisterPlugin("SyslogInput", func() interface{} {
+		return new(SyslogInput)
+	})
+	RegisterPlugin("HttpInput", func() interface{} {
+		return new(HttpInput)
+	})
+	RegisterPlugin("KafkaInput", func() interface{} {
+		return new(KafkaInput)
+	})
+	RegisterPlugin("AmqpInput", func() interface{} {
+		return new(AmqpInput)
+	})
 	RegisterPlugin("JsonDecoder", func() interface{} {
 		return new(JsonDecoder)
 	})
 	RegisterPlugin("ProtobufDecoder", func() interface{} {
 		return new(ProtobufDecoder)
 	})
+	RegisterPlugin("MsgPackDecoder", func() interface{} {
+		return new(MsgPackDecoder)
+	})
+	RegisterPlugin("CborDecoder", func() interface{} {
+		return new(CborDecoder)
+	})
+	RegisterPlugin("GrokDecoder", func() interface{} {
+		return new(GrokDecoder)
+	})
 	RegisterPlugin("StatsdInput", func() interface{} {
 		return new(StatsdInput)
 	})
@@ -507,6 +941,18 @@ func init() {
 	RegisterPlugin("TcpOutput", func() interface{} {
 		return new(TcpOutput)
 	})
+	RegisterPlugin("HttpOutput", func() interface{} {
+		return new(HttpOutput)
+	})
+	RegisterPlugin("ElasticSearchOutput", func() interface{} {
+		return new(ElasticSearchOutput)
+	})
+	RegisterPlugin("KafkaOutput", func() interface{} {
+		return new(KafkaOutput)
+	})
+	RegisterPlugin("AmqpOutput", func() interface{} {
+		return new(AmqpOutput)
+	})
 	RegisterPlugin("StatFilter", func() interface{} {
 		return new(StatFilter)
 	})
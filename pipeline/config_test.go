@@ -15,9 +15,14 @@
 package pipeline
 
 import (
+	"fmt"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
 )
 
 func LoadFromConfigSpec(c gs.Context) {
@@ -79,10 +84,14 @@ func LoadFromConfigSpec(c gs.Context) {
 			c.Assume(err, gs.Not(gs.IsNil))
 
 			// Decoders are loaded
-			c.Expect(len(pipeConfig.DecoderWrappers), gs.Equals, 2)
+			c.Expect(len(pipeConfig.DecoderWrappers), gs.Equals, 4)
 			c.Expect(DecodersByEncoding[message.Header_JSON], gs.Equals, "JsonDecoder")
 			c.Expect(DecodersByEncoding[message.Header_PROTOCOL_BUFFER], gs.Equals,
 				"ProtobufDecoder")
+			c.Expect(DecodersByEncoding[message.Header_MSGPACK], gs.Equals,
+				"MsgPackDecoder")
+			c.Expect(DecodersByEncoding[message.Header_CBOR], gs.Equals,
+				"CborDecoder")
 		})
 		c.Specify("explodes w/ bad config file", func() {
 			err := pipeConfig.LoadFromConfigFile("../testsupport/config_bad_test.toml")
@@ -105,6 +114,147 @@ func LoadFromConfigSpec(c gs.Context) {
 			c.Expect(msg, ts.StringContains, "No such plugin")
 		})
 
+		c.Specify("reloads a changed config file", func() {
+			configPath := path.Join(os.TempDir(),
+				fmt.Sprintf("reload-test-%d.toml", time.Now().UnixNano()))
+			defer os.Remove(configPath)
+			writeConfig := func(toml string) {
+				err := ioutil.WriteFile(configPath, []byte(toml), 0600)
+				c.Assume(err, gs.IsNil)
+			}
+			writeConfig(`
+[UdpInput]
+address = "127.0.0.1:0"
+
+[LogOutput]
+message_matcher = "Type == 'reload'"
+
+[counter]
+type = "CounterFilter"
+message_matcher = "Type == 'reload'"
+`)
+			err := pipeConfig.LoadFromConfigFile(configPath)
+			c.Assume(err, gs.IsNil)
+
+			for i := 0; i < Globals().PoolSize; i++ {
+				pipeConfig.inputRecycleChan <- NewPipelinePack(pipeConfig.inputRecycleChan)
+			}
+			pipeConfig.router.Start()
+			err = pipeConfig.AddOutputRunner(pipeConfig.OutputRunners["LogOutput"])
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.AddFilterRunner(pipeConfig.FilterRunners["counter"])
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.AddInputRunner(pipeConfig.InputRunners["UdpInput"])
+			c.Assume(err, gs.IsNil)
+
+			output := pipeConfig.OutputRunners["LogOutput"]
+			counter := pipeConfig.FilterRunners["counter"]
+
+			// Nothing changed, nothing restarted.
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.IsNil)
+			c.Expect(pipeConfig.FilterRunners["counter"], gs.Equals, counter)
+
+			writeConfig(`
+[LogOutput]
+message_matcher = "Type == 'reload'"
+
+[counter]
+type = "CounterFilter"
+message_matcher = "Type == 'other'"
+
+[counter2]
+type = "CounterFilter"
+message_matcher = "Type == 'reload'"
+`)
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.IsNil)
+
+			_, ok := pipeConfig.InputRunners["UdpInput"]
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(pipeConfig.OutputRunners["LogOutput"], gs.Equals, output)
+			newCounter, ok := pipeConfig.FilterRunners["counter"]
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(newCounter == counter, gs.IsFalse)
+			_, ok = pipeConfig.FilterRunners["counter2"]
+			c.Expect(ok, gs.IsTrue)
+
+			Globals().Stopping = true
+			defer func() {
+				Globals().Stopping = false
+			}()
+			for name := range pipeConfig.FilterRunners {
+				close(pipeConfig.FilterRunners[name].InChan())
+			}
+			pipeConfig.filtersWg.Wait()
+			close(output.InChan())
+			pipeConfig.outputsWg.Wait()
+		})
+
+		c.Specify("keeps running plugins whose new config is bad", func() {
+			configPath := path.Join(os.TempDir(),
+				fmt.Sprintf("reload-test-%d.toml", time.Now().UnixNano()))
+			defer os.Remove(configPath)
+			writeConfig := func(toml string) {
+				err := ioutil.WriteFile(configPath, []byte(toml), 0600)
+				c.Assume(err, gs.IsNil)
+			}
+			writeConfig(`
+[LogOutput]
+message_matcher = "Type == 'reload'"
+
+[TcpOutput]
+address = "127.0.0.1:1"
+message_matcher = "Type == 'reload'"
+`)
+			err := pipeConfig.LoadFromConfigFile(configPath)
+			c.Assume(err, gs.IsNil)
+			pipeConfig.router.Start()
+			for _, name := range []string{"LogOutput", "TcpOutput"} {
+				err = pipeConfig.AddOutputRunner(pipeConfig.OutputRunners[name])
+				c.Assume(err, gs.IsNil)
+			}
+			output := pipeConfig.OutputRunners["LogOutput"]
+			tcpOutput := pipeConfig.OutputRunners["TcpOutput"]
+
+			// The LogOutput's and counter's configs are caught before
+			// anything's stopped, the TcpOutput's only when it's loaded.
+			writeConfig(`
+[LogOutput]
+message_matcher = "Type == ("
+
+[TcpOutput]
+address = "127.0.0.1:1"
+message_matcher = "Type == 'reload'"
+reconnect_delay = 0
+
+[counter]
+type = "NoSuchFilter"
+`)
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), ts.StringContains, "3 errors reloading plugins")
+			c.Expect(pipeConfig.OutputRunners["LogOutput"], gs.Equals, output)
+			_, ok := pipeConfig.FilterRunners["counter"]
+			c.Expect(ok, gs.IsFalse)
+			restarted, ok := pipeConfig.OutputRunners["TcpOutput"]
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(restarted == tcpOutput, gs.IsFalse)
+
+			// Reloading the same file again fails the same way.
+			err = pipeConfig.Reload()
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			Globals().Stopping = true
+			defer func() {
+				Globals().Stopping = false
+			}()
+			for _, runner := range pipeConfig.OutputRunners {
+				close(runner.InChan())
+			}
+			pipeConfig.outputsWg.Wait()
+		})
+
 		c.Specify("captures plugin Init() panics", func() {
 			RegisterPlugin("PanicOutput", func() interface{} {
 				return new(PanicOutput)
@@ -23,6 +23,7 @@ import (
 	"github.com/mozilla-services/heka/message"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
 type DecoderSet interface {
@@ -145,6 +146,7 @@ func (dr *dRunner) Start(h PluginHelper, wg *sync.WaitGroup) {
 				continue
 			}
 			pack.Decoded = true
+			atomic.AddInt64(&dr.processCount, 1)
 			h.PipelineConfig().router.InChan() <- pack
 		}
 		dr.LogMessage("stopped")
@@ -161,6 +163,7 @@ func (dr *dRunner) UUID() string {
 }
 
 func (dr *dRunner) LogError(err error) {
+	atomic.AddInt64(&dr.errorCount, 1)
 	log.Printf("Decoder '%s' error: %s", dr.name, err)
 }
 
@@ -191,3 +194,23 @@ func (self *ProtobufDecoder) Init(config interface{}) error {
 func (self *ProtobufDecoder) Decode(pack *PipelinePack) error {
 	return proto.Unmarshal(pack.MsgBytes, pack.Message)
 }
+
+type MsgPackDecoder struct{}
+
+func (self *MsgPackDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (self *MsgPackDecoder) Decode(pack *PipelinePack) error {
+	return pack.Message.UnmarshalMsgpack(pack.MsgBytes)
+}
+
+type CborDecoder struct{}
+
+func (self *CborDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (self *CborDecoder) Decode(pack *PipelinePack) error {
+	return pack.Message.UnmarshalCbor(pack.MsgBytes)
+}
@@ -94,6 +94,53 @@ func DecodersSpec(c gospec.Context) {
 		})
 	})
 
+	c.Specify("A MsgPackDecoder", func() {
+		encoded, err := msg.MarshalMsgpack()
+		c.Assume(err, gs.IsNil)
+		pack := NewPipelinePack(config.inputRecycleChan)
+		decoder := new(MsgPackDecoder)
+
+		c.Specify("decodes a msgpack message", func() {
+			pack.MsgBytes = encoded
+			err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(pack.Message, gs.Equals, msg)
+			v, ok := pack.Message.GetFieldValue("foo")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, "bar")
+		})
+
+		c.Specify("returns an error for bunk encoding", func() {
+			pack.MsgBytes = encoded[:len(encoded)-1]
+			err := decoder.Decode(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A CborDecoder", func() {
+		encoded, err := msg.MarshalCbor()
+		c.Assume(err, gs.IsNil)
+		pack := NewPipelinePack(config.inputRecycleChan)
+		decoder := new(CborDecoder)
+
+		c.Specify("decodes a cbor message", func() {
+			pack.MsgBytes = encoded
+			err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(pack.Message, gs.Equals, msg)
+			v, ok := pack.Message.GetFieldValue("foo")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, "bar")
+		})
+
+		c.Specify("returns an error for bunk encoding", func() {
+			bunk := append([]byte{0xff}, encoded...)
+			pack.MsgBytes = bunk
+			err := decoder.Decode(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
 	c.Specify("Recovers from a panic in `Decode()`", func() {
 		decoder := new(PanicDecoder)
 		dRunner := NewDecoderRunner("panic", decoder)
@@ -150,3 +197,31 @@ func BenchmarkDecodeProtobuf(b *testing.B) {
 		decoder.Decode(pack)
 	}
 }
+
+func BenchmarkDecodeMsgPack(b *testing.B) {
+	b.StopTimer()
+	msg := getTestMessage()
+	encoded, _ := msg.MarshalMsgpack()
+	config := NewPipelineConfig(nil)
+	pack := NewPipelinePack(config.inputRecycleChan)
+	decoder := new(MsgPackDecoder)
+	pack.MsgBytes = encoded
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		decoder.Decode(pack)
+	}
+}
+
+func BenchmarkDecodeCbor(b *testing.B) {
+	b.StopTimer()
+	msg := getTestMessage()
+	encoded, _ := msg.MarshalCbor()
+	config := NewPipelineConfig(nil)
+	pack := NewPipelinePack(config.inputRecycleChan)
+	decoder := new(CborDecoder)
+	pack.MsgBytes = encoded
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		decoder.Decode(pack)
+	}
+}
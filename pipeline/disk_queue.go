@@ -0,0 +1,379 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	. "github.com/mozilla-services/heka/message"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	diskQueueCheckpoint = "checkpoint.txt"
+	diskQueueSuffix     = ".log"
+)
+
+// Persistent FIFO of Heka protocol buffer stream records. Records are
+// appended to a rotating set of numbered segment files in the queue
+// directory. A checkpoint file holds the segment number and offset of the
+// oldest record that hasn't been acknowledged, so a queue reopened after a
+// restart resumes replay from that record.
+type diskQueue struct {
+	dir          string
+	maxSize      int64
+	maxSegment   int64
+	dropOldest   bool
+	lock         sync.Mutex
+	cond         *sync.Cond
+	closed       bool
+	size         int64 // Unacknowledged bytes on disk.
+	droppedBytes int64
+	writeSeq     uint64
+	writeFile    *os.File
+	writeOffset  int64
+	readSeq      uint64
+	readFile     *os.File
+	readOffset   int64 // Offset of the next unread record in readSeq.
+	ackOffset    int64 // Offset of the oldest unacknowledged record.
+	pending      []byte
+	checkpoint   *os.File
+	header       *Header
+}
+
+// Opens (or creates) the queue stored in `dir`. A `maxSize` of zero means
+// the queue size is unbounded. When the queue is full, `dropOldest`
+// determines whether the oldest segment is discarded to make room or the
+// writer blocks until the reader catches up.
+func newDiskQueue(dir string, maxSize, maxSegment int64, dropOldest bool) (
+	q *diskQueue, err error) {
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	q = &diskQueue{
+		dir:        dir,
+		maxSize:    maxSize,
+		maxSegment: maxSegment,
+		dropOldest: dropOldest,
+		header:     &Header{},
+	}
+	q.cond = sync.NewCond(&q.lock)
+
+	cpPath := path.Join(dir, diskQueueCheckpoint)
+	if q.checkpoint, err = os.OpenFile(cpPath, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	var cpSeq uint64
+	var cpOffset int64
+	buf := make([]byte, 64)
+	if n, _ := q.checkpoint.ReadAt(buf, 0); n > 0 {
+		if _, err = fmt.Sscanf(string(buf[:n]), "%d %d", &cpSeq, &cpOffset); err != nil {
+			q.checkpoint.Close()
+			return nil, fmt.Errorf("corrupt queue checkpoint '%s': %s", cpPath, err)
+		}
+	}
+
+	var seqs []uint64
+	if seqs, err = q.segments(); err != nil {
+		q.checkpoint.Close()
+		return nil, err
+	}
+	live := seqs[:0]
+	for _, seq := range seqs {
+		if seq < cpSeq {
+			// Already delivered, left over from an unclean shutdown.
+			os.Remove(q.segmentPath(seq))
+		} else {
+			live = append(live, seq)
+		}
+	}
+	if len(live) == 0 {
+		if q.readSeq = cpSeq; q.readSeq == 0 {
+			q.readSeq = 1
+		}
+		q.writeSeq = q.readSeq
+	} else {
+		q.readSeq = live[0]
+		if q.readSeq == cpSeq {
+			q.ackOffset = cpOffset
+		}
+		for _, seq := range live {
+			if info, e := os.Stat(q.segmentPath(seq)); e == nil {
+				q.size += info.Size()
+			}
+		}
+		q.size -= q.ackOffset
+		// Never append to an existing segment, it might end in a partial
+		// record written just before a crash.
+		q.writeSeq = live[len(live)-1] + 1
+	}
+	q.readOffset = q.ackOffset
+	if err = q.openWriteSegment(); err != nil {
+		q.checkpoint.Close()
+		return nil, err
+	}
+	if err = q.writeCheckpoint(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return
+}
+
+// Returns the sorted sequence numbers of the segment files on disk.
+func (q *diskQueue) segments() (seqs []uint64, err error) {
+	var matches []string
+	if matches, err = filepath.Glob(path.Join(q.dir, "*"+diskQueueSuffix)); err != nil {
+		return
+	}
+	var seq uint64
+	for _, match := range matches {
+		name := strings.TrimSuffix(path.Base(match), diskQueueSuffix)
+		if seq, err = strconv.ParseUint(name, 10, 64); err != nil {
+			err = nil
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Sort(uint64Slice(seqs))
+	return
+}
+
+func (q *diskQueue) segmentPath(seq uint64) string {
+	return path.Join(q.dir, fmt.Sprintf("%d%s", seq, diskQueueSuffix))
+}
+
+func (q *diskQueue) openWriteSegment() (err error) {
+	q.writeFile, err = os.OpenFile(q.segmentPath(q.writeSeq),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	q.writeOffset = 0
+	return
+}
+
+func (q *diskQueue) rotate() (err error) {
+	q.writeFile.Close()
+	q.writeSeq++
+	return q.openWriteSegment()
+}
+
+// Fixed width so each update overwrites the previous one completely.
+func (q *diskQueue) writeCheckpoint() (err error) {
+	_, err = q.checkpoint.WriteAt([]byte(fmt.Sprintf("%020d %020d\n",
+		q.readSeq, q.ackOffset)), 0)
+	return
+}
+
+// Appends a record to the queue, dropping old data or blocking as configured
+// if the queue is full. A record that's bigger than the whole queue is only
+// appended once the queue is empty.
+func (q *diskQueue) Push(record []byte) (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return fmt.Errorf("queue '%s' is closed", q.dir)
+	}
+
+	recLen := int64(len(record))
+	for q.maxSize > 0 && q.size > 0 && q.size+recLen > q.maxSize && !q.closed {
+		if q.dropOldest {
+			if !q.dropSegment() {
+				break
+			}
+		} else {
+			// Rather than lose data, overfill the queue on shutdown.
+			if Globals().Stopping {
+				break
+			}
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return fmt.Errorf("queue '%s' is closed", q.dir)
+	}
+
+	if q.writeOffset > 0 && q.writeOffset+recLen > q.maxSegment {
+		if err = q.rotate(); err != nil {
+			return
+		}
+	}
+	var n int
+	n, err = q.writeFile.Write(record)
+	q.writeOffset += int64(n)
+	q.size += int64(n)
+	q.cond.Broadcast()
+	return
+}
+
+// Discards the oldest segment, returns false if there's nothing to discard.
+func (q *diskQueue) dropSegment() bool {
+	if q.readSeq == q.writeSeq {
+		if q.writeOffset == 0 {
+			return false
+		}
+		if err := q.rotate(); err != nil {
+			return false
+		}
+	}
+	var segSize int64
+	if info, err := os.Stat(q.segmentPath(q.readSeq)); err == nil {
+		segSize = info.Size()
+	}
+	q.droppedBytes += segSize - q.ackOffset
+	q.nextReadSegment(segSize)
+	return true
+}
+
+// Moves the reader past the current read segment, which is `segSize` bytes
+// long, and removes the segment file.
+func (q *diskQueue) nextReadSegment(segSize int64) {
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	os.Remove(q.segmentPath(q.readSeq))
+	q.size -= segSize - q.ackOffset
+	q.readSeq++
+	q.readOffset, q.ackOffset = 0, 0
+	q.pending = nil
+	q.writeCheckpoint()
+}
+
+// Reads the record at the current read position, returns nil if there isn't
+// a complete and valid record there.
+func (q *diskQueue) readRecord() (record []byte, corrupt bool) {
+	if q.readFile == nil {
+		var err error
+		if q.readFile, err = os.Open(q.segmentPath(q.readSeq)); err != nil {
+			return nil, os.IsNotExist(err)
+		}
+	}
+	head := make([]byte, 2)
+	if n, _ := q.readFile.ReadAt(head, q.readOffset); n < len(head) {
+		return
+	}
+	if head[0] != RECORD_SEPARATOR {
+		return nil, true
+	}
+	headerBytes := make([]byte, int(head[1])+1)
+	if n, _ := q.readFile.ReadAt(headerBytes, q.readOffset+2); n < len(headerBytes) {
+		return
+	}
+	if !decodeHeader(headerBytes, q.header) {
+		return nil, true
+	}
+	record = make([]byte, 2+len(headerBytes)+int(q.header.GetMessageLength()))
+	if n, _ := q.readFile.ReadAt(record, q.readOffset); n < len(record) {
+		return nil, false
+	}
+	q.readOffset += int64(len(record))
+	return
+}
+
+// Returns the oldest unacknowledged record, blocking until one is available.
+// The same record is returned until it is acknowledged w/ `Ack`. Returns
+// false once the queue has been closed.
+func (q *diskQueue) Next() (record []byte, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var corrupt bool
+	for !q.closed {
+		if q.pending != nil {
+			return q.pending, true
+		}
+		if record, corrupt = q.readRecord(); record != nil {
+			q.pending = record
+			return record, true
+		}
+		if q.readSeq < q.writeSeq {
+			// End of a finished segment, or a record truncated by a crash.
+			var segSize int64
+			if info, err := os.Stat(q.segmentPath(q.readSeq)); err == nil {
+				segSize = info.Size()
+			}
+			q.nextReadSegment(segSize)
+			continue
+		}
+		if corrupt {
+			// Can't skip data in the active segment, start a new one.
+			if err := q.rotate(); err == nil {
+				continue
+			}
+		}
+		q.cond.Wait()
+	}
+	return nil, false
+}
+
+// Acknowledges successful delivery of the record most recently returned by
+// `Next`, advancing the checkpoint past it.
+func (q *diskQueue) Ack() (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.pending == nil {
+		// Dropped while in flight.
+		return
+	}
+	recLen := int64(len(q.pending))
+	q.ackOffset += recLen
+	q.size -= recLen
+	q.pending = nil
+	err = q.writeCheckpoint()
+	q.cond.Broadcast()
+	return
+}
+
+// Wakes any writers blocked on a full queue so they notice Heka is shutting
+// down, for when the reader gives up w/o acknowledging anything.
+func (q *diskQueue) Wake() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+// Returns the number of unacknowledged bytes, and the number of bytes that
+// have been discarded to keep the queue under its size limit.
+func (q *diskQueue) Stats() (size, droppedBytes int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size, q.droppedBytes
+}
+
+// Closes the queue's files, waking any blocked readers and writers. Queued
+// records remain on disk to be replayed when the queue is next opened.
+func (q *diskQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	if q.readFile != nil {
+		q.readFile.Close()
+	}
+	q.writeFile.Close()
+	q.checkpoint.Close()
+	q.cond.Broadcast()
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
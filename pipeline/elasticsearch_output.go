@@ -0,0 +1,408 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type ElasticSearchOutputConfig struct {
+	// Base URL of the Elasticsearch server.
+	Server string
+	// Name of the index each message is added to. `@Name` is replaced w/ the
+	// value of the message header or field called Name and the rest is
+	// formatted as a Go time layout w/ the message's timestamp.
+	Index string
+	// Document type of the indexed messages.
+	TypeName string `toml:"type_name"`
+	// Credentials for HTTP basic authentication, sent if Username is set.
+	Username string
+	Password string
+	// Send a bulk request once it holds this many messages.
+	BatchCount int `toml:"batch_count"`
+	// Send a bulk request before it grows past this many bytes.
+	BatchSize int `toml:"batch_size"`
+	// Maximum milliseconds a partial batch waits before it's sent.
+	FlushInterval uint `toml:"flush_interval"`
+	// Milliseconds to wait for a response before the request is retried.
+	Timeout uint
+	// Milliseconds to wait before the first retry of a failed request. The
+	// delay doubles w/ each failed attempt.
+	RetryDelay uint `toml:"retry_delay"`
+	// Upper bound in milliseconds on the delay between retries.
+	MaxRetryDelay uint `toml:"max_retry_delay"`
+}
+
+// Indexes messages as Elasticsearch documents using the bulk API.
+type ElasticSearchOutput struct {
+	config        *ElasticSearchOutputConfig
+	bulkUrl       string
+	flushInterval time.Duration
+	client        *http.Client
+	backoff       *client.Backoff
+	records       [][]byte // The bulk action and document for each message.
+	size          int
+	indexedDocs   int64
+	failedDocs    int64
+	retries       int64
+}
+
+// Result of one action of a bulk request.
+type bulkItem struct {
+	Status int
+	Error  interface{}
+}
+
+type bulkResponse struct {
+	Errors bool
+	Items  []map[string]bulkItem
+}
+
+func (o *ElasticSearchOutput) ConfigStruct() interface{} {
+	return &ElasticSearchOutputConfig{
+		Server:        "http://localhost:9200",
+		Index:         "heka-2006.01.02",
+		TypeName:      "message",
+		BatchCount:    500,
+		BatchSize:     message.MAX_BATCH_SIZE,
+		FlushInterval: 1000,
+		Timeout:       30000,
+		RetryDelay:    250,
+		MaxRetryDelay: 30000,
+	}
+}
+
+func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
+	conf := config.(*ElasticSearchOutputConfig)
+	if _, err = url.Parse(conf.Server); err != nil || conf.Server == "" {
+		return fmt.Errorf("ElasticSearchOutput invalid server: '%s'", conf.Server)
+	}
+	if conf.Index == "" {
+		return fmt.Errorf("ElasticSearchOutput index must be set")
+	}
+	if conf.BatchCount < 1 || conf.BatchSize < 1 {
+		return fmt.Errorf("ElasticSearchOutput batch_count and batch_size " +
+			"must be greater than 0")
+	}
+	if conf.FlushInterval == 0 {
+		return fmt.Errorf("ElasticSearchOutput flush_interval must be " +
+			"greater than 0")
+	}
+	if conf.RetryDelay == 0 {
+		return fmt.Errorf("ElasticSearchOutput retry_delay must be greater " +
+			"than 0")
+	}
+	if conf.MaxRetryDelay < conf.RetryDelay {
+		return fmt.Errorf("ElasticSearchOutput max_retry_delay must be at "+
+			"least %d", conf.RetryDelay)
+	}
+	o.config = conf
+	o.bulkUrl = strings.TrimRight(conf.Server, "/") + "/_bulk"
+	o.flushInterval = time.Duration(conf.FlushInterval) * time.Millisecond
+	o.client = &http.Client{
+		Timeout: time.Duration(conf.Timeout) * time.Millisecond,
+	}
+	o.backoff = client.NewBackoff(
+		time.Duration(conf.RetryDelay)*time.Millisecond,
+		time.Duration(conf.MaxRetryDelay)*time.Millisecond)
+	return
+}
+
+func (o *ElasticSearchOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		e      error
+		plc    *PipelineCapture
+		record []byte
+		ok     = true
+	)
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+	inChan := or.InChan()
+
+	for ok {
+		select {
+		case plc, ok = <-inChan:
+			if !ok {
+				break
+			}
+			record, e = o.bulkRecord(plc.Pack.Message)
+			plc.Pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				continue
+			}
+			if len(o.records) > 0 && o.size+len(record) > o.config.BatchSize {
+				o.flush(or)
+			}
+			o.records = append(o.records, record)
+			o.size += len(record)
+			if len(o.records) >= o.config.BatchCount {
+				o.flush(or)
+			}
+		case <-ticker.C:
+			o.flush(or)
+		}
+	}
+	o.flush(or)
+	return
+}
+
+// Returns the bulk API action line and document for a message.
+func (o *ElasticSearchOutput) bulkRecord(msg *message.Message) (record []byte,
+	err error) {
+
+	action := map[string]map[string]string{
+		"index": {
+			"_index": o.indexName(msg),
+			"_type":  o.config.TypeName,
+		},
+	}
+	// Using the message's UUID as the document id keeps a retried request
+	// from indexing the message twice.
+	if uuid := msg.GetUuidString(); uuid != "" {
+		action["index"]["_id"] = uuid
+	}
+	if record, err = json.Marshal(action); err != nil {
+		return
+	}
+	doc, err := json.Marshal(elasticSearchDocument(msg))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding to JSON: %s", err)
+	}
+	record = append(record, NEWLINE)
+	record = append(record, doc...)
+	record = append(record, NEWLINE)
+	return
+}
+
+// Returns the name of the index a message is added to. Elasticsearch index
+// names must be lower case.
+func (o *ElasticSearchOutput) indexName(msg *message.Message) string {
+	timestamp := time.Unix(0, msg.GetTimestamp()).UTC()
+	parts := messageMatchSet(msg)
+	var name []byte
+	last := 0
+	// Only the text around the @Name references is a time layout, so values
+	// interpolated into the name aren't mistaken for parts of it.
+	for _, loc := range varMatcher.FindAllStringIndex(o.config.Index, -1) {
+		name = append(name, timestamp.Format(o.config.Index[last:loc[0]])...)
+		name = append(name,
+			InterpolateString(o.config.Index[loc[0]:loc[1]], parts)...)
+		last = loc[1]
+	}
+	name = append(name, timestamp.Format(o.config.Index[last:])...)
+	return strings.ToLower(string(name))
+}
+
+// Returns a message as an Elasticsearch document. The message headers become
+// top level keys, as do its fields, whose values keep their types and are
+// converted to dates if they're formatted as such. A field w/ more than one
+// value becomes an array. Fields don't replace headers of the same name.
+func elasticSearchDocument(msg *message.Message) map[string]interface{} {
+	doc := map[string]interface{}{
+		"Uuid":       msg.GetUuidString(),
+		"Timestamp":  time.Unix(0, msg.GetTimestamp()).UTC().Format(time.RFC3339Nano),
+		"Type":       msg.GetType(),
+		"Logger":     msg.GetLogger(),
+		"Severity":   msg.GetSeverity(),
+		"Payload":    msg.GetPayload(),
+		"EnvVersion": msg.GetEnvVersion(),
+		"Pid":        msg.GetPid(),
+		"Hostname":   msg.GetHostname(),
+	}
+	for _, field := range msg.Fields {
+		name := field.GetName()
+		if _, ok := doc[name]; ok {
+			continue
+		}
+		values := fieldValues(field)
+		if len(values) == 1 {
+			doc[name] = values[0]
+		} else {
+			doc[name] = values
+		}
+	}
+	return doc
+}
+
+// Returns all of a field's values, w/ date formatted values as RFC 3339 UTC
+// timestamps.
+func fieldValues(field *message.Field) (values []interface{}) {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.ValueString {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.ValueBytes {
+			values = append(values, v)
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.ValueInteger {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.ValueDouble {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.ValueBool {
+			values = append(values, v)
+		}
+	}
+	for i, v := range values {
+		if t, ok := fieldTime(field.GetValueFormat(), v); ok {
+			values[i] = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return
+}
+
+// Converts a value to a time according to its field's format, if it's a
+// date.
+func fieldTime(format message.Field_ValueFormat, value interface{}) (
+	t time.Time, ok bool) {
+
+	var err error
+	switch v := value.(type) {
+	case string:
+		if format == message.Field_DATE_RFC3339 {
+			t, err = time.Parse(time.RFC3339Nano, v)
+			return t, err == nil
+		}
+	case int64:
+		switch format {
+		case message.Field_UTC_SECONDS:
+			return time.Unix(v, 0), true
+		case message.Field_UTC_NANOSECONDS:
+			return time.Unix(0, v), true
+		}
+	case float64:
+		switch format {
+		case message.Field_UTC_SECONDS:
+			return time.Unix(0, int64(v*1e9)), true
+		case message.Field_UTC_NANOSECONDS:
+			return time.Unix(0, int64(v)), true
+		}
+	}
+	return
+}
+
+// Sends the batched messages, retrying w/ exponential backoff until each has
+// either been indexed or been rejected by Elasticsearch. Only gives up on
+// the rest when Heka is shutting down.
+func (o *ElasticSearchOutput) flush(or OutputRunner) {
+	records := o.records
+	for len(records) > 0 {
+		retry, e := o.bulk(or, records)
+		if e == nil && len(retry) == 0 {
+			o.backoff.Reset()
+			break
+		}
+		if e != nil {
+			or.LogError(fmt.Errorf("posting to %s: %s", o.bulkUrl, e))
+		} else {
+			records = retry
+			or.LogError(fmt.Errorf("retrying %d messages", len(records)))
+		}
+		if Globals().Stopping {
+			atomic.AddInt64(&o.failedDocs, int64(len(records)))
+			or.LogError(fmt.Errorf("dropped %d messages for %s", len(records),
+				o.bulkUrl))
+			break
+		}
+		atomic.AddInt64(&o.retries, 1)
+		time.Sleep(o.backoff.Next())
+	}
+	o.records = o.records[:0]
+	o.size = 0
+}
+
+// Makes a bulk request, returning the records that failed but may succeed
+// if they're retried.
+func (o *ElasticSearchOutput) bulk(or OutputRunner, records [][]byte) (
+	retry [][]byte, err error) {
+
+	req, err := http.NewRequest("POST", o.bulkUrl,
+		bytes.NewReader(bytes.Join(records, nil)))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if o.config.Username != "" {
+		req.SetBasicAuth(o.config.Username, o.config.Password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if httpRetriable(resp.StatusCode) {
+			return nil, fmt.Errorf("server responded w/ %s", resp.Status)
+		}
+		// The request itself is bad, sending it again won't help.
+		atomic.AddInt64(&o.failedDocs, int64(len(records)))
+		or.LogError(fmt.Errorf("dropped %d messages, server responded w/ %s",
+			len(records), resp.Status))
+		return
+	}
+	result := new(bulkResponse)
+	if err = json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("can't parse response: %s", err)
+	}
+	if len(result.Items) != len(records) {
+		return nil, fmt.Errorf("response has %d items for %d messages",
+			len(result.Items), len(records))
+	}
+	var indexed int64
+	for i, actions := range result.Items {
+		for _, item := range actions {
+			switch {
+			case item.Status >= 200 && item.Status <= 299:
+				indexed++
+			case item.Status == 429 || item.Status >= 500:
+				retry = append(retry, records[i])
+			default:
+				atomic.AddInt64(&o.failedDocs, 1)
+				or.LogError(fmt.Errorf("message rejected w/ status %d: %v",
+					item.Status, item.Error))
+			}
+		}
+	}
+	atomic.AddInt64(&o.indexedDocs, indexed)
+	return
+}
+
+func (o *ElasticSearchOutput) ReportMsg(msg *message.Message) (err error) {
+	newIntField(msg, "IndexedDocs", int(atomic.LoadInt64(&o.indexedDocs)))
+	newIntField(msg, "FailedDocs", int(atomic.LoadInt64(&o.failedDocs)))
+	newIntField(msg, "Retries", int(atomic.LoadInt64(&o.retries)))
+	return
+}
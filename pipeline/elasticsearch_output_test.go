@@ -0,0 +1,210 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/gomock/gomock"
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// A document sent to the Elasticsearch stand-in, w/ its bulk action.
+type bulkDoc struct {
+	action map[string]map[string]string
+	doc    map[string]interface{}
+}
+
+func ElasticSearchOutputSpec(c gs.Context) {
+	t := new(ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oth := NewOutputTestHelper(ctrl)
+	inChan := make(chan *PipelineCapture, 2)
+	oth.MockOutputRunner.EXPECT().InChan().Return(inChan).AnyTimes()
+
+	// The stand-in answers each bulk request's items w/ the next of
+	// `statuses`, then w/ 201s, unless `bulkStatus` fails the whole request.
+	var statuses []int
+	var bulkStatus int
+	requests := make(chan []bulkDoc, 4)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/_bulk" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var docs []bulkDoc
+			scanner := bufio.NewScanner(req.Body)
+			for scanner.Scan() {
+				var doc bulkDoc
+				json.Unmarshal(scanner.Bytes(), &doc.action)
+				scanner.Scan()
+				json.Unmarshal(scanner.Bytes(), &doc.doc)
+				docs = append(docs, doc)
+			}
+			requests <- docs
+			if bulkStatus != 0 {
+				w.WriteHeader(bulkStatus)
+				return
+			}
+			items := make([]map[string]bulkItem, len(docs))
+			for i := range docs {
+				status := http.StatusCreated
+				if len(statuses) > 0 {
+					status, statuses = statuses[0], statuses[1:]
+				}
+				items[i] = map[string]bulkItem{"index": {Status: status}}
+			}
+			writeJson(w, http.StatusOK, map[string]interface{}{
+				"errors": true, "items": items})
+		}))
+	defer server.Close()
+
+	output := new(ElasticSearchOutput)
+	config := output.ConfigStruct().(*ElasticSearchOutputConfig)
+	config.Server = server.URL
+	config.RetryDelay = 1
+
+	msg := getTestMessage()
+	msg.SetTimestamp(time.Date(2013, 6, 1, 23, 30, 0, 0, time.UTC).UnixNano())
+
+	c.Specify("An ElasticSearchOutput", func() {
+		c.Specify("names indexes", func() {
+			config.Index = "Logs-@Type-2006.01.02"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.indexName(msg), gs.Equals, "logs-test-2013.06.01")
+
+			c.Specify("w/o formatting interpolated values", func() {
+				msg.SetType("Mon-2")
+				c.Expect(output.indexName(msg), gs.Equals, "logs-mon-2-2013.06.01")
+			})
+		})
+
+		c.Specify("converts messages to documents", func() {
+			f, _ := message.NewField("count", 3, message.Field_RAW)
+			f.AddValue(4)
+			msg.AddField(f)
+			f, _ = message.NewField("when", "2013-06-01T12:00:00.5+02:00",
+				message.Field_DATE_RFC3339)
+			msg.AddField(f)
+			f, _ = message.NewField("started", 1370044800, message.Field_UTC_SECONDS)
+			msg.AddField(f)
+			f, _ = message.NewField("Type", "ignored", message.Field_RAW)
+			msg.AddField(f)
+			doc := elasticSearchDocument(msg)
+			c.Expect(doc["Type"], gs.Equals, "TEST")
+			c.Expect(doc["Timestamp"], gs.Equals, "2013-06-01T23:30:00Z")
+			c.Expect(doc["Severity"], gs.Equals, int32(6))
+			c.Expect(doc["Uuid"], gs.Equals, msg.GetUuidString())
+			c.Expect(doc["foo"], gs.Equals, "bar")
+			counts := doc["count"].([]interface{})
+			c.Expect(len(counts), gs.Equals, 2)
+			c.Expect(counts[1], gs.Equals, int64(4))
+			c.Expect(doc["when"], gs.Equals, "2013-06-01T10:00:00.5Z")
+			c.Expect(doc["started"], gs.Equals, "2013-06-01T00:00:00Z")
+		})
+
+		c.Specify("indexes messages in bulk", func() {
+			second := getTestMessage()
+			second.SetLogger("second")
+			config.BatchCount = 2
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			// Runs the output over the messages until they've all been sent.
+			run := func() {
+				done := make(chan bool)
+				go func() {
+					output.Run(oth.MockOutputRunner, oth.MockHelper)
+					close(done)
+				}()
+				for _, m := range []*message.Message{msg, second} {
+					pack := NewPipelinePack(make(chan *PipelinePack, 1))
+					pack.Message = m
+					inChan <- &PipelineCapture{Pack: pack}
+				}
+				close(inChan)
+				<-done
+			}
+
+			c.Specify("to the configured index", func() {
+				run()
+				docs := <-requests
+				c.Expect(len(docs), gs.Equals, 2)
+				index := docs[0].action["index"]
+				c.Expect(index["_index"], gs.Equals, "heka-2013.06.01")
+				c.Expect(index["_type"], gs.Equals, "message")
+				c.Expect(index["_id"], gs.Equals, msg.GetUuidString())
+				c.Expect(docs[1].doc["Logger"], gs.Equals, "second")
+				c.Expect(len(requests), gs.Equals, 0)
+			})
+
+			c.Specify("retrying only the messages that can be retried", func() {
+				statuses = []int{http.StatusCreated, 429}
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				run()
+				c.Expect(len(<-requests), gs.Equals, 2)
+				docs := <-requests
+				c.Expect(len(docs), gs.Equals, 1)
+				c.Expect(docs[0].doc["Logger"], gs.Equals, "second")
+
+				report := getTestMessage()
+				output.ReportMsg(report)
+				indexed, _ := report.GetFieldValue("IndexedDocs")
+				c.Expect(indexed, gs.Equals, int64(2))
+				retries, _ := report.GetFieldValue("Retries")
+				c.Expect(retries, gs.Equals, int64(1))
+			})
+
+			c.Specify("dropping messages that are rejected", func() {
+				statuses = []int{http.StatusBadRequest}
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				run()
+				c.Expect(len(<-requests), gs.Equals, 2)
+				c.Expect(len(requests), gs.Equals, 0)
+
+				report := getTestMessage()
+				output.ReportMsg(report)
+				failed, _ := report.GetFieldValue("FailedDocs")
+				c.Expect(failed, gs.Equals, int64(1))
+				indexed, _ := report.GetFieldValue("IndexedDocs")
+				c.Expect(indexed, gs.Equals, int64(1))
+			})
+
+			c.Specify("dropping a request that's rejected", func() {
+				bulkStatus = http.StatusBadRequest
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				run()
+				c.Expect(len(<-requests), gs.Equals, 2)
+				c.Expect(len(requests), gs.Equals, 0)
+
+				report := getTestMessage()
+				output.ReportMsg(report)
+				failed, _ := report.GetFieldValue("FailedDocs")
+				c.Expect(failed, gs.Equals, int64(2))
+				retries, _ := report.GetFieldValue("Retries")
+				c.Expect(retries, gs.Equals, int64(0))
+			})
+		})
+	})
+}
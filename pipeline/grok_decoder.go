@@ -0,0 +1,400 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The named patterns available to every GrokDecoder, which may refer to each
+// other as %{NAME}.
+var GrokPatterns = map[string]string{
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"INT":          `[+-]?[0-9]+`,
+	"POSINT":       `[1-9][0-9]*`,
+	"NONNEGINT":    `[0-9]+`,
+	"BASE10NUM":    `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":       `%{BASE10NUM}`,
+	"BASE16NUM":    `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	"IPV4":     `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":     `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|%{IPV4})?`,
+	"IP":       `%{IPV6}|%{IPV4}`,
+	"HOSTNAME": `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"HOST":     `%{HOSTNAME}`,
+	"IPORHOST": `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"UNIXPATH":     `(?:/[\w_%!$@:.,~-]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":         `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":     `[A-Za-z]+(?:\+[A-Za-z+]+)?`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%_\-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+	"HTTPVERB":     `GET|HEAD|POST|PUT|DELETE|CONNECT|OPTIONS|TRACE|PATCH`,
+
+	"MONTH":            `\b(?:Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|Jun(?:e)?|Jul(?:y)?|Aug(?:ust)?|Sep(?:tember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\b`,
+	"MONTHNUM":         `0?[1-9]|1[0-2]`,
+	"MONTHDAY":         `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":              `Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?`,
+	"YEAR":             `[0-9]{2,4}`,
+	"HOUR":             `2[0123]|[01]?[0-9]`,
+	"MINUTE":           `[0-5][0-9]`,
+	"SECOND":           `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":             `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":          `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":          `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE": `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}` +
+		`(?::?%{SECOND})?(?:%{ISO8601_TIMEZONE})?`,
+	"HTTPDATE":        `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP": `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"LOGLEVEL": `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|` +
+		`[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|` +
+		`[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|` +
+		`[Ee]merg(?:ency)?|EMERG(?:ENCY)?`,
+
+	"COMMONAPACHELOG": `%{IPORHOST:clientip} %{USER:ident} %{USER:auth} ` +
+		`\[%{HTTPDATE:timestamp:date}\] "(?:%{HTTPVERB:verb} %{NOTSPACE:request}` +
+		`(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" ` +
+		`%{NONNEGINT:response:int} (?:%{NONNEGINT:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QUOTEDSTRING:referrer} ` +
+		`%{QUOTEDSTRING:agent}`,
+}
+
+// How deeply patterns may refer to other patterns, which catches patterns
+// that refer to themselves.
+const maxGrokDepth = 32
+
+// Matches a %{NAME}, %{NAME:field} or %{NAME:field:type} pattern reference.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(\w+))?\}`)
+
+// Layout of the HTTPDATE pattern, tried for dates before the more general
+// layouts.
+const httpDateLayout = "02/Jan/2006:15:04:05 -0700"
+
+type GrokDecoderConfig struct {
+	// Pattern the payload must match, made up of regular expression syntax
+	// and references to named patterns.
+	Match string
+	// Named patterns to add to, or override, those in GrokPatterns.
+	Patterns map[string]string
+	// Files of named patterns, one per line as "NAME pattern". Blank lines
+	// and those starting w/ '#' are skipped.
+	PatternsFiles []string `toml:"patterns_files"`
+	// Layout of captured dates, in Go's time package format. Dates are parsed
+	// w/ a set of common layouts if this doesn't fit.
+	TimestampLayout string `toml:"timestamp_layout"`
+	// Layouts of the dates captured by particular fields, overriding
+	// `TimestampLayout`.
+	DateLayouts map[string]string `toml:"date_layouts"`
+	// Severity numbers of captured severity names.
+	SeverityMap map[string]int32 `toml:"severity_map"`
+	// Name of a field set to true on messages whose payload doesn't match,
+	// which are passed on as they are. They're untagged if empty.
+	UnmatchedTag string `toml:"unmatched_tag"`
+	// Name of a field holding an error for each capture whose value couldn't
+	// be converted, e.g. a bad date. Such captures are skipped, and the
+	// message is passed on. No field is added if empty.
+	ConversionErrorTag string `toml:"conversion_error_tag"`
+}
+
+// A named pattern capture, and the type its value is converted to.
+type grokCapture struct {
+	field    string
+	typeHint string
+}
+
+// Decoder that parses a message's payload w/ a regular expression built from
+// named patterns, setting message fields from the parts it captures.
+type GrokDecoder struct {
+	patterns        map[string]string
+	regex           *regexp.Regexp
+	captures        map[string]grokCapture // By the regex group name.
+	timestampLayout string
+	dateLayouts     map[string]string
+	severityMap     map[string]int32
+	unmatchedTag    string
+	convErrorTag    string
+}
+
+func (g *GrokDecoder) ConfigStruct() interface{} {
+	return &GrokDecoderConfig{
+		UnmatchedTag:       "grok_unmatched",
+		ConversionErrorTag: "grok_conversion_error",
+	}
+}
+
+func (g *GrokDecoder) Init(config interface{}) (err error) {
+	conf := config.(*GrokDecoderConfig)
+	if conf.Match == "" {
+		return fmt.Errorf("GrokDecoder requires a match pattern")
+	}
+	g.patterns = make(map[string]string)
+	for name, pattern := range GrokPatterns {
+		g.patterns[name] = pattern
+	}
+	for _, fileName := range conf.PatternsFiles {
+		if err = g.loadPatterns(fileName); err != nil {
+			return fmt.Errorf("GrokDecoder can't load patterns from %s: %s",
+				fileName, err)
+		}
+	}
+	for name, pattern := range conf.Patterns {
+		g.patterns[name] = pattern
+	}
+
+	g.captures = make(map[string]grokCapture)
+	expanded, err := g.expand(conf.Match, 0)
+	if err != nil {
+		return fmt.Errorf("GrokDecoder bad match pattern: %s", err)
+	}
+	if g.regex, err = regexp.Compile(expanded); err != nil {
+		return fmt.Errorf("GrokDecoder bad match pattern: %s", err)
+	}
+	g.timestampLayout = conf.TimestampLayout
+	g.dateLayouts = conf.DateLayouts
+	g.severityMap = conf.SeverityMap
+	g.unmatchedTag = conf.UnmatchedTag
+	g.convErrorTag = conf.ConversionErrorTag
+	return
+}
+
+// Adds the named patterns in a patterns file.
+func (g *GrokDecoder) loadPatterns(fileName string) (err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("line %d has no pattern", lineNum)
+		}
+		g.patterns[parts[0]] = strings.TrimSpace(parts[1])
+	}
+	return scanner.Err()
+}
+
+// Replaces the pattern references in `pattern` w/ the patterns they refer
+// to, as capturing groups for those that name a field.
+func (g *GrokDecoder) expand(pattern string, depth int) (expanded string,
+	err error) {
+
+	if depth > maxGrokDepth {
+		return "", fmt.Errorf("patterns nested more than %d deep", maxGrokDepth)
+	}
+	expanded = grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		parts := grokReference.FindStringSubmatch(ref)
+		name, field, typeHint := parts[1], parts[2], parts[3]
+		sub, ok := g.patterns[name]
+		if !ok {
+			err = fmt.Errorf("unknown pattern %%{%s}", name)
+			return ""
+		}
+		if sub, err = g.expand(sub, depth+1); err != nil {
+			return ""
+		}
+		if field == "" {
+			return "(?:" + sub + ")"
+		}
+		switch typeHint {
+		case "", "int", "float", "date":
+		default:
+			err = fmt.Errorf("unknown type '%s' for field %s", typeHint, field)
+			return ""
+		}
+		group := fmt.Sprintf("grok%d", len(g.captures))
+		g.captures[group] = grokCapture{field, typeHint}
+		return fmt.Sprintf("(?P<%s>%s)", group, sub)
+	})
+	return
+}
+
+func (g *GrokDecoder) Decode(pack *PipelinePack) (err error) {
+	payload := pack.Message.GetPayload()
+	matches := g.regex.FindStringSubmatch(payload)
+	if matches == nil {
+		// Passed on rather than dropped, so a pattern that misses a case
+		// doesn't lose messages.
+		if g.unmatchedTag != "" {
+			field, err := message.NewField(g.unmatchedTag, true,
+				message.Field_RAW)
+			if err != nil {
+				return err
+			}
+			pack.Message.AddField(field)
+		}
+		return nil
+	}
+	for i, group := range g.regex.SubexpNames() {
+		// Skip the unnamed groups, and those that didn't take part in the
+		// match.
+		if group == "" || matches[i] == "" {
+			continue
+		}
+		capture, ok := g.captures[group]
+		if !ok {
+			// A named group written directly in the match pattern.
+			capture = grokCapture{field: group}
+		}
+		if e := g.setField(pack.Message, capture, matches[i]); e != nil {
+			// The rest of the message is still worth passing on.
+			if err = g.tagConversionError(pack.Message, capture, e); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Records a capture that couldn't be converted in the conversion error
+// field, w/ a value for each such capture.
+func (g *GrokDecoder) tagConversionError(msg *message.Message,
+	capture grokCapture, convErr error) (err error) {
+
+	if g.convErrorTag == "" {
+		return
+	}
+	value := fmt.Sprintf("can't set %s: %s", capture.field, convErr)
+	if field := msg.FindFirstField(g.convErrorTag); field != nil {
+		return field.AddValue(value)
+	}
+	field, err := message.NewField(g.convErrorTag, value, message.Field_RAW)
+	if err == nil {
+		msg.AddField(field)
+	}
+	return
+}
+
+// Parses a date captured for `field`.
+func (g *GrokDecoder) parseDate(field, value string) (t time.Time, err error) {
+	layout, ok := g.dateLayouts[field]
+	if !ok {
+		layout = g.timestampLayout
+	}
+	if layout == "" {
+		layout = httpDateLayout
+	}
+	if t, err = message.ForgivingTimeParse(layout, value); err != nil {
+		return
+	}
+	// Did we get a year?
+	if t.Year() == 0 {
+		t = t.AddDate(time.Now().Year(), 0, 0)
+	}
+	return
+}
+
+// Sets the message field a capture is for, converting the value per its type
+// hint. Captures named for a message header, such as Timestamp or Severity,
+// set the header, otherwise a field is added.
+func (g *GrokDecoder) setField(msg *message.Message, capture grokCapture,
+	value string) (err error) {
+
+	switch capture.field {
+	case "Timestamp":
+		var t time.Time
+		if t, err = g.parseDate(capture.field, value); err == nil {
+			msg.SetTimestamp(t.UnixNano())
+		}
+		return
+	case "Severity":
+		severity, ok := g.severityMap[value]
+		if !ok {
+			var parsed int64
+			if parsed, err = strconv.ParseInt(value, 10, 32); err != nil {
+				return
+			}
+			severity = int32(parsed)
+		}
+		msg.SetSeverity(severity)
+		return
+	case "Pid":
+		var pid int64
+		if pid, err = strconv.ParseInt(value, 10, 32); err == nil {
+			msg.SetPid(int32(pid))
+		}
+		return
+	case "Hostname":
+		msg.SetHostname(value)
+		return
+	case "Logger":
+		msg.SetLogger(value)
+		return
+	case "Type":
+		msg.SetType(value)
+		return
+	case "Payload":
+		msg.SetPayload(value)
+		return
+	}
+
+	var field *message.Field
+	switch capture.typeHint {
+	case "int":
+		var i int64
+		if i, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return
+		}
+		field, err = message.NewField(capture.field, i, message.Field_RAW)
+	case "float":
+		var f float64
+		if f, err = strconv.ParseFloat(value, 64); err != nil {
+			return
+		}
+		field, err = message.NewField(capture.field, f, message.Field_RAW)
+	case "date":
+		var t time.Time
+		if t, err = g.parseDate(capture.field, value); err != nil {
+			return
+		}
+		field, err = message.NewField(capture.field,
+			t.Format(time.RFC3339Nano), message.Field_DATE_RFC3339)
+	default:
+		field, err = message.NewField(capture.field, value, message.Field_RAW)
+	}
+	if err == nil {
+		msg.AddField(field)
+	}
+	return
+}
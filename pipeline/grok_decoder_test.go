@@ -0,0 +1,176 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+func GrokDecoderSpec(c gs.Context) {
+	config := NewPipelineConfig(nil)
+	pack := NewPipelinePack(config.inputRecycleChan)
+	decoder := new(GrokDecoder)
+	conf := decoder.ConfigStruct().(*GrokDecoderConfig)
+
+	fieldValue := func(name string) interface{} {
+		value, ok := pack.Message.GetFieldValue(name)
+		c.Expect(ok, gs.IsTrue)
+		return value
+	}
+
+	c.Specify("A GrokDecoder", func() {
+		c.Specify("parses an Apache log line", func() {
+			conf.Match = "%{COMBINEDAPACHELOG}"
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] ` +
+				`"GET /apache_pb.gif HTTP/1.0" 200 2326 ` +
+				`"http://www.example.com/start.html" "Mozilla/4.08"`)
+			err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(fieldValue("clientip"), gs.Equals, "127.0.0.1")
+			c.Expect(fieldValue("auth"), gs.Equals, "frank")
+			c.Expect(fieldValue("verb"), gs.Equals, "GET")
+			c.Expect(fieldValue("request"), gs.Equals, "/apache_pb.gif")
+			c.Expect(fieldValue("httpversion"), gs.Equals, "1.0")
+			c.Expect(fieldValue("response"), gs.Equals, int64(200))
+			c.Expect(fieldValue("bytes"), gs.Equals, int64(2326))
+			c.Expect(fieldValue("referrer"), gs.Equals,
+				`"http://www.example.com/start.html"`)
+			c.Expect(fieldValue("timestamp"), gs.Equals, "2000-10-10T13:55:36-07:00")
+			field := pack.Message.FindFirstField("timestamp")
+			c.Expect(field.GetValueFormat(), gs.Equals, message.Field_DATE_RFC3339)
+			_, ok := pack.Message.GetFieldValue("rawrequest")
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("sets the message headers it captures", func() {
+			conf.Match = `%{SYSLOGTIMESTAMP:Timestamp} %{HOSTNAME:Hostname} ` +
+				`%{WORD:Logger}\[%{POSINT:Pid}\]: %{LOGLEVEL:Severity} ` +
+				`%{GREEDYDATA:Payload}`
+			conf.TimestampLayout = "Jan _2 15:04:05"
+			conf.SeverityMap = map[string]int32{"ERROR": 3}
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("Jun  1 12:30:45 web1 app[123]: ERROR it broke")
+			err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			timestamp := time.Unix(0, pack.Message.GetTimestamp()).UTC()
+			c.Expect(timestamp, gs.Equals, time.Date(time.Now().Year(), 6, 1, 12,
+				30, 45, 0, time.UTC))
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "web1")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "app")
+			c.Expect(pack.Message.GetPid(), gs.Equals, int32(123))
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(3))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "it broke")
+			c.Expect(len(pack.Message.Fields), gs.Equals, 0)
+		})
+
+		c.Specify("composes configured patterns", func() {
+			conf.Match = `%{DURATION:took} (?P<unit>\w+)`
+			conf.Patterns = map[string]string{
+				"DURATION": "took %{SECS:seconds:float}",
+				"SECS":     `%{NUMBER}`,
+			}
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("took 1.5 seconds")
+			err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(fieldValue("took"), gs.Equals, "took 1.5")
+			c.Expect(fieldValue("seconds"), gs.Equals, 1.5)
+			c.Expect(fieldValue("unit"), gs.Equals, "seconds")
+		})
+
+		c.Specify("loads patterns from a file", func() {
+			tmpDir, err := ioutil.TempDir("", "grok-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			patternsFile := path.Join(tmpDir, "patterns")
+			err = ioutil.WriteFile(patternsFile,
+				[]byte("# Queue names\n\nQUEUE q-%{INT}\n"), 0644)
+			c.Assume(err, gs.IsNil)
+			conf.PatternsFiles = []string{patternsFile}
+			conf.Match = "%{QUEUE:queue}"
+			err = decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("q-42")
+			err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(fieldValue("queue"), gs.Equals, "q-42")
+		})
+
+		c.Specify("passes on a payload that doesn't match", func() {
+			conf.Match = "^%{INT:count:int}$"
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("many")
+			err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "many")
+			c.Expect(fieldValue("grok_unmatched"), gs.Equals, true)
+
+			c.Specify("untagged", func() {
+				conf.UnmatchedTag = ""
+				err := decoder.Init(conf)
+				c.Assume(err, gs.IsNil)
+				pack.Message.Fields = nil
+				err = decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(pack.Message.Fields), gs.Equals, 0)
+			})
+		})
+
+		c.Specify("passes on a message w/ captures it can't convert", func() {
+			conf.Match = `%{SYSLOGTIMESTAMP:Timestamp} %{WORD:Severity} ` +
+				`%{WORD:user} %{GREEDYDATA:Payload}`
+			conf.TimestampLayout = "Jan _2 15:04:05"
+			conf.SeverityMap = map[string]int32{"ERROR": 3}
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetTimestamp(0)
+			pack.Message.SetPayload("Jun 31 12:30:45 BAD frank it broke")
+			err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(0))
+			c.Expect(fieldValue("user"), gs.Equals, "frank")
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "it broke")
+			field := pack.Message.FindFirstField("grok_conversion_error")
+			c.Assume(field, gs.Not(gs.IsNil))
+			c.Expect(len(field.ValueString), gs.Equals, 2)
+		})
+
+		c.Specify("rejects an unknown pattern", func() {
+			conf.Match = "%{NOPE:x}"
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an unknown type", func() {
+			conf.Match = "%{INT:x:bool}"
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a pattern that refers to itself", func() {
+			conf.Patterns = map[string]string{"LOOP": "a%{LOOP}"}
+			conf.Match = "%{LOOP}"
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,296 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	. "github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message encodings by the Content-Type they're POSTed as.
+var HttpContentTypes = map[string]Header_MessageEncoding{
+	"application/json":       Header_JSON,
+	"application/x-protobuf": Header_PROTOCOL_BUFFER,
+	"application/x-msgpack":  Header_MSGPACK,
+	"application/cbor":       Header_CBOR,
+}
+
+// Request headers carrying a signature of the body, the same as the signing
+// fields of a stream message's header.
+const (
+	HTTP_SIGNER_HEADER      = "X-Heka-Signer"
+	HTTP_KEY_VERSION_HEADER = "X-Heka-Key-Version"
+	HTTP_HASH_HEADER        = "X-Heka-Hash-Function"
+	HTTP_SIGNATURE_HEADER   = "X-Heka-Signature"
+)
+
+type HttpInputConfig struct {
+	// Address to listen on, or "fd:N" to use a socket passed in as file
+	// descriptor N.
+	Address string
+	Signers map[string]Signer `toml:"signer"`
+	// Milliseconds to wait for free packs before turning a request away w/ a
+	// 503.
+	PackTimeout uint `toml:"pack_timeout"`
+	// Accept HTTPS connections, configured by the `tls` section.
+	UseTls bool      `toml:"use_tls"`
+	Tls    TlsConfig `toml:"tls"`
+}
+
+// Accepts messages POSTed over HTTP, one per request or, for JSON, one per
+// line. Messages are handed to the decoder for the request's Content-Type.
+type HttpInput struct {
+	config       *HttpInputConfig
+	listener     net.Listener
+	ir           InputRunner
+	decoders     DecoderSet
+	packTimeout  time.Duration
+	stopped      int32
+	authFailures int64
+	// Requests being handled, which Run waits for. The lock orders adding
+	// to them w/ Run's check that the input has stopped.
+	requests     sync.WaitGroup
+	requestsLock sync.Mutex
+}
+
+func (self *HttpInput) ConfigStruct() interface{} {
+	return &HttpInputConfig{PackTimeout: 1000}
+}
+
+func (self *HttpInput) Init(config interface{}) (err error) {
+	self.config = config.(*HttpInputConfig)
+	if err = initSigners(self.config.Signers); err != nil {
+		return
+	}
+	self.packTimeout = time.Duration(self.config.PackTimeout) * time.Millisecond
+	file, err := fdAddressFile(self.config.Address, "httpFile")
+	if err != nil {
+		return
+	}
+	if file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", self.config.Address)
+	}
+	if err != nil {
+		return fmt.Errorf("HttpInput can't listen on %s: %s",
+			self.config.Address, err)
+	}
+	if self.config.UseTls {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = self.config.Tls.ServerConfig(); err != nil {
+			self.listener.Close()
+			return
+		}
+		self.listener = tls.NewListener(self.listener, tlsConfig)
+	}
+	return
+}
+
+func (self *HttpInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	self.ir = ir
+	self.decoders = h.DecoderSet()
+	err = http.Serve(self.listener, self)
+	// Connections that are still open can carry more requests, so turn them
+	// away and wait for the ones being handled to hand on their packs.
+	self.requestsLock.Lock()
+	if !atomic.CompareAndSwapInt32(&self.stopped, 0, 1) {
+		err = nil
+	}
+	self.requestsLock.Unlock()
+	self.requests.Wait()
+	return
+}
+
+func (self *HttpInput) Stop() {
+	atomic.StoreInt32(&self.stopped, 1)
+	self.listener.Close()
+}
+
+func (self *HttpInput) AuthFailures() int64 {
+	return atomic.LoadInt64(&self.authFailures)
+}
+
+func (self *HttpInput) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	self.requestsLock.Lock()
+	if atomic.LoadInt32(&self.stopped) == 1 {
+		self.requestsLock.Unlock()
+		writeJsonError(w, http.StatusServiceUnavailable,
+			fmt.Errorf("shutting down"))
+		return
+	}
+	self.requests.Add(1)
+	self.requestsLock.Unlock()
+	defer self.requests.Done()
+
+	if req.Method != "POST" {
+		writeJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("messages must be POSTed"))
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	encoding, ok := HttpContentTypes[mediaType]
+	var decoder DecoderRunner
+	if ok {
+		decoder, ok = self.decoders.ByEncoding(encoding)
+	}
+	if !ok {
+		writeJsonError(w, http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported Content-Type: %s", req.Header.Get("Content-Type")))
+		return
+	}
+
+	// Only JSON messages can be batched, one per line.
+	maxSize := MAX_MESSAGE_SIZE
+	if encoding == Header_JSON {
+		maxSize = MAX_BATCH_SIZE
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, int64(maxSize)))
+	if err != nil {
+		writeJsonError(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("body is over %d bytes", maxSize))
+		return
+	}
+	records := [][]byte{body}
+	if encoding == Header_JSON {
+		records = splitJsonLines(body)
+	}
+	if len(records) == 0 || len(records[0]) == 0 {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("no messages"))
+		return
+	}
+	if len(records) > Globals().PoolSize {
+		writeJsonError(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("batch has more than %d messages", Globals().PoolSize))
+		return
+	}
+	for _, record := range records {
+		if len(record) > MAX_MESSAGE_SIZE {
+			writeJsonError(w, http.StatusRequestEntityTooLarge,
+				fmt.Errorf("message is over %d bytes", MAX_MESSAGE_SIZE))
+			return
+		}
+	}
+
+	signer, ok := self.authenticate(req, body)
+	if !ok {
+		atomic.AddInt64(&self.authFailures, 1)
+		writeJsonError(w, http.StatusForbidden, fmt.Errorf("invalid signature"))
+		return
+	}
+	var commonName string
+	if req.TLS != nil {
+		commonName = stateCommonName(*req.TLS)
+	}
+
+	// Take all of the packs before handing any on, so a batch is either
+	// accepted whole or not at all.
+	packs := make([]*PipelinePack, 0, len(records))
+	timeout := time.After(self.packTimeout)
+	for len(packs) < len(records) {
+		pack, ok := self.takePack(timeout)
+		if !ok {
+			for _, pack := range packs {
+				pack.Recycle()
+			}
+			w.Header().Set("Retry-After", "1")
+			writeJsonError(w, http.StatusServiceUnavailable,
+				fmt.Errorf("too busy to accept messages"))
+			return
+		}
+		packs = append(packs, pack)
+	}
+	for i, pack := range packs {
+		pack.MsgBytes = append(pack.MsgBytes[:0], records[i]...)
+		pack.Signer = signer
+		pack.ClientCommonName = commonName
+		decoder.InChan() <- pack
+	}
+	writeJson(w, http.StatusAccepted, map[string]int{"accepted": len(packs)})
+}
+
+// Takes a pack from the input's supply, giving up once `timeout` fires.
+func (self *HttpInput) takePack(timeout <-chan time.Time) (pack *PipelinePack,
+	ok bool) {
+
+	// A free pack is taken even if the timeout has already fired.
+	select {
+	case pack = <-self.ir.InChan():
+		return pack, true
+	default:
+	}
+	select {
+	case pack = <-self.ir.InChan():
+		return pack, true
+	case <-timeout:
+	}
+	return nil, false
+}
+
+// Splits a body of JSON messages into one per line, skipping blank lines.
+func splitJsonLines(body []byte) (records [][]byte) {
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			records = append(records, line)
+		}
+	}
+	return
+}
+
+// Checks the request's signature, if it has one, returning the signer.
+func (self *HttpInput) authenticate(req *http.Request, body []byte) (
+	signer string, ok bool) {
+
+	encoded := req.Header.Get(HTTP_SIGNATURE_HEADER)
+	if encoded == "" {
+		return "", true
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	function, err := HmacHashFunctionByName(req.Header.Get(HTTP_HASH_HEADER))
+	if err != nil {
+		return
+	}
+	var version uint64
+	if versionStr := req.Header.Get(HTTP_KEY_VERSION_HEADER); versionStr != "" {
+		if version, err = strconv.ParseUint(versionStr, 10, 32); err != nil {
+			return
+		}
+	}
+	header := new(Header)
+	header.SetHmacSigner(req.Header.Get(HTTP_SIGNER_HEADER))
+	header.SetHmacKeyVersion(uint32(version))
+	header.SetHmacHashFunction(function)
+	header.SetHmac(signature)
+	pack := &PipelinePack{MsgBytes: body}
+	if !authenticateMessage(self.config.Signers, header, pack) {
+		return
+	}
+	return pack.Signer, true
+}
@@ -0,0 +1,204 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"code.google.com/p/gomock/gomock"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"time"
+)
+
+func HttpInputSpec(c gs.Context) {
+	t := &ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ir := NewMockInputRunner(ctrl)
+	h := NewMockPluginHelper(ctrl)
+	dSet := NewMockDecoderSet(ctrl)
+	dRunner := NewMockDecoderRunner(ctrl)
+	packSupply := make(chan *PipelinePack, 2)
+	for i := 0; i < 2; i++ {
+		packSupply <- NewPipelinePack(packSupply)
+	}
+	decodeChan := make(chan *PipelinePack, 2)
+	ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+	h.EXPECT().DecoderSet().Return(dSet)
+	dSet.EXPECT().ByEncoding(message.Header_JSON).Return(dRunner, true).AnyTimes()
+	dRunner.EXPECT().InChan().Return(decodeChan).AnyTimes()
+
+	input := new(HttpInput)
+	config := input.ConfigStruct().(*HttpInputConfig)
+	config.Address = "127.0.0.1:0"
+	config.Signers = map[string]Signer{
+		"test_1":   {HmacKey: "testkey"},
+		"strict_1": {HmacKey: "testkey", Hashes: []string{"sha256", "SHA512"}},
+	}
+	err := input.Init(config)
+	c.Assume(err, gs.IsNil)
+	url := "http://" + input.listener.Addr().String() + "/"
+	done := make(chan error, 1)
+	go func() {
+		done <- input.Run(ir, h)
+	}()
+	running := true
+	defer func() {
+		if running {
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		}
+	}()
+
+	post := func(contentType, body string, headers map[string]string) int {
+		req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		c.Assume(err, gs.IsNil)
+		req.Header.Set("Content-Type", contentType)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assume(err, gs.IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	decoded := func() (packs []*PipelinePack) {
+		for {
+			select {
+			case pack := <-decodeChan:
+				packs = append(packs, pack)
+			case <-time.After(10 * time.Millisecond):
+				return
+			}
+		}
+	}
+	body := `{"type": "one"}` + "\n\n" + `{"type": "two"}` + "\n"
+
+	c.Specify("An HttpInput", func() {
+		c.Specify("decodes a batch of JSON messages", func() {
+			status := post("application/json; charset=utf-8", body, nil)
+			c.Expect(status, gs.Equals, http.StatusAccepted)
+			packs := decoded()
+			c.Expect(len(packs), gs.Equals, 2)
+			c.Expect(string(packs[0].MsgBytes), gs.Equals, `{"type": "one"}`)
+			c.Expect(string(packs[1].MsgBytes), gs.Equals, `{"type": "two"}`)
+			c.Expect(packs[0].Signer, gs.Equals, "")
+		})
+
+		c.Specify("checks a signature", func() {
+			hm := hmac.New(sha256.New, []byte("testkey"))
+			hm.Write([]byte(body))
+			headers := map[string]string{
+				HTTP_SIGNER_HEADER:      "test",
+				HTTP_KEY_VERSION_HEADER: "1",
+				HTTP_HASH_HEADER:        "sha256",
+				HTTP_SIGNATURE_HEADER:   base64.StdEncoding.EncodeToString(hm.Sum(nil)),
+			}
+			status := post("application/json", body, headers)
+			c.Expect(status, gs.Equals, http.StatusAccepted)
+			packs := decoded()
+			c.Expect(len(packs), gs.Equals, 2)
+			c.Expect(packs[1].Signer, gs.Equals, "test")
+
+			c.Specify("and rejects a bad one", func() {
+				status := post("application/json", body+"\n", headers)
+				c.Expect(status, gs.Equals, http.StatusForbidden)
+				c.Expect(len(decoded()), gs.Equals, 0)
+				c.Expect(input.AuthFailures(), gs.Equals, int64(1))
+			})
+		})
+
+		c.Specify("refuses a hash function the signer doesn't allow", func() {
+			// No hash header means MD5.
+			hm := hmac.New(md5.New, []byte("testkey"))
+			hm.Write([]byte(body))
+			headers := map[string]string{
+				HTTP_SIGNER_HEADER:      "strict",
+				HTTP_KEY_VERSION_HEADER: "1",
+				HTTP_SIGNATURE_HEADER:   base64.StdEncoding.EncodeToString(hm.Sum(nil)),
+			}
+			status := post("application/json", body, headers)
+			c.Expect(status, gs.Equals, http.StatusForbidden)
+			c.Expect(len(decoded()), gs.Equals, 0)
+
+			hm = hmac.New(sha256.New, []byte("testkey"))
+			hm.Write([]byte(body))
+			headers[HTTP_HASH_HEADER] = "sha256"
+			headers[HTTP_SIGNATURE_HEADER] = base64.StdEncoding.EncodeToString(
+				hm.Sum(nil))
+			status = post("application/json", body, headers)
+			c.Expect(status, gs.Equals, http.StatusAccepted)
+			c.Expect(len(decoded()), gs.Equals, 2)
+		})
+
+		c.Specify("refuses a batch there aren't enough packs for", func() {
+			input.packTimeout = 10 * time.Millisecond
+			<-packSupply
+			status := post("application/json", body, nil)
+			c.Expect(status, gs.Equals, http.StatusServiceUnavailable)
+			c.Expect(len(decoded()), gs.Equals, 0)
+			// The pack it took is returned to the supply.
+			c.Expect(len(packSupply), gs.Equals, 1)
+		})
+
+		c.Specify("waits for a request being handled when it stops", func() {
+			// Fill the decoder's channel so the request blocks handing on
+			// its packs.
+			for i := 0; i < cap(decodeChan); i++ {
+				decodeChan <- NewPipelinePack(nil)
+			}
+			go post("application/json", body, nil)
+			for len(packSupply) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			input.Stop()
+			running = false
+			returned := false
+			select {
+			case err := <-done:
+				returned = true
+				done <- err
+			case <-time.After(50 * time.Millisecond):
+			}
+			c.Expect(returned, gs.IsFalse)
+			c.Expect(len(decoded()), gs.Equals, 2*cap(decodeChan))
+			c.Expect(<-done, gs.IsNil)
+		})
+
+		c.Specify("refuses an unsupported Content-Type", func() {
+			status := post("text/plain", body, nil)
+			c.Expect(status, gs.Equals, http.StatusUnsupportedMediaType)
+		})
+
+		c.Specify("refuses an empty body", func() {
+			status := post("application/json", "\n", nil)
+			c.Expect(status, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("only accepts POSTs", func() {
+			resp, err := http.Get(url)
+			c.Assume(err, gs.IsNil)
+			resp.Body.Close()
+			c.Expect(resp.StatusCode, gs.Equals, http.StatusMethodNotAllowed)
+		})
+	})
+}
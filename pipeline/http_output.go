@@ -0,0 +1,340 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Content-Type of the body POSTed for each of the HttpOutput's formats.
+var HttpOutputFormats = map[string]string{
+	"json":           "application/json",
+	"json_lines":     "application/json",
+	"protobufstream": "application/x-protobuf",
+}
+
+type HttpOutputConfig struct {
+	// URL to POST batches to. `@Name` is replaced w/ the value of the
+	// message header or field called Name, so messages are batched per URL.
+	Url string
+	// Format for message serialization, from json (a JSON array of the
+	// batch's messages), json_lines (one JSON message per line) or
+	// protobufstream.
+	Format string
+	// Extra headers sent w/ each request.
+	Headers map[string]string
+	// Credentials for HTTP basic authentication, sent if Username is set.
+	Username string
+	Password string
+	// Send a batch once it holds this many messages.
+	BatchCount int `toml:"batch_count"`
+	// Send a batch before it grows past this many bytes.
+	BatchSize int `toml:"batch_size"`
+	// Maximum milliseconds a partial batch waits before it's sent.
+	FlushInterval uint `toml:"flush_interval"`
+	// Milliseconds to wait for a response before the request is retried.
+	Timeout uint
+	// Milliseconds to wait before the first retry of a failed request. The
+	// delay doubles w/ each failed attempt.
+	RetryDelay uint `toml:"retry_delay"`
+	// Upper bound in milliseconds on the delay between retries.
+	MaxRetryDelay uint `toml:"max_retry_delay"`
+}
+
+// Batches messages and POSTs each batch to an HTTP endpoint.
+type HttpOutput struct {
+	config         *HttpOutputConfig
+	interpolate    bool
+	flushInterval  time.Duration
+	client         *http.Client
+	backoff        *client.Backoff
+	batches        map[string]*httpBatch
+	sentBatches    int64
+	droppedBatches int64
+	retries        int64
+}
+
+// Messages waiting to be sent to the same URL.
+type httpBatch struct {
+	url   string
+	body  []byte
+	count int
+}
+
+func (o *HttpOutput) ConfigStruct() interface{} {
+	return &HttpOutputConfig{
+		Format:        "json",
+		BatchCount:    100,
+		BatchSize:     message.MAX_BATCH_SIZE,
+		FlushInterval: 1000,
+		Timeout:       10000,
+		RetryDelay:    250,
+		MaxRetryDelay: 30000,
+	}
+}
+
+func (o *HttpOutput) Init(config interface{}) (err error) {
+	conf := config.(*HttpOutputConfig)
+	// Interpolated values are only known per message, so stand in for them
+	// to check the rest of the URL.
+	checkUrl := varMatcher.ReplaceAllString(conf.Url, "x")
+	if err = checkHttpUrl(checkUrl); err != nil {
+		return fmt.Errorf("HttpOutput invalid url '%s': %s", conf.Url, err)
+	}
+	if _, ok := HttpOutputFormats[conf.Format]; !ok {
+		return fmt.Errorf("HttpOutput unsupported format: %s", conf.Format)
+	}
+	if conf.BatchCount < 1 || conf.BatchSize < 1 {
+		return fmt.Errorf("HttpOutput batch_count and batch_size must be " +
+			"greater than 0")
+	}
+	if conf.FlushInterval == 0 {
+		return fmt.Errorf("HttpOutput flush_interval must be greater than 0")
+	}
+	if conf.RetryDelay == 0 {
+		return fmt.Errorf("HttpOutput retry_delay must be greater than 0")
+	}
+	if conf.MaxRetryDelay < conf.RetryDelay {
+		return fmt.Errorf("HttpOutput max_retry_delay must be at least %d",
+			conf.RetryDelay)
+	}
+	o.config = conf
+	o.interpolate = varMatcher.MatchString(conf.Url)
+	o.flushInterval = time.Duration(conf.FlushInterval) * time.Millisecond
+	o.client = &http.Client{
+		Timeout: time.Duration(conf.Timeout) * time.Millisecond,
+	}
+	o.backoff = client.NewBackoff(
+		time.Duration(conf.RetryDelay)*time.Millisecond,
+		time.Duration(conf.MaxRetryDelay)*time.Millisecond)
+	o.batches = make(map[string]*httpBatch)
+	return
+}
+
+func (o *HttpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		e        error
+		plc      *PipelineCapture
+		outBytes = make([]byte, 0, 2000)
+		ok       = true
+	)
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+	inChan := or.InChan()
+
+	for ok {
+		select {
+		case plc, ok = <-inChan:
+			if !ok {
+				break
+			}
+			outBytes = outBytes[:0]
+			e = o.encode(plc.Pack.Message, &outBytes)
+			batchUrl := o.url(plc.Pack.Message)
+			plc.Pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				continue
+			}
+			o.add(or, batchUrl, outBytes)
+		case <-ticker.C:
+			o.flushAll(or)
+		}
+	}
+	o.flushAll(or)
+	return
+}
+
+// Appends a message to `outBytes` in the output's format.
+func (o *HttpOutput) encode(msg *message.Message, outBytes *[]byte) (err error) {
+	if o.config.Format == "protobufstream" {
+		pack := &PipelinePack{Message: msg}
+		if err = createProtobufStream(pack, outBytes); err != nil {
+			err = fmt.Errorf("error encoding to ProtoBuf: %s", err)
+		}
+		return
+	}
+	jsonMessage, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding to JSON: %s", err)
+	}
+	*outBytes = append(*outBytes, jsonMessage...)
+	if o.config.Format == "json_lines" {
+		*outBytes = append(*outBytes, NEWLINE)
+	}
+	return
+}
+
+// Returns the URL a message is sent to, w/ its headers and fields
+// interpolated.
+func (o *HttpOutput) url(msg *message.Message) string {
+	if !o.interpolate {
+		return o.config.Url
+	}
+	parts := messageMatchSet(msg)
+	for name, value := range parts {
+		parts[name] = url.QueryEscape(value)
+	}
+	return InterpolateString(o.config.Url, parts)
+}
+
+// Adds an encoded message to the batch for `batchUrl`, sending the batch
+// first if the message would make it too large and after if it's full.
+func (o *HttpOutput) add(or OutputRunner, batchUrl string, record []byte) {
+	batch, ok := o.batches[batchUrl]
+	if !ok {
+		batch = &httpBatch{url: batchUrl}
+		o.batches[batchUrl] = batch
+	}
+	if batch.count > 0 && len(batch.body)+len(record)+2 > o.config.BatchSize {
+		o.flush(or, batch)
+	}
+	if o.config.Format == "json" {
+		if batch.count == 0 {
+			batch.body = append(batch.body, '[')
+		} else {
+			batch.body = append(batch.body, ',')
+		}
+	}
+	batch.body = append(batch.body, record...)
+	batch.count++
+	if batch.count >= o.config.BatchCount {
+		o.flush(or, batch)
+	}
+}
+
+func (o *HttpOutput) flushAll(or OutputRunner) {
+	for batchUrl, batch := range o.batches {
+		o.flush(or, batch)
+		// URLs w/ interpolated values may not come up again.
+		delete(o.batches, batchUrl)
+	}
+}
+
+// Sends a batch and empties it.
+func (o *HttpOutput) flush(or OutputRunner, batch *httpBatch) {
+	if batch.count == 0 {
+		return
+	}
+	if o.config.Format == "json" {
+		batch.body = append(batch.body, ']')
+	}
+	if !o.send(or, batch.url, batch.body) {
+		or.LogError(fmt.Errorf("dropped %d messages for %s", batch.count,
+			batch.url))
+	}
+	batch.body = batch.body[:0]
+	batch.count = 0
+}
+
+// POSTs a batch, retrying w/ exponential backoff until it gets a 2xx
+// response. Gives up, returning false, when the response says resending it
+// won't help or when Heka is shutting down.
+func (o *HttpOutput) send(or OutputRunner, batchUrl string, body []byte) bool {
+	for {
+		retriable, e := o.post(batchUrl, body)
+		if e == nil {
+			atomic.AddInt64(&o.sentBatches, 1)
+			o.backoff.Reset()
+			return true
+		}
+		or.LogError(fmt.Errorf("posting to %s: %s", batchUrl, e))
+		if !retriable {
+			atomic.AddInt64(&o.droppedBatches, 1)
+			return false
+		}
+		if Globals().Stopping {
+			atomic.AddInt64(&o.droppedBatches, 1)
+			return false
+		}
+		atomic.AddInt64(&o.retries, 1)
+		time.Sleep(o.backoff.Next())
+	}
+}
+
+// Returns whether a request that got a response w/ the given status may
+// succeed if it's sent again, i.e. the server timed out, is overloaded or
+// failed.
+func httpRetriable(status int) bool {
+	return status == http.StatusRequestTimeout || status == 429 || status >= 500
+}
+
+// Returns an error unless `rawUrl` is an absolute http or https URL.
+func checkHttpUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// POSTs a batch, returning whether sending it again may succeed if it
+// fails. A URL that can't be requested or a response that rejects the batch
+// won't change, a failed connection or an overloaded server may.
+func (o *HttpOutput) post(batchUrl string, body []byte) (retriable bool,
+	err error) {
+
+	// Interpolated values can make a bad URL from a good one.
+	if err = checkHttpUrl(batchUrl); err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", batchUrl, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", HttpOutputFormats[o.config.Format])
+	for name, value := range o.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if o.config.Username != "" {
+		req.SetBasicAuth(o.config.Username, o.config.Password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// Read the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("server responded w/ %s", resp.Status)
+	}
+	return httpRetriable(resp.StatusCode), err
+}
+
+func (o *HttpOutput) ReportMsg(msg *message.Message) (err error) {
+	newIntField(msg, "SentBatches", int(atomic.LoadInt64(&o.sentBatches)))
+	newIntField(msg, "DroppedBatches",
+		int(atomic.LoadInt64(&o.droppedBatches)))
+	newIntField(msg, "Retries", int(atomic.LoadInt64(&o.retries)))
+	return
+}
@@ -0,0 +1,231 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+type httpRequest struct {
+	req  *http.Request
+	body string
+}
+
+func HttpOutputSpec(c gs.Context) {
+	t := new(ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oth := NewOutputTestHelper(ctrl)
+	inChan := make(chan *PipelineCapture, 2)
+	oth.MockOutputRunner.EXPECT().InChan().Return(inChan).AnyTimes()
+
+	// The server answers w/ the next of `statuses`, then w/ 200s.
+	var statuses []int
+	requests := make(chan httpRequest, 4)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			requests <- httpRequest{req, string(body)}
+			status := http.StatusOK
+			if len(statuses) > 0 {
+				status, statuses = statuses[0], statuses[1:]
+			}
+			w.WriteHeader(status)
+		}))
+	defer server.Close()
+
+	output := new(HttpOutput)
+	config := output.ConfigStruct().(*HttpOutputConfig)
+	config.Url = server.URL + "/messages"
+
+	// Runs the output over `msgs` until they've all been sent.
+	run := func(msgs ...*message.Message) {
+		err := output.Init(config)
+		c.Assume(err, gs.IsNil)
+		done := make(chan bool)
+		go func() {
+			output.Run(oth.MockOutputRunner, oth.MockHelper)
+			close(done)
+		}()
+		for _, msg := range msgs {
+			pack := NewPipelinePack(make(chan *PipelinePack, 1))
+			pack.Message = msg
+			inChan <- &PipelineCapture{Pack: pack}
+		}
+		close(inChan)
+		<-done
+	}
+	received := func() (reqs []httpRequest) {
+		for {
+			select {
+			case req := <-requests:
+				reqs = append(reqs, req)
+			default:
+				return
+			}
+		}
+	}
+
+	c.Specify("An HttpOutput", func() {
+		first, second := getTestMessage(), getTestMessage()
+		second.SetType("OTHER")
+
+		c.Specify("posts a batch of messages as a JSON array", func() {
+			config.BatchCount = 2
+			config.Headers = map[string]string{"X-Test": "yes"}
+			config.Username = "user"
+			config.Password = "secret"
+			run(first, second)
+			reqs := received()
+			c.Expect(len(reqs), gs.Equals, 1)
+			req := reqs[0].req
+			c.Expect(req.Method, gs.Equals, "POST")
+			c.Expect(req.URL.Path, gs.Equals, "/messages")
+			c.Expect(req.Header.Get("Content-Type"), gs.Equals, "application/json")
+			c.Expect(req.Header.Get("X-Test"), gs.Equals, "yes")
+			username, password, ok := req.BasicAuth()
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(username, gs.Equals, "user")
+			c.Expect(password, gs.Equals, "secret")
+			var msgs []*message.Message
+			err := json.Unmarshal([]byte(reqs[0].body), &msgs)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(msgs), gs.Equals, 2)
+			c.Expect(msgs[1].GetType(), gs.Equals, "OTHER")
+		})
+
+		c.Specify("posts newline delimited JSON", func() {
+			config.Format = "json_lines"
+			run(first, second)
+			reqs := received()
+			c.Expect(len(reqs), gs.Equals, 1)
+			lines := strings.Split(reqs[0].body, "\n")
+			c.Expect(len(lines), gs.Equals, 3)
+			msg := new(message.Message)
+			err := json.Unmarshal([]byte(lines[0]), msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "TEST")
+		})
+
+		c.Specify("splits batches that would be too large", func() {
+			config.Format = "protobufstream"
+			config.BatchSize = 10
+			run(first, second)
+			reqs := received()
+			c.Expect(len(reqs), gs.Equals, 2)
+			c.Expect(reqs[0].req.Header.Get("Content-Type"), gs.Equals,
+				"application/x-protobuf")
+			header := new(message.Header)
+			record := make([]byte, 0, 200)
+			_, ok := findMessage([]byte(reqs[1].body), header, &record)
+			c.Expect(ok, gs.IsTrue)
+			msg := new(message.Message)
+			c.Expect(proto.Unmarshal(record, msg), gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "OTHER")
+		})
+
+		c.Specify("interpolates message values into the URL", func() {
+			config.Url = server.URL + "/@Type/@foo"
+			second.SetType("a b")
+			run(first, second)
+			paths := make(map[string]bool)
+			for _, req := range received() {
+				paths[req.req.URL.Path] = true
+			}
+			c.Expect(len(paths), gs.Equals, 2)
+			c.Expect(paths["/TEST/bar"], gs.IsTrue)
+			c.Expect(paths["/a+b/bar"], gs.IsTrue)
+		})
+
+		c.Specify("retries a failed request", func() {
+			statuses = []int{http.StatusInternalServerError}
+			config.RetryDelay = 1
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+			run(first)
+			reqs := received()
+			c.Expect(len(reqs), gs.Equals, 2)
+			c.Expect(reqs[0].body, gs.Equals, reqs[1].body)
+
+			msg := getTestMessage()
+			err := output.ReportMsg(msg)
+			c.Expect(err, gs.IsNil)
+			retries, _ := msg.GetFieldValue("Retries")
+			c.Expect(retries, gs.Equals, int64(1))
+			sent, _ := msg.GetFieldValue("SentBatches")
+			c.Expect(sent, gs.Equals, int64(1))
+		})
+
+		c.Specify("drops a batch the server rejects", func() {
+			statuses = []int{http.StatusBadRequest}
+			config.RetryDelay = 1
+			// The failed request and the dropped batch.
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Times(2)
+			run(first)
+			c.Expect(len(received()), gs.Equals, 1)
+
+			msg := getTestMessage()
+			err := output.ReportMsg(msg)
+			c.Expect(err, gs.IsNil)
+			dropped, _ := msg.GetFieldValue("DroppedBatches")
+			c.Expect(dropped, gs.Equals, int64(1))
+			retries, _ := msg.GetFieldValue("Retries")
+			c.Expect(retries, gs.Equals, int64(0))
+		})
+
+		c.Specify("drops a batch for a bad interpolated URL", func() {
+			// The escaped slash isn't allowed in a host.
+			first.SetLogger("a/b")
+			config.Url = "http://@Logger/messages"
+			config.RetryDelay = 1
+			// The failed request and the dropped batch.
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Times(2)
+			run(first)
+			c.Expect(len(received()), gs.Equals, 0)
+
+			msg := getTestMessage()
+			err := output.ReportMsg(msg)
+			c.Expect(err, gs.IsNil)
+			dropped, _ := msg.GetFieldValue("DroppedBatches")
+			c.Expect(dropped, gs.Equals, int64(1))
+			retries, _ := msg.GetFieldValue("Retries")
+			c.Expect(retries, gs.Equals, int64(0))
+		})
+
+		c.Specify("rejects a URL w/o an http scheme or a host", func() {
+			for _, badUrl := range []string{"", "ftp://example.com/",
+				"example.com/messages", "http:///messages"} {
+				config.Url = badUrl
+				c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			}
+			config.Url = "https://@Hostname/@Type"
+			c.Expect(output.Init(config), gs.IsNil)
+		})
+
+		c.Specify("rejects an unknown format", func() {
+			config.Format = "xml"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -17,18 +17,18 @@ package pipeline
 import (
 	"bytes"
 	"code.google.com/p/goprotobuf/proto"
+	"crypto/ed25519"
 	"crypto/hmac"
-	"crypto/md5"
-	"crypto/sha1"
+	"crypto/tls"
 	"fmt"
 	. "github.com/mozilla-services/heka/message"
-	"hash"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type TimeoutError string
@@ -37,6 +37,12 @@ func (self *TimeoutError) Error() string {
 	return fmt.Sprint("Error: Read timed out")
 }
 
+// Implemented by inputs that authenticate signed messages, so the number that
+// failed can be reported.
+type AuthenticatingInput interface {
+	AuthFailures() int64
+}
+
 type InputRunner interface {
 	PluginRunner
 	InChan() chan *PipelinePack
@@ -94,10 +100,12 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 }
 
 func (ir *iRunner) Inject(pack *PipelinePack) {
+	atomic.AddInt64(&ir.processCount, 1)
 	ir.h.PipelineConfig().router.InChan() <- pack
 }
 
 func (ir *iRunner) LogError(err error) {
+	atomic.AddInt64(&ir.errorCount, 1)
 	log.Printf("Input '%s' error: %s", ir.name, err)
 }
 
@@ -113,10 +121,11 @@ type Input interface {
 
 // UdpInput
 type UdpInput struct {
-	listener net.Conn
-	name     string
-	stopped  bool
-	config   *UdpInputConfig
+	listener     net.Conn
+	name         string
+	stopped      bool
+	config       *UdpInputConfig
+	authFailures int64
 }
 
 type UdpInputConfig struct {
@@ -130,16 +139,15 @@ func (self *UdpInput) ConfigStruct() interface{} {
 
 func (self *UdpInput) Init(config interface{}) error {
 	self.config = config.(*UdpInputConfig)
-	if len(self.config.Address) > 3 && self.config.Address[:3] == "fd:" {
+	if err := initSigners(self.config.Signers); err != nil {
+		return err
+	}
+	udpFile, err := fdAddressFile(self.config.Address, "udpFile")
+	if err != nil {
+		return err
+	}
+	if udpFile != nil {
 		// File descriptor
-		fdStr := self.config.Address[3:]
-		fdInt, err := strconv.ParseUint(fdStr, 0, 0)
-		if err != nil {
-			log.Println(err)
-			return fmt.Errorf("Invalid file descriptor: %s", self.config.Address)
-		}
-		fd := uintptr(fdInt)
-		udpFile := os.NewFile(fd, "udpFile")
 		self.listener, err = net.FileConn(udpFile)
 		if err != nil {
 			return fmt.Errorf("Error accessing UDP fd: %s\n", err.Error())
@@ -158,10 +166,25 @@ func (self *UdpInput) Init(config interface{}) error {
 	return nil
 }
 
+// Returns the socket an "fd:N" address refers to, one passed in as file
+// descriptor N, e.g. by socket activation, or nil for any other address.
+func fdAddressFile(address, name string) (file *os.File, err error) {
+	if len(address) <= 3 || address[:3] != "fd:" {
+		return
+	}
+	fdInt, err := strconv.ParseUint(address[3:], 0, 0)
+	if err != nil {
+		log.Println(err)
+		return nil, fmt.Errorf("Invalid file descriptor: %s", address)
+	}
+	return os.NewFile(uintptr(fdInt), name), nil
+}
+
 func (self *UdpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	buf := make([]byte, MAX_MESSAGE_SIZE+MAX_HEADER_SIZE+3)
 	header := &Header{}
-	decoders := h.DecoderSet()
+	dispatcher := newMessageDispatcher(self.config.Signers, h.DecoderSet(), ir,
+		&self.authFailures)
 
 	var e error
 	var n int
@@ -178,16 +201,7 @@ func (self *UdpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		}
 		_, msgOk = findMessage(buf[:n], header, &(pack.MsgBytes))
 		if msgOk {
-			if authenticateMessage(self.config.Signers, header, pack) {
-				encoding := header.GetMessageEncoding()
-				if decoder, ok := decoders.ByEncoding(encoding); ok {
-					decoder.InChan() <- pack
-				} else {
-					pack.Recycle()
-				}
-			} else {
-				pack.Recycle()
-			}
+			dispatcher.dispatch(header, pack)
 		} else {
 			pack.Recycle()
 		}
@@ -203,25 +217,74 @@ func (self *UdpInput) Stop() {
 	self.listener.Close()
 }
 
+func (self *UdpInput) AuthFailures() int64 {
+	return atomic.LoadInt64(&self.authFailures)
+}
+
 // TCP Input
 
 type TcpInput struct {
-	listener net.Listener
-	name     string
-	wg       sync.WaitGroup
-	stopChan chan bool
-	ir       InputRunner
-	h        PluginHelper
-	config   *TcpInputConfig
+	listener     net.Listener
+	name         string
+	wg           sync.WaitGroup
+	stopChan     chan bool
+	ir           InputRunner
+	h            PluginHelper
+	config       *TcpInputConfig
+	authFailures int64
+	// Open connections, closed by Stop so a reader blocked on an idle one
+	// doesn't hold up shutdown.
+	conns     map[net.Conn]bool
+	connsLock sync.Mutex
 }
 
+// A key that messages can be signed w/, either an HMAC key or, for Ed25519
+// signatures, a public key.
 type Signer struct {
 	HmacKey string `toml:"hmac_key"`
+	// Base64 encoded Ed25519 public key.
+	PublicKey string `toml:"public_key"`
+	publicKey ed25519.PublicKey
+	// Hash functions the signer's messages may use, e.g. to refuse MD5
+	// and SHA1. Any are accepted if empty.
+	Hashes []string `toml:"hashes"`
+	hashes map[Header_HmacHashFunction]bool
+}
+
+// Decodes the signers' public keys and hash functions, failing if any is
+// invalid.
+func initSigners(signers map[string]Signer) (err error) {
+	for name, s := range signers {
+		if len(s.Hashes) > 0 {
+			s.hashes = make(map[Header_HmacHashFunction]bool)
+			for _, hash := range s.Hashes {
+				var function Header_HmacHashFunction
+				if function, err = HmacHashFunctionByName(hash); err != nil {
+					return fmt.Errorf("signer %s: %s", name, err)
+				}
+				s.hashes[function] = true
+			}
+		}
+		if s.PublicKey != "" {
+			if s.HmacKey != "" {
+				return fmt.Errorf("signer %s has both an hmac_key and a "+
+					"public_key", name)
+			}
+			if s.publicKey, err = ParseEd25519PublicKey(s.PublicKey); err != nil {
+				return fmt.Errorf("signer %s: %s", name, err)
+			}
+		}
+		signers[name] = s
+	}
+	return
 }
 
 type TcpInputConfig struct {
 	Address string
 	Signers map[string]Signer `toml:"signer"`
+	// Accept TLS connections, configured by the `tls` section.
+	UseTls bool      `toml:"use_tls"`
+	Tls    TlsConfig `toml:"tls"`
 }
 
 func (self *TcpInput) ConfigStruct() interface{} {
@@ -245,6 +308,10 @@ func decodeHeader(buf []byte, header *Header) bool {
 	return true
 }
 
+// Finds the next framed message in `buf`, decompressing it into `message` if
+// the header says it's compressed. Returns the position following the
+// message, or where an incomplete message starts. A message that can't be
+// decompressed is skipped, w/ `ok` false.
 func findMessage(buf []byte, header *Header, message *[]byte) (pos int, ok bool) {
 	pos = bytes.IndexByte(buf, RECORD_SEPARATOR)
 	if pos != -1 {
@@ -255,15 +322,15 @@ func findMessage(buf []byte, header *Header, message *[]byte) (pos int, ok bool)
 				if header.MessageLength != nil || decodeHeader(buf[pos+2:headerEnd], header) {
 					messageEnd := headerEnd + int(header.GetMessageLength())
 					if len(buf) >= messageEnd {
-						*message = (*message)[:messageEnd-headerEnd]
-						copy(*message, buf[headerEnd:messageEnd])
 						pos = messageEnd
-						ok = true
+						ok = readMessageBody(buf[headerEnd:messageEnd], header, message)
 					} else {
 						*message = (*message)[:0]
 					}
 				} else {
-					pos, ok = findMessage(buf[pos+1:], header, message)
+					var skipped int
+					skipped, ok = findMessage(buf[pos+1:], header, message)
+					pos += 1 + skipped
 				}
 			}
 		}
@@ -273,49 +340,167 @@ func findMessage(buf []byte, header *Header, message *[]byte) (pos int, ok bool)
 	return
 }
 
+func readMessageBody(body []byte, header *Header, message *[]byte) bool {
+	compression := header.GetCompression()
+	if compression == Header_NONE {
+		*message = (*message)[:len(body)]
+		copy(*message, body)
+		return true
+	}
+	maxSize := MAX_MESSAGE_SIZE
+	if header.GetBatch() {
+		maxSize = MAX_BATCH_SIZE
+	}
+	var err error
+	if *message, err = Decompress(compression, *message, body, maxSize); err != nil {
+		log.Printf("error decompressing message: %s", err)
+		*message = (*message)[:0]
+		return false
+	}
+	return true
+}
+
 func authenticateMessage(signers map[string]Signer, header *Header,
 	pack *PipelinePack) bool {
 	digest := header.GetHmac()
-	if digest != nil {
-		var key string
-		signer := fmt.Sprintf("%s_%d", header.GetHmacSigner(),
-			header.GetHmacKeyVersion())
-		if s, ok := signers[signer]; ok {
-			key = s.HmacKey
-		} else {
+	if digest == nil {
+		return true
+	}
+	signer := fmt.Sprintf("%s_%d", header.GetHmacSigner(),
+		header.GetHmacKeyVersion())
+	s, ok := signers[signer]
+	if !ok {
+		return false
+	}
+
+	function := header.GetHmacHashFunction()
+	if s.hashes != nil && !s.hashes[function] {
+		return false
+	}
+	if function == Header_ED25519 {
+		if s.publicKey == nil || !ed25519.Verify(s.publicKey, pack.MsgBytes, digest) {
 			return false
 		}
-
-		var hm hash.Hash
-		switch header.GetHmacHashFunction() {
-		case Header_MD5:
-			hm = hmac.New(md5.New, []byte(key))
-		case Header_SHA1:
-			hm = hmac.New(sha1.New, []byte(key))
+	} else {
+		// A signer w/ a public key has no HMAC key, accepting an HMAC would
+		// let anyone sign as it.
+		if s.publicKey != nil {
+			return false
+		}
+		hm := NewHmac(function, []byte(s.HmacKey))
+		if hm == nil {
+			return false
 		}
 		hm.Write(pack.MsgBytes)
-		expectedDigest := hm.Sum(nil)
-		if bytes.Compare(digest, expectedDigest) != 0 {
+		if !hmac.Equal(digest, hm.Sum(nil)) {
 			return false
 		}
-		pack.Signer = header.GetHmacSigner()
 	}
+	pack.Signer = header.GetHmacSigner()
 	return true
 }
 
+// Hands authenticated messages to the decoder for their encoding. Each of the
+// messages in a batch gets a pack of its own from the input's supply.
+type messageDispatcher struct {
+	signers      map[string]Signer
+	decoders     DecoderSet
+	ir           InputRunner
+	authFailures *int64
+	batch        []byte
+	batchHeader  *Header
+}
+
+func newMessageDispatcher(signers map[string]Signer, decoders DecoderSet,
+	ir InputRunner, authFailures *int64) *messageDispatcher {
+
+	return &messageDispatcher{
+		signers:      signers,
+		decoders:     decoders,
+		ir:           ir,
+		authFailures: authFailures,
+		batchHeader:  new(Header),
+	}
+}
+
+// Authenticates the message, counting it and recycling its pack if it fails.
+func (d *messageDispatcher) authenticate(header *Header, pack *PipelinePack) bool {
+	if authenticateMessage(d.signers, header, pack) {
+		return true
+	}
+	atomic.AddInt64(d.authFailures, 1)
+	pack.Recycle()
+	return false
+}
+
+func (d *messageDispatcher) dispatch(header *Header, pack *PipelinePack) {
+	if !d.authenticate(header, pack) {
+		return
+	}
+	if !header.GetBatch() {
+		d.decode(header, pack)
+		return
+	}
+
+	// Free the batch's pack before taking the ones for its messages.
+	d.batch = append(d.batch[:0], pack.MsgBytes...)
+	signer, commonName := pack.Signer, pack.ClientCommonName
+	pack.Recycle()
+
+	var (
+		pos, n int
+		ok     bool
+	)
+	for pos < len(d.batch) {
+		pack = <-d.ir.InChan()
+		d.batchHeader.Reset()
+		n, ok = findMessage(d.batch[pos:], d.batchHeader, &pack.MsgBytes)
+		if n == 0 {
+			// Truncated message.
+			pack.Recycle()
+			break
+		}
+		pos += n
+		if !ok || d.batchHeader.GetBatch() {
+			pack.Recycle()
+			continue
+		}
+		pack.ClientCommonName = commonName
+		if !d.authenticate(d.batchHeader, pack) {
+			continue
+		}
+		if pack.Signer == "" {
+			pack.Signer = signer
+		}
+		d.decode(d.batchHeader, pack)
+	}
+}
+
+func (d *messageDispatcher) decode(header *Header, pack *PipelinePack) {
+	if decoder, ok := d.decoders.ByEncoding(header.GetMessageEncoding()); ok {
+		decoder.InChan() <- pack
+	} else {
+		pack.Recycle()
+	}
+}
+
 func (self *TcpInput) handleConnection(conn net.Conn) {
 	buf := make([]byte, MAX_MESSAGE_SIZE+MAX_HEADER_SIZE+3)
 	header := &Header{}
 	var (
 		readPos, scanPos, posDelta int
 		pack                       *PipelinePack
-		encoding                   Header_MessageEncoding
-		decoder                    DecoderRunner
 		ok, stopped                bool
 	)
 
 	packSupply := self.ir.InChan()
-	decoders := self.h.DecoderSet()
+	dispatcher := newMessageDispatcher(self.config.Signers, self.h.DecoderSet(),
+		self.ir, &self.authFailures)
+
+	var commonName string
+	if tlsConn, isTls := conn.(*tls.Conn); isTls {
+		commonName = peerCommonName(tlsConn)
+	}
 
 	for !stopped {
 		select {
@@ -332,22 +517,13 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 					scanPos += posDelta
 
 					// Recycle pack and bail if incomplete header or incomplete message.
-					if header.MessageLength == nil ||
-						header.GetMessageLength() != uint32(len(pack.MsgBytes)) {
+					if header.MessageLength == nil || (!ok && posDelta == 0) {
 						pack.Recycle()
 						break
 					}
 					if ok {
-						if authenticateMessage(self.config.Signers, header, pack) {
-							encoding = header.GetMessageEncoding()
-							if decoder, ok = decoders.ByEncoding(encoding); ok {
-								decoder.InChan() <- pack
-							} else {
-								pack.Recycle()
-							}
-						} else {
-							pack.Recycle()
-						}
+						pack.ClientCommonName = commonName
+						dispatcher.dispatch(header, pack)
 					} else {
 						pack.Recycle()
 					}
@@ -371,6 +547,9 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 			}
 		}
 	}
+	self.connsLock.Lock()
+	delete(self.conns, conn)
+	self.connsLock.Unlock()
 	conn.Close()
 	self.wg.Done()
 }
@@ -378,10 +557,22 @@ func (self *TcpInput) handleConnection(conn net.Conn) {
 func (self *TcpInput) Init(config interface{}) error {
 	var err error
 	self.config = config.(*TcpInputConfig)
+	self.conns = make(map[net.Conn]bool)
+	if err = initSigners(self.config.Signers); err != nil {
+		return err
+	}
 	self.listener, err = net.Listen("tcp", self.config.Address)
 	if err != nil {
 		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
 	}
+	if self.config.UseTls {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = self.config.Tls.ServerConfig(); err != nil {
+			self.listener.Close()
+			return err
+		}
+		self.listener = tls.NewListener(self.listener, tlsConfig)
+	}
 	return nil
 }
 
@@ -402,6 +593,14 @@ func (self *TcpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 				break
 			}
 		}
+		self.connsLock.Lock()
+		if self.stopped() {
+			self.connsLock.Unlock()
+			conn.Close()
+			break
+		}
+		self.conns[conn] = true
+		self.connsLock.Unlock()
 		self.wg.Add(1)
 		go self.handleConnection(conn)
 	}
@@ -411,5 +610,23 @@ func (self *TcpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 
 func (self *TcpInput) Stop() {
 	self.listener.Close()
+	self.connsLock.Lock()
 	close(self.stopChan)
+	for conn := range self.conns {
+		conn.Close()
+	}
+	self.connsLock.Unlock()
+}
+
+func (self *TcpInput) stopped() bool {
+	select {
+	case <-self.stopChan:
+		return true
+	default:
+	}
+	return false
+}
+
+func (self *TcpInput) AuthFailures() int64 {
+	return atomic.LoadInt64(&self.authFailures)
 }
@@ -17,15 +17,31 @@ package pipeline
 import (
 	"code.google.com/p/gomock/gomock"
 	"code.google.com/p/goprotobuf/proto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path"
 	"sync"
 	"time"
 )
@@ -68,6 +84,76 @@ func getPayloadBytes(hbytes, mbytes []byte) func(msgBytes []byte) {
 	}
 }
 
+// Writes a CA and server and client key pairs signed by it to `dir`.
+func writeTestCerts(dir string) (err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "heka-test-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return
+	}
+	if err = writePem(path.Join(dir, "ca.pem"), "CERTIFICATE", caDer); err != nil {
+		return
+	}
+
+	for i, name := range []string{"server", "client"} {
+		var key *ecdsa.PrivateKey
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: "heka-" + name},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+			DNSNames:     []string{"localhost"},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+				x509.ExtKeyUsageClientAuth},
+		}
+		var der, keyDer []byte
+		if der, err = x509.CreateCertificate(rand.Reader, template, caCert,
+			&key.PublicKey, caKey); err != nil {
+			return
+		}
+		if keyDer, err = x509.MarshalECPrivateKey(key); err != nil {
+			return
+		}
+		if err = writePem(path.Join(dir, name+".pem"), "CERTIFICATE", der); err != nil {
+			return
+		}
+		if err = writePem(path.Join(dir, name+".key"), "EC PRIVATE KEY", keyDer); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writePem(filename, blockType string, der []byte) error {
+	return ioutil.WriteFile(filename,
+		pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
+
 func InputsSpec(c gs.Context) {
 	t := &ts.SimpleT{}
 	ctrl := gomock.NewController(t)
@@ -92,7 +178,10 @@ func InputsSpec(c gs.Context) {
 	ith.DecodeChan = make(chan *PipelinePack)
 	ith.MockDecoderSet = NewMockDecoderSet(ctrl)
 	key := "testkey"
-	signers := map[string]Signer{"test_1": {key}}
+	signers := map[string]Signer{"test_1": {HmacKey: key}}
+	edKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	signers["ed_1"] = Signer{PublicKey: base64.StdEncoding.EncodeToString(
+		edKey.Public().(ed25519.PublicKey))}
 	signer := "test"
 
 	c.Specify("A UdpInput", func() {
@@ -185,7 +274,7 @@ func InputsSpec(c gs.Context) {
 
 	c.Specify("A TcpInput", func() {
 		tcpInput := TcpInput{}
-		err := tcpInput.Init(&TcpInputConfig{ith.AddrStr, signers})
+		err := tcpInput.Init(&TcpInputConfig{Address: ith.AddrStr, Signers: signers})
 		c.Assume(err, gs.IsNil)
 		realListener := tcpInput.listener
 		c.Expect(realListener.Addr().String(), gs.Equals, ith.ResolvedAddrStr)
@@ -234,6 +323,61 @@ func InputsSpec(c gs.Context) {
 			c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
 		})
 
+		c.Specify("reads a compressed message from its connection", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			compressed, e := message.Compress(message.Header_GZIP, nil, mbytes)
+			c.Assume(e, gs.IsNil)
+			header.SetCompression(message.Header_GZIP)
+			header.SetMessageLength(uint32(len(compressed)))
+			hbytes, _ := proto.Marshal(header)
+			buflen := 3 + len(hbytes) + len(compressed)
+			readCall.Return(buflen, err)
+			readCall.Do(getPayloadBytes(hbytes, compressed))
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			ith.PackSupply <- ith.Pack
+			packRef := <-ith.DecodeChan
+			c.Expect(ith.Pack, gs.Equals, packRef)
+			c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
+		})
+
+		c.Specify("reads a compressed batch of messages from its connection", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true).Times(2)
+			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply).Times(2)
+			mockDecoderRunner.EXPECT().InChan().Return(ith.DecodeChan)
+			encoder := client.NewProtobufEncoder(nil)
+			var records, record, frame []byte
+			for i := 0; i < 2; i++ {
+				e := encoder.EncodeMessageStream(ith.Msg, &record)
+				c.Assume(e, gs.IsNil)
+				records = append(records, record...)
+			}
+			e := client.CreateBatchStream(records, message.Header_SNAPPY, &frame, nil)
+			c.Assume(e, gs.IsNil)
+			readCall.Return(len(frame), err)
+			readCall.Do(func(buf []byte) {
+				copy(buf, frame)
+			})
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			packs := []*PipelinePack{ith.Pack, NewPipelinePack(config.inputRecycleChan),
+				NewPipelinePack(config.inputRecycleChan)}
+			go func() {
+				for _, pack := range packs {
+					ith.PackSupply <- pack
+				}
+			}()
+			for _, pack := range packs[1:] {
+				packRef := <-ith.DecodeChan
+				c.Expect(packRef, gs.Equals, pack)
+				c.Expect(string(packRef.MsgBytes), gs.Equals, string(mbytes))
+			}
+		})
+
 		c.Specify("reads a MD5 signed message from its connection", func() {
 			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
 			pbcall.Return(mockDecoderRunner, true)
@@ -300,6 +444,82 @@ func InputsSpec(c gs.Context) {
 			}
 		})
 
+		c.Specify("reads a SHA256 signed message from its connection", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			header.SetHmacHashFunction(message.Header_SHA256)
+			header.SetHmacSigner(signer)
+			header.SetHmacKeyVersion(uint32(1))
+			hm := hmac.New(sha256.New, []byte(key))
+			hm.Write(mbytes)
+			header.SetHmac(hm.Sum(nil))
+			hbytes, _ := proto.Marshal(header)
+			buflen := 3 + len(hbytes) + len(mbytes)
+			readCall.Return(buflen, err)
+			readCall.Do(getPayloadBytes(hbytes, mbytes))
+
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			ith.PackSupply <- ith.Pack
+			packRef := <-ith.DecodeChan
+			c.Expect(ith.Pack, gs.Equals, packRef)
+			c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
+			c.Expect(ith.Pack.Signer, gs.Equals, "test")
+		})
+
+		c.Specify("reads an Ed25519 signed message from its connection", func() {
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			header.SetHmacHashFunction(message.Header_ED25519)
+			header.SetHmacSigner("ed")
+			header.SetHmacKeyVersion(uint32(1))
+			header.SetHmac(ed25519.Sign(edKey, mbytes))
+			hbytes, _ := proto.Marshal(header)
+			buflen := 3 + len(hbytes) + len(mbytes)
+			readCall.Return(buflen, err)
+			readCall.Do(getPayloadBytes(hbytes, mbytes))
+
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			ith.PackSupply <- ith.Pack
+			packRef := <-ith.DecodeChan
+			c.Expect(ith.Pack, gs.Equals, packRef)
+			c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
+			c.Expect(ith.Pack.Signer, gs.Equals, "ed")
+		})
+
+		c.Specify("rejects an HMAC signed message from an Ed25519 signer", func() {
+			header.SetHmacHashFunction(message.Header_SHA256)
+			header.SetHmacSigner("ed")
+			header.SetHmacKeyVersion(uint32(1))
+			hm := hmac.New(sha256.New, nil)
+			hm.Write(mbytes)
+			header.SetHmac(hm.Sum(nil))
+			hbytes, _ := proto.Marshal(header)
+			buflen := 3 + len(hbytes) + len(mbytes)
+			readCall.Return(buflen, err)
+			readCall.Do(getPayloadBytes(hbytes, mbytes))
+
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			ith.PackSupply <- ith.Pack
+			timeout := make(chan bool)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				timeout <- true
+			}()
+			select {
+			case packRef := <-mockDecoderRunner.InChan():
+				c.Expect(packRef, gs.IsNil)
+			case t := <-timeout:
+				c.Expect(t, gs.IsTrue)
+			}
+			c.Expect(tcpInput.AuthFailures(), gs.Equals, int64(1))
+		})
+
 		c.Specify("reads a signed message with an expired key from its connection", func() {
 			header.SetHmacHashFunction(message.Header_MD5)
 			header.SetHmacSigner(signer)
@@ -356,7 +576,115 @@ func InputsSpec(c gs.Context) {
 			case t := <-timeout:
 				c.Expect(t, gs.IsTrue)
 			}
+			c.Expect(tcpInput.AuthFailures(), gs.Equals, int64(1))
+		})
+	})
+
+	c.Specify("A TcpInput w/ TLS", func() {
+		certDir := path.Join(os.TempDir(),
+			fmt.Sprintf("tls-test-%d", time.Now().UnixNano()))
+		defer os.RemoveAll(certDir)
+		err := writeTestCerts(certDir)
+		c.Assume(err, gs.IsNil)
+
+		tcpInput := TcpInput{}
+		inputConfig := &TcpInputConfig{
+			Address: "localhost:0",
+			UseTls:  true,
+			Tls: TlsConfig{
+				CertFile:          path.Join(certDir, "server.pem"),
+				KeyFile:           path.Join(certDir, "server.key"),
+				CaFile:            path.Join(certDir, "ca.pem"),
+				RequireClientCert: true,
+			},
+		}
+		err = tcpInput.Init(inputConfig)
+		c.Assume(err, gs.IsNil)
+		defer tcpInput.listener.Close()
+
+		clientTls := &TlsConfig{
+			CertFile:   path.Join(certDir, "client.pem"),
+			KeyFile:    path.Join(certDir, "client.key"),
+			CaFile:     path.Join(certDir, "ca.pem"),
+			ServerName: "localhost",
+		}
+		clientConfig, err := clientTls.ClientConfig()
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("requires a server certificate", func() {
+			inputConfig.Tls.CertFile = ""
+			err := new(TcpInput).Init(inputConfig)
+			c.Expect(err, gs.Not(gs.IsNil))
 		})
+
+		c.Specify("exposes the client certificate's common name", func() {
+			mockDecoderRunner := ith.Decoders[message.Header_PROTOCOL_BUFFER].(*MockDecoderRunner)
+			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply)
+			ith.MockHelper.EXPECT().DecoderSet().Return(ith.MockDecoderSet)
+			pbcall := ith.MockDecoderSet.EXPECT().ByEncoding(message.Header_PROTOCOL_BUFFER)
+			pbcall.Return(mockDecoderRunner, true)
+			mockDecoderRunner.EXPECT().InChan().Return(ith.DecodeChan)
+			go tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+
+			conn, err := tls.Dial("tcp", tcpInput.listener.Addr().String(),
+				clientConfig)
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			record := make([]byte, 0, 1000)
+			pack := NewPipelinePack(config.inputRecycleChan)
+			pack.Message = ith.Msg
+			err = createProtobufStream(pack, &record)
+			c.Assume(err, gs.IsNil)
+			_, err = conn.Write(record)
+			c.Assume(err, gs.IsNil)
+
+			ith.PackSupply <- ith.Pack
+			packRef := <-ith.DecodeChan
+			c.Expect(packRef.ClientCommonName, gs.Equals, "heka-client")
+			c.Expect(packRef.Signer, gs.Equals, "")
+		})
+
+		c.Specify("rejects clients w/o a certificate", func() {
+			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply).AnyTimes()
+			ith.MockHelper.EXPECT().DecoderSet().Return(ith.MockDecoderSet).AnyTimes()
+			go tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			clientConfig.Certificates = nil
+			conn, err := tls.Dial("tcp", tcpInput.listener.Addr().String(),
+				clientConfig)
+			if err == nil {
+				// TLS 1.3 reports the rejection on the first read.
+				_, err = conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A TcpInput w/ an idle connection stops", func() {
+		tcpInput := TcpInput{}
+		err := tcpInput.Init(&TcpInputConfig{Address: "localhost:0"})
+		c.Assume(err, gs.IsNil)
+		ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply)
+		ith.MockHelper.EXPECT().DecoderSet().Return(ith.MockDecoderSet)
+		done := make(chan error)
+		go func() {
+			done <- tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+		}()
+
+		conn, err := net.Dial("tcp", tcpInput.listener.Addr().String())
+		c.Assume(err, gs.IsNil)
+		defer conn.Close()
+		// Give Run time to accept the connection and start reading from it.
+		time.Sleep(50 * time.Millisecond)
+		tcpInput.Stop()
+
+		var returned bool
+		select {
+		case <-done:
+			returned = true
+		case <-time.After(time.Second):
+		}
+		c.Expect(returned, gs.IsTrue)
 	})
 
 	c.Specify("Runner recovers from panic in input's `Run()` method", func() {
@@ -0,0 +1,709 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+// Just enough of the Kafka 0.8 wire protocol for the KafkaInput and
+// KafkaOutput to produce to and consume from the partitions of a topic and
+// keep a consumer group's offsets. See
+// https://cwiki.apache.org/confluence/display/KAFKA/A+Guide+To+The+Kafka+Protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "github.com/mozilla-services/heka/message"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Message encodings the Kafka plugins can use for message values.
+var KafkaEncodings = map[string]Header_MessageEncoding{
+	"protobuf": Header_PROTOCOL_BUFFER,
+	"json":     Header_JSON,
+}
+
+// Request API keys.
+const (
+	kafkaProduceKey      int16 = 0
+	kafkaFetchKey        int16 = 1
+	kafkaOffsetsKey      int16 = 2
+	kafkaMetadataKey     int16 = 3
+	kafkaOffsetCommitKey int16 = 8
+	kafkaOffsetFetchKey  int16 = 9
+	kafkaCoordinatorKey  int16 = 10
+)
+
+// Times for an offsets request that ask for the offset of the next message
+// to be produced or of the oldest message still kept.
+const (
+	kafkaNewestOffset int64 = -1
+	kafkaOldestOffset int64 = -2
+)
+
+// An error code returned by a broker.
+type kafkaError int16
+
+const (
+	kafkaOffsetOutOfRange kafkaError = 1
+	kafkaMessageTooLarge  kafkaError = 10
+)
+
+var kafkaErrorMessages = map[kafkaError]string{
+	-1: "unknown error",
+	1:  "offset out of range",
+	2:  "invalid message",
+	3:  "unknown topic or partition",
+	4:  "invalid message size",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	8:  "broker not available",
+	9:  "replica not available",
+	10: "message size too large",
+	12: "offset metadata too large",
+	14: "offsets load in progress",
+	15: "consumer coordinator not available",
+	16: "not coordinator for consumer",
+}
+
+func (e kafkaError) Error() string {
+	if msg, ok := kafkaErrorMessages[e]; ok {
+		return "kafka: " + msg
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// Returns whether an error might go away after the topic's metadata is
+// refreshed or the request is retried.
+func kafkaRetriable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code, ok := err.(kafkaError); ok {
+		switch code {
+		case 3, 5, 6, 7, 8, 14, 15, 16:
+			return true
+		}
+		return false
+	}
+	// Network errors and the like.
+	return true
+}
+
+func kafkaErr(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return kafkaError(code)
+}
+
+var errKafkaShort = errors.New("kafka: response is too short")
+
+// Builds a request or response.
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) putInt8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *kafkaEncoder) putInt16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) putInt32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) putInt64(v int64) {
+	e.putInt32(int32(v >> 32))
+	e.putInt32(int32(v))
+}
+
+func (e *kafkaEncoder) putString(s string) {
+	e.putInt16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// A nil slice is encoded as null.
+func (e *kafkaEncoder) putBytes(b []byte) {
+	if b == nil {
+		e.putInt32(-1)
+		return
+	}
+	e.putInt32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// Reads a request or response. The first read past the end sets `err`, and
+// every read after returns zero values.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errKafkaShort
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) getInt8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getInt16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getInt32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getInt64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) getString() string {
+	n := d.getInt16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) getBytes() []byte {
+	n := d.getInt32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// Reads the length of an array, which can't have more elements than there
+// are bytes left.
+func (d *kafkaDecoder) getArrayLen() int {
+	n := int(d.getInt32())
+	if n > len(d.buf) {
+		d.err = errKafkaShort
+	}
+	if d.err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+type kafkaMessage struct {
+	Offset int64
+	Key    []byte
+	Value  []byte
+}
+
+// Appends a message set, preceded by its size.
+func (e *kafkaEncoder) putMessageSet(msgs []kafkaMessage) {
+	setAt := len(e.buf)
+	e.putInt32(0)
+	for _, msg := range msgs {
+		e.putInt64(msg.Offset)
+		sizeAt := len(e.buf)
+		e.putInt32(0)
+		crcAt := len(e.buf)
+		e.putInt32(0)
+		e.putInt8(0) // Magic byte.
+		e.putInt8(0) // Attributes, i.e. no compression.
+		e.putBytes(msg.Key)
+		e.putBytes(msg.Value)
+		binary.BigEndian.PutUint32(e.buf[crcAt:],
+			crc32.ChecksumIEEE(e.buf[crcAt+4:]))
+		binary.BigEndian.PutUint32(e.buf[sizeAt:], uint32(len(e.buf)-crcAt))
+	}
+	binary.BigEndian.PutUint32(e.buf[setAt:], uint32(len(e.buf)-setAt-4))
+}
+
+// Parses a message set. A broker may cut the last message of a fetched set
+// short, so a partial message at the end is ignored, unless there's no whole
+// message before it as then it's larger than the fetch size.
+func parseMessageSet(data []byte) (msgs []kafkaMessage, err error) {
+	d := &kafkaDecoder{buf: data}
+	for len(d.buf) >= 12 {
+		offset := d.getInt64()
+		size := int(d.getInt32())
+		if size > len(d.buf) {
+			break
+		}
+		m := &kafkaDecoder{buf: d.next(size)}
+		crc := uint32(m.getInt32())
+		if m.err == nil && crc32.ChecksumIEEE(m.buf) != crc {
+			return msgs, fmt.Errorf("kafka: message %d is corrupt", offset)
+		}
+		m.getInt8()
+		attributes := m.getInt8()
+		msg := kafkaMessage{Offset: offset, Key: m.getBytes(), Value: m.getBytes()}
+		if m.err != nil {
+			return msgs, fmt.Errorf("kafka: message %d is malformed", offset)
+		}
+		if attributes&0x07 != 0 {
+			return msgs, fmt.Errorf("kafka: message %d is compressed", offset)
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 && len(data) > 0 {
+		return nil, kafkaMessageTooLarge
+	}
+	return msgs, d.err
+}
+
+// A connection to a broker, over which one request is made at a time.
+type kafkaConn struct {
+	conn          net.Conn
+	clientId      string
+	timeout       time.Duration
+	correlationId int32
+}
+
+// Sends a request and returns a decoder for the body of its response.
+func (c *kafkaConn) request(apiKey, apiVersion int16, body []byte) (
+	d *kafkaDecoder, err error) {
+
+	c.correlationId++
+	e := &kafkaEncoder{buf: make([]byte, 0, len(body)+64)}
+	e.putInt32(0)
+	e.putInt16(apiKey)
+	e.putInt16(apiVersion)
+	e.putInt32(c.correlationId)
+	e.putString(c.clientId)
+	e.buf = append(e.buf, body...)
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err = c.conn.Write(e.buf); err != nil {
+		return
+	}
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(c.conn, header); err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint32(header)) - 4
+	if size < 0 || size > MAX_BATCH_SIZE*16 {
+		return nil, fmt.Errorf("kafka: response size %d is invalid", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != c.correlationId {
+		return nil, fmt.Errorf("kafka: response is for request %d, not %d", id,
+			c.correlationId)
+	}
+	d = &kafkaDecoder{buf: make([]byte, size)}
+	_, err = io.ReadFull(c.conn, d.buf)
+	return
+}
+
+type kafkaFetchResult struct {
+	Err       error
+	Messages  []kafkaMessage
+	HighWater int64
+}
+
+// Talks to the brokers of a Kafka cluster about a single topic.
+type kafkaClient struct {
+	brokers     []string // Addresses to ask for the topic's metadata.
+	clientId    string
+	topic       string
+	timeout     time.Duration
+	conns       map[string]*kafkaConn
+	partitions  []int32
+	leaders     map[int32]string // Address of each partition's leader.
+	coordinator string           // Address of the consumer group coordinator.
+}
+
+func newKafkaClient(brokers []string, clientId, topic string,
+	timeout time.Duration) *kafkaClient {
+
+	return &kafkaClient{
+		brokers:  brokers,
+		clientId: clientId,
+		topic:    topic,
+		timeout:  timeout,
+		conns:    make(map[string]*kafkaConn),
+		leaders:  make(map[int32]string),
+	}
+}
+
+// Makes a request of the broker at `addr`. The connection is closed if the
+// request fails, to be redialed next time.
+func (c *kafkaClient) request(addr string, apiKey, apiVersion int16,
+	body *kafkaEncoder) (d *kafkaDecoder, err error) {
+
+	conn, ok := c.conns[addr]
+	if !ok {
+		var netConn net.Conn
+		if netConn, err = net.DialTimeout("tcp", addr, c.timeout); err != nil {
+			return
+		}
+		conn = &kafkaConn{conn: netConn, clientId: c.clientId, timeout: c.timeout}
+		c.conns[addr] = conn
+	}
+	if d, err = conn.request(apiKey, apiVersion, body.buf); err != nil {
+		conn.conn.Close()
+		delete(c.conns, addr)
+	}
+	return
+}
+
+func (c *kafkaClient) Close() {
+	for addr, conn := range c.conns {
+		conn.conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+// Asks each broker in turn for the topic's partitions and their leaders
+// until one answers.
+func (c *kafkaClient) refreshMetadata() (err error) {
+	body := new(kafkaEncoder)
+	body.putInt32(1)
+	body.putString(c.topic)
+	for _, addr := range c.brokers {
+		var d *kafkaDecoder
+		if d, err = c.request(addr, kafkaMetadataKey, 0, body); err != nil {
+			continue
+		}
+		if err = c.parseMetadata(d); err == nil {
+			return
+		}
+	}
+	return fmt.Errorf("kafka: can't get metadata for %s: %s", c.topic, err)
+}
+
+func (c *kafkaClient) parseMetadata(d *kafkaDecoder) (err error) {
+	brokers := make(map[int32]string)
+	for i := d.getArrayLen(); i > 0; i-- {
+		id := d.getInt32()
+		host := d.getString()
+		port := d.getInt32()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	var (
+		partitions []int32
+		leaders    = make(map[int32]string)
+	)
+	for i := d.getArrayLen(); i > 0; i-- {
+		code := d.getInt16()
+		name := d.getString()
+		if name == c.topic && code != 0 {
+			err = kafkaErr(code)
+		}
+		for j := d.getArrayLen(); j > 0; j-- {
+			d.getInt16() // A replica may be down w/o affecting the leader.
+			id := d.getInt32()
+			leader := d.getInt32()
+			for k := d.getArrayLen(); k > 0; k-- {
+				d.getInt32()
+			}
+			for k := d.getArrayLen(); k > 0; k-- {
+				d.getInt32()
+			}
+			if name != c.topic {
+				continue
+			}
+			partitions = append(partitions, id)
+			if addr, ok := brokers[leader]; ok {
+				leaders[id] = addr
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if err != nil {
+		return
+	}
+	if len(partitions) == 0 {
+		return kafkaError(3)
+	}
+	sort.Sort(int32Slice(partitions))
+	c.partitions = partitions
+	c.leaders = leaders
+	return
+}
+
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (c *kafkaClient) leader(partition int32) (addr string, err error) {
+	addr, ok := c.leaders[partition]
+	if !ok {
+		err = kafkaError(5)
+	}
+	return
+}
+
+// Sends messages to a partition's leader and waits for `acks` replicas to
+// have them.
+func (c *kafkaClient) produce(partition int32, acks int16,
+	msgs []kafkaMessage) (err error) {
+
+	addr, err := c.leader(partition)
+	if err != nil {
+		return
+	}
+	body := new(kafkaEncoder)
+	body.putInt16(acks)
+	body.putInt32(int32(c.timeout / time.Millisecond))
+	body.putInt32(1)
+	body.putString(c.topic)
+	body.putInt32(1)
+	body.putInt32(partition)
+	body.putMessageSet(msgs)
+	d, err := c.request(addr, kafkaProduceKey, 0, body)
+	if err != nil {
+		return
+	}
+	err = kafkaError(3)
+	for i := d.getArrayLen(); i > 0; i-- {
+		d.getString()
+		for j := d.getArrayLen(); j > 0; j-- {
+			if d.getInt32() == partition {
+				err = kafkaErr(d.getInt16())
+			} else {
+				d.getInt16()
+			}
+			d.getInt64()
+		}
+	}
+	if d.err != nil {
+		err = d.err
+	}
+	return
+}
+
+// Fetches messages from partitions led by the broker at `addr`, starting at
+// the given offsets. The broker waits up to `maxWait` for there to be any.
+func (c *kafkaClient) fetch(addr string, offsets map[int32]int64,
+	maxWait time.Duration, maxBytes int32) (results map[int32]*kafkaFetchResult,
+	err error) {
+
+	body := new(kafkaEncoder)
+	body.putInt32(-1) // Replica id, -1 for a consumer.
+	body.putInt32(int32(maxWait / time.Millisecond))
+	body.putInt32(1) // Minimum bytes.
+	body.putInt32(1)
+	body.putString(c.topic)
+	body.putInt32(int32(len(offsets)))
+	for partition, offset := range offsets {
+		body.putInt32(partition)
+		body.putInt64(offset)
+		body.putInt32(maxBytes)
+	}
+	d, err := c.request(addr, kafkaFetchKey, 0, body)
+	if err != nil {
+		return
+	}
+	results = make(map[int32]*kafkaFetchResult)
+	for i := d.getArrayLen(); i > 0; i-- {
+		d.getString()
+		for j := d.getArrayLen(); j > 0; j-- {
+			partition := d.getInt32()
+			result := &kafkaFetchResult{Err: kafkaErr(d.getInt16())}
+			result.HighWater = d.getInt64()
+			set := d.getBytes()
+			if result.Err == nil && d.err == nil {
+				result.Messages, result.Err = parseMessageSet(set)
+			}
+			results[partition] = result
+		}
+	}
+	return results, d.err
+}
+
+// Returns the offset of the newest or oldest message in a partition.
+func (c *kafkaClient) offset(partition int32, when int64) (offset int64,
+	err error) {
+
+	addr, err := c.leader(partition)
+	if err != nil {
+		return
+	}
+	body := new(kafkaEncoder)
+	body.putInt32(-1)
+	body.putInt32(1)
+	body.putString(c.topic)
+	body.putInt32(1)
+	body.putInt32(partition)
+	body.putInt64(when)
+	body.putInt32(1) // Maximum number of offsets.
+	d, err := c.request(addr, kafkaOffsetsKey, 0, body)
+	if err != nil {
+		return
+	}
+	err = kafkaError(3)
+	for i := d.getArrayLen(); i > 0; i-- {
+		d.getString()
+		for j := d.getArrayLen(); j > 0; j-- {
+			id := d.getInt32()
+			code := d.getInt16()
+			for k := d.getArrayLen(); k > 0; k-- {
+				if o := d.getInt64(); id == partition && code == 0 {
+					offset, err = o, nil
+				}
+			}
+			if id == partition && code != 0 {
+				err = kafkaErr(code)
+			}
+		}
+	}
+	if d.err != nil {
+		err = d.err
+	}
+	return
+}
+
+// Makes a request of the broker that keeps `group`'s offsets, which is
+// looked up first if need be.
+func (c *kafkaClient) groupRequest(group string, apiKey, apiVersion int16,
+	body *kafkaEncoder) (d *kafkaDecoder, err error) {
+
+	if c.coordinator == "" {
+		req := new(kafkaEncoder)
+		req.putString(group)
+		for _, addr := range c.brokers {
+			if d, err = c.request(addr, kafkaCoordinatorKey, 0, req); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return
+		}
+		err = kafkaErr(d.getInt16())
+		d.getInt32()
+		host := d.getString()
+		port := d.getInt32()
+		if d.err != nil {
+			err = d.err
+		}
+		if err != nil {
+			return
+		}
+		c.coordinator = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	if d, err = c.request(c.coordinator, apiKey, apiVersion, body); err != nil {
+		c.coordinator = ""
+	}
+	return
+}
+
+// Returns the offsets `group` has committed for the given partitions, -1
+// for those it hasn't.
+func (c *kafkaClient) fetchOffsets(group string, partitions []int32) (
+	offsets map[int32]int64, err error) {
+
+	body := new(kafkaEncoder)
+	body.putString(group)
+	body.putInt32(1)
+	body.putString(c.topic)
+	body.putInt32(int32(len(partitions)))
+	for _, partition := range partitions {
+		body.putInt32(partition)
+	}
+	d, err := c.groupRequest(group, kafkaOffsetFetchKey, 1, body)
+	if err != nil {
+		return
+	}
+	offsets = make(map[int32]int64)
+	for i := d.getArrayLen(); i > 0; i-- {
+		d.getString()
+		for j := d.getArrayLen(); j > 0; j-- {
+			partition := d.getInt32()
+			offset := d.getInt64()
+			d.getString()
+			if e := kafkaErr(d.getInt16()); e != nil && e != kafkaError(3) {
+				err = e
+			}
+			offsets[partition] = offset
+		}
+	}
+	if d.err != nil {
+		err = d.err
+	}
+	if kafkaRetriable(err) {
+		c.coordinator = ""
+	}
+	return
+}
+
+// Commits `group`'s offsets, each the offset of the next message to be
+// consumed from its partition.
+func (c *kafkaClient) commitOffsets(group string, offsets map[int32]int64) (
+	err error) {
+
+	body := new(kafkaEncoder)
+	body.putString(group)
+	body.putInt32(-1) // Generation id, -1 when the group isn't managed.
+	body.putString("")
+	body.putInt32(1)
+	body.putString(c.topic)
+	body.putInt32(int32(len(offsets)))
+	for partition, offset := range offsets {
+		body.putInt32(partition)
+		body.putInt64(offset)
+		body.putInt64(-1) // Timestamp, -1 for the broker's time.
+		body.putString("")
+	}
+	d, err := c.groupRequest(group, kafkaOffsetCommitKey, 1, body)
+	if err != nil {
+		return
+	}
+	for i := d.getArrayLen(); i > 0; i-- {
+		d.getString()
+		for j := d.getArrayLen(); j > 0; j-- {
+			d.getInt32()
+			if e := kafkaErr(d.getInt16()); e != nil {
+				err = e
+			}
+		}
+	}
+	if d.err != nil {
+		err = d.err
+	}
+	if kafkaRetriable(err) {
+		c.coordinator = ""
+	}
+	return
+}
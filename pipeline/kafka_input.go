@@ -0,0 +1,312 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"time"
+)
+
+type KafkaInputConfig struct {
+	// Addresses of brokers to ask for the topic's partitions and leaders.
+	Brokers []string
+	Topic   string
+	// Name the input identifies itself w/ to the brokers.
+	ClientId string `toml:"client_id"`
+	// Consumer group whose offsets are committed as messages are consumed.
+	Group string
+	// Partitions to consume, all of the topic's if empty.
+	Partitions []int32
+	// Where to start consuming a partition the group has no offset for, or
+	// whose offset is no longer available: newest or oldest.
+	OffsetReset string `toml:"offset_reset"`
+	// Encoding of the messages, protobuf or json.
+	Encoding string
+	// Milliseconds a broker may wait for new messages before answering a
+	// fetch.
+	MaxWait uint `toml:"max_wait"`
+	// Maximum bytes of messages fetched from a partition at once.
+	MaxBytes int32 `toml:"max_bytes"`
+	// Milliseconds between commits of the group's offsets.
+	CommitInterval uint `toml:"commit_interval"`
+	// Milliseconds to wait for a broker to respond, on top of max_wait.
+	Timeout uint
+	// Milliseconds to wait before the first retry after an error. The delay
+	// doubles w/ each failed attempt.
+	RetryDelay uint `toml:"retry_delay"`
+	// Upper bound in milliseconds on the delay between retries.
+	MaxRetryDelay uint `toml:"max_retry_delay"`
+}
+
+// Consumes messages from the partitions of a Kafka topic, committing a
+// consumer group's offsets once the messages have been handed to the router.
+type KafkaInput struct {
+	config         *KafkaInputConfig
+	client         *kafkaClient
+	decoder        Decoder
+	maxWait        time.Duration
+	commitInterval time.Duration
+	backoff        *client.Backoff
+	offsets        map[int32]int64 // Next offset to consume from each partition.
+	committed      map[int32]int64
+	refresh        bool // Whether the topic's metadata needs refreshing.
+	ir             InputRunner
+	stopChan       chan bool
+}
+
+func (self *KafkaInput) ConfigStruct() interface{} {
+	return &KafkaInputConfig{
+		Brokers:        []string{"localhost:9092"},
+		ClientId:       "heka",
+		Group:          "heka",
+		OffsetReset:    "newest",
+		Encoding:       "protobuf",
+		MaxWait:        500,
+		MaxBytes:       1024 * 1024,
+		CommitInterval: 1000,
+		Timeout:        10000,
+		RetryDelay:     250,
+		MaxRetryDelay:  30000,
+	}
+}
+
+func (self *KafkaInput) Init(config interface{}) (err error) {
+	conf := config.(*KafkaInputConfig)
+	if len(conf.Brokers) == 0 || conf.Topic == "" || conf.Group == "" {
+		return fmt.Errorf("KafkaInput brokers, topic and group must be set")
+	}
+	switch conf.Encoding {
+	case "protobuf":
+		self.decoder = new(ProtobufDecoder)
+	case "json":
+		self.decoder = new(JsonDecoder)
+	default:
+		return fmt.Errorf("KafkaInput unsupported encoding: %s", conf.Encoding)
+	}
+	if conf.OffsetReset != "newest" && conf.OffsetReset != "oldest" {
+		return fmt.Errorf("KafkaInput offset_reset must be newest or oldest")
+	}
+	if conf.MaxBytes < 1 || conf.CommitInterval == 0 {
+		return fmt.Errorf("KafkaInput max_bytes and commit_interval must be " +
+			"greater than 0")
+	}
+	if conf.RetryDelay == 0 {
+		return fmt.Errorf("KafkaInput retry_delay must be greater than 0")
+	}
+	if conf.MaxRetryDelay < conf.RetryDelay {
+		return fmt.Errorf("KafkaInput max_retry_delay must be at least %d",
+			conf.RetryDelay)
+	}
+	self.config = conf
+	self.maxWait = time.Duration(conf.MaxWait) * time.Millisecond
+	self.client = newKafkaClient(conf.Brokers, conf.ClientId, conf.Topic,
+		self.maxWait+time.Duration(conf.Timeout)*time.Millisecond)
+	self.commitInterval = time.Duration(conf.CommitInterval) * time.Millisecond
+	self.backoff = client.NewBackoff(
+		time.Duration(conf.RetryDelay)*time.Millisecond,
+		time.Duration(conf.MaxRetryDelay)*time.Millisecond)
+	self.committed = make(map[int32]int64)
+	self.stopChan = make(chan bool)
+	return
+}
+
+func (self *KafkaInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	self.ir = ir
+	lastCommit := time.Now()
+	for !self.stopping() {
+		var e error
+		if self.offsets == nil {
+			e = self.start()
+		} else {
+			e = self.consume()
+		}
+		if time.Since(lastCommit) >= self.commitInterval {
+			self.commit()
+			lastCommit = time.Now()
+		}
+		if e == nil {
+			self.backoff.Reset()
+			continue
+		}
+		ir.LogError(e)
+		// The partitions' leaders may have moved.
+		self.refresh = true
+		select {
+		case <-self.stopChan:
+		case <-time.After(self.backoff.Next()):
+		}
+	}
+	self.commit()
+	self.client.Close()
+	return
+}
+
+func (self *KafkaInput) Stop() {
+	close(self.stopChan)
+}
+
+func (self *KafkaInput) stopping() bool {
+	select {
+	case <-self.stopChan:
+		return true
+	default:
+	}
+	return false
+}
+
+// Looks up the topic's partitions and where to start consuming each of them.
+func (self *KafkaInput) start() (err error) {
+	if err = self.client.refreshMetadata(); err != nil {
+		return
+	}
+	partitions := self.config.Partitions
+	if len(partitions) == 0 {
+		partitions = self.client.partitions
+	}
+	offsets, err := self.client.fetchOffsets(self.config.Group, partitions)
+	if err != nil {
+		return fmt.Errorf("fetching offsets for group %s: %s",
+			self.config.Group, err)
+	}
+	for _, partition := range partitions {
+		offset, ok := offsets[partition]
+		if !ok || offset < 0 {
+			if offset, err = self.resetOffset(partition); err != nil {
+				return
+			}
+		}
+		offsets[partition] = offset
+	}
+	self.offsets = offsets
+	return
+}
+
+// Returns where to start consuming a partition, according to offset_reset.
+func (self *KafkaInput) resetOffset(partition int32) (offset int64,
+	err error) {
+
+	when := kafkaNewestOffset
+	if self.config.OffsetReset == "oldest" {
+		when = kafkaOldestOffset
+	}
+	if offset, err = self.client.offset(partition, when); err != nil {
+		err = fmt.Errorf("getting offset for partition %d: %s", partition, err)
+	}
+	return
+}
+
+// Fetches messages from each leader in turn and injects them.
+func (self *KafkaInput) consume() (err error) {
+	if self.refresh {
+		if err = self.client.refreshMetadata(); err != nil {
+			return
+		}
+		self.refresh = false
+	}
+	byLeader := make(map[string]map[int32]int64)
+	for partition, offset := range self.offsets {
+		addr, e := self.client.leader(partition)
+		if e != nil {
+			return e
+		}
+		if byLeader[addr] == nil {
+			byLeader[addr] = make(map[int32]int64)
+		}
+		byLeader[addr][partition] = offset
+	}
+	for addr, offsets := range byLeader {
+		results, e := self.client.fetch(addr, offsets, self.maxWait,
+			self.config.MaxBytes)
+		if e != nil {
+			return e
+		}
+		for partition, result := range results {
+			if _, ok := offsets[partition]; !ok {
+				continue
+			}
+			if err = self.handleFetch(partition, result); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *KafkaInput) handleFetch(partition int32,
+	result *kafkaFetchResult) (err error) {
+
+	if result.Err == kafkaOffsetOutOfRange {
+		self.ir.LogError(fmt.Errorf("offset %d of partition %d is out of range",
+			self.offsets[partition], partition))
+		var offset int64
+		if offset, err = self.resetOffset(partition); err == nil {
+			self.offsets[partition] = offset
+		}
+		return
+	}
+	if result.Err == kafkaMessageTooLarge {
+		// Fetching again would only get the same part of it.
+		return fmt.Errorf("message %d of partition %d is larger than max_bytes, "+
+			"which must be raised above %d", self.offsets[partition], partition,
+			self.config.MaxBytes)
+	}
+	for _, msg := range result.Messages {
+		if msg.Offset < self.offsets[partition] {
+			continue
+		}
+		var pack *PipelinePack
+		select {
+		case pack = <-self.ir.InChan():
+		case <-self.stopChan:
+			return
+		}
+		pack.MsgBytes = append(pack.MsgBytes[:0], msg.Value...)
+		if e := self.decoder.Decode(pack); e != nil {
+			self.ir.LogError(fmt.Errorf("can't decode message %d of partition "+
+				"%d: %s", msg.Offset, partition, e))
+			pack.Recycle()
+		} else {
+			pack.Decoded = true
+			self.ir.Inject(pack)
+		}
+		self.offsets[partition] = msg.Offset + 1
+	}
+	if result.Err != nil {
+		err = fmt.Errorf("fetching from partition %d: %s", partition, result.Err)
+	}
+	return
+}
+
+// Commits the offsets of the messages injected since the last commit.
+func (self *KafkaInput) commit() {
+	changed := make(map[int32]int64)
+	for partition, offset := range self.offsets {
+		if committed, ok := self.committed[partition]; !ok || committed != offset {
+			changed[partition] = offset
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if e := self.client.commitOffsets(self.config.Group, changed); e != nil {
+		self.ir.LogError(fmt.Errorf("committing offsets for group %s: %s",
+			self.config.Group, e))
+		return
+	}
+	for partition, offset := range changed {
+		self.committed[partition] = offset
+	}
+}
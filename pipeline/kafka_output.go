@@ -0,0 +1,249 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+type KafkaOutputConfig struct {
+	// Addresses of brokers to ask for the topic's partitions and leaders.
+	Brokers []string
+	Topic   string
+	// Name the output identifies itself w/ to the brokers.
+	ClientId string `toml:"client_id"`
+	// Message header or field whose value is the key each message is
+	// partitioned by. Messages are spread over the partitions in turn if
+	// empty.
+	PartitionKey string `toml:"partition_key"`
+	// Encoding of the messages, protobuf or json.
+	Encoding string
+	// Number of replicas that must have a batch before it's acknowledged, or
+	// -1 for all of the in sync replicas.
+	RequiredAcks int `toml:"required_acks"`
+	// Send a partition's batch once it holds this many messages.
+	BatchCount int `toml:"batch_count"`
+	// Maximum milliseconds a partial batch waits before it's sent.
+	FlushInterval uint `toml:"flush_interval"`
+	// Milliseconds to wait for a broker to respond.
+	Timeout uint
+	// Milliseconds to wait before the first retry of a failed batch. The
+	// delay doubles w/ each failed attempt.
+	RetryDelay uint `toml:"retry_delay"`
+	// Upper bound in milliseconds on the delay between retries.
+	MaxRetryDelay uint `toml:"max_retry_delay"`
+}
+
+// Publishes messages to the partitions of a Kafka topic.
+type KafkaOutput struct {
+	config        *KafkaOutputConfig
+	client        *kafkaClient
+	encoder       client.Encoder
+	flushInterval time.Duration
+	backoff       *client.Backoff
+	batches       map[int32][]kafkaMessage
+	next          int // Partition index for messages w/o a key.
+	sentMessages  int64
+	dropped       int64
+	retries       int64
+}
+
+func (o *KafkaOutput) ConfigStruct() interface{} {
+	return &KafkaOutputConfig{
+		Brokers:       []string{"localhost:9092"},
+		ClientId:      "heka",
+		Encoding:      "protobuf",
+		RequiredAcks:  1,
+		BatchCount:    100,
+		FlushInterval: 1000,
+		Timeout:       10000,
+		RetryDelay:    250,
+		MaxRetryDelay: 30000,
+	}
+}
+
+func (o *KafkaOutput) Init(config interface{}) (err error) {
+	conf := config.(*KafkaOutputConfig)
+	if len(conf.Brokers) == 0 || conf.Topic == "" {
+		return fmt.Errorf("KafkaOutput brokers and topic must be set")
+	}
+	switch conf.Encoding {
+	case "protobuf":
+		o.encoder = client.NewProtobufEncoder(nil)
+	case "json":
+		o.encoder = client.NewJsonEncoder(nil)
+	default:
+		return fmt.Errorf("KafkaOutput unsupported encoding: %s", conf.Encoding)
+	}
+	if conf.RequiredAcks == 0 || conf.RequiredAcks < -1 ||
+		conf.RequiredAcks > 32767 {
+		return fmt.Errorf("KafkaOutput required_acks must be -1 or at least 1")
+	}
+	if conf.BatchCount < 1 || conf.FlushInterval == 0 {
+		return fmt.Errorf("KafkaOutput batch_count and flush_interval must " +
+			"be greater than 0")
+	}
+	if conf.RetryDelay == 0 {
+		return fmt.Errorf("KafkaOutput retry_delay must be greater than 0")
+	}
+	if conf.MaxRetryDelay < conf.RetryDelay {
+		return fmt.Errorf("KafkaOutput max_retry_delay must be at least %d",
+			conf.RetryDelay)
+	}
+	o.config = conf
+	o.client = newKafkaClient(conf.Brokers, conf.ClientId, conf.Topic,
+		time.Duration(conf.Timeout)*time.Millisecond)
+	o.flushInterval = time.Duration(conf.FlushInterval) * time.Millisecond
+	o.backoff = client.NewBackoff(
+		time.Duration(conf.RetryDelay)*time.Millisecond,
+		time.Duration(conf.MaxRetryDelay)*time.Millisecond)
+	o.batches = make(map[int32][]kafkaMessage)
+	return
+}
+
+func (o *KafkaOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		plc *PipelineCapture
+		ok  = true
+	)
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+	inChan := or.InChan()
+
+	for ok {
+		select {
+		case plc, ok = <-inChan:
+			if !ok {
+				break
+			}
+			value, e := o.encoder.EncodeMessage(plc.Pack.Message)
+			key := o.key(plc.Pack.Message)
+			plc.Pack.Recycle()
+			if e != nil {
+				or.LogError(fmt.Errorf("error encoding message: %s", e))
+				continue
+			}
+			if !o.waitForMetadata(or) {
+				// Shutting down.
+				atomic.AddInt64(&o.dropped, 1)
+				continue
+			}
+			partition := o.partition(key)
+			o.batches[partition] = append(o.batches[partition],
+				kafkaMessage{Key: key, Value: value})
+			if len(o.batches[partition]) >= o.config.BatchCount {
+				o.flush(or, partition)
+			}
+		case <-ticker.C:
+			o.flushAll(or)
+		}
+	}
+	o.flushAll(or)
+	o.client.Close()
+	return
+}
+
+// Returns the key a message is partitioned by, nil if it has none.
+func (o *KafkaOutput) key(msg *message.Message) []byte {
+	if o.config.PartitionKey == "" {
+		return nil
+	}
+	if value, ok := messageMatchSet(msg)[o.config.PartitionKey]; ok {
+		return []byte(value)
+	}
+	return nil
+}
+
+// Picks the partition for a message from a hash of its key, or the next
+// partition in turn if it has none.
+func (o *KafkaOutput) partition(key []byte) int32 {
+	partitions := o.client.partitions
+	if key == nil {
+		partition := partitions[o.next%len(partitions)]
+		o.next++
+		return partition
+	}
+	hash := fnv.New32a()
+	hash.Write(key)
+	return partitions[hash.Sum32()%uint32(len(partitions))]
+}
+
+// Fetches the topic's metadata if we don't have it yet, retrying until it
+// succeeds. Only gives up, returning false, when Heka is shutting down.
+func (o *KafkaOutput) waitForMetadata(or OutputRunner) bool {
+	for len(o.client.partitions) == 0 {
+		e := o.client.refreshMetadata()
+		if e == nil {
+			o.backoff.Reset()
+			break
+		}
+		or.LogError(e)
+		if Globals().Stopping {
+			return false
+		}
+		time.Sleep(o.backoff.Next())
+	}
+	return true
+}
+
+func (o *KafkaOutput) flushAll(or OutputRunner) {
+	for partition := range o.batches {
+		o.flush(or, partition)
+	}
+}
+
+// Sends a partition's batch, retrying w/ exponential backoff while the
+// errors may be temporary, refreshing the topic's metadata in case the
+// partition has a new leader. Only gives up on the batch when a broker
+// rejects it or Heka is shutting down.
+func (o *KafkaOutput) flush(or OutputRunner, partition int32) {
+	msgs := o.batches[partition]
+	if len(msgs) == 0 {
+		return
+	}
+	for {
+		e := o.client.produce(partition, int16(o.config.RequiredAcks), msgs)
+		if e == nil {
+			atomic.AddInt64(&o.sentMessages, int64(len(msgs)))
+			o.backoff.Reset()
+			break
+		}
+		or.LogError(fmt.Errorf("producing to %s partition %d: %s",
+			o.config.Topic, partition, e))
+		if !kafkaRetriable(e) || Globals().Stopping {
+			atomic.AddInt64(&o.dropped, int64(len(msgs)))
+			or.LogError(fmt.Errorf("dropped %d messages", len(msgs)))
+			break
+		}
+		atomic.AddInt64(&o.retries, 1)
+		time.Sleep(o.backoff.Next())
+		if e = o.client.refreshMetadata(); e != nil {
+			or.LogError(e)
+		}
+	}
+	delete(o.batches, partition)
+}
+
+func (o *KafkaOutput) ReportMsg(msg *message.Message) (err error) {
+	newIntField(msg, "SentMessages", int(atomic.LoadInt64(&o.sentMessages)))
+	newIntField(msg, "DroppedMessages", int(atomic.LoadInt64(&o.dropped)))
+	newIntField(msg, "Retries", int(atomic.LoadInt64(&o.retries)))
+	return
+}
@@ -0,0 +1,562 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single Kafka broker that keeps one topic's partitions and its consumer
+// groups' offsets in memory.
+type kafkaStandIn struct {
+	listener      net.Listener
+	topic         string
+	logs          [][]kafkaMessage
+	offsets       map[string]map[int32]int64
+	produceErrors []int16 // Error codes for the next produce requests.
+	lock          sync.Mutex
+}
+
+func newKafkaStandIn(topic string, partitions int) (s *kafkaStandIn, err error) {
+	s = &kafkaStandIn{
+		topic:   topic,
+		logs:    make([][]kafkaMessage, partitions),
+		offsets: make(map[string]map[int32]int64),
+	}
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return
+}
+
+func (s *kafkaStandIn) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *kafkaStandIn) Close() {
+	s.listener.Close()
+}
+
+// Appends messages to a partition's log.
+func (s *kafkaStandIn) append(partition int32, msgs ...kafkaMessage) (
+	offset int64) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	offset = int64(len(s.logs[partition]))
+	for i, msg := range msgs {
+		msg.Offset = offset + int64(i)
+		s.logs[partition] = append(s.logs[partition], msg)
+	}
+	return
+}
+
+func (s *kafkaStandIn) log(partition int32) []kafkaMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]kafkaMessage(nil), s.logs[partition]...)
+}
+
+func (s *kafkaStandIn) groupOffset(group string, partition int32) (
+	offset int64, ok bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	offset, ok = s.offsets[group][partition]
+	return
+}
+
+func (s *kafkaStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		req := &kafkaDecoder{buf: make([]byte, binary.BigEndian.Uint32(size))}
+		if _, err := io.ReadFull(conn, req.buf); err != nil {
+			return
+		}
+		apiKey := req.getInt16()
+		req.getInt16()
+		resp := new(kafkaEncoder)
+		resp.putInt32(0)
+		resp.putInt32(req.getInt32())
+		req.getString()
+		switch apiKey {
+		case kafkaMetadataKey:
+			s.metadata(resp)
+		case kafkaProduceKey:
+			s.produce(req, resp)
+		case kafkaFetchKey:
+			s.fetch(req, resp)
+		case kafkaOffsetsKey:
+			s.offset(req, resp)
+		case kafkaCoordinatorKey:
+			resp.putInt16(0)
+			s.putBroker(resp)
+		case kafkaOffsetFetchKey:
+			s.fetchOffsets(req, resp)
+		case kafkaOffsetCommitKey:
+			s.commitOffsets(req, resp)
+		default:
+			return
+		}
+		if req.err != nil {
+			return
+		}
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		if _, err := conn.Write(resp.buf); err != nil {
+			return
+		}
+	}
+}
+
+// Writes this broker's id, host and port.
+func (s *kafkaStandIn) putBroker(resp *kafkaEncoder) {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	portNum, _ := strconv.Atoi(port)
+	resp.putInt32(1)
+	resp.putString(host)
+	resp.putInt32(int32(portNum))
+}
+
+func (s *kafkaStandIn) metadata(resp *kafkaEncoder) {
+	resp.putInt32(1)
+	s.putBroker(resp)
+	resp.putInt32(1)
+	resp.putInt16(0)
+	resp.putString(s.topic)
+	resp.putInt32(int32(len(s.logs)))
+	for i := range s.logs {
+		resp.putInt16(0)
+		resp.putInt32(int32(i))
+		resp.putInt32(1) // Leader.
+		resp.putInt32(1) // Replicas.
+		resp.putInt32(1)
+		resp.putInt32(1) // In sync replicas.
+		resp.putInt32(1)
+	}
+}
+
+func (s *kafkaStandIn) produce(req *kafkaDecoder, resp *kafkaEncoder) {
+	req.getInt16()
+	req.getInt32()
+	resp.putInt32(int32(req.getArrayLen()))
+	resp.putString(req.getString())
+	partitions := req.getArrayLen()
+	resp.putInt32(int32(partitions))
+	for ; partitions > 0; partitions-- {
+		partition := req.getInt32()
+		msgs, _ := parseMessageSet(req.getBytes())
+		s.lock.Lock()
+		var code int16
+		if len(s.produceErrors) > 0 {
+			code, s.produceErrors = s.produceErrors[0], s.produceErrors[1:]
+		}
+		s.lock.Unlock()
+		var offset int64
+		if code == 0 {
+			offset = s.append(partition, msgs...)
+		}
+		resp.putInt32(partition)
+		resp.putInt16(code)
+		resp.putInt64(offset)
+	}
+}
+
+func (s *kafkaStandIn) fetch(req *kafkaDecoder, resp *kafkaEncoder) {
+	req.getInt32()
+	maxWait := time.Duration(req.getInt32()) * time.Millisecond
+	req.getInt32()
+	req.getArrayLen()
+	topic := req.getString()
+	partitions := make(map[int32]int64)
+	var maxBytes int
+	for i := req.getArrayLen(); i > 0; i-- {
+		partition := req.getInt32()
+		partitions[partition] = req.getInt64()
+		maxBytes = int(req.getInt32())
+	}
+	results := new(kafkaEncoder)
+	found := false
+	for partition, offset := range partitions {
+		log := s.log(partition)
+		results.putInt32(partition)
+		if offset > int64(len(log)) {
+			results.putInt16(int16(kafkaOffsetOutOfRange))
+		} else {
+			results.putInt16(0)
+			found = found || offset < int64(len(log))
+		}
+		results.putInt64(int64(len(log)))
+		if offset < 0 || offset > int64(len(log)) {
+			offset = int64(len(log))
+		}
+		// Like a broker, cut the set short at max_bytes.
+		set := new(kafkaEncoder)
+		set.putMessageSet(log[offset:])
+		if len(set.buf)-4 > maxBytes {
+			set.buf = set.buf[:4+maxBytes]
+			binary.BigEndian.PutUint32(set.buf, uint32(maxBytes))
+		}
+		results.buf = append(results.buf, set.buf...)
+	}
+	if !found {
+		time.Sleep(maxWait)
+	}
+	resp.putInt32(1)
+	resp.putString(topic)
+	resp.putInt32(int32(len(partitions)))
+	resp.buf = append(resp.buf, results.buf...)
+}
+
+func (s *kafkaStandIn) offset(req *kafkaDecoder, resp *kafkaEncoder) {
+	req.getInt32()
+	req.getArrayLen()
+	resp.putInt32(1)
+	resp.putString(req.getString())
+	partitions := req.getArrayLen()
+	resp.putInt32(int32(partitions))
+	for ; partitions > 0; partitions-- {
+		partition := req.getInt32()
+		when := req.getInt64()
+		req.getInt32()
+		offset := int64(len(s.log(partition)))
+		if when == kafkaOldestOffset {
+			offset = 0
+		}
+		resp.putInt32(partition)
+		resp.putInt16(0)
+		resp.putInt32(1)
+		resp.putInt64(offset)
+	}
+}
+
+func (s *kafkaStandIn) fetchOffsets(req *kafkaDecoder, resp *kafkaEncoder) {
+	group := req.getString()
+	req.getArrayLen()
+	resp.putInt32(1)
+	resp.putString(req.getString())
+	partitions := req.getArrayLen()
+	resp.putInt32(int32(partitions))
+	for ; partitions > 0; partitions-- {
+		partition := req.getInt32()
+		offset, ok := s.groupOffset(group, partition)
+		if !ok {
+			offset = -1
+		}
+		resp.putInt32(partition)
+		resp.putInt64(offset)
+		resp.putString("")
+		resp.putInt16(0)
+	}
+}
+
+func (s *kafkaStandIn) commitOffsets(req *kafkaDecoder, resp *kafkaEncoder) {
+	group := req.getString()
+	req.getInt32()
+	req.getString()
+	req.getArrayLen()
+	resp.putInt32(1)
+	resp.putString(req.getString())
+	partitions := req.getArrayLen()
+	resp.putInt32(int32(partitions))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.offsets[group] == nil {
+		s.offsets[group] = make(map[int32]int64)
+	}
+	for ; partitions > 0; partitions-- {
+		partition := req.getInt32()
+		s.offsets[group][partition] = req.getInt64()
+		req.getInt64()
+		req.getString()
+		resp.putInt32(partition)
+		resp.putInt16(0)
+	}
+}
+
+func KafkaSpec(c gs.Context) {
+	t := new(ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	broker, err := newKafkaStandIn("logs", 2)
+	c.Assume(err, gs.IsNil)
+	defer broker.Close()
+
+	c.Specify("A Kafka message set", func() {
+		msgs := []kafkaMessage{
+			{Offset: 5, Key: []byte("key"), Value: []byte("first")},
+			{Offset: 6, Value: []byte("second")},
+		}
+		e := new(kafkaEncoder)
+		e.putMessageSet(msgs)
+		d := &kafkaDecoder{buf: e.buf}
+		set := d.getBytes()
+		c.Assume(d.err, gs.IsNil)
+
+		c.Specify("survives a round trip", func() {
+			parsed, err := parseMessageSet(set)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(parsed), gs.Equals, 2)
+			c.Expect(parsed[0].Offset, gs.Equals, int64(5))
+			c.Expect(string(parsed[0].Key), gs.Equals, "key")
+			c.Expect(parsed[1].Key == nil, gs.IsTrue)
+			c.Expect(string(parsed[1].Value), gs.Equals, "second")
+		})
+
+		c.Specify("ignores a partial message at the end", func() {
+			parsed, err := parseMessageSet(set[:len(set)-3])
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(parsed), gs.Equals, 1)
+		})
+
+		c.Specify("reports a message that was cut short on its own", func() {
+			_, err := parseMessageSet(set[:20])
+			c.Expect(err, gs.Equals, kafkaMessageTooLarge)
+		})
+
+		c.Specify("rejects a corrupt message", func() {
+			set[len(set)-1] = 'X'
+			_, err := parseMessageSet(set)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A KafkaOutput", func() {
+		oth := NewOutputTestHelper(ctrl)
+		inChan := make(chan *PipelineCapture, 3)
+		oth.MockOutputRunner.EXPECT().InChan().Return(inChan).AnyTimes()
+		output := new(KafkaOutput)
+		config := output.ConfigStruct().(*KafkaOutputConfig)
+		config.Brokers = []string{broker.Addr()}
+		config.Topic = "logs"
+		config.RetryDelay = 1
+
+		// Runs the output over `msgs` until they've all been sent.
+		run := func(msgs ...*message.Message) {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			done := make(chan bool)
+			go func() {
+				output.Run(oth.MockOutputRunner, oth.MockHelper)
+				close(done)
+			}()
+			for _, msg := range msgs {
+				pack := NewPipelinePack(make(chan *PipelinePack, 1))
+				pack.Message = msg
+				inChan <- &PipelineCapture{Pack: pack}
+			}
+			close(inChan)
+			<-done
+		}
+		decode := func(msg kafkaMessage) *message.Message {
+			m := new(message.Message)
+			c.Expect(proto.Unmarshal(msg.Value, m), gs.IsNil)
+			return m
+		}
+
+		c.Specify("partitions messages by key", func() {
+			config.PartitionKey = "foo"
+			msgs := []*message.Message{getTestMessage(), getTestMessage(),
+				getTestMessage()}
+			msgs[1].SetLogger("second")
+			run(msgs...)
+			var logs [][]kafkaMessage
+			for partition := int32(0); partition < 2; partition++ {
+				if log := broker.log(partition); len(log) > 0 {
+					logs = append(logs, log)
+				}
+			}
+			c.Expect(len(logs), gs.Equals, 1)
+			c.Expect(len(logs[0]), gs.Equals, 3)
+			c.Expect(string(logs[0][1].Key), gs.Equals, "bar")
+			c.Expect(decode(logs[0][1]).GetLogger(), gs.Equals, "second")
+		})
+
+		c.Specify("spreads messages w/o a key over the partitions", func() {
+			config.BatchCount = 1
+			run(getTestMessage(), getTestMessage())
+			c.Expect(len(broker.log(0)), gs.Equals, 1)
+			c.Expect(len(broker.log(1)), gs.Equals, 1)
+			c.Expect(broker.log(0)[0].Key == nil, gs.IsTrue)
+		})
+
+		c.Specify("encodes messages as JSON", func() {
+			config.Encoding = "json"
+			run(getTestMessage())
+			msgs := append(broker.log(0), broker.log(1)...)
+			c.Expect(len(msgs), gs.Equals, 1)
+			msg := new(message.Message)
+			c.Expect(json.Unmarshal(msgs[0].Value, msg), gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "TEST")
+		})
+
+		c.Specify("retries when a partition's leader is unavailable", func() {
+			broker.produceErrors = []int16{6}
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+			run(getTestMessage())
+			c.Expect(len(broker.log(0)), gs.Equals, 1)
+
+			msg := getTestMessage()
+			output.ReportMsg(msg)
+			retries, _ := msg.GetFieldValue("Retries")
+			c.Expect(retries, gs.Equals, int64(1))
+			sent, _ := msg.GetFieldValue("SentMessages")
+			c.Expect(sent, gs.Equals, int64(1))
+		})
+
+		c.Specify("drops messages a broker rejects", func() {
+			broker.produceErrors = []int16{int16(kafkaMessageTooLarge)}
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Times(2)
+			run(getTestMessage())
+			c.Expect(len(broker.log(0)), gs.Equals, 0)
+		})
+
+		c.Specify("rejects an unknown encoding", func() {
+			config.Encoding = "xml"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A KafkaInput", func() {
+		ir := NewMockInputRunner(ctrl)
+		packSupply := make(chan *PipelinePack, 4)
+		for i := 0; i < 4; i++ {
+			packSupply <- NewPipelinePack(packSupply)
+		}
+		injected := make(chan *PipelinePack, 4)
+		ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+		ir.EXPECT().Inject(gomock.Any()).Do(func(pack *PipelinePack) {
+			injected <- pack
+		}).AnyTimes()
+		// Connection errors are logged and retried.
+		ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+		input := new(KafkaInput)
+		config := input.ConfigStruct().(*KafkaInputConfig)
+		config.Brokers = []string{broker.Addr()}
+		config.Topic = "logs"
+		config.MaxWait = 10
+		config.CommitInterval = 10
+
+		for i, partition := range []int32{0, 1, 0} {
+			msg := getTestMessage()
+			msg.SetPayload(fmt.Sprintf("message %d", i))
+			value, err := proto.Marshal(msg)
+			c.Assume(err, gs.IsNil)
+			broker.append(partition, kafkaMessage{Value: value})
+		}
+
+		// Starts the input and returns the payloads of the first `count`
+		// messages it injects.
+		receive := func(count int) (payloads map[string]bool) {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			done := make(chan bool)
+			go func() {
+				input.Run(ir, nil)
+				close(done)
+			}()
+			payloads = make(map[string]bool)
+			for i := 0; i < count; i++ {
+				select {
+				case pack := <-injected:
+					c.Expect(pack.Decoded, gs.IsTrue)
+					payloads[pack.Message.GetPayload()] = true
+				case <-time.After(time.Second):
+					c.Expect(fmt.Sprintf("timed out after %d messages", i), gs.IsNil)
+					count = 0
+				}
+			}
+			input.Stop()
+			<-done
+			return
+		}
+
+		c.Specify("consumes every partition from the oldest message", func() {
+			config.OffsetReset = "oldest"
+			payloads := receive(3)
+			c.Expect(len(payloads), gs.Equals, 3)
+			c.Expect(payloads["message 2"], gs.IsTrue)
+			offset, _ := broker.groupOffset("heka", 0)
+			c.Expect(offset, gs.Equals, int64(2))
+			offset, _ = broker.groupOffset("heka", 1)
+			c.Expect(offset, gs.Equals, int64(1))
+		})
+
+		c.Specify("resumes from the group's committed offsets", func() {
+			broker.offsets["heka"] = map[int32]int64{0: 1, 1: 1}
+			config.Partitions = []int32{0}
+			payloads := receive(1)
+			c.Expect(len(payloads), gs.Equals, 1)
+			c.Expect(payloads["message 2"], gs.IsTrue)
+			offset, _ := broker.groupOffset("heka", 0)
+			c.Expect(offset, gs.Equals, int64(2))
+		})
+
+		c.Specify("starts from the newest message w/o a committed offset",
+			func() {
+				config.Group = "other"
+				err := input.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(input.start(), gs.IsNil)
+				c.Expect(input.offsets[0], gs.Equals, int64(2))
+				c.Expect(input.offsets[1], gs.Equals, int64(1))
+				input.client.Close()
+			})
+
+		c.Specify("fails to fetch a message larger than max_bytes", func() {
+			config.OffsetReset = "oldest"
+			config.MaxBytes = 20
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Assume(input.start(), gs.IsNil)
+			err = input.consume()
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(strings.Contains(err.Error(), "max_bytes"), gs.IsTrue)
+			input.client.Close()
+		})
+
+		c.Specify("rejects an unknown offset_reset", func() {
+			config.OffsetReset = "middle"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
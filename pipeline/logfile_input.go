@@ -17,22 +17,65 @@ package pipeline
 
 import (
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type LogfileInputConfig struct {
+	// Seconds between saves of the read positions to the sincedb.
 	SincedbFlush int
-	LogFiles     []string
-	Hostname     string
+	// File in which the read positions are saved, so that a restarted hekad
+	// resumes reading each file where it left off. Positions aren't saved if
+	// not set.
+	SincedbPath string `toml:"sincedb_path"`
+	// Paths of the files to tail, which may be glob patterns such as
+	// "/var/log/app/*.log".
+	LogFiles []string
+	Hostname string
+	// Seconds between checks for files matching `LogFiles` that have
+	// appeared.
+	DiscoverInterval uint `toml:"discover_interval"`
+	// Lines matching this regex are joined to the line before them, e.g.
+	// "^\s" for indented stack trace lines.
+	ContinuationRegex string `toml:"continuation_regex"`
+	// Lines matching this regex start a new message, any others are joined to
+	// the line before them. Mutually exclusive w/ `ContinuationRegex`.
+	StartRegex string `toml:"start_regex"`
+	// Milliseconds a multi-line message waits for more lines before it's
+	// sent.
+	MultilineTimeout uint `toml:"multiline_timeout"`
+	// Glob patterns of rotated log files, such as "/var/log/app/*.log.*.gz",
+	// that are read in full when the input starts, unless the sincedb shows
+	// they've already been read. Requires SincedbPath.
+	RotatedFiles []string `toml:"rotated_files"`
+	// Poll the files for changes rather than being notified of them, e.g. for
+	// files on a network filesystem. Polling is also used where notification
+	// isn't available.
+	Polling bool
+	// Name of a decoder, such as a GrokDecoder, that parses each message's
+	// payload before it's routed.
+	Decoder string
 }
 
 type LogfileInput struct {
-	Monitor  *FileMonitor
-	hostname string
-	stopped  bool
+	Monitor     *FileMonitor
+	hostname    string
+	stopped     bool
+	decoderName string
 }
 
 type Logline struct {
@@ -41,7 +84,11 @@ type Logline struct {
 }
 
 func (lw *LogfileInput) ConfigStruct() interface{} {
-	return &LogfileInputConfig{SincedbFlush: 1}
+	return &LogfileInputConfig{
+		SincedbFlush:     1,
+		DiscoverInterval: 5,
+		MultilineTimeout: 1000,
+	}
 }
 
 func (lw *LogfileInput) Init(config interface{}) (err error) {
@@ -55,15 +102,30 @@ func (lw *LogfileInput) Init(config interface{}) (err error) {
 		}
 	}
 	lw.hostname = val
-	if err = lw.Monitor.Init(conf.LogFiles); err != nil {
+	lw.decoderName = conf.Decoder
+	if err = lw.Monitor.Init(conf); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (lw *LogfileInput) Run(ir InputRunner, h PluginHelper) (err error) {
-	var pack *PipelinePack
+	var (
+		pack    *PipelinePack
+		decoder DecoderRunner
+		ok      bool
+	)
+	if lw.decoderName != "" {
+		if decoder, ok = h.DecoderSet().ByName(lw.decoderName); !ok {
+			return fmt.Errorf("LogfileInput decoder not found: %s", lw.decoderName)
+		}
+	}
 	packSupply := ir.InChan()
+	lw.Monitor.wg.Add(1)
+	go func() {
+		lw.Monitor.Watcher()
+		lw.Monitor.wg.Done()
+	}()
 
 	for logline := range lw.Monitor.NewLines {
 		pack = <-packSupply
@@ -71,6 +133,10 @@ func (lw *LogfileInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		pack.Message.SetPayload(logline.Line)
 		pack.Message.SetLogger(logline.Path)
 		pack.Message.SetHostname(lw.hostname)
+		if decoder != nil {
+			decoder.InChan() <- pack
+			continue
+		}
 		pack.Decoded = true
 		ir.Inject(pack)
 	}
@@ -80,21 +146,93 @@ func (lw *LogfileInput) Run(ir InputRunner, h PluginHelper) (err error) {
 }
 
 func (lw *LogfileInput) Stop() {
-	close(lw.Monitor.stopChan) // stops the monitor's watcher
-	runtime.Gosched()          // lets the monitor close
-	close(lw.Monitor.NewLines) // stops the input
+	// The monitor's watcher closes NewLines once it's stopped, which stops the
+	// input. Wait for it so the read positions are saved before we exit.
+	close(lw.Monitor.stopChan)
+	lw.Monitor.wg.Wait()
+}
+
+// A message being assembled from multiple lines.
+type multilineRecord struct {
+	text     string
+	offset   int64 // Where the record's first line starts.
+	lastRead time.Time
+}
+
+// Identifies a file independently of its path, so a file that's been
+// rotated can be told apart from its replacement.
+type fileId struct {
+	device uint64
+	inode  uint64
+}
+
+func getFileId(info os.FileInfo) (id fileId) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		id.device = uint64(stat.Dev)
+		id.inode = uint64(stat.Ino)
+	}
+	return
+}
+
+// A file's read position, as saved in the sincedb. The offset of a
+// compressed rotated file counts its decompressed bytes.
+type sincedbEntry struct {
+	Path    string `json:"path"`
+	Device  uint64 `json:"device"`
+	Inode   uint64 `json:"inode"`
+	Offset  int64  `json:"offset"`
+	Rotated bool   `json:"rotated,omitempty"`
+	Done    bool   `json:"done,omitempty"` // The rotated file's been read.
 }
 
+// A change to a file in a watched directory.
+type fileEvent struct {
+	Path     string
+	Created  bool // The file was created or moved into the directory.
+	Overflow bool // Events were dropped, so any file may have changed.
+}
+
+// Tells the FileMonitor about changes to the files in the directories it
+// watches.
+type fileNotifier interface {
+	Watch(dir string) error
+	Events() <-chan fileEvent
+	Close()
+}
+
+// Creates a fileNotifier, set on platforms that support one.
+var newFileNotifier func() (fileNotifier, error)
+
 // FileMonitor, manages a group of FileTailers
 //
-// The FileMonitor
+// The FileMonitor tails every file matching its glob patterns, sending each
+// line, or each group of lines when joining multi-line messages, to
+// NewLines. It reads files as it's notified of changes to them where it can,
+// and polls them otherwise.
 type FileMonitor struct {
 	NewLines  chan Logline
 	stopChan  chan bool
 	seek      map[string]int64
-	discover  map[string]bool
+	patterns  []string
 	fds       map[string]*os.File
 	checkStat <-chan time.Time
+
+	discoverInterval time.Duration
+	checkInterval    time.Duration
+	continuation     *regexp.Regexp
+	start            *regexp.Regexp
+	multilineTimeout time.Duration
+	records          map[string]*multilineRecord
+	ids              map[string]fileId
+	sincedbPath      string
+	sincedbFlush     time.Duration
+	sincedb          map[string]sincedbEntry // Saved positions not yet resumed.
+	rotatedPatterns  []string
+	rotated          map[fileId]sincedbEntry
+	polling          bool
+	notifier         fileNotifier
+	draining         map[string]time.Time // Rotated files still being read.
+	wg               sync.WaitGroup
 }
 
 func (fm *FileMonitor) OpenFile(fileName string) (err error) {
@@ -103,7 +241,27 @@ func (fm *FileMonitor) OpenFile(fileName string) (err error) {
 	if err != nil {
 		return
 	}
+	info, err := fd.Stat()
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("%s is a directory", fileName)
+	}
+	if err != nil {
+		fd.Close()
+		return
+	}
 	fm.fds[fileName] = fd
+	id := getFileId(info)
+	fm.ids[fileName] = id
+
+	// Resume from the saved position, unless the file has been replaced, e.g.
+	// by rotation, since it was saved.
+	if entry, ok := fm.sincedb[fileName]; ok {
+		delete(fm.sincedb, fileName)
+		if _, ok = fm.seek[fileName]; !ok && entry.Device == id.device &&
+			entry.Inode == id.inode && entry.Offset <= info.Size() {
+			fm.seek[fileName] = entry.Offset
+		}
+	}
 
 	// Seek as needed
 	begin := 0
@@ -119,77 +277,543 @@ func (fm *FileMonitor) OpenFile(fileName string) (err error) {
 	return nil
 }
 
+// Opens any files matching the monitor's patterns that aren't open yet.
+func (fm *FileMonitor) discover() {
+	for _, pattern := range fm.patterns {
+		// Only a malformed pattern errors, and those are caught by Init.
+		matches, _ := filepath.Glob(pattern)
+		for _, fileName := range matches {
+			if _, ok := fm.fds[fileName]; ok {
+				continue
+			}
+			if info, err := os.Stat(fileName); err != nil || info.IsDir() {
+				continue
+			}
+			if err := fm.OpenFile(fileName); err != nil {
+				log.Printf("LogfileInput can't open %s: %s", fileName, err)
+			}
+		}
+	}
+}
+
 func (fm *FileMonitor) Watcher() {
-	discovery := time.Tick(time.Second * 5)
-	checkStat := time.Tick(time.Millisecond * 500)
+	discovery := time.NewTicker(fm.discoverInterval)
+	defer discovery.Stop()
+	checkStat := time.NewTicker(fm.checkInterval)
+	defer checkStat.Stop()
+	defer close(fm.NewLines)
+	var flushSincedb <-chan time.Time
+	if fm.sincedbPath != "" {
+		sincedbTicker := time.NewTicker(fm.sincedbFlush)
+		defer sincedbTicker.Stop()
+		flushSincedb = sincedbTicker.C
+	}
+
+	// Watch for changes before the files are first read, so none are missed.
+	var events <-chan fileEvent
+	if !fm.polling && newFileNotifier != nil {
+		notifier, err := newFileNotifier()
+		if err == nil {
+			defer notifier.Close()
+			fm.notifier = notifier
+			events = notifier.Events()
+			err = fm.watchDirs()
+		}
+		if err != nil {
+			log.Printf("LogfileInput polling for changes: %s", err)
+			fm.notifier, events = nil, nil
+		}
+	}
 
-	for {
+	if fm.ingestRotated() {
+		fm.discover()
+	}
+	for !fm.stopped() {
 		select {
-		case <-checkStat:
+		case <-checkStat.C:
+			// When notified of changes, only rotated files need polling,
+			// since their changes are no longer reported under their names.
 			for fileName, _ := range fm.fds {
-				fm.ReadLines(fileName)
+				if _, ok := fm.draining[fileName]; fm.notifier != nil && !ok {
+					continue
+				}
+				if !fm.ReadLines(fileName) {
+					break
+				}
+			}
+			fm.flushRecords()
+		case event, ok := <-events:
+			if !ok {
+				log.Println("LogfileInput lost change notification, polling")
+				fm.notifier, events = nil, nil
+				continue
 			}
-		case <-discovery:
-			// Check to see if the files exist now, start reading them
-			// if we can, and watch them
-			for fileName, _ := range fm.discover {
-				if fm.OpenFile(fileName) == nil {
-					delete(fm.discover, fileName)
+			fm.handleEvent(event)
+		case <-discovery.C:
+			// Start reading any files matching our patterns that have
+			// appeared since we last looked, which also catches those in
+			// directories created since then.
+			if fm.notifier != nil {
+				if err := fm.watchDirs(); err != nil {
+					log.Printf("LogfileInput polling for changes: %s", err)
+					fm.notifier, events = nil, nil
 				}
 			}
+			fm.discover()
+			fm.skipRotated()
+		case <-flushSincedb:
+			fm.saveSincedb()
 		case <-fm.stopChan:
-			for _, fd := range fm.fds {
-				fd.Close()
+		}
+	}
+	fm.saveSincedb()
+	for _, fd := range fm.fds {
+		fd.Close()
+	}
+}
+
+// Watches the directories the monitor's patterns match files in.
+func (fm *FileMonitor) watchDirs() (err error) {
+	for _, pattern := range fm.patterns {
+		dirs, _ := filepath.Glob(filepath.Dir(pattern))
+		for _, dir := range dirs {
+			if err = fm.notifier.Watch(dir); err != nil {
+				return fmt.Errorf("can't watch %s: %s", dir, err)
 			}
-			return
 		}
 	}
+	return
+}
+
+// Reads the file an event is for, first opening it if it's new and matches
+// one of the monitor's patterns. Returns false if the monitor was stopped.
+func (fm *FileMonitor) handleEvent(event fileEvent) bool {
+	if event.Overflow {
+		fm.discover()
+		for fileName, _ := range fm.fds {
+			if !fm.ReadLines(fileName) {
+				return false
+			}
+		}
+		return true
+	}
+	if _, ok := fm.fds[event.Path]; !ok {
+		if !event.Created || !fm.matches(event.Path) {
+			return true
+		}
+		// Opening a file as soon as it's created means it can still be read
+		// if it's removed right away. It may be gone already, or be a
+		// directory, so errors aren't worth reporting.
+		if err := fm.OpenFile(event.Path); err != nil {
+			return true
+		}
+	}
+	return fm.ReadLines(event.Path)
+}
+
+// Returns whether the path matches one of the monitor's patterns.
+func (fm *FileMonitor) matches(fileName string) bool {
+	for _, pattern := range fm.patterns {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), fileName); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (fm *FileMonitor) ReadLines(fileName string) {
+func (fm *FileMonitor) stopped() bool {
+	select {
+	case <-fm.stopChan:
+		return true
+	default:
+	}
+	return false
+}
+
+// Sends a line to NewLines, returning false if the monitor was stopped
+// instead.
+func (fm *FileMonitor) sendLine(line Logline) bool {
+	select {
+	case fm.NewLines <- line:
+		return true
+	case <-fm.stopChan:
+	}
+	return false
+}
+
+// Adds a line read from `fileName` at `offset`, either sending it or, when
+// joining multi-line messages, adding it to the file's current record.
+// Returns false if the monitor was stopped.
+func (fm *FileMonitor) addLine(fileName, line string, offset int64) bool {
+	if fm.continuation == nil && fm.start == nil {
+		return fm.sendLine(Logline{Path: fileName, Line: line})
+	}
+	record, ok := fm.records[fileName]
+	if ok {
+		trimmed := strings.TrimRight(line, "\r\n")
+		var joins bool
+		if fm.continuation != nil {
+			joins = fm.continuation.MatchString(trimmed)
+		} else {
+			joins = !fm.start.MatchString(trimmed)
+		}
+		// Don't let a record grow bigger than a message can be.
+		if !joins || len(record.text)+len(line) > message.MAX_MESSAGE_SIZE {
+			if !fm.flushRecord(fileName) {
+				return false
+			}
+			ok = false
+		}
+	}
+	if !ok {
+		record = &multilineRecord{offset: offset}
+		fm.records[fileName] = record
+	}
+	record.text += line
+	record.lastRead = time.Now()
+	return true
+}
+
+// Sends the record being assembled for `fileName`, if there is one.
+// Returns false if the monitor was stopped.
+func (fm *FileMonitor) flushRecord(fileName string) bool {
+	record, ok := fm.records[fileName]
+	if !ok {
+		return true
+	}
+	if !fm.sendLine(Logline{Path: fileName, Line: record.text}) {
+		return false
+	}
+	delete(fm.records, fileName)
+	return true
+}
+
+// Sends the records that have waited longer than the multi-line timeout
+// for more lines. Returns false if the monitor was stopped.
+func (fm *FileMonitor) flushRecords() bool {
+	// Flush in a stable order, which keeps the tests deterministic.
+	fileNames := make([]string, 0, len(fm.records))
+	for fileName, record := range fm.records {
+		if time.Since(record.lastRead) >= fm.multilineTimeout {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		if !fm.flushRecord(fileName) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads any complete lines added to the file since it was last read,
+// returning false if the monitor was stopped.
+func (fm *FileMonitor) ReadLines(fileName string) bool {
 	fd, _ := fm.fds[fileName]
 
 	// Determine if we're farther into the file than possible (truncate)
 	finfo, err := fd.Stat()
 	if err == nil {
 		if finfo.Size() < fm.seek[fileName] {
-			fd.Seek(0, 0)
 			fm.seek[fileName] = 0
 		}
 	}
 
-	// Attempt to read lines from where we are
+	// Attempt to read lines from where we are. A partial line at the end is
+	// left for the next read, once the rest of it has been written.
+	start := fm.seek[fileName]
+	if _, err = fd.Seek(start, 0); err != nil {
+		return true
+	}
 	reader := bufio.NewReader(fd)
 	readLine, err := reader.ReadString('\n')
 	for err == nil {
-		line := Logline{Path: fileName, Line: readLine}
+		if !fm.addLine(fileName, readLine, fm.seek[fileName]) {
+			return false
+		}
 		fm.seek[fileName] += int64(len(readLine))
-		fm.NewLines <- line
 		readLine, err = reader.ReadString('\n')
 	}
-	fm.seek[fileName] += int64(len(readLine))
+	if err != io.EOF {
+		log.Printf("LogfileInput error reading %s: %s", fileName, err)
+	}
 
-	// Check that we haven't been rotated, if we have, put this back on
-	// discover
-	pinfo, err := os.Stat(fileName)
-	if err != nil || !os.SameFile(pinfo, finfo) {
-		fd.Close()
-		delete(fm.fds, fileName)
-		delete(fm.seek, fileName)
-		fm.discover[fileName] = true
+	// Check that we haven't been rotated or removed. If we have, keep
+	// reading the old file until it's stopped growing for a check interval,
+	// since its writer may not have switched to the new one yet, then move
+	// on to the new one.
+	pinfo, statErr := os.Stat(fileName)
+	if statErr == nil && os.SameFile(pinfo, finfo) {
+		return true
+	}
+	drainedAt, ok := fm.draining[fileName]
+	if !ok || fm.seek[fileName] > start {
+		fm.draining[fileName] = time.Now()
+		return true
+	}
+	if time.Since(drainedAt) < fm.checkInterval {
+		return true
+	}
+	delete(fm.draining, fileName)
+	if readLine != "" && !fm.addLine(fileName, readLine, fm.seek[fileName]) {
+		return false
+	}
+	if !fm.flushRecord(fileName) {
+		return false
 	}
+	fd.Close()
+	delete(fm.fds, fileName)
+	delete(fm.seek, fileName)
+	delete(fm.ids, fileName)
+	if statErr == nil {
+		if err = fm.OpenFile(fileName); err != nil {
+			log.Printf("LogfileInput can't open %s: %s", fileName, err)
+		}
+	}
+	return true
+}
+
+// A rotated file matching the monitor's `rotatedPatterns`.
+type rotatedFile struct {
+	path string
+	id   fileId
+	info os.FileInfo
+}
+
+// Finds the files matching `rotatedPatterns`, oldest first.
+func (fm *FileMonitor) findRotated() (files []rotatedFile) {
+	seen := make(map[fileId]bool)
+	for _, pattern := range fm.rotatedPatterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, fileName := range matches {
+			info, err := os.Stat(fileName)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			id := getFileId(info)
+			if !seen[id] {
+				seen[id] = true
+				files = append(files, rotatedFile{fileName, id, info})
+			}
+		}
+	}
+	sort.Sort(rotatedFilesByAge(files))
 	return
 }
 
-func (fm *FileMonitor) Init(files []string) (err error) {
+type rotatedFilesByAge []rotatedFile
+
+func (r rotatedFilesByAge) Len() int      { return len(r) }
+func (r rotatedFilesByAge) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rotatedFilesByAge) Less(i, j int) bool {
+	return r[i].info.ModTime().Before(r[j].info.ModTime())
+}
+
+// Reads the rotated files that haven't been read yet. A file that was being
+// tailed before it was rotated is read from where tailing left off. Returns
+// false if the monitor was stopped.
+func (fm *FileMonitor) ingestRotated() bool {
+	tailed := make(map[fileId]int64)
+	for _, entry := range fm.sincedb {
+		tailed[fileId{entry.Device, entry.Inode}] = entry.Offset
+	}
+	for _, file := range fm.findRotated() {
+		entry, ok := fm.rotated[file.id]
+		if ok && entry.Done {
+			continue
+		}
+		if !ok {
+			entry = sincedbEntry{Device: file.id.device, Inode: file.id.inode,
+				Offset: tailed[file.id], Rotated: true}
+		}
+		entry.Path = file.path
+		ok = fm.readRotated(&entry)
+		fm.rotated[file.id] = entry
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Records rotated files that have appeared since the monitor started as
+// read, since their lines were read while they were being tailed, and
+// forgets those that have been removed.
+func (fm *FileMonitor) skipRotated() {
+	if len(fm.rotatedPatterns) == 0 {
+		return
+	}
+	rotated := make(map[fileId]sincedbEntry)
+	for _, file := range fm.findRotated() {
+		entry, ok := fm.rotated[file.id]
+		if !ok {
+			entry = sincedbEntry{Device: file.id.device, Inode: file.id.inode,
+				Rotated: true, Done: true}
+		}
+		entry.Path = file.path
+		rotated[file.id] = entry
+	}
+	fm.rotated = rotated
+}
+
+// Reads a rotated file from `entry.Offset` to the end, decompressing it if
+// its name ends in .gz or .bz2. Returns false if the monitor was stopped.
+func (fm *FileMonitor) readRotated(entry *sincedbEntry) bool {
+	fd, err := os.Open(entry.Path)
+	if err != nil {
+		log.Printf("LogfileInput can't open %s: %s", entry.Path, err)
+		return true
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	switch filepath.Ext(entry.Path) {
+	case ".gz":
+		if r, err = gzip.NewReader(fd); err != nil {
+			log.Printf("LogfileInput can't read %s: %s", entry.Path, err)
+			entry.Done = true
+			return true
+		}
+	case ".bz2":
+		r = bzip2.NewReader(fd)
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, entry.Offset); err == nil {
+		reader := bufio.NewReader(r)
+		var line string
+		for err == nil {
+			line, err = reader.ReadString('\n')
+			if line == "" {
+				continue
+			}
+			if !fm.addLine(entry.Path, line, entry.Offset) {
+				return false
+			}
+			entry.Offset += int64(len(line))
+		}
+	}
+	if err != io.EOF {
+		log.Printf("LogfileInput error reading %s: %s", entry.Path, err)
+	}
+	if !fm.flushRecord(entry.Path) {
+		return false
+	}
+	entry.Done = true
+	return true
+}
+
+// Loads the read positions saved by a previous run.
+func (fm *FileMonitor) loadSincedb() (err error) {
+	data, err := ioutil.ReadFile(fm.sincedbPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var entries []sincedbEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Rotated {
+			fm.rotated[fileId{entry.Device, entry.Inode}] = entry
+		} else {
+			fm.sincedb[entry.Path] = entry
+		}
+	}
+	return
+}
+
+// Saves the read position of each open file to the sincedb, replacing the
+// old one only once the new one is completely written. The position of a
+// file w/ a multi-line record that hasn't been sent yet is the start of the
+// record, so it's read again after a restart.
+func (fm *FileMonitor) saveSincedb() {
+	if fm.sincedbPath == "" {
+		return
+	}
+	entries := make([]sincedbEntry, 0, len(fm.fds))
+	for fileName, _ := range fm.fds {
+		offset := fm.seek[fileName]
+		if record, ok := fm.records[fileName]; ok {
+			offset = record.offset
+		}
+		id := fm.ids[fileName]
+		entries = append(entries, sincedbEntry{Path: fileName,
+			Device: id.device, Inode: id.inode, Offset: offset})
+	}
+	for _, entry := range fm.rotated {
+		if record, ok := fm.records[entry.Path]; ok && !entry.Done {
+			entry.Offset = record.offset
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmpPath := fm.sincedbPath + ".tmp"
+		if err = ioutil.WriteFile(tmpPath, data, 0644); err == nil {
+			err = os.Rename(tmpPath, fm.sincedbPath)
+		}
+	}
+	if err != nil {
+		log.Printf("LogfileInput can't save the sincedb %s: %s", fm.sincedbPath,
+			err)
+	}
+}
+
+func (fm *FileMonitor) Init(conf *LogfileInputConfig) (err error) {
+	for _, pattern := range append(conf.LogFiles, conf.RotatedFiles...) {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("LogfileInput bad log file pattern '%s': %s",
+				pattern, err)
+		}
+	}
+	if len(conf.RotatedFiles) > 0 && conf.SincedbPath == "" {
+		return fmt.Errorf("LogfileInput rotated_files requires sincedb_path")
+	}
+	if conf.ContinuationRegex != "" && conf.StartRegex != "" {
+		return fmt.Errorf("LogfileInput continuation_regex and start_regex " +
+			"are mutually exclusive")
+	}
+	if conf.ContinuationRegex != "" {
+		if fm.continuation, err = regexp.Compile(conf.ContinuationRegex); err != nil {
+			return fmt.Errorf("LogfileInput bad continuation_regex: %s", err)
+		}
+	}
+	if conf.StartRegex != "" {
+		if fm.start, err = regexp.Compile(conf.StartRegex); err != nil {
+			return fmt.Errorf("LogfileInput bad start_regex: %s", err)
+		}
+	}
+	if conf.DiscoverInterval == 0 {
+		return fmt.Errorf("LogfileInput discover_interval must be greater than 0")
+	}
+	fm.discoverInterval = time.Duration(conf.DiscoverInterval) * time.Second
+	fm.checkInterval = time.Millisecond * 500
+	fm.multilineTimeout = time.Duration(conf.MultilineTimeout) * time.Millisecond
 	fm.NewLines = make(chan Logline)
 	fm.stopChan = make(chan bool)
 	fm.seek = make(map[string]int64)
 	fm.fds = make(map[string]*os.File)
-	fm.discover = make(map[string]bool)
-	for _, fileName := range files {
-		fm.discover[fileName] = true
+	fm.records = make(map[string]*multilineRecord)
+	fm.ids = make(map[string]fileId)
+	fm.sincedb = make(map[string]sincedbEntry)
+	fm.rotated = make(map[fileId]sincedbEntry)
+	fm.draining = make(map[string]time.Time)
+	fm.polling = conf.Polling
+	fm.patterns = conf.LogFiles
+	fm.rotatedPatterns = conf.RotatedFiles
+	if conf.SincedbPath != "" {
+		if conf.SincedbFlush <= 0 {
+			return fmt.Errorf("LogfileInput SincedbFlush must be greater than 0")
+		}
+		fm.sincedbPath = conf.SincedbPath
+		fm.sincedbFlush = time.Duration(conf.SincedbFlush) * time.Second
+		if err = fm.loadSincedb(); err != nil {
+			return fmt.Errorf("LogfileInput can't read the sincedb %s: %s",
+				conf.SincedbPath, err)
+		}
 	}
-	go fm.Watcher()
 	return
 }
@@ -0,0 +1,472 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"code.google.com/p/gomock/gomock"
+	"compress/gzip"
+	"fmt"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"time"
+)
+
+// Appends `text` to the file, creating it if need be.
+func appendToFile(fileName, text string) (err error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(text)
+	return
+}
+
+// Returns the lines sent by the monitor so far.
+func readLoglines(fm *FileMonitor) (lines []Logline) {
+	for {
+		select {
+		case line := <-fm.NewLines:
+			lines = append(lines, line)
+		default:
+			return
+		}
+	}
+}
+
+// "bz\n" compressed w/ bzip2, which Go can read but not write.
+var bzippedLine = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x72, 0x90,
+	0xa0, 0x23, 0x00, 0x00, 0x00, 0xc1, 0x80, 0x00, 0x10, 0x10, 0x00, 0x00,
+	0x10, 0x20, 0x00, 0x21, 0x98, 0x19, 0x84, 0x61, 0x77, 0x24, 0x53, 0x85,
+	0x09, 0x07, 0x29, 0x0a, 0x02, 0x30,
+}
+
+// Writes `text` gzipped to the file.
+func writeGzipFile(fileName, text string) (err error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(text))
+	w.Close()
+	return ioutil.WriteFile(fileName, buf.Bytes(), 0644)
+}
+
+// Reads every open file, the same as the monitor's watcher does.
+func readAllFiles(fm *FileMonitor) {
+	for fileName, _ := range fm.fds {
+		fm.ReadLines(fileName)
+	}
+}
+
+func LogfileInputSpec(c gs.Context) {
+	tmpDir := path.Join(os.TempDir(),
+		fmt.Sprintf("logfileinput-test-%d", time.Now().UnixNano()))
+	err := os.MkdirAll(tmpDir, 0700)
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	input := new(LogfileInput)
+	config := input.ConfigStruct().(*LogfileInputConfig)
+	config.LogFiles = []string{path.Join(tmpDir, "*.log")}
+	fm := new(FileMonitor)
+	logA := path.Join(tmpDir, "a.log")
+	logB := path.Join(tmpDir, "b.log")
+
+	c.Specify("A FileMonitor", func() {
+		initMonitor := func() {
+			err := fm.Init(config)
+			c.Assume(err, gs.IsNil)
+			// Buffered so the tests can read files w/o the watcher.
+			fm.NewLines = make(chan Logline, 10)
+			// Finish reading rotated files as soon as they stop growing.
+			fm.checkInterval = 0
+		}
+
+		c.Specify("tails the files matching its patterns", func() {
+			initMonitor()
+			err := appendToFile(logA, "one\ntwo\n")
+			c.Assume(err, gs.IsNil)
+			err = appendToFile(path.Join(tmpDir, "a.txt"), "ignored\n")
+			c.Assume(err, gs.IsNil)
+			fm.discover()
+			readAllFiles(fm)
+			lines := readLoglines(fm)
+			c.Expect(len(lines), gs.Equals, 2)
+			c.Expect(lines[0], gs.Equals, Logline{Path: logA, Line: "one\n"})
+			c.Expect(lines[1], gs.Equals, Logline{Path: logA, Line: "two\n"})
+
+			c.Specify("and picks up new ones", func() {
+				err := appendToFile(logB, "three\n")
+				c.Assume(err, gs.IsNil)
+				fm.discover()
+				readAllFiles(fm)
+				lines := readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 1)
+				c.Expect(lines[0], gs.Equals, Logline{Path: logB, Line: "three\n"})
+			})
+
+			c.Specify("and drops the ones that vanish", func() {
+				err := os.Remove(logA)
+				c.Assume(err, gs.IsNil)
+				readAllFiles(fm)
+				_, ok := fm.fds[logA]
+				c.Expect(ok, gs.IsTrue)
+				readAllFiles(fm)
+				_, ok = fm.fds[logA]
+				c.Expect(ok, gs.IsFalse)
+			})
+
+			c.Specify("and waits for the rest of a partial line", func() {
+				err := appendToFile(logA, "thr")
+				c.Assume(err, gs.IsNil)
+				readAllFiles(fm)
+				c.Expect(len(readLoglines(fm)), gs.Equals, 0)
+				err = appendToFile(logA, "ee\n")
+				c.Assume(err, gs.IsNil)
+				readAllFiles(fm)
+				lines := readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 1)
+				c.Expect(lines[0].Line, gs.Equals, "three\n")
+			})
+
+			c.Specify("and finishes a rotated file before the new one", func() {
+				err := appendToFile(logA, "three\n")
+				c.Assume(err, gs.IsNil)
+				err = os.Rename(logA, logA+".1")
+				c.Assume(err, gs.IsNil)
+				err = appendToFile(logA, "four\n")
+				c.Assume(err, gs.IsNil)
+				readAllFiles(fm)
+				lines := readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 1)
+				c.Expect(lines[0].Line, gs.Equals, "three\n")
+				// Nothing more in the old file, so it moves to the new one.
+				readAllFiles(fm)
+				readAllFiles(fm)
+				lines = readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 1)
+				c.Expect(lines[0].Line, gs.Equals, "four\n")
+			})
+
+			c.Specify("and sends a rotated file's partial last line", func() {
+				err := appendToFile(logA, "thr")
+				c.Assume(err, gs.IsNil)
+				readAllFiles(fm)
+				err = os.Rename(logA, logA+".1")
+				c.Assume(err, gs.IsNil)
+				readAllFiles(fm)
+				c.Expect(len(readLoglines(fm)), gs.Equals, 0)
+				readAllFiles(fm)
+				lines := readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 1)
+				c.Expect(lines[0].Line, gs.Equals, "thr")
+				_, ok := fm.fds[logA]
+				c.Expect(ok, gs.IsFalse)
+			})
+		})
+
+		c.Specify("joins lines matching continuation_regex", func() {
+			config.ContinuationRegex = `^\s`
+			config.MultilineTimeout = 0
+			initMonitor()
+			err := appendToFile(logA, "Exception in thread \"main\"\n"+
+				"\tat Main.main(Main.java:5)\n"+
+				"next\n")
+			c.Assume(err, gs.IsNil)
+			fm.discover()
+			readAllFiles(fm)
+			lines := readLoglines(fm)
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0].Line, gs.Equals, "Exception in thread \"main\"\n"+
+				"\tat Main.main(Main.java:5)\n")
+
+			c.Specify("and flushes the last message after the timeout", func() {
+				fm.flushRecords()
+				lines := readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 1)
+				c.Expect(lines[0].Line, gs.Equals, "next\n")
+			})
+		})
+
+		c.Specify("joins lines not matching start_regex", func() {
+			config.StartRegex = `^\d{4}-`
+			initMonitor()
+			err := appendToFile(logA, "2013-06-01 ERROR oops\n"+
+				"Traceback (most recent call last):\n"+
+				"ValueError\n"+
+				"2013-06-01 INFO ok\n")
+			c.Assume(err, gs.IsNil)
+			fm.discover()
+			readAllFiles(fm)
+			lines := readLoglines(fm)
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0].Line, gs.Equals, "2013-06-01 ERROR oops\n"+
+				"Traceback (most recent call last):\nValueError\n")
+
+			c.Specify("but waits for the timeout before sending the last one", func() {
+				fm.flushRecords()
+				c.Expect(len(readLoglines(fm)), gs.Equals, 0)
+			})
+		})
+
+		c.Specify("waits for a rotated file to stop growing", func() {
+			initMonitor()
+			fm.checkInterval = time.Hour
+			err := appendToFile(logA, "one\n")
+			c.Assume(err, gs.IsNil)
+			fm.discover()
+			readAllFiles(fm)
+			err = os.Rename(logA, logA+".1")
+			c.Assume(err, gs.IsNil)
+			err = appendToFile(logA, "two\n")
+			c.Assume(err, gs.IsNil)
+			readAllFiles(fm)
+			readAllFiles(fm)
+			lines := readLoglines(fm)
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0].Line, gs.Equals, "one\n")
+			c.Expect(fm.ids[logA], gs.Not(gs.Equals), fm.ids[logA+".1"])
+		})
+
+		c.Specify("is notified of changes", func() {
+			if newFileNotifier == nil {
+				return // Polling is all there is on this platform.
+			}
+			config.DiscoverInterval = 3600
+			err := fm.Init(config)
+			c.Assume(err, gs.IsNil)
+			// Never poll, so only notification can find the lines.
+			fm.checkInterval = time.Hour
+			fm.wg.Add(1)
+			go func() {
+				fm.Watcher()
+				fm.wg.Done()
+			}()
+			// Give the watcher time to start watching.
+			time.Sleep(100 * time.Millisecond)
+			for _, line := range []string{"one\n", "two\n"} {
+				err = appendToFile(logA, line)
+				c.Assume(err, gs.IsNil)
+				select {
+				case logline := <-fm.NewLines:
+					c.Expect(logline, gs.Equals, Logline{Path: logA, Line: line})
+				case <-time.After(time.Second):
+					c.Expect("timed out", gs.IsNil)
+				}
+			}
+			close(fm.stopChan)
+			fm.wg.Wait()
+		})
+
+		c.Specify("sends lines while watching", func() {
+			config.DiscoverInterval = 1
+			config.Polling = true
+			err := fm.Init(config)
+			c.Assume(err, gs.IsNil)
+			fm.checkInterval = 10 * time.Millisecond
+			err = appendToFile(logA, "one\n")
+			c.Assume(err, gs.IsNil)
+			go fm.Watcher()
+			select {
+			case line := <-fm.NewLines:
+				c.Expect(line.Line, gs.Equals, "one\n")
+			case <-time.After(time.Second):
+				c.Expect("timed out", gs.IsNil)
+			}
+			close(fm.stopChan)
+			_, ok := <-fm.NewLines
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+
+	c.Specify("A FileMonitor w/ a sincedb", func() {
+		config.SincedbPath = path.Join(tmpDir, "sincedb")
+		restart := func() *FileMonitor {
+			fm.saveSincedb()
+			for _, fd := range fm.fds {
+				fd.Close()
+			}
+			fm = new(FileMonitor)
+			err := fm.Init(config)
+			c.Assume(err, gs.IsNil)
+			fm.NewLines = make(chan Logline, 10)
+			fm.discover()
+			readAllFiles(fm)
+			return fm
+		}
+		err := fm.Init(config)
+		c.Assume(err, gs.IsNil)
+		fm.NewLines = make(chan Logline, 10)
+		err = appendToFile(logA, "one\ntwo\n")
+		c.Assume(err, gs.IsNil)
+		fm.discover()
+		readAllFiles(fm)
+		c.Expect(len(readLoglines(fm)), gs.Equals, 2)
+
+		c.Specify("resumes where it left off", func() {
+			err := appendToFile(logA, "three\n")
+			c.Assume(err, gs.IsNil)
+			lines := readLoglines(restart())
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0].Line, gs.Equals, "three\n")
+		})
+
+		c.Specify("starts a replaced file from the beginning", func() {
+			err := os.Rename(logA, logA+".1")
+			c.Assume(err, gs.IsNil)
+			err = appendToFile(logA, "new\n")
+			c.Assume(err, gs.IsNil)
+			lines := readLoglines(restart())
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0].Line, gs.Equals, "new\n")
+		})
+
+		c.Specify("rereads an unsent multi-line message", func() {
+			fm.continuation = regexp.MustCompile(`^\s`)
+			config.ContinuationRegex = `^\s`
+			err := appendToFile(logA, "three\n  four\n")
+			c.Assume(err, gs.IsNil)
+			readAllFiles(fm)
+			c.Expect(len(readLoglines(fm)), gs.Equals, 0)
+			fm = restart()
+			fm.multilineTimeout = 0
+			fm.flushRecords()
+			lines := readLoglines(fm)
+			c.Expect(len(lines), gs.Equals, 1)
+			c.Expect(lines[0].Line, gs.Equals, "three\n  four\n")
+		})
+
+		c.Specify("w/ rotated_files", func() {
+			config.RotatedFiles = []string{path.Join(tmpDir, "*.log.*")}
+			fm.rotatedPatterns = config.RotatedFiles
+			err := writeGzipFile(logA+".3.gz", "gz\n")
+			c.Assume(err, gs.IsNil)
+			err = ioutil.WriteFile(logA+".2.bz2", bzippedLine, 0644)
+			c.Assume(err, gs.IsNil)
+			err = os.Rename(logA, logA+".1")
+			c.Assume(err, gs.IsNil)
+			err = appendToFile(logA+".1", "three\n")
+			c.Assume(err, gs.IsNil)
+			now := time.Now()
+			for i, ext := range []string{".3.gz", ".2.bz2", ".1"} {
+				modTime := now.Add(time.Duration(i-3) * time.Hour)
+				err = os.Chtimes(logA+ext, modTime, modTime)
+				c.Assume(err, gs.IsNil)
+			}
+
+			c.Specify("reads them oldest first, once", func() {
+				fm = restart()
+				c.Expect(fm.ingestRotated(), gs.IsTrue)
+				lines := readLoglines(fm)
+				c.Expect(len(lines), gs.Equals, 3)
+				c.Expect(lines[0], gs.Equals, Logline{Path: logA + ".3.gz", Line: "gz\n"})
+				c.Expect(lines[1], gs.Equals, Logline{Path: logA + ".2.bz2", Line: "bz\n"})
+				// Picks up from where tailing the file stopped.
+				c.Expect(lines[2], gs.Equals, Logline{Path: logA + ".1", Line: "three\n"})
+				fm = restart()
+				c.Expect(fm.ingestRotated(), gs.IsTrue)
+				c.Expect(len(readLoglines(fm)), gs.Equals, 0)
+			})
+
+			c.Specify("skips those rotated while it's running", func() {
+				fm.skipRotated()
+				fm = restart()
+				c.Expect(fm.ingestRotated(), gs.IsTrue)
+				c.Expect(len(readLoglines(fm)), gs.Equals, 0)
+			})
+		})
+
+		c.Specify("saves it when stopped", func() {
+			fm.saveSincedb()
+			err := os.Remove(config.SincedbPath)
+			c.Assume(err, gs.IsNil)
+			fm.checkInterval = time.Hour
+			fm.wg.Add(1)
+			go func() {
+				fm.Watcher()
+				fm.wg.Done()
+			}()
+			close(fm.stopChan)
+			fm.wg.Wait()
+			_, err = os.Stat(config.SincedbPath)
+			c.Expect(err, gs.IsNil)
+		})
+	})
+
+	c.Specify("A LogfileInput", func() {
+		c.Specify("sends messages to its decoder", func() {
+			t := &ts.SimpleT{}
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			ir := NewMockInputRunner(ctrl)
+			h := NewMockPluginHelper(ctrl)
+			dSet := NewMockDecoderSet(ctrl)
+			dRunner := NewMockDecoderRunner(ctrl)
+			packSupply := make(chan *PipelinePack, 1)
+			packSupply <- NewPipelinePack(nil)
+			decodeChan := make(chan *PipelinePack, 1)
+			h.EXPECT().DecoderSet().Return(dSet)
+			dSet.EXPECT().ByName("grok").Return(dRunner, true)
+			ir.EXPECT().InChan().Return(packSupply)
+			dRunner.EXPECT().InChan().Return(decodeChan)
+
+			config.Decoder = "grok"
+			config.Polling = true
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			input.Monitor.checkInterval = 10 * time.Millisecond
+			err = appendToFile(logA, "one\n")
+			c.Assume(err, gs.IsNil)
+			done := make(chan error)
+			go func() {
+				done <- input.Run(ir, h)
+			}()
+			select {
+			case pack := <-decodeChan:
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "one\n")
+				c.Expect(pack.Message.GetLogger(), gs.Equals, logA)
+				c.Expect(pack.Decoded, gs.IsFalse)
+			case <-time.After(time.Second):
+				c.Expect("timed out", gs.IsNil)
+			}
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		})
+
+		c.Specify("rejects both multi-line regexes", func() {
+			config.ContinuationRegex = `^\s`
+			config.StartRegex = `^\S`
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects rotated_files w/o a sincedb", func() {
+			config.RotatedFiles = []string{"/var/log/app.log.*.gz"}
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a bad pattern", func() {
+			config.LogFiles = []string{"[/var/log"}
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const notifyMask = syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+
+func init() {
+	newFileNotifier = newInotifyNotifier
+}
+
+// Watches directories w/ inotify, sending an event for each change to a
+// file in them.
+type inotifyNotifier struct {
+	fd     int
+	file   *os.File
+	events chan fileEvent
+	done   chan bool
+	lock   sync.Mutex
+	dirs   map[string]int32 // Watch descriptors by directory.
+	paths  map[int32]string // Directories by watch descriptor.
+}
+
+func newInotifyNotifier() (fileNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotifyNotifier{
+		fd: fd,
+		// A non-blocking file uses the runtime's poller, so closing it wakes
+		// the reader. Calling its Fd method would undo that.
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan fileEvent),
+		done:   make(chan bool),
+		dirs:   make(map[string]int32),
+		paths:  make(map[int32]string),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) Events() <-chan fileEvent {
+	return n.events
+}
+
+// Watches `dir` for changes to the files in it, if it isn't already.
+func (n *inotifyNotifier) Watch(dir string) (err error) {
+	dir = filepath.Clean(dir)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.dirs[dir]; ok {
+		return
+	}
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, notifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.dirs[dir] = int32(wd)
+	n.paths[int32(wd)] = dir
+	return
+}
+
+func (n *inotifyNotifier) Close() {
+	close(n.done)
+	n.file.Close()
+}
+
+func (n *inotifyNotifier) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*1024)
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(raw.Len)
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !n.send(fileEvent{Overflow: true}) {
+					return
+				}
+				continue
+			}
+			n.lock.Lock()
+			dir, ok := n.paths[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				// The directory was removed, it'll be watched again if it
+				// reappears.
+				delete(n.paths, raw.Wd)
+				delete(n.dirs, dir)
+				ok = false
+			}
+			n.lock.Unlock()
+			if !ok || raw.Len == 0 {
+				continue
+			}
+			name := string(buf[nameStart:offset])
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			event := fileEvent{
+				Path:    filepath.Join(dir, name),
+				Created: raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+			}
+			if !n.send(event) {
+				return
+			}
+		}
+	}
+}
+
+func (n *inotifyNotifier) send(event fileEvent) bool {
+	select {
+	case n.events <- event:
+		return true
+	case <-n.done:
+	}
+	return false
+}
@@ -0,0 +1,276 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Name of the config file section that enables the management API.
+const MANAGEMENT_SECTION = "management"
+
+type ManagementConfig struct {
+	// Address on which the management API listens for HTTP requests.
+	Address string `toml:"address"`
+}
+
+// Status of a single plugin runner as served by the management API.
+type pluginStatus struct {
+	Name   string                 `json:"name"`
+	Report map[string]interface{} `json:"report"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+type byName []*pluginStatus
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func newPluginStatus(name string, runner PluginRunner) (status *pluginStatus) {
+	status = &pluginStatus{
+		Name:   name,
+		Report: make(map[string]interface{}),
+	}
+	msg := new(message.Message)
+	if err := PopulateReportMsg(runner, msg); err != nil {
+		status.Error = err.Error()
+	}
+	for _, field := range msg.Fields {
+		status.Report[field.GetName()] = field.GetValue()
+	}
+	return
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Management API error writing response: %s", err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// Starts serving the management API if the config file enabled it.
+func (self *PipelineConfig) startManagement() (err error) {
+	if self.management == nil || self.management.Address == "" {
+		return
+	}
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", self.management.Address); err != nil {
+		return fmt.Errorf("Management API listen failed: %s", err)
+	}
+	go func() {
+		if err := http.Serve(listener, self.managementHandler()); err != nil {
+			log.Printf("Management API stopped: %s", err)
+		}
+	}()
+	log.Printf("Management API listening on %s", listener.Addr())
+	return
+}
+
+// Returns the HTTP handler serving the management API. Requests aren't
+// authenticated, so it should only listen on localhost:
+//
+//	GET  /health                   liveness and readiness
+//	GET  /inputs, /decoders,
+//	     /filters, /outputs        running plugins w/ their report data
+//	POST /plugins/<name>/stop      stop a plugin
+//	POST /plugins/<name>/start     start a stopped plugin from its config
+//	POST /plugins/<name>/restart   stop and start a plugin
+//	GET  /metrics                  pipeline stats in Prometheus text format
+func (self *PipelineConfig) managementHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", self.serveHealth)
+	for _, category := range []string{"inputs", "decoders", "filters", "outputs"} {
+		category := category
+		mux.HandleFunc("/"+category, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				writeJsonError(w, http.StatusMethodNotAllowed,
+					fmt.Errorf("%s not allowed", r.Method))
+				return
+			}
+			writeJson(w, http.StatusOK, self.pluginStatuses(category))
+		})
+	}
+	mux.HandleFunc("/plugins/", self.servePluginControl)
+	mux.HandleFunc("/metrics", self.serveMetrics)
+	return mux
+}
+
+// Always answers while hekad is up, but only reports ready, w/ a 200
+// status, while the pipeline is running and not shutting down.
+func (self *PipelineConfig) serveHealth(w http.ResponseWriter, r *http.Request) {
+	ready := atomic.LoadInt32(&self.running) == 1 && !Globals().Stopping
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, map[string]bool{"alive": true, "ready": ready})
+}
+
+func (self *PipelineConfig) pluginStatuses(category string) (statuses []*pluginStatus) {
+	self.controlLock.Lock()
+	defer self.controlLock.Unlock()
+
+	statuses = make([]*pluginStatus, 0)
+	self.forEachRunner(category, func(name string, runner PluginRunner) {
+		statuses = append(statuses, newPluginStatus(name, runner))
+	})
+	sort.Sort(byName(statuses))
+	return
+}
+
+// Calls `fn` for each running plugin in `category`, i.e. "inputs",
+// "decoders", "filters" or "outputs". Decoders are named after their
+// position in the DecoderSet pool, the same as in the plugin reports.
+func (self *PipelineConfig) forEachRunner(category string,
+	fn func(name string, runner PluginRunner)) {
+
+	switch category {
+	case "inputs":
+		self.inputsLock.Lock()
+		defer self.inputsLock.Unlock()
+		for name, runner := range self.InputRunners {
+			fn(name, runner)
+		}
+	case "decoders":
+		for i, dSet := range self.DecoderSets {
+			if dSet == nil {
+				continue
+			}
+			for name, runner := range dSet.AllByName() {
+				fn(fmt.Sprintf("%s-%d", name, i), runner)
+			}
+		}
+	case "filters":
+		self.filtersLock.Lock()
+		defer self.filtersLock.Unlock()
+		for name, runner := range self.FilterRunners {
+			fn(name, runner)
+		}
+	case "outputs":
+		self.outputsLock.Lock()
+		defer self.outputsLock.Unlock()
+		for name, runner := range self.OutputRunners {
+			fn(name, runner)
+		}
+	}
+}
+
+func (self *PipelineConfig) servePluginControl(w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != "POST" {
+		writeJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 {
+		writeJsonError(w, http.StatusNotFound,
+			fmt.Errorf("expected /plugins/<name>/<action>"))
+		return
+	}
+	name, action := parts[1], parts[2]
+	if action != "stop" && action != "start" && action != "restart" {
+		writeJsonError(w, http.StatusNotFound,
+			fmt.Errorf("unknown action: %s", action))
+		return
+	}
+	if status, err := self.controlPlugin(name, action); err != nil {
+		writeJsonError(w, status, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"name": name, "action": action})
+}
+
+// Stops, starts or restarts the named plugin, returning the HTTP status to
+// report if it fails. Nothing's started once hekad is shutting down.
+func (self *PipelineConfig) controlPlugin(name, action string) (status int,
+	err error) {
+
+	self.controlLock.Lock()
+	defer self.controlLock.Unlock()
+
+	if Globals().Stopping {
+		return http.StatusServiceUnavailable, fmt.Errorf("hekad is shutting down")
+	}
+
+	conf, ok := self.configSections[name]
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("no configured plugin named '%s'",
+			name)
+	}
+	category := sectionCategory(name, conf)
+	if category == "Decoder" {
+		return http.StatusBadRequest,
+			fmt.Errorf("decoders can't be controlled individually")
+	}
+	running := self.isRunning(name, category)
+
+	if action == "stop" || action == "restart" {
+		if !running && action == "stop" {
+			return http.StatusConflict, fmt.Errorf("'%s' isn't running", name)
+		}
+		if running {
+			log.Printf("Management API: stopping '%s'", name)
+			self.stopSection(name, category)
+		}
+	}
+	if action == "start" || action == "restart" {
+		if running && action == "start" {
+			return http.StatusConflict, fmt.Errorf("'%s' is already running", name)
+		}
+		log.Printf("Management API: starting '%s'", name)
+		if self.loadSection(name, conf) != 0 {
+			return http.StatusInternalServerError,
+				fmt.Errorf("loading '%s' failed, see the hekad log", name)
+		}
+		if err = self.startSection(name, category); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+func (self *PipelineConfig) isRunning(name, category string) (ok bool) {
+	switch category {
+	case "Input":
+		self.inputsLock.Lock()
+		_, ok = self.InputRunners[name]
+		self.inputsLock.Unlock()
+	case "Filter":
+		self.filtersLock.Lock()
+		_, ok = self.FilterRunners[name]
+		self.filtersLock.Unlock()
+	case "Output":
+		self.outputsLock.Lock()
+		_, ok = self.OutputRunners[name]
+		self.outputsLock.Unlock()
+	}
+	return
+}
@@ -0,0 +1,149 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func ManagementSpec(c gs.Context) {
+	origGlobals := Globals
+	pipeConfig := NewPipelineConfig(nil)
+	defer func() {
+		Globals = origGlobals
+	}()
+
+	request := func(method, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		c.Assume(err, gs.IsNil)
+		w := httptest.NewRecorder()
+		pipeConfig.managementHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	c.Specify("The management API", func() {
+		configPath := path.Join(os.TempDir(),
+			fmt.Sprintf("management-test-%d.toml", time.Now().UnixNano()))
+		defer os.Remove(configPath)
+		err := ioutil.WriteFile(configPath, []byte(`
+[management]
+address = "127.0.0.1:0"
+
+[LogOutput]
+message_matcher = "Type == 'management'"
+
+[counter]
+type = "CounterFilter"
+message_matcher = "Type == 'management'"
+`), 0600)
+		c.Assume(err, gs.IsNil)
+		err = pipeConfig.LoadFromConfigFile(configPath)
+		c.Assume(err, gs.IsNil)
+		c.Expect(pipeConfig.management.Address, gs.Equals, "127.0.0.1:0")
+
+		pipeConfig.router.Start()
+		err = pipeConfig.AddOutputRunner(pipeConfig.OutputRunners["LogOutput"])
+		c.Assume(err, gs.IsNil)
+		err = pipeConfig.AddFilterRunner(pipeConfig.FilterRunners["counter"])
+		c.Assume(err, gs.IsNil)
+
+		// Reports readiness only once the pipeline is running.
+		w := request("GET", "/health")
+		c.Expect(w.Code, gs.Equals, http.StatusServiceUnavailable)
+		atomic.StoreInt32(&pipeConfig.running, 1)
+		w = request("GET", "/health")
+		c.Expect(w.Code, gs.Equals, http.StatusOK)
+
+		// Lists the running plugins w/ their report data.
+		w = request("GET", "/filters")
+		c.Expect(w.Code, gs.Equals, http.StatusOK)
+		var statuses []pluginStatus
+		err = json.Unmarshal(w.Body.Bytes(), &statuses)
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(statuses), gs.Equals, 1)
+		c.Expect(statuses[0].Name, gs.Equals, "counter")
+		_, ok := statuses[0].Report["InChanCapacity"]
+		c.Expect(ok, gs.IsTrue)
+		w = request("GET", "/decoders")
+		err = json.Unmarshal(w.Body.Bytes(), &statuses)
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(statuses), gs.Equals, 4*Globals().DecoderPoolSize)
+
+		// Exposes the pipeline stats as Prometheus metrics.
+		w = request("GET", "/metrics")
+		c.Expect(w.Code, gs.Equals, http.StatusOK)
+		metrics := w.Body.String()
+		c.Expect(strings.Contains(metrics,
+			"# TYPE heka_router_messages_total counter\n"), gs.IsTrue)
+		c.Expect(strings.Contains(metrics,
+			`heka_channel_capacity{channel="inputRecycleChan"} `), gs.IsTrue)
+		c.Expect(strings.Contains(metrics,
+			`heka_plugin_messages_matched_total{plugin="counter",kind="filter"} 0`),
+			gs.IsTrue)
+		c.Expect(strings.Contains(metrics,
+			`heka_plugin_errors_total{plugin="LogOutput",kind="output"} 0`),
+			gs.IsTrue)
+		c.Expect(strings.Count(metrics, "# TYPE heka_plugin_inchan_length "),
+			gs.Equals, 1)
+
+		// Stops and starts plugins.
+		counter := pipeConfig.FilterRunners["counter"]
+		w = request("POST", "/plugins/counter/stop")
+		c.Expect(w.Code, gs.Equals, http.StatusOK)
+		_, ok = pipeConfig.FilterRunners["counter"]
+		c.Expect(ok, gs.IsFalse)
+		w = request("POST", "/plugins/counter/stop")
+		c.Expect(w.Code, gs.Equals, http.StatusConflict)
+		w = request("POST", "/plugins/counter/start")
+		c.Expect(w.Code, gs.Equals, http.StatusOK)
+		c.Expect(pipeConfig.FilterRunners["counter"] == counter, gs.IsFalse)
+		w = request("POST", "/plugins/LogOutput/restart")
+		c.Expect(w.Code, gs.Equals, http.StatusOK)
+
+		w = request("POST", "/plugins/nosuchplugin/start")
+		c.Expect(w.Code, gs.Equals, http.StatusNotFound)
+		w = request("POST", "/plugins/JsonDecoder/stop")
+		c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+		w = request("GET", "/plugins/counter/stop")
+		c.Expect(w.Code, gs.Equals, http.StatusMethodNotAllowed)
+
+		Globals().Stopping = true
+		defer func() {
+			Globals().Stopping = false
+		}()
+		// Nothing's started during a shutdown.
+		w = request("POST", "/plugins/counter/restart")
+		c.Expect(w.Code, gs.Equals, http.StatusServiceUnavailable)
+		c.Expect(pipeConfig.FilterRunners["counter"] == nil, gs.IsFalse)
+		for _, fRunner := range pipeConfig.FilterRunners {
+			close(fRunner.InChan())
+		}
+		pipeConfig.filtersWg.Wait()
+		for _, oRunner := range pipeConfig.OutputRunners {
+			close(oRunner.InChan())
+		}
+		pipeConfig.outputsWg.Wait()
+	})
+}
@@ -0,0 +1,247 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	METRIC_GAUGE   = "gauge"
+	METRIC_COUNTER = "counter"
+)
+
+// A Prometheus metric family, i.e. all samples sharing a metric name.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels []string // Alternating label names and values.
+	value  float64
+}
+
+// Collects metric families, keeping them in the order they're first used so
+// the output is stable.
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{byName: make(map[string]*metricFamily)}
+}
+
+// Adds a sample to the named family, creating the family if needed. `labels`
+// alternates label names and values.
+func (ms *metricSet) add(name, kind, help string, value float64,
+	labels ...string) {
+
+	family, ok := ms.byName[name]
+	if !ok {
+		family = &metricFamily{name: name, help: help, kind: kind}
+		ms.byName[name] = family
+		ms.families = append(ms.families, family)
+	}
+	family.samples = append(family.samples, metricSample{labels, value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes the metrics in the Prometheus text exposition format.
+func (ms *metricSet) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	for _, family := range ms.families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			buf.WriteString(family.name)
+			if len(sample.labels) > 0 {
+				buf.WriteByte('{')
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(&buf, `%s="%s"`, sample.labels[i],
+						labelEscaper.Replace(sample.labels[i+1]))
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatFloat(sample.value, 'g', -1, 64))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// Implemented by the runners that count the messages they handle and the
+// errors they log.
+type runnerCounter interface {
+	ProcessCount() int64
+	ErrorCount() int64
+}
+
+// Report fields that have metrics of their own.
+var reportMetricFields = map[string]bool{
+	"InChanCapacity": true,
+	"InChanLength":   true,
+	"DropCount":      true,
+	"AuthFailures":   true,
+}
+
+// Gathers the same data as the plugin report messages, plus the runner and
+// router message counters.
+func (self *PipelineConfig) collectMetrics() (ms *metricSet) {
+	self.controlLock.Lock()
+	defer self.controlLock.Unlock()
+
+	ms = newMetricSet()
+	chanLen := func(name string, length, capacity int) {
+		ms.add("heka_channel_length", METRIC_GAUGE,
+			"Number of items in an internal channel.", float64(length),
+			"channel", name)
+		ms.add("heka_channel_capacity", METRIC_GAUGE,
+			"Capacity of an internal channel.", float64(capacity),
+			"channel", name)
+	}
+	chanLen("inputRecycleChan", len(self.inputRecycleChan),
+		cap(self.inputRecycleChan))
+	chanLen("injectRecycleChan", len(self.injectRecycleChan),
+		cap(self.injectRecycleChan))
+	chanLen("Router", len(self.router.InChan()), cap(self.router.InChan()))
+	ms.add("heka_router_messages_total", METRIC_COUNTER,
+		"Messages handed to the filter and output matchers.",
+		float64(self.router.ProcessCount()))
+
+	var names []string
+	runners := make(map[string]PluginRunner)
+	for _, category := range []string{"inputs", "decoders", "filters", "outputs"} {
+		names = names[:0]
+		self.forEachRunner(category, func(name string, runner PluginRunner) {
+			names = append(names, name)
+			runners[name] = runner
+		})
+		sort.Strings(names)
+		for _, name := range names {
+			self.runnerMetrics(ms, category[:len(category)-1], name,
+				runners[name])
+		}
+	}
+	return
+}
+
+func (self *PipelineConfig) runnerMetrics(ms *metricSet, kind, name string,
+	runner PluginRunner) {
+
+	labels := []string{"plugin", name, "kind", kind}
+	var inChan, inChanCap int
+	switch r := runner.(type) {
+	case FilterRunner:
+		inChan, inChanCap = len(r.InChan()), cap(r.InChan())
+	case DecoderRunner:
+		inChan, inChanCap = len(r.InChan()), cap(r.InChan())
+	}
+	if kind != "input" {
+		ms.add("heka_plugin_inchan_length", METRIC_GAUGE,
+			"Number of messages waiting in a plugin's input channel.",
+			float64(inChan), labels...)
+		ms.add("heka_plugin_inchan_capacity", METRIC_GAUGE,
+			"Capacity of a plugin's input channel.", float64(inChanCap),
+			labels...)
+	}
+
+	counter, ok := runner.(runnerCounter)
+	var processed float64
+	if ok {
+		processed = float64(counter.ProcessCount())
+	}
+	if fRunner, isFilter := runner.(FilterRunner); isFilter {
+		if matcher := fRunner.MatchRunner(); matcher != nil {
+			processed = float64(matcher.InCount())
+			ms.add("heka_plugin_messages_matched_total", METRIC_COUNTER,
+				"Messages that matched a plugin's message_matcher.",
+				float64(matcher.MatchCount()), labels...)
+			ms.add("heka_plugin_messages_dropped_total", METRIC_COUNTER,
+				"Matched messages dropped by a plugin's overflow policy.",
+				float64(matcher.DropCount()), labels...)
+		}
+	}
+	ms.add("heka_plugin_messages_processed_total", METRIC_COUNTER,
+		"Messages injected by an input, decoded by a decoder, or seen by a "+
+			"filter or output's matcher.", processed, labels...)
+	if ok {
+		ms.add("heka_plugin_errors_total", METRIC_COUNTER,
+			"Errors logged by a plugin.", float64(counter.ErrorCount()),
+			labels...)
+	}
+
+	if authInput, ok := runner.Plugin().(AuthenticatingInput); ok {
+		ms.add("heka_plugin_auth_failures_total", METRIC_COUNTER,
+			"Signed messages an input discarded because they failed "+
+				"authentication.", float64(authInput.AuthFailures()), labels...)
+	}
+
+	// Anything else the plugin reports, e.g. TcpOutput stats.
+	msg := new(message.Message)
+	if err := PopulateReportMsg(runner, msg); err != nil {
+		log.Printf("Metrics error for '%s': %s", name, err)
+		return
+	}
+	for _, field := range msg.Fields {
+		if reportMetricFields[field.GetName()] {
+			continue
+		}
+		var value float64
+		switch v := field.GetValue().(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		case bool:
+			if v {
+				value = 1
+			}
+		default:
+			continue
+		}
+		ms.add("heka_plugin_report_value", METRIC_GAUGE,
+			"Numeric fields of a plugin's report message.", value,
+			append(labels, "field", field.GetName())...)
+	}
+}
+
+func (self *PipelineConfig) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := self.collectMetrics().WriteTo(w); err != nil {
+		log.Printf("Management API error writing metrics: %s", err)
+	}
+}
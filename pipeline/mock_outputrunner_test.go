@@ -64,6 +64,16 @@ func (_mr *_MockOutputRunnerRecorder) LogMessage(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "LogMessage", arg0)
 }
 
+func (_m *MockOutputRunner) MatchRunner() *MatchRunner {
+	ret := _m.ctrl.Call(_m, "MatchRunner")
+	ret0, _ := ret[0].(*MatchRunner)
+	return ret0
+}
+
+func (_mr *_MockOutputRunnerRecorder) MatchRunner() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MatchRunner")
+}
+
 func (_m *MockOutputRunner) Name() string {
 	ret := _m.ctrl.Call(_m, "Name")
 	ret0, _ := ret[0].(string)
@@ -16,6 +16,7 @@
 package pipeline
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/mozilla-services/heka/client"
@@ -25,6 +26,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +37,7 @@ type OutputRunner interface {
 	Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 	Ticker() (ticker <-chan time.Time)
 	Deliver(pack *PipelinePack)
+	MatchRunner() *MatchRunner
 }
 
 type Output interface {
@@ -90,11 +93,78 @@ func (self *LogOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 // Create a protocol buffers stream for the given message, put it in the given
 // byte slice.
 func createProtobufStream(pack *PipelinePack, outBytes *[]byte) (err error) {
+	return createCompressedStream(pack, message.Header_NONE, outBytes)
+}
+
+// Same as createProtobufStream, compressing the message w/ `compression`.
+func createCompressedStream(pack *PipelinePack,
+	compression message.Header_Compression, outBytes *[]byte) (err error) {
+
 	enc := client.NewProtobufEncoder(nil)
+	enc.SetCompression(compression)
 	err = enc.EncodeMessageStream(pack.Message, outBytes)
 	return
 }
 
+// Collects framed messages and packs them into compressed batch frames.
+type messageBatcher struct {
+	compression message.Header_Compression
+	maxSize     int
+	records     []byte
+	ends        []int // Where each message ends in `records`.
+	frame       []byte
+}
+
+func newMessageBatcher(compression message.Header_Compression,
+	maxSize int) *messageBatcher {
+
+	return &messageBatcher{
+		compression: compression,
+		maxSize:     maxSize,
+		records:     make([]byte, 0, maxSize),
+		frame:       make([]byte, 0, message.MAX_MESSAGE_SIZE),
+	}
+}
+
+// Adds a framed message, returning true once the batch is full.
+func (b *messageBatcher) add(record []byte) bool {
+	b.records = append(b.records, record...)
+	b.ends = append(b.ends, len(b.records))
+	return len(b.records) >= b.maxSize
+}
+
+// Appends the batched messages to `dst` as compressed frames and empties the
+// batch.
+func (b *messageBatcher) flush(dst []byte) []byte {
+	dst = b.appendFrames(dst, 0, len(b.ends))
+	b.records = b.records[:0]
+	b.ends = b.ends[:0]
+	return dst
+}
+
+// Frames messages `first` up to `last` as one batch, splitting it in two if
+// it doesn't compress small enough to fit in a frame. A lone message that
+// doesn't fit is appended as is.
+func (b *messageBatcher) appendFrames(dst []byte, first, last int) []byte {
+	if first == last {
+		return dst
+	}
+	start := 0
+	if first > 0 {
+		start = b.ends[first-1]
+	}
+	records := b.records[start:b.ends[last-1]]
+	if err := client.CreateBatchStream(records, b.compression, &b.frame, nil); err == nil {
+		return append(dst, b.frame...)
+	}
+	if last-first == 1 {
+		return append(dst, records...)
+	}
+	middle := (first + last) / 2
+	dst = b.appendFrames(dst, first, middle)
+	return b.appendFrames(dst, middle, last)
+}
+
 // FileWriter implementation
 var (
 	FILEFORMATS = map[string]bool{
@@ -117,6 +187,8 @@ type FileOutput struct {
 	file          *os.File
 	batchChan     chan []byte
 	backChan      chan []byte
+	compression   message.Header_Compression
+	batcher       *messageBatcher
 }
 
 type FileOutputConfig struct {
@@ -132,6 +204,12 @@ type FileOutputConfig struct {
 	// Interval at which accumulated file data should be written to disk, in
 	// milliseconds (default 1000, i.e. 1 second).
 	FlushInterval uint32
+	// Compression for the protobufstream format, one of "none", "gzip",
+	// "snappy" or "lz4".
+	Compression string
+	// Compress each batch of messages flushed to disk as a single frame,
+	// rather than each message on its own.
+	Compress_batches bool
 }
 
 func (o *FileOutput) ConfigStruct() interface{} {
@@ -145,6 +223,16 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 			conf.Format)
 		return
 	}
+	if o.compression, err = message.CompressionByName(conf.Compression); err != nil {
+		return fmt.Errorf("FileOutput '%s' %s", conf.Path, err)
+	}
+	if o.compression != message.Header_NONE && conf.Format != "protobufstream" {
+		return fmt.Errorf("FileOutput '%s' compression requires the "+
+			"protobufstream format", conf.Path)
+	}
+	if conf.Compress_batches && o.compression != message.Header_NONE {
+		o.batcher = newMessageBatcher(o.compression, message.MAX_BATCH_SIZE)
+	}
 	o.path = conf.Path
 	o.format = conf.Format
 	o.prefix_ts = conf.Prefix_ts
@@ -187,6 +275,9 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 		case plc, ok = <-inChan:
 			if !ok {
 				// Closed inChan => we're shutting down, flush data
+				if o.batcher != nil {
+					outBatch = o.batcher.flush(outBatch)
+				}
 				if len(outBatch) > 0 {
 					o.batchChan <- outBatch
 				}
@@ -195,12 +286,19 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 			}
 			if e = o.handleMessage(plc.Pack, &outBytes); e != nil {
 				or.LogError(e)
+			} else if o.batcher != nil {
+				if o.batcher.add(outBytes) {
+					outBatch = o.batcher.flush(outBatch)
+				}
 			} else {
 				outBatch = append(outBatch, outBytes...)
 			}
 			outBytes = outBytes[:0]
 			plc.Pack.Recycle()
 		case <-ticker:
+			if o.batcher != nil {
+				outBatch = o.batcher.flush(outBatch)
+			}
 			if len(outBatch) > 0 {
 				// This will block until the other side is ready to accept
 				// this batch, freeing us to start on the next one.
@@ -229,7 +327,11 @@ func (o *FileOutput) handleMessage(pack *PipelinePack, outBytes *[]byte) (err er
 		*outBytes = append(*outBytes, *pack.Message.Payload...)
 		*outBytes = append(*outBytes, NEWLINE)
 	case "protobufstream":
-		if err = createProtobufStream(pack, &*outBytes); err != nil {
+		compression := o.compression
+		if o.batcher != nil {
+			compression = message.Header_NONE
+		}
+		if err = createCompressedStream(pack, compression, &*outBytes); err != nil {
 			err = fmt.Errorf("FileOutput '%s' error encoding to ProtoBuf: %s", o.path, err)
 		}
 	default:
@@ -282,46 +384,300 @@ func (o *FileOutput) committer(wg *sync.WaitGroup) {
 
 // TcpOutput implementation
 type TcpOutput struct {
-	address    string
-	connection net.Conn
+	address           string
+	connection        net.Conn
+	queue             *diskQueue
+	backoff           *client.Backoff
+	reconnectAttempts int64
+	connected         int32
+	tlsConfig         *tls.Config
+	compression       message.Header_Compression
+	batcher           *messageBatcher
+	batchInterval     time.Duration
 }
 
 type TcpOutputConfig struct {
 	Address string
+	// Directory in which to spool outgoing messages until they've been
+	// successfully written to the network. No spooling happens if empty.
+	QueueDir string `toml:"queue_dir"`
+	// Maximum number of bytes the spool may hold, 0 means unlimited.
+	QueueMaxBufferSize int64 `toml:"queue_max_buffer_size"`
+	// Action to take when the spool is full, either "block" or "drop_oldest".
+	QueueFullAction string `toml:"queue_full_action"`
+	// Size in bytes at which spool segment files are rotated.
+	QueueSegmentSize int64 `toml:"queue_segment_size"`
+	// Milliseconds to wait before the first reconnect attempt after the
+	// connection fails. The delay doubles w/ each failed attempt.
+	ReconnectDelay uint `toml:"reconnect_delay"`
+	// Upper bound in milliseconds on the delay between reconnect attempts.
+	MaxReconnectDelay uint `toml:"max_reconnect_delay"`
+	// Connect using TLS, configured by the `tls` section.
+	UseTls bool      `toml:"use_tls"`
+	Tls    TlsConfig `toml:"tls"`
+	// Compression for outgoing messages, one of "none", "gzip", "snappy" or
+	// "lz4".
+	Compression string `toml:"compression"`
+	// Compress up to this many bytes of messages together in one frame,
+	// rather than each message on its own. 0 disables batching.
+	BatchSize int `toml:"batch_size"`
+	// Maximum milliseconds a partial batch waits before it's sent.
+	BatchInterval uint `toml:"batch_interval"`
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
-	return &TcpOutputConfig{Address: "localhost:9125"}
+	return &TcpOutputConfig{
+		Address:           "localhost:9125",
+		QueueFullAction:   "block",
+		QueueSegmentSize:  1024 * 1024,
+		ReconnectDelay:    250,
+		MaxReconnectDelay: 30000,
+		BatchInterval:     1000,
+	}
 }
 
 func (t *TcpOutput) Init(config interface{}) (err error) {
 	conf := config.(*TcpOutputConfig)
 	t.address = conf.Address
-	t.connection, err = net.Dial("tcp", t.address)
+	if conf.ReconnectDelay == 0 {
+		return fmt.Errorf("TcpOutput reconnect_delay must be greater than 0")
+	}
+	if conf.MaxReconnectDelay < conf.ReconnectDelay {
+		return fmt.Errorf("TcpOutput max_reconnect_delay must be at least %d",
+			conf.ReconnectDelay)
+	}
+	t.backoff = client.NewBackoff(
+		time.Duration(conf.ReconnectDelay)*time.Millisecond,
+		time.Duration(conf.MaxReconnectDelay)*time.Millisecond)
+	if conf.UseTls {
+		if t.tlsConfig, err = conf.Tls.ClientConfig(); err != nil {
+			return
+		}
+	}
+	if t.compression, err = message.CompressionByName(conf.Compression); err != nil {
+		return fmt.Errorf("TcpOutput %s", err)
+	}
+	if conf.BatchSize > 0 {
+		if t.compression == message.Header_NONE {
+			return fmt.Errorf("TcpOutput batch_size requires compression")
+		}
+		if conf.BatchSize > message.MAX_BATCH_SIZE {
+			return fmt.Errorf("TcpOutput batch_size must be at most %d",
+				message.MAX_BATCH_SIZE)
+		}
+		if conf.BatchInterval == 0 {
+			return fmt.Errorf("TcpOutput batch_interval must be greater than 0")
+		}
+		t.batcher = newMessageBatcher(t.compression, conf.BatchSize)
+		t.batchInterval = time.Duration(conf.BatchInterval) * time.Millisecond
+	}
+	if conf.QueueDir == "" {
+		// `send` dials once there's something to send.
+		return
+	}
+
+	if conf.QueueSegmentSize <= 0 {
+		return fmt.Errorf("TcpOutput queue_segment_size must be greater than 0")
+	}
+	if conf.QueueMaxBufferSize != 0 {
+		// The queue must hold at least the biggest record we'll push.
+		framing := int64(message.MAX_HEADER_SIZE + 3)
+		minSize := message.MAX_MESSAGE_SIZE + framing
+		if batchSize := int64(conf.BatchSize) + framing; batchSize > minSize {
+			minSize = batchSize
+		}
+		if conf.QueueMaxBufferSize < minSize {
+			return fmt.Errorf("TcpOutput queue_max_buffer_size must be 0 or at least %d",
+				minSize)
+		}
+	}
+
+	var dropOldest bool
+	switch conf.QueueFullAction {
+	case "block":
+	case "drop_oldest":
+		dropOldest = true
+	default:
+		return fmt.Errorf("TcpOutput unsupported queue_full_action: %s",
+			conf.QueueFullAction)
+	}
+	// The spool holds anything sent while the remote end is down, so we
+	// don't need it to be reachable yet.
+	t.queue, err = newDiskQueue(conf.QueueDir, conf.QueueMaxBufferSize,
+		conf.QueueSegmentSize, dropOldest)
 	return
 }
 
 func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
-	var e error
-	var n int
-	outBytes := make([]byte, 0, 2000)
+	// When spooling, the `sender` goroutine does the network writes.
+	var wg sync.WaitGroup
+	if t.queue != nil {
+		wg.Add(1)
+		go t.sender(or, &wg)
+	}
 
-	for plc := range or.InChan() {
-		outBytes = outBytes[:0]
+	var (
+		e        error
+		plc      *PipelineCapture
+		flush    <-chan time.Time
+		outBytes = make([]byte, 0, 2000)
+		frames   []byte
+		ok       = true
+	)
+	compression := t.compression
+	if t.batcher != nil {
+		// Messages are compressed together when their batch is sent.
+		compression = message.Header_NONE
+		ticker := time.NewTicker(t.batchInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	inChan := or.InChan()
 
-		if e = createProtobufStream(plc.Pack, &outBytes); e != nil {
-			or.LogError(e)
-			continue
+	for ok {
+		select {
+		case plc, ok = <-inChan:
+			if !ok {
+				break
+			}
+			outBytes = outBytes[:0]
+			e = createCompressedStream(plc.Pack, compression, &outBytes)
+			plc.Pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				continue
+			}
+			if t.batcher == nil {
+				t.emit(or, outBytes)
+			} else if t.batcher.add(outBytes) {
+				frames = t.batcher.flush(frames[:0])
+				t.emit(or, frames)
+			}
+		case <-flush:
+			if frames = t.batcher.flush(frames[:0]); len(frames) > 0 {
+				t.emit(or, frames)
+			}
 		}
+	}
+	if t.batcher != nil {
+		if frames = t.batcher.flush(frames[:0]); len(frames) > 0 {
+			t.emit(or, frames)
+		}
+	}
 
-		if n, e = t.connection.Write(outBytes); e != nil {
-			or.LogError(fmt.Errorf("writing to %s: %s", t.address, e))
-		} else if n != len(outBytes) {
-			or.LogError(fmt.Errorf("truncated output to: %s", t.address))
+	if t.queue != nil {
+		// Anything still queued is replayed the next time the output starts.
+		t.queue.Close()
+		wg.Wait()
+	} else if t.connection != nil {
+		t.connection.Close()
+	}
+	return
+}
+
+// Sends a record, or appends it to the disk queue for the `sender` goroutine
+// if spooling.
+func (t *TcpOutput) emit(or OutputRunner, record []byte) {
+	if t.queue == nil {
+		t.send(or, record)
+	} else if e := t.queue.Push(record); e != nil {
+		or.LogError(fmt.Errorf("queueing output to %s: %s", t.address, e))
+	}
+}
+
+// Writes queued records to the network, advancing the queue only after a
+// record is fully written.
+func (t *TcpOutput) sender(or OutputRunner, wg *sync.WaitGroup) {
+	var (
+		record []byte
+		ok     bool
+		e      error
+	)
+	for {
+		if record, ok = t.queue.Next(); !ok {
+			break
+		}
+		if !t.send(or, record) {
+			// Shutting down, the record stays queued for the next run. Run
+			// may be blocked pushing to a full queue that'll never drain.
+			t.queue.Wake()
+			break
+		}
+		if e = t.queue.Ack(); e != nil {
+			or.LogError(fmt.Errorf("updating queue checkpoint: %s", e))
 		}
 	}
+	if t.connection != nil {
+		t.connection.Close()
+	}
+	wg.Done()
+}
 
-	t.connection.Close()
+func (t *TcpOutput) dial() (conn net.Conn, err error) {
+	if t.tlsConfig == nil {
+		return net.Dial("tcp", t.address)
+	}
+	var tlsConn *tls.Conn
+	if tlsConn, err = tls.Dial("tcp", t.address, t.tlsConfig); err == nil {
+		conn = tlsConn
+	}
+	return
+}
 
+// Writes a record to the network, redialing w/ exponential backoff and
+// resending the whole record whenever the connection fails. Only gives up,
+// returning false, when Heka is shutting down.
+func (t *TcpOutput) send(or OutputRunner, record []byte) bool {
+	var (
+		n int
+		e error
+	)
+	for {
+		if t.connection == nil {
+			t.connection, e = t.dial()
+			if e != nil {
+				t.connection = nil
+				or.LogError(fmt.Errorf("dialing %s: %s", t.address, e))
+			}
+		}
+		if t.connection != nil {
+			if n, e = t.connection.Write(record); e == nil && n == len(record) {
+				atomic.StoreInt32(&t.connected, 1)
+				t.backoff.Reset()
+				return true
+			}
+			if e == nil {
+				e = fmt.Errorf("truncated output")
+			}
+			or.LogError(fmt.Errorf("writing to %s: %s", t.address, e))
+			t.connection.Close()
+			t.connection = nil
+		}
+		atomic.StoreInt32(&t.connected, 0)
+		if Globals().Stopping {
+			return false
+		}
+		atomic.AddInt64(&t.reconnectAttempts, 1)
+		time.Sleep(t.backoff.Next())
+	}
+}
+
+func (t *TcpOutput) ReportMsg(msg *message.Message) (err error) {
+	state := "disconnected"
+	if atomic.LoadInt32(&t.connected) == 1 {
+		state = "connected"
+	}
+	f, err := message.NewField("ConnectionState", state, message.Field_RAW)
+	if err != nil {
+		return
+	}
+	msg.AddField(f)
+	newIntField(msg, "ReconnectAttempts",
+		int(atomic.LoadInt64(&t.reconnectAttempts)))
+	if t.queue != nil {
+		size, dropped := t.queue.Stats()
+		newIntField(msg, "QueueSize", int(size))
+		newIntField(msg, "QueueDroppedBytes", int(dropped))
+	}
 	return
 }
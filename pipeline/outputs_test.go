@@ -21,11 +21,13 @@ import (
 	"code.google.com/p/goprotobuf/proto"
 	"encoding/json"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"sync"
 	"time"
 )
@@ -149,6 +151,46 @@ func OutputsSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("compresses batches of protocol buffer stream output", func() {
+			config.Format = "protobufstream"
+			config.Compression = "gzip"
+			config.Compress_batches = true
+			err := fileOutput.Init(config)
+			defer os.Remove(tmpFilePath)
+			c.Assume(err, gs.IsNil)
+			// The output recycles the pack, so encode our copy first.
+			msgBytes, err := proto.Marshal(pack.Message)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			wg.Add(1)
+			go fileOutput.receiver(oth.MockOutputRunner, &wg)
+			inChan <- plc
+			close(inChan)
+			outBatch := <-fileOutput.batchChan
+			wg.Wait()
+
+			header := new(message.Header)
+			batch := make([]byte, 0, 200)
+			pos, ok := findMessage(outBatch, header, &batch)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(pos, gs.Equals, len(outBatch))
+			c.Expect(header.GetBatch(), gs.IsTrue)
+			c.Expect(header.GetCompression(), gs.Equals, message.Header_GZIP)
+			header.Reset()
+			record := make([]byte, 0, 200)
+			_, ok = findMessage(batch, header, &record)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(bytes.Equal(record, msgBytes), gs.IsTrue)
+		})
+
+		c.Specify("requires protocol buffer stream output to compress", func() {
+			config.Compression = "snappy"
+			err := fileOutput.Init(config)
+			defer os.Remove(tmpFilePath)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("processes incoming messages", func() {
 			err := fileOutput.Init(config)
 			defer os.Remove(tmpFilePath)
@@ -277,11 +319,17 @@ func OutputsSpec(c gs.Context) {
 
 			err := tcpOutput.Init(config)
 			c.Assume(err, gs.IsNil)
+			tcpOutput.connection = nil
 
 			outStr := "Write me out to the network"
 			pack.Message.SetPayload(outStr)
+			// The output recycles the pack, so encode our copy first.
+			matchBytes := make([]byte, 0, 1000)
+			err = createProtobufStream(pack, &matchBytes)
+			c.Expect(err, gs.IsNil)
+
+			wg.Add(1)
 			go func() {
-				wg.Add(1)
 				tcpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
 				wg.Done()
 			}()
@@ -290,13 +338,290 @@ func OutputsSpec(c gs.Context) {
 			close(inChan)
 			wg.Wait() // wait for close to finish, prevents intermittent test failures
 
-			matchBytes := make([]byte, 0, 1000)
-			err = createProtobufStream(pack, &matchBytes)
-			c.Expect(err, gs.IsNil)
-
 			result = <-ch
 			c.Expect(result, gs.Equals, string(matchBytes))
 		})
+
+		c.Specify("writes compressed batches to the network", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					received <- nil
+					return
+				}
+				defer conn.Close()
+				b, _ := ioutil.ReadAll(conn)
+				received <- b
+			}()
+
+			config.Address = ln.Addr().String()
+			config.Compression = "lz4"
+			config.BatchSize = 1000
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			tcpOutput.connection = nil
+			msgBytes, err := proto.Marshal(pack.Message)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			wg.Add(1)
+			go func() {
+				tcpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				wg.Done()
+			}()
+			inChan <- plc
+			close(inChan)
+			wg.Wait()
+
+			result := <-received
+			header := new(message.Header)
+			batch := make([]byte, 0, 200)
+			_, ok := findMessage(result, header, &batch)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(header.GetBatch(), gs.IsTrue)
+			c.Expect(header.GetCompression(), gs.Equals, message.Header_LZ4)
+			header.Reset()
+			record := make([]byte, 0, 200)
+			_, ok = findMessage(batch, header, &record)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(bytes.Equal(record, msgBytes), gs.IsTrue)
+		})
+
+		c.Specify("rejects a reconnect_delay of 0", func() {
+			config.ReconnectDelay = 0
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("starts w/ the remote down", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = ln.Addr().String()
+			ln.Close()
+			err = tcpOutput.Init(config)
+			c.Expect(err, gs.IsNil)
+		})
+
+		c.Specify("rejects a queue too small for one record", func() {
+			config.QueueDir = path.Join(os.TempDir(),
+				fmt.Sprintf("tcpoutput-test-%d", time.Now().UnixNano()))
+			defer os.RemoveAll(config.QueueDir)
+			config.QueueMaxBufferSize = message.MAX_MESSAGE_SIZE
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config.QueueMaxBufferSize = 2 * message.MAX_MESSAGE_SIZE
+			config.Compression = "snappy"
+			config.BatchSize = 4 * message.MAX_MESSAGE_SIZE
+			err = tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config.QueueMaxBufferSize = 0
+			config.QueueSegmentSize = 0
+			err = tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("won't batch w/o compression", func() {
+			config.BatchSize = 1000
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("redials and resends after a failed write", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					received <- nil
+					return
+				}
+				defer conn.Close()
+				b := make([]byte, 1000)
+				n, _ := conn.Read(b)
+				received <- b[:n]
+			}()
+
+			config.Address = ln.Addr().String()
+			config.ReconnectDelay = 1
+			config.MaxReconnectDelay = 10
+			config.QueueDir = path.Join(os.TempDir(),
+				fmt.Sprintf("tcpoutput-test-%d", time.Now().UnixNano()))
+			defer os.RemoveAll(config.QueueDir)
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer tcpOutput.queue.Close()
+
+			mockConn := tcpOutput.connection.(*ts.MockConn)
+			mockConn.EXPECT().Write(gomock.Any()).Return(0, fmt.Errorf("broken pipe"))
+			mockConn.EXPECT().Close()
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+
+			record := make([]byte, 0, 1000)
+			err = createProtobufStream(pack, &record)
+			c.Assume(err, gs.IsNil)
+			c.Expect(tcpOutput.send(oth.MockOutputRunner, record), gs.IsTrue)
+			c.Expect(bytes.Equal(<-received, record), gs.IsTrue)
+			tcpOutput.connection.Close()
+
+			msg := getTestMessage()
+			err = tcpOutput.ReportMsg(msg)
+			c.Expect(err, gs.IsNil)
+			attempts, _ := msg.GetFieldValue("ReconnectAttempts")
+			c.Expect(attempts, gs.Equals, int64(1))
+			state, _ := msg.GetFieldValue("ConnectionState")
+			c.Expect(state, gs.Equals, "connected")
+		})
+
+		c.Specify("shuts down w/ a full queue and the remote down", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = ln.Addr().String()
+			ln.Close()
+			config.ReconnectDelay = 1
+			config.MaxReconnectDelay = 10
+			config.QueueDir = path.Join(os.TempDir(),
+				fmt.Sprintf("tcpoutput-test-%d", time.Now().UnixNano()))
+			defer os.RemoveAll(config.QueueDir)
+			record := make([]byte, 0, 1000)
+			err = createProtobufStream(pack, &record)
+			c.Assume(err, gs.IsNil)
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			// Room for only one record, less than Init allows.
+			tcpOutput.queue.maxSize = int64(len(record))
+			tcpOutput.connection = nil
+
+			recycleChan := make(chan *PipelinePack, 3)
+			inChan := make(chan *PipelineCapture, 3)
+			for i := 0; i < 3; i++ {
+				pack := NewPipelinePack(recycleChan)
+				pack.Message = getTestMessage()
+				inChan <- &PipelineCapture{Pack: pack}
+			}
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+			done := make(chan bool)
+			go func() {
+				tcpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				close(done)
+			}()
+			// Let the queue fill up w/ Run blocked on it.
+			time.Sleep(50 * time.Millisecond)
+			Globals().Stopping = true
+			defer func() {
+				Globals().Stopping = false
+			}()
+			close(inChan)
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				c.Expect("TcpOutput still running", gs.IsNil)
+			}
+		})
+	})
+
+	c.Specify("A disk queue", func() {
+		queueDir := path.Join(os.TempDir(),
+			fmt.Sprintf("diskqueue-test-%d", time.Now().UnixNano()))
+		defer os.RemoveAll(queueDir)
+
+		records := make([][]byte, 3)
+		for i := range records {
+			msg := getTestMessage()
+			msg.SetPayload(fmt.Sprintf("record %d", i))
+			pack := NewPipelinePack(pConfig.inputRecycleChan)
+			pack.Message = msg
+			err := createProtobufStream(pack, &records[i])
+			c.Assume(err, gs.IsNil)
+		}
+		recLen := int64(len(records[0]))
+
+		c.Specify("replays unacknowledged records after reopening", func() {
+			q, err := newDiskQueue(queueDir, 0, 1024*1024, false)
+			c.Assume(err, gs.IsNil)
+			for _, rec := range records {
+				c.Expect(q.Push(rec), gs.IsNil)
+			}
+			rec, ok := q.Next()
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(bytes.Equal(rec, records[0]), gs.IsTrue)
+			c.Expect(q.Ack(), gs.IsNil)
+
+			// Fetched but never acknowledged, must come back.
+			rec, ok = q.Next()
+			c.Expect(bytes.Equal(rec, records[1]), gs.IsTrue)
+			q.Close()
+
+			q, err = newDiskQueue(queueDir, 0, 1024*1024, false)
+			c.Assume(err, gs.IsNil)
+			defer q.Close()
+			size, _ := q.Stats()
+			c.Expect(size, gs.Equals, 2*recLen)
+			for _, expected := range records[1:] {
+				rec, ok = q.Next()
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(bytes.Equal(rec, expected), gs.IsTrue)
+				c.Expect(q.Ack(), gs.IsNil)
+			}
+			size, _ = q.Stats()
+			c.Expect(size, gs.Equals, int64(0))
+		})
+
+		c.Specify("drops the oldest segment when full", func() {
+			// One record per segment, room for two records.
+			q, err := newDiskQueue(queueDir, 2*recLen, recLen, true)
+			c.Assume(err, gs.IsNil)
+			defer q.Close()
+			for _, rec := range records {
+				c.Expect(q.Push(rec), gs.IsNil)
+			}
+			size, dropped := q.Stats()
+			c.Expect(size, gs.Equals, 2*recLen)
+			c.Expect(dropped, gs.Equals, recLen)
+			rec, ok := q.Next()
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(bytes.Equal(rec, records[1]), gs.IsTrue)
+		})
+
+		c.Specify("takes a record bigger than the queue when it's empty", func() {
+			q, err := newDiskQueue(queueDir, recLen-1, 1024*1024, false)
+			c.Assume(err, gs.IsNil)
+			defer q.Close()
+			done := make(chan error)
+			go func() {
+				done <- q.Push(records[0])
+			}()
+			select {
+			case err = <-done:
+				c.Expect(err, gs.IsNil)
+			case <-time.After(time.Second):
+				c.Expect("Push still blocked", gs.IsNil)
+				q.Close()
+			}
+			rec, ok := q.Next()
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(bytes.Equal(rec, records[0]), gs.IsTrue)
+		})
+
+		c.Specify("unblocks readers when closed", func() {
+			q, err := newDiskQueue(queueDir, 0, 1024*1024, false)
+			c.Assume(err, gs.IsNil)
+			done := make(chan bool)
+			go func() {
+				_, ok := q.Next()
+				done <- ok
+			}()
+			q.Close()
+			c.Expect(<-done, gs.IsFalse)
+		})
 	})
 
 	c.Specify("Runner recovers from panic in output's `Run()` method", func() {
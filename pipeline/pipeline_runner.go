@@ -91,6 +91,9 @@ type pRunnerBase struct {
 	name   string
 	plugin Plugin
 	h      PluginHelper
+	// Message and error counters, accessed atomically.
+	processCount int64
+	errorCount   int64
 }
 
 func (pr *pRunnerBase) Name() string {
@@ -105,6 +108,18 @@ func (pr *pRunnerBase) Plugin() Plugin {
 	return pr.plugin
 }
 
+// Number of messages the runner has handed on, i.e. injected by an input or
+// successfully decoded by a decoder. Filters and outputs count the messages
+// their MatchRunner delivers instead.
+func (pr *pRunnerBase) ProcessCount() int64 {
+	return atomic.LoadInt64(&pr.processCount)
+}
+
+// Number of errors the runner has logged.
+func (pr *pRunnerBase) ErrorCount() int64 {
+	return atomic.LoadInt64(&pr.errorCount)
+}
+
 type foRunner struct {
 	pRunnerBase
 	matcher    *MatchRunner
@@ -175,6 +190,7 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 }
 
 func (foRunner *foRunner) LogError(err error) {
+	atomic.AddInt64(&foRunner.errorCount, 1)
 	log.Printf("Plugin '%s' error: %s", foRunner.name, err)
 }
 
@@ -210,6 +226,9 @@ type PipelinePack struct {
 	RefCount     int32
 	Signer       string
 	MsgLoopCount uint
+	// Common name of the verified client certificate presented on the TLS
+	// connection the message arrived on.
+	ClientCommonName string
 }
 
 type PipelineCapture struct {
@@ -237,6 +256,7 @@ func (p *PipelinePack) Zero() {
 	p.RefCount = 1
 	p.MsgLoopCount = 0
 	p.Signer = ""
+	p.ClientCommonName = ""
 
 	// TODO: Possibly zero the message instead depending on benchmark
 	// results of re-allocating a new message
@@ -254,27 +274,35 @@ func (p *PipelinePack) Recycle() {
 func Run(config *PipelineConfig) {
 	log.Println("Starting hekad...")
 
-	var inputsWg sync.WaitGroup
-	var outputsWg sync.WaitGroup
 	var err error
 
 	for name, output := range config.OutputRunners {
-		outputsWg.Add(1)
-		if err = output.Start(config, &outputsWg); err != nil {
+		err = config.startRunner(name, &config.outputsWg,
+			func(wg *sync.WaitGroup) error {
+				return output.Start(config, wg)
+			})
+		if err != nil {
 			log.Printf("Output '%s' failed to start: %s", name, err)
-			outputsWg.Done()
 			continue
 		}
+		if matcher := output.MatchRunner(); matcher != nil {
+			config.router.addMatcher(matcher)
+		}
 		log.Println("Output started: ", name)
 	}
 
 	for name, filter := range config.FilterRunners {
-		config.filtersWg.Add(1)
-		if err = filter.Start(config, &config.filtersWg); err != nil {
+		err = config.startRunner(name, &config.filtersWg,
+			func(wg *sync.WaitGroup) error {
+				return filter.Start(config, wg)
+			})
+		if err != nil {
 			log.Printf("Filter '%s' failed to start: %s", name, err)
-			config.filtersWg.Done()
 			continue
 		}
+		if matcher := filter.MatchRunner(); matcher != nil {
+			config.router.addMatcher(matcher)
+		}
 		log.Println("Filter started: ", name)
 	}
 
@@ -287,15 +315,22 @@ func Run(config *PipelineConfig) {
 	config.router.Start()
 
 	for name, input := range config.InputRunners {
-		inputsWg.Add(1)
-		if err = input.Start(config, &inputsWg); err != nil {
+		err = config.startRunner(name, &config.inputsWg,
+			func(wg *sync.WaitGroup) error {
+				return input.Start(config, wg)
+			})
+		if err != nil {
 			log.Printf("Input '%s' failed to start: %s", name, err)
-			inputsWg.Done()
 			continue
 		}
 		log.Printf("Input started: %s\n", name)
 	}
 
+	if err = config.startManagement(); err != nil {
+		log.Println(err)
+	}
+	atomic.StoreInt32(&config.running, 1)
+
 	// wait for sigint
 	sigChan := make(chan os.Signal)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
@@ -306,13 +341,33 @@ func Run(config *PipelineConfig) {
 		case sig := <-sigChan:
 			switch sig {
 			case syscall.SIGHUP:
-				log.Println("Reload initiated.")
-				if err := notify.Post(RELOAD, nil); err != nil {
-					log.Println("Error sending reload event: ", err)
+				// Reloading waits on the plugins it stops, so it's done off
+				// this loop to keep SIGINT working.
+				if !atomic.CompareAndSwapInt32(&config.reloading, 0, 1) {
+					log.Println("Reload already in progress.")
+					break
 				}
+				log.Println("Reload initiated.")
+				go func() {
+					defer atomic.StoreInt32(&config.reloading, 0)
+					if config.configFilename != "" {
+						if err := config.Reload(); err != nil {
+							log.Println("Error reloading config: ", err)
+						}
+					}
+					if err := notify.Post(RELOAD, nil); err != nil {
+						log.Println("Error sending reload event: ", err)
+					}
+				}()
 			case syscall.SIGINT:
 				log.Println("Shutdown initiated.")
+				atomic.StoreInt32(&config.running, 0)
+				// Reloads and management requests check Stopping under the
+				// control lock, so one that's under way finishes before the
+				// plugins are stopped and none starts anything after.
+				config.controlLock.Lock()
 				globals.Stopping = true
+				config.controlLock.Unlock()
 			case syscall.SIGUSR1:
 				log.Println("Queue report initiated.")
 				go config.allReportsMsg()
@@ -325,14 +380,16 @@ func Run(config *PipelineConfig) {
 			log.Printf("PANIC during shutdown: %s", r)
 		}
 	}()
+	config.inputsLock.Lock()
 	for _, input := range config.InputRunners {
 		input.Input().Stop()
 		log.Printf("Stop message sent to input '%s'", input.Name())
 	}
-	inputsWg.Wait()
+	config.inputsLock.Unlock()
+	config.inputsWg.Wait()
 
 	log.Println("Waiting for decoders shutdown")
-	config.decodersWg.Wait()
+	config.stopDecoderSets()
 	log.Println("Decoders shutdown complete")
 
 	config.filtersLock.Lock()
@@ -343,10 +400,12 @@ func Run(config *PipelineConfig) {
 	config.filtersLock.Unlock()
 	config.filtersWg.Wait()
 
+	config.outputsLock.Lock()
 	for _, output := range config.OutputRunners {
 		close(output.InChan())
 		log.Printf("Stop message sent to output '%s'", output.Name())
 	}
-	outputsWg.Wait()
+	config.outputsLock.Unlock()
+	config.outputsWg.Wait()
 	log.Println("Shutdown complete.")
 }
@@ -53,9 +53,19 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		}
 	}
 
+	if authInput, ok := pr.Plugin().(AuthenticatingInput); ok {
+		newIntField(msg, "AuthFailures", int(authInput.AuthFailures()))
+	}
+
 	if fRunner, ok := pr.(FilterRunner); ok {
 		newIntField(msg, "InChanCapacity", cap(fRunner.InChan()))
 		newIntField(msg, "InChanLength", len(fRunner.InChan()))
+		if matcher := fRunner.MatchRunner(); matcher != nil {
+			newIntField(msg, "DropCount", int(matcher.DropCount()))
+			if matcher.spill != nil {
+				newIntField(msg, "SpillSize", int(matcher.SpillSize()))
+			}
+		}
 	} else if dRunner, ok := pr.(DecoderRunner); ok {
 		newIntField(msg, "InChanCapacity", cap(dRunner.InChan()))
 		newIntField(msg, "InChanLength", len(dRunner.InChan()))
@@ -16,6 +16,8 @@
 package pipeline
 
 import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"log"
 	"runtime"
@@ -26,23 +28,30 @@ import (
 type MessageRouter interface {
 	InChan() chan *PipelinePack
 	MrChan() chan *MatchRunner
+	OMrChan() chan *MatchRunner
 }
 
 // Pushes the message onto the input channel for every filter and output
-// plugin that is a match
+// plugin that is a match. All of the plugins' matchers are compiled into one
+// MatcherSet, so a test several of them share is only run once per message.
 type messageRouter struct {
-	inChan    chan *PipelinePack
-	mrChan    chan *MatchRunner
-	fMatchers []*MatchRunner
-	oMatchers []*MatchRunner
+	inChan     chan *PipelinePack
+	mrChan     chan *MatchRunner
+	oMrChan    chan *MatchRunner
+	matcherSet *message.MatcherSet
+	// Filter and output matchers, indexed by their matcherSet slot.
+	matchers []*MatchRunner
+	// Number of messages routed, accessed atomically.
+	processCount int64
 }
 
 func NewMessageRouter() (router *messageRouter) {
 	router = new(messageRouter)
 	router.inChan = make(chan *PipelinePack, Globals().PluginChanSize)
 	router.mrChan = make(chan *MatchRunner, 0)
-	router.fMatchers = make([]*MatchRunner, 0, 10)
-	router.oMatchers = make([]*MatchRunner, 0, 10)
+	router.oMrChan = make(chan *MatchRunner, 0)
+	router.matcherSet = message.NewMatcherSet()
+	router.matchers = make([]*MatchRunner, 0, 10)
 	return router
 }
 
@@ -50,75 +59,124 @@ func (self *messageRouter) InChan() chan *PipelinePack {
 	return self.inChan
 }
 
+// A filter's MatchRunner sent on this channel is added to the router if it
+// isn't already registered, otherwise it's removed and its input channel is
+// closed.
 func (self *messageRouter) MrChan() chan *MatchRunner {
 	return self.mrChan
 }
 
+// Same as MrChan, but for an output's MatchRunner.
+func (self *messageRouter) OMrChan() chan *MatchRunner {
+	return self.oMrChan
+}
+
+// Number of messages the router has handed to the filter and output
+// matchers.
+func (self *messageRouter) ProcessCount() int64 {
+	return atomic.LoadInt64(&self.processCount)
+}
+
+// Adds `matcher` to the router, or removes it and closes its input channel if
+// it's already there.
+func (self *messageRouter) toggleMatcher(matcher *MatchRunner) {
+	for slot, m := range self.matchers {
+		if matcher == m {
+			close(m.inChan)
+			self.matchers[slot] = nil
+			self.matcherSet.Remove(slot)
+			return
+		}
+	}
+	self.addMatcher(matcher)
+}
+
+func (self *messageRouter) addMatcher(matcher *MatchRunner) {
+	slot := self.matcherSet.Add(matcher.spec)
+	if slot == len(self.matchers) {
+		self.matchers = append(self.matchers, matcher)
+	} else {
+		self.matchers[slot] = matcher
+	}
+}
+
 func (self *messageRouter) Start() {
 	go func() {
 		var matcher *MatchRunner
 		var ok = true
 		var pack *PipelinePack
+		var matched []bool
 		for ok {
 			runtime.Gosched()
 			select {
 			case matcher = <-self.mrChan:
 				if matcher != nil {
-					removed := false
-					available := -1
-					for i, m := range self.fMatchers {
-						if m == nil {
-							available = i
-						}
-						if matcher == m {
-							close(m.inChan)
-							self.fMatchers[i] = nil
-							removed = true
-							break
-						}
-					}
-					if !removed {
-						if available != -1 {
-							self.fMatchers[available] = matcher
-						} else {
-							self.fMatchers = append(self.fMatchers, matcher)
-						}
-					}
+					self.toggleMatcher(matcher)
+				}
+			case matcher = <-self.oMrChan:
+				if matcher != nil {
+					self.toggleMatcher(matcher)
 				}
 			case pack, ok = <-self.inChan:
 				if !ok {
 					break
 				}
-				for _, matcher = range self.fMatchers {
-					if matcher != nil {
+				atomic.AddInt64(&self.processCount, 1)
+				matched = self.matcherSet.Match(pack.Message)
+				for slot, matcher := range self.matchers {
+					if matcher == nil {
+						continue
+					}
+					atomic.AddInt64(&matcher.inCount, 1)
+					if matched[slot] {
 						atomic.AddInt32(&pack.RefCount, 1)
-						matcher.inChan <- pack
+						plc := &PipelineCapture{Pack: pack}
+						if matcher.spec.HasCaptures() {
+							plc.Captures = self.matcherSet.Captures(slot,
+								pack.Message)
+						}
+						matcher.inChan <- plc
 					}
 				}
-				for _, matcher = range self.oMatchers {
-					atomic.AddInt32(&pack.RefCount, 1)
-					matcher.inChan <- pack
-				}
 				pack.Recycle()
 			}
 		}
-		for _, matcher = range self.fMatchers {
+		for _, matcher = range self.matchers {
 			if matcher != nil {
 				close(matcher.inChan)
 			}
 		}
-		for _, matcher = range self.oMatchers {
-			close(matcher.inChan)
-		}
 		log.Println("MessageRouter stopped.")
 	}()
 	log.Println("MessageRouter started.")
 }
 
+// Overflow policies, determining what a MatchRunner does w/ a matched
+// message when the plugin's input channel is full.
+const (
+	// Wait for the plugin to catch up, stalling the router.
+	OVERFLOW_BLOCK = "block"
+	// Discard the message that doesn't fit.
+	OVERFLOW_DROP_NEWEST = "drop_newest"
+	// Discard the oldest message waiting in the plugin's input channel.
+	OVERFLOW_DROP_OLDEST = "drop_oldest"
+	// Write messages to a disk queue, to be delivered once the plugin
+	// catches up.
+	OVERFLOW_SPILL = "spill"
+)
+
 type MatchRunner struct {
 	spec   *message.MatcherSpecification
 	signer string
-	inChan chan *PipelinePack
+	inChan chan *PipelineCapture
+	policy string
+	spill  *diskQueue
+	// Closed once the runner has stopped and closed its spill queue.
+	done chan bool
+	// Message counters, accessed atomically.
+	inCount    int64
+	matchCount int64
+	dropCount  int64
 }
 
 func NewMatchRunner(filter, signer string) (matcher *MatchRunner, err error) {
@@ -129,8 +187,31 @@ func NewMatchRunner(filter, signer string) (matcher *MatchRunner, err error) {
 	matcher = &MatchRunner{
 		spec:   spec,
 		signer: signer,
-		inChan: make(chan *PipelinePack, Globals().PluginChanSize),
+		inChan: make(chan *PipelineCapture, Globals().PluginChanSize),
+		policy: OVERFLOW_BLOCK,
+	}
+	return
+}
+
+// Sets the overflow policy, `spillDir` is the disk queue directory used by
+// the OVERFLOW_SPILL policy. An empty policy means OVERFLOW_BLOCK.
+func (mr *MatchRunner) SetOverflowPolicy(policy, spillDir string) (err error) {
+	switch policy {
+	case "":
+		policy = OVERFLOW_BLOCK
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST:
+	case OVERFLOW_SPILL:
+		if spillDir == "" {
+			return fmt.Errorf("overflow_policy '%s' requires an overflow_dir",
+				policy)
+		}
+		if mr.spill, err = newDiskQueue(spillDir, 0, 1024*1024, false); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("unsupported overflow_policy: %s", policy)
 	}
+	mr.policy = policy
 	return
 }
 
@@ -138,33 +219,215 @@ func (mr *MatchRunner) MatcherSpecification() *message.MatcherSpecification {
 	return mr.spec
 }
 
+// Number of messages the router has tested against the matcher.
+func (mr *MatchRunner) InCount() int64 {
+	return atomic.LoadInt64(&mr.inCount)
+}
+
+// Number of messages that passed the signer check and matched.
+func (mr *MatchRunner) MatchCount() int64 {
+	return atomic.LoadInt64(&mr.matchCount)
+}
+
+// Number of matched messages discarded because the plugin couldn't keep up.
+func (mr *MatchRunner) DropCount() int64 {
+	return atomic.LoadInt64(&mr.dropCount)
+}
+
+// Number of bytes waiting in the spill queue, if there is one.
+func (mr *MatchRunner) SpillSize() (size int64) {
+	if mr.spill != nil {
+		size, _ = mr.spill.Stats()
+	}
+	return
+}
+
 func (mr *MatchRunner) Start(matchChan chan *PipelineCapture) {
+	mr.done = make(chan bool)
+	if mr.spill != nil {
+		go mr.drainSpill(matchChan)
+	}
 	go func() {
 		defer func() {
-			if r := recover(); r != nil {
-				var err error
-				var ok bool
-				if err, ok = r.(error); !ok {
-					panic(r)
-				}
-				if !strings.Contains(err.Error(), "send on closed channel") {
-					panic(r)
-				}
+			if mr.spill != nil {
+				// Undelivered messages stay on disk for the next run.
+				mr.spill.Close()
 			}
+			close(mr.done)
+			recoverClosedSend(recover())
 		}()
 
-		for pack := range mr.inChan {
-			if len(mr.signer) != 0 && mr.signer != pack.Signer {
-				pack.Recycle()
+		// The router only sends the messages that match, w/ their captures.
+		for plc := range mr.inChan {
+			if len(mr.signer) != 0 && mr.signer != plc.Pack.Signer &&
+				mr.signer != plc.Pack.ClientCommonName {
+				plc.Pack.Recycle()
 				continue
 			}
-			match, captures := mr.spec.Match(pack.Message)
-			if match {
-				plc := &PipelineCapture{Pack: pack, Captures: captures}
-				matchChan <- plc
-			} else {
-				pack.Recycle()
+			atomic.AddInt64(&mr.matchCount, 1)
+			mr.deliver(plc, matchChan)
+		}
+	}()
+}
+
+// Waits for a started runner that's been removed from the router to finish
+// w/ the messages it was sent, so its spill queue is closed before another
+// runner opens the same overflow_dir.
+func (mr *MatchRunner) Wait() {
+	if mr != nil && mr.done != nil {
+		<-mr.done
+	}
+}
+
+// Swallows `r`, recovered from a panic, if it's from sending to a plugin's
+// input channel after it was closed on shutdown, and panics again otherwise.
+func recoverClosedSend(r interface{}) {
+	if r == nil {
+		return
+	}
+	if err, ok := r.(error); !ok ||
+		!strings.Contains(err.Error(), "send on closed channel") {
+		panic(r)
+	}
+}
+
+// Hands a matched message to the plugin, applying the overflow policy if the
+// plugin's input channel is full.
+func (mr *MatchRunner) deliver(plc *PipelineCapture,
+	matchChan chan *PipelineCapture) {
+
+	if mr.policy == OVERFLOW_BLOCK {
+		matchChan <- plc
+		return
+	}
+	// Once spilling has started everything goes through the spill queue
+	// until it's empty, so the plugin still sees messages in order.
+	if mr.policy != OVERFLOW_SPILL || mr.SpillSize() == 0 {
+		select {
+		case matchChan <- plc:
+			return
+		default:
+		}
+	}
+
+	switch mr.policy {
+	case OVERFLOW_DROP_NEWEST:
+		mr.drop(plc)
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case old, ok := <-matchChan:
+				if ok {
+					mr.drop(old)
+				}
+			default:
+			}
+			select {
+			case matchChan <- plc:
+				return
+			default:
+			}
+		}
+	case OVERFLOW_SPILL:
+		record, err := spillRecord(plc)
+		if err == nil {
+			err = mr.spill.Push(record)
+		}
+		if err != nil {
+			log.Printf("Error spilling message to disk: %s", err)
+			mr.drop(plc)
+			return
+		}
+		plc.Pack.Recycle()
+	}
+}
+
+// Type of the spill queue record that holds the captures of the message
+// spilled right after it.
+const spillCapturesType = "heka.spill-captures"
+
+// Frames a message for the spill queue, preceded by a record holding its
+// captures as fields if it has any.
+func spillRecord(plc *PipelineCapture) (record []byte, err error) {
+	record = make([]byte, 0, 2000)
+	if len(plc.Captures) > 0 {
+		captures := &PipelinePack{Message: new(message.Message)}
+		captures.Message.SetUuid(plc.Pack.Message.GetUuid())
+		captures.Message.SetTimestamp(plc.Pack.Message.GetTimestamp())
+		captures.Message.SetType(spillCapturesType)
+		for name, value := range plc.Captures {
+			var field *message.Field
+			if field, err = message.NewField(name, value, message.Field_RAW); err != nil {
+				return
 			}
+			captures.Message.AddField(field)
 		}
+		if err = createProtobufStream(captures, &record); err != nil {
+			return
+		}
+	}
+	msgRecord := make([]byte, 0, 2000)
+	if err = createProtobufStream(plc.Pack, &msgRecord); err == nil {
+		record = append(record, msgRecord...)
+	}
+	return
+}
+
+func (mr *MatchRunner) drop(plc *PipelineCapture) {
+	atomic.AddInt64(&mr.dropCount, 1)
+	plc.Pack.Recycle()
+}
+
+// Feeds spilled messages to the plugin, in order, as it has room for them.
+// The messages get packs from a small pool of their own, so a backed up
+// plugin can't use up the packs the inputs need.
+func (mr *MatchRunner) drainSpill(matchChan chan *PipelineCapture) {
+	defer func() {
+		// The plugin's input channel is closed on shutdown.
+		recoverClosedSend(recover())
 	}()
+
+	const poolSize = 2
+	pool := make(chan *PipelinePack, poolSize)
+	for i := 0; i < poolSize; i++ {
+		pool <- NewPipelinePack(pool)
+	}
+	header := new(message.Header)
+	var (
+		record   []byte
+		ok       bool
+		pack     *PipelinePack
+		captures map[string]string
+	)
+	for {
+		if record, ok = mr.spill.Next(); !ok {
+			return
+		}
+		pack = <-pool
+		header.Reset()
+		if _, ok = findMessage(record, header, &pack.MsgBytes); ok {
+			ok = proto.Unmarshal(pack.MsgBytes, pack.Message) == nil
+		}
+		switch {
+		case ok && pack.Message.GetType() == spillCapturesType:
+			captures = make(map[string]string, len(pack.Message.Fields))
+			for _, field := range pack.Message.Fields {
+				if value, isString := field.GetValue().(string); isString {
+					captures[field.GetName()] = value
+				}
+			}
+			pack.Recycle()
+		case ok:
+			pack.Decoded = true
+			matchChan <- &PipelineCapture{Pack: pack, Captures: captures}
+			captures = nil
+		default:
+			log.Println("Discarding corrupt spilled message")
+			pack.Recycle()
+			captures = nil
+		}
+		if err := mr.spill.Ack(); err != nil {
+			log.Printf("Error updating spill queue checkpoint: %s", err)
+		}
+	}
 }
@@ -0,0 +1,203 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"os"
+	"path"
+	"time"
+)
+
+func MatchRunnerSpec(c gs.Context) {
+	NewPipelineConfig(nil)
+	recycleChan := make(chan *PipelinePack, 10)
+	matchChan := make(chan *PipelineCapture, 1)
+
+	newCapture := func(payload string) *PipelineCapture {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message = getTestMessage()
+		pack.Message.SetPayload(payload)
+		return &PipelineCapture{Pack: pack}
+	}
+	payloads := []string{"first", "second", "third"}
+
+	matcher, err := NewMatchRunner("TRUE", "")
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("A MatchRunner", func() {
+		c.Specify("rejects an unknown overflow policy", func() {
+			err := matcher.SetOverflowPolicy("drop_everything", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires a directory to spill to", func() {
+			err := matcher.SetOverflowPolicy(OVERFLOW_SPILL, "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("drops the newest message when full", func() {
+			err := matcher.SetOverflowPolicy(OVERFLOW_DROP_NEWEST, "")
+			c.Assume(err, gs.IsNil)
+			for _, payload := range payloads {
+				matcher.deliver(newCapture(payload), matchChan)
+			}
+			plc := <-matchChan
+			c.Expect(plc.Pack.Message.GetPayload(), gs.Equals, "first")
+			c.Expect(matcher.DropCount(), gs.Equals, int64(2))
+			c.Expect(len(recycleChan), gs.Equals, 2)
+		})
+
+		c.Specify("drops the oldest message when full", func() {
+			err := matcher.SetOverflowPolicy(OVERFLOW_DROP_OLDEST, "")
+			c.Assume(err, gs.IsNil)
+			for _, payload := range payloads {
+				matcher.deliver(newCapture(payload), matchChan)
+			}
+			plc := <-matchChan
+			c.Expect(plc.Pack.Message.GetPayload(), gs.Equals, "third")
+			c.Expect(matcher.DropCount(), gs.Equals, int64(2))
+		})
+
+		c.Specify("spills to disk when full and delivers in order", func() {
+			spillDir := path.Join(os.TempDir(),
+				fmt.Sprintf("spill-test-%d", time.Now().UnixNano()))
+			defer os.RemoveAll(spillDir)
+			err := matcher.SetOverflowPolicy(OVERFLOW_SPILL, spillDir)
+			c.Assume(err, gs.IsNil)
+			defer matcher.spill.Close()
+
+			for _, payload := range payloads {
+				plc := newCapture(payload)
+				plc.Captures = map[string]string{"payload": payload}
+				matcher.deliver(plc, matchChan)
+			}
+			c.Expect(matcher.DropCount(), gs.Equals, int64(0))
+			c.Expect(matcher.SpillSize() > 0, gs.IsTrue)
+			// Spilled packs are recycled right away.
+			c.Expect(len(recycleChan), gs.Equals, 2)
+
+			go matcher.drainSpill(matchChan)
+			for _, payload := range payloads {
+				plc := <-matchChan
+				c.Expect(plc.Pack.Message.GetPayload(), gs.Equals, payload)
+				c.Expect(plc.Captures["payload"], gs.Equals, payload)
+				plc.Pack.Recycle()
+			}
+		})
+
+		c.Specify("closes its spill queue once it's stopped", func() {
+			spillDir := path.Join(os.TempDir(),
+				fmt.Sprintf("spill-test-%d", time.Now().UnixNano()))
+			defer os.RemoveAll(spillDir)
+			err := matcher.SetOverflowPolicy(OVERFLOW_SPILL, spillDir)
+			c.Assume(err, gs.IsNil)
+
+			matcher.Start(matchChan)
+			for _, payload := range payloads {
+				matcher.inChan <- newCapture(payload)
+			}
+			close(matcher.inChan)
+			matcher.Wait()
+			c.Expect(matcher.spill.Push([]byte("late")), gs.Not(gs.IsNil))
+			// Stops drainSpill, which is waiting for room in the channel.
+			close(matchChan)
+
+			// What wasn't delivered is left for the next run.
+			spill, err := newDiskQueue(spillDir, 0, 1024*1024, false)
+			c.Assume(err, gs.IsNil)
+			defer spill.Close()
+			size, _ := spill.Stats()
+			c.Expect(size > 0, gs.IsTrue)
+		})
+	})
+}
+
+func MessageRouterSpec(c gs.Context) {
+	NewPipelineConfig(nil)
+	recycleChan := make(chan *PipelinePack, 10)
+	router := NewMessageRouter()
+	router.Start()
+	defer close(router.InChan())
+
+	route := func(typ string) {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message = getTestMessage()
+		pack.Message.SetType(typ)
+		router.InChan() <- pack
+	}
+	receiveCapture := func(matcher *MatchRunner) *PipelineCapture {
+		select {
+		case plc := <-matcher.inChan:
+			return plc
+		case <-time.After(time.Second):
+		}
+		return nil
+	}
+	receive := func(matcher *MatchRunner) *PipelinePack {
+		if plc := receiveCapture(matcher); plc != nil {
+			return plc.Pack
+		}
+		return nil
+	}
+
+	test, err := NewMatchRunner("Type == 'TEST' && Severity == 6", "")
+	c.Assume(err, gs.IsNil)
+	other, err := NewMatchRunner("Type == 'OTHER' && Severity == 6", "")
+	c.Assume(err, gs.IsNil)
+	router.MrChan() <- test
+	router.OMrChan() <- other
+
+	c.Specify("A MessageRouter", func() {
+		c.Specify("only hands a message to the matchers it matches", func() {
+			route("TEST")
+			route("OTHER")
+			c.Expect(receive(test).Message.GetType(), gs.Equals, "TEST")
+			c.Expect(receive(other).Message.GetType(), gs.Equals, "OTHER")
+			c.Expect(len(test.inChan), gs.Equals, 0)
+			c.Expect(len(other.inChan), gs.Equals, 0)
+			c.Expect(test.InCount(), gs.Equals, int64(2))
+			c.Expect(other.InCount(), gs.Equals, int64(2))
+			c.Expect(router.ProcessCount(), gs.Equals, int64(2))
+		})
+
+		c.Specify("captures w/ the outcome of the match's samples", func() {
+			captured, err := NewMatchRunner(
+				"sample(0) || Type =~ /(?P<word>TE)ST/", "")
+			c.Assume(err, gs.IsNil)
+			router.MrChan() <- captured
+			route("TEST")
+			plc := receiveCapture(captured)
+			c.Assume(plc, gs.Not(gs.IsNil))
+			c.Expect(plc.Captures["word"], gs.Equals, "TE")
+		})
+
+		c.Specify("removes a matcher sent to it again", func() {
+			router.MrChan() <- test
+			_, ok := <-test.inChan
+			c.Expect(ok, gs.IsFalse)
+
+			added, err := NewMatchRunner("Type == 'TEST'", "")
+			c.Assume(err, gs.IsNil)
+			router.MrChan() <- added
+			route("TEST")
+			route("OTHER")
+			c.Expect(receive(added).Message.GetType(), gs.Equals, "TEST")
+			c.Expect(receive(other).Message.GetType(), gs.Equals, "OTHER")
+			c.Expect(added.InCount(), gs.Equals, int64(2))
+		})
+	})
+}
@@ -124,6 +124,15 @@ func createRunner(dir, name string, configSection toml.Primitive) (FilterRunner,
 			return nil, fmt.Errorf("Can't create message matcher for '%s': %s",
 				wrapper.name, err)
 		}
+		// Managed filters don't get to choose where to write on disk.
+		if pluginGlobals.OverflowPolicy == OVERFLOW_SPILL {
+			return nil, fmt.Errorf("overflow_policy '%s' isn't available to '%s'",
+				OVERFLOW_SPILL, wrapper.name)
+		}
+		if err = matcher.SetOverflowPolicy(pluginGlobals.OverflowPolicy, ""); err != nil {
+			return nil, fmt.Errorf("Can't set overflow policy for '%s': %s",
+				wrapper.name, err)
+		}
 		runner.matcher = matcher
 	}
 
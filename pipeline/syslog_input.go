@@ -0,0 +1,451 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	. "github.com/mozilla-services/heka/message"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of an RFC 3164 timestamp, which has no year.
+const rfc3164Layout = "Jan _2 15:04:05"
+
+type SyslogInputConfig struct {
+	// Network to listen on, one of "udp", "tcp" or "unixgram".
+	Net string
+	// Address to listen on, a path for "unixgram", or "fd:N" to use a socket
+	// passed in as file descriptor N, e.g. by socket activation.
+	Address string
+}
+
+// Receives syslog messages, in the RFC 5424 or the older BSD (RFC 3164)
+// format, setting the message headers and fields from their parts.
+type SyslogInput struct {
+	config     *SyslogInputConfig
+	packetConn net.PacketConn // For "udp" and "unixgram".
+	listener   net.Listener   // For "tcp".
+	hostname   string
+	ir         InputRunner
+	stopChan   chan bool
+	wg         sync.WaitGroup
+	connsLock  sync.Mutex
+	conns      map[net.Conn]bool
+}
+
+func (s *SyslogInput) ConfigStruct() interface{} {
+	return &SyslogInputConfig{Net: "udp"}
+}
+
+func (s *SyslogInput) Init(config interface{}) (err error) {
+	s.config = config.(*SyslogInputConfig)
+	if s.hostname, err = os.Hostname(); err != nil {
+		return
+	}
+	file, err := fdAddressFile(s.config.Address, "syslogFile")
+	if err != nil {
+		return
+	}
+	switch s.config.Net {
+	case "udp", "unixgram":
+		if file != nil {
+			s.packetConn, err = net.FilePacketConn(file)
+			file.Close()
+		} else {
+			if s.config.Net == "unixgram" {
+				// Clear away the socket left by an earlier run.
+				removeSocket(s.config.Address)
+			}
+			s.packetConn, err = net.ListenPacket(s.config.Net, s.config.Address)
+		}
+	case "tcp":
+		if file != nil {
+			s.listener, err = net.FileListener(file)
+			file.Close()
+		} else {
+			s.listener, err = net.Listen("tcp", s.config.Address)
+		}
+	default:
+		return fmt.Errorf("SyslogInput unsupported net: %s", s.config.Net)
+	}
+	if err != nil {
+		return fmt.Errorf("SyslogInput can't listen on %s: %s",
+			s.config.Address, err)
+	}
+	s.stopChan = make(chan bool)
+	s.conns = make(map[net.Conn]bool)
+	return
+}
+
+// Removes the unix socket at `path`, if that's what's there.
+func removeSocket(path string) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+func (s *SyslogInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	s.ir = ir
+	if s.packetConn != nil {
+		s.readPackets()
+	} else {
+		s.accept()
+	}
+	s.wg.Wait()
+	return
+}
+
+func (s *SyslogInput) Stop() {
+	close(s.stopChan)
+	if s.packetConn != nil {
+		s.packetConn.Close()
+		if s.config.Net == "unixgram" {
+			removeSocket(s.config.Address)
+		}
+		return
+	}
+	s.listener.Close()
+	s.connsLock.Lock()
+	for conn, _ := range s.conns {
+		conn.Close()
+	}
+	s.connsLock.Unlock()
+}
+
+func (s *SyslogInput) stopped() bool {
+	select {
+	case <-s.stopChan:
+		return true
+	default:
+	}
+	return false
+}
+
+// Reads a syslog message from each datagram.
+func (s *SyslogInput) readPackets() {
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, addr, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if s.stopped() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.ir.LogError(fmt.Errorf("Read error: %s", err))
+			return
+		}
+		host := s.hostname
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			host = udpAddr.IP.String()
+		}
+		s.deliver(buf[:n], host)
+	}
+}
+
+func (s *SyslogInput) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && !s.stopped() {
+				s.ir.LogError(fmt.Errorf("TCP accept failed: %s", err))
+				continue
+			}
+			return
+		}
+		s.connsLock.Lock()
+		if s.stopped() {
+			s.connsLock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.connsLock.Unlock()
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+}
+
+// Reads syslog messages from a TCP connection. Each message is either
+// preceded by its length and a space (octet counting), or ends w/ a newline,
+// as described in RFC 6587.
+func (s *SyslogInput) handleConnection(conn net.Conn) {
+	defer func() {
+		s.connsLock.Lock()
+		delete(s.conns, conn)
+		s.connsLock.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	host := s.hostname
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		host = tcpAddr.IP.String()
+	}
+	reader := bufio.NewReader(conn)
+	var record []byte
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] >= '0' && first[0] <= '9' {
+			// A length that doesn't fit in the buffer is no length at all.
+			var lengthBytes []byte
+			if lengthBytes, err = reader.ReadSlice(' '); err != nil {
+				return
+			}
+			lengthStr := string(lengthBytes)
+			length, err := strconv.Atoi(lengthStr[:len(lengthStr)-1])
+			if err != nil || length > MAX_MESSAGE_SIZE {
+				s.ir.LogError(fmt.Errorf("bad syslog message length from %s: %s",
+					host, lengthStr))
+				return
+			}
+			if cap(record) < length {
+				record = make([]byte, length)
+			}
+			record = record[:length]
+			if _, err = io.ReadFull(reader, record); err != nil {
+				return
+			}
+		} else {
+			// Gather the line a buffer at a time, giving up on a client
+			// that's sent too much w/o a newline.
+			record = record[:0]
+			var chunk []byte
+			for err = bufio.ErrBufferFull; err == bufio.ErrBufferFull; {
+				chunk, err = reader.ReadSlice('\n')
+				if len(record)+len(chunk) > MAX_MESSAGE_SIZE {
+					s.ir.LogError(fmt.Errorf("syslog message from %s too long",
+						host))
+					return
+				}
+				record = append(record, chunk...)
+			}
+			if err != nil && (err != io.EOF || len(record) == 0) {
+				return
+			}
+		}
+		s.deliver(record, host)
+	}
+}
+
+// Parses a syslog message and sends it on to the router.
+func (s *SyslogInput) deliver(record []byte, host string) {
+	line := strings.TrimRight(string(record), "\r\n\x00")
+	if line == "" {
+		return
+	}
+	pack := <-s.ir.InChan()
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetType("syslog")
+	if err := ParseSyslog(line, pack.Message, time.Now()); err != nil {
+		s.ir.LogError(fmt.Errorf("bad syslog message from %s: %s", host, err))
+		pack.Recycle()
+		return
+	}
+	if pack.Message.GetHostname() == "" {
+		pack.Message.SetHostname(host)
+	}
+	pack.Decoded = true
+	s.ir.Inject(pack)
+}
+
+// Adds a field w/ a single value to the message.
+func addSyslogField(msg *Message, name string, value interface{}) {
+	if field, err := NewField(name, value, Field_RAW); err == nil {
+		msg.AddField(field)
+	}
+}
+
+// Parses a syslog message in the RFC 5424 or the older BSD (RFC 3164) format
+// into `msg`. The severity and hostname, timestamp, app name or tag, and
+// process id set the message's headers, and the text its payload. The
+// facility, message id and structured data parameters become fields, the
+// parameters named "<SD-ID>.<PARAM-NAME>". `now` supplies the year that BSD
+// timestamps leave out.
+func ParseSyslog(line string, msg *Message, now time.Time) (err error) {
+	end := strings.IndexByte(line, '>')
+	if len(line) < 3 || line[0] != '<' || end < 2 || end > 4 {
+		return errors.New("missing PRI")
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri > 191 {
+		return fmt.Errorf("invalid PRI: %s", line[1:end])
+	}
+	msg.SetSeverity(int32(pri % 8))
+	addSyslogField(msg, "facility", int64(pri/8))
+	line = line[end+1:]
+	if strings.HasPrefix(line, "1 ") {
+		return parseRfc5424(line[2:], msg)
+	}
+	parseRfc3164(line, msg, now)
+	return
+}
+
+// Splits off the next space separated part of an RFC 5424 header.
+func nextSyslogPart(line string) (part, rest string, err error) {
+	if line == "" {
+		return "", "", errors.New("truncated header")
+	}
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], line[i+1:], nil
+	}
+	return line, "", nil
+}
+
+func parseRfc5424(line string, msg *Message) (err error) {
+	var parts [5]string
+	for i := range parts {
+		if parts[i], line, err = nextSyslogPart(line); err != nil {
+			return
+		}
+	}
+	timestamp, hostname, appName, procId, msgId := parts[0], parts[1],
+		parts[2], parts[3], parts[4]
+	if timestamp != "-" {
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			return fmt.Errorf("invalid timestamp: %s", timestamp)
+		}
+		msg.SetTimestamp(t.UnixNano())
+	}
+	if hostname != "-" {
+		msg.SetHostname(hostname)
+	}
+	if appName != "-" {
+		msg.SetLogger(appName)
+	}
+	if procId != "-" {
+		if pid, err := strconv.ParseInt(procId, 10, 32); err == nil {
+			msg.SetPid(int32(pid))
+		} else {
+			addSyslogField(msg, "procid", procId)
+		}
+	}
+	if msgId != "-" {
+		addSyslogField(msg, "msgid", msgId)
+	}
+	if strings.HasPrefix(line, "-") {
+		line = line[1:]
+	} else if line, err = parseStructuredData(line, msg); err != nil {
+		return
+	}
+	if strings.HasPrefix(line, " ") {
+		line = line[1:]
+	}
+	msg.SetPayload(strings.TrimPrefix(line, "\ufeff"))
+	return
+}
+
+// Adds a field for each parameter of the structured data elements at the
+// start of `line`, returning what follows them.
+func parseStructuredData(line string, msg *Message) (rest string, err error) {
+	if !strings.HasPrefix(line, "[") {
+		return "", errors.New("missing structured data")
+	}
+	for strings.HasPrefix(line, "[") {
+		line = line[1:]
+		idEnd := strings.IndexAny(line, " ]")
+		if idEnd < 1 {
+			return "", errors.New("invalid structured data id")
+		}
+		id := line[:idEnd]
+		line = line[idEnd:]
+		for strings.HasPrefix(line, " ") {
+			line = line[1:]
+			nameEnd := strings.Index(line, `="`)
+			if nameEnd < 1 {
+				return "", fmt.Errorf("invalid parameter in %s", id)
+			}
+			name := line[:nameEnd]
+			line = line[nameEnd+2:]
+			// The value runs to the first unescaped quote.
+			value := make([]byte, 0, len(line))
+			i := 0
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte(`"\]`,
+					line[i+1]) >= 0 {
+					i++
+				}
+				value = append(value, line[i])
+			}
+			if i == len(line) {
+				return "", fmt.Errorf("unterminated value of %s.%s", id, name)
+			}
+			line = line[i+1:]
+			addSyslogField(msg, id+"."+name, string(value))
+		}
+		if !strings.HasPrefix(line, "]") {
+			return "", fmt.Errorf("unterminated element %s", id)
+		}
+		line = line[1:]
+	}
+	return line, nil
+}
+
+// Parses a BSD syslog message, which is loosely specified, so anything that
+// doesn't look like a timestamp, hostname or tag is left in the payload.
+func parseRfc3164(line string, msg *Message, now time.Time) {
+	if len(line) > len(rfc3164Layout) && line[len(rfc3164Layout)] == ' ' {
+		t, err := time.ParseInLocation(rfc3164Layout, line[:len(rfc3164Layout)],
+			now.Location())
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			// Sent late in December, received early in January.
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			msg.SetTimestamp(t.UnixNano())
+			line = line[len(rfc3164Layout)+1:]
+			// Messages logged locally leave out the hostname, so the tag, which
+			// ends w/ a colon, comes next.
+			if i := strings.IndexByte(line, ' '); i > 0 &&
+				!strings.HasSuffix(line[:i], ":") {
+				msg.SetHostname(line[:i])
+				line = line[i+1:]
+			}
+		}
+	}
+
+	// The tag, and maybe a process id, e.g. "sshd[1234]: ".
+	if i := strings.IndexAny(line, "[: "); i > 0 && line[i] != ' ' {
+		tag, rest, pid := line[:i], line[i:], ""
+		if rest[0] == '[' {
+			if j := strings.IndexByte(rest, ']'); j > 0 {
+				pid, rest = rest[1:j], rest[j+1:]
+			}
+		}
+		if strings.HasPrefix(rest, ":") {
+			msg.SetLogger(tag)
+			if pidInt, err := strconv.ParseInt(pid, 10, 32); err == nil {
+				msg.SetPid(int32(pidInt))
+			}
+			line = strings.TrimPrefix(rest[1:], " ")
+		}
+	}
+	msg.SetPayload(line)
+}
@@ -0,0 +1,263 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"fmt"
+	. "github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func SyslogInputSpec(c gs.Context) {
+	t := &ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	msg := new(Message)
+	now := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+	fieldValue := func(name string) interface{} {
+		value, ok := msg.GetFieldValue(name)
+		c.Expect(ok, gs.IsTrue)
+		return value
+	}
+
+	c.Specify("ParseSyslog", func() {
+		c.Specify("parses an RFC 5424 message", func() {
+			err := ParseSyslog(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com `+
+				`evntslog 8710 ID47 [exampleSDID@32473 iut="3" `+
+				`eventSource="Appl\"ication"][other@1 a="b"] `+"\ufeff"+
+				`An application event log entry`, msg, now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(fieldValue("facility"), gs.Equals, int64(20))
+			c.Expect(msg.GetTimestamp(), gs.Equals,
+				time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC).UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "mymachine.example.com")
+			c.Expect(msg.GetLogger(), gs.Equals, "evntslog")
+			c.Expect(msg.GetPid(), gs.Equals, int32(8710))
+			c.Expect(fieldValue("msgid"), gs.Equals, "ID47")
+			c.Expect(fieldValue("exampleSDID@32473.iut"), gs.Equals, "3")
+			c.Expect(fieldValue("exampleSDID@32473.eventSource"), gs.Equals,
+				`Appl"ication`)
+			c.Expect(fieldValue("other@1.a"), gs.Equals, "b")
+			c.Expect(msg.GetPayload(), gs.Equals, "An application event log entry")
+		})
+
+		c.Specify("parses an RFC 5424 message w/ nil values", func() {
+			err := ParseSyslog("<13>1 - - - - - -", msg, now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetHostname(), gs.Equals, "")
+			c.Expect(msg.GetPayload(), gs.Equals, "")
+			c.Expect(len(msg.Fields), gs.Equals, 1)
+		})
+
+		c.Specify("parses a BSD message", func() {
+			err := ParseSyslog("<34>Oct 11 22:14:15 mymachine su[230]: 'su root' "+
+				"failed for lonvick on /dev/pts/8", msg, now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(2))
+			c.Expect(fieldValue("facility"), gs.Equals, int64(4))
+			// The year's from `now`, less one since October's in the future.
+			c.Expect(msg.GetTimestamp(), gs.Equals,
+				time.Date(2012, 10, 11, 22, 14, 15, 0, time.UTC).UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "mymachine")
+			c.Expect(msg.GetLogger(), gs.Equals, "su")
+			c.Expect(msg.GetPid(), gs.Equals, int32(230))
+			c.Expect(msg.GetPayload(), gs.Equals,
+				"'su root' failed for lonvick on /dev/pts/8")
+		})
+
+		c.Specify("parses a BSD message w/o a hostname", func() {
+			err := ParseSyslog("<14>May 31 08:00:00 cron: job done", msg, now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetTimestamp(), gs.Equals,
+				time.Date(2013, 5, 31, 8, 0, 0, 0, time.UTC).UnixNano())
+			c.Expect(msg.GetHostname(), gs.Equals, "")
+			c.Expect(msg.GetLogger(), gs.Equals, "cron")
+			c.Expect(msg.GetPayload(), gs.Equals, "job done")
+		})
+
+		c.Specify("keeps unrecognized BSD text in the payload", func() {
+			err := ParseSyslog("<14>just some text", msg, now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetPayload(), gs.Equals, "just some text")
+		})
+
+		c.Specify("rejects a message w/o a PRI", func() {
+			c.Expect(ParseSyslog("hello", msg, now), gs.Not(gs.IsNil))
+			c.Expect(ParseSyslog("<192>hello", msg, now), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects bad structured data", func() {
+			err := ParseSyslog(`<13>1 - - - - - [id a="b] msg`, msg, now)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A SyslogInput", func() {
+		input := new(SyslogInput)
+		config := input.ConfigStruct().(*SyslogInputConfig)
+		ir := NewMockInputRunner(ctrl)
+		packSupply := make(chan *PipelinePack, 2)
+		injected := make(chan *PipelinePack, 2)
+		ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+		ir.EXPECT().Inject(gomock.Any()).Do(func(pack *PipelinePack) {
+			injected <- pack
+		}).AnyTimes()
+		recycleChan := make(chan *PipelinePack, 2)
+		for i := 0; i < 2; i++ {
+			packSupply <- NewPipelinePack(recycleChan)
+		}
+
+		// Starts the input, sends it `data` over `network`, and returns the
+		// messages it injects.
+		receive := func(network, address string, data string, count int) (
+			msgs []*Message) {
+
+			done := make(chan bool)
+			go func() {
+				input.Run(ir, nil)
+				close(done)
+			}()
+			conn, err := net.Dial(network, address)
+			c.Assume(err, gs.IsNil)
+			_, err = conn.Write([]byte(data))
+			c.Assume(err, gs.IsNil)
+			conn.Close()
+			for i := 0; i < count; i++ {
+				select {
+				case pack := <-injected:
+					c.Expect(pack.Decoded, gs.IsTrue)
+					c.Expect(pack.Message.GetType(), gs.Equals, "syslog")
+					msgs = append(msgs, pack.Message)
+				case <-time.After(time.Second):
+					c.Expect(fmt.Sprintf("timed out after %d messages", i), gs.IsNil)
+					count = 0
+				}
+			}
+			input.Stop()
+			<-done
+			return
+		}
+
+		c.Specify("receives messages over UDP", func() {
+			config.Address = "127.0.0.1:0"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			msgs := receive("udp", input.packetConn.LocalAddr().String(),
+				"<14>Oct 11 22:14:15 host app: hello\n", 1)
+			c.Expect(len(msgs), gs.Equals, 1)
+			c.Expect(msgs[0].GetHostname(), gs.Equals, "host")
+			c.Expect(msgs[0].GetPayload(), gs.Equals, "hello")
+		})
+
+		c.Specify("receives octet counted and newline framed messages over TCP",
+			func() {
+				config.Net = "tcp"
+				config.Address = "127.0.0.1:0"
+				err := input.Init(config)
+				c.Assume(err, gs.IsNil)
+				first := "<13>1 - web1 app - - - multi\nline"
+				msgs := receive("tcp", input.listener.Addr().String(),
+					fmt.Sprintf("%d %s<14>app: second\n", len(first), first), 2)
+				c.Expect(len(msgs), gs.Equals, 2)
+				c.Expect(msgs[0].GetPayload(), gs.Equals, "multi\nline")
+				c.Expect(msgs[0].GetHostname(), gs.Equals, "web1")
+				c.Expect(msgs[1].GetPayload(), gs.Equals, "second")
+				// Filled in from the connection.
+				c.Expect(msgs[1].GetHostname(), gs.Equals, "127.0.0.1")
+			})
+
+		c.Specify("drops a TCP client that sends too long a line", func() {
+			config.Net = "tcp"
+			config.Address = "127.0.0.1:0"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			ir.EXPECT().LogError(gomock.Any())
+			done := make(chan bool)
+			go func() {
+				input.Run(ir, nil)
+				close(done)
+			}()
+			conn, err := net.Dial("tcp", input.listener.Addr().String())
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			// Never sends the newline.
+			go conn.Write([]byte("<14>app: " +
+				strings.Repeat("x", 2*MAX_MESSAGE_SIZE)))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			// Closed, so EOF or reset rather than a timeout.
+			_, err = conn.Read(make([]byte, 1))
+			c.Expect(err, gs.Not(gs.IsNil))
+			ne, ok := err.(net.Error)
+			c.Expect(ok && ne.Timeout(), gs.IsFalse)
+			input.Stop()
+			<-done
+		})
+
+		c.Specify("receives messages over a unix datagram socket", func() {
+			tmpDir, err := ioutil.TempDir("", "syslog-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			config.Net = "unixgram"
+			config.Address = path.Join(tmpDir, "log")
+			err = input.Init(config)
+			c.Assume(err, gs.IsNil)
+			msgs := receive("unixgram", config.Address,
+				"<30>Jun  1 08:00:00 sshd[12]: accepted", 1)
+			c.Expect(len(msgs), gs.Equals, 1)
+			c.Expect(msgs[0].GetLogger(), gs.Equals, "sshd")
+			c.Expect(msgs[0].GetPid(), gs.Equals, int32(12))
+			hostname, _ := os.Hostname()
+			c.Expect(msgs[0].GetHostname(), gs.Equals, hostname)
+			_, err = os.Stat(config.Address)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		c.Specify("listens on an inherited socket", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			file, err := conn.(*net.UDPConn).File()
+			c.Assume(err, gs.IsNil)
+			address := conn.LocalAddr().String()
+			conn.Close()
+			// The input closes the descriptor it's given, so it gets one
+			// that `file` won't close again, maybe after it's been reused.
+			fd, err := syscall.Dup(int(file.Fd()))
+			c.Assume(err, gs.IsNil)
+			file.Close()
+			config.Address = fmt.Sprintf("fd:%d", fd)
+			err = input.Init(config)
+			c.Assume(err, gs.IsNil)
+			msgs := receive("udp", address, "<14>app: inherited", 1)
+			c.Expect(len(msgs), gs.Equals, 1)
+			c.Expect(msgs[0].GetPayload(), gs.Equals, "inherited")
+		})
+
+		c.Specify("rejects an unknown net", func() {
+			config.Net = "sctp"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
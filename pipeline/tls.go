@@ -0,0 +1,126 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS settings shared by the TCP plugins, loaded from a plugin's `tls`
+// config section.
+type TlsConfig struct {
+	// PEM encoded certificate and private key presented to the other end.
+	// Required for a listener, optional for a client.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// PEM encoded CA certificates. A listener uses them to verify client
+	// certificates, a client to verify the server. If empty a client
+	// uses the host's root CAs.
+	CaFile string `toml:"ca_file"`
+	// Listener only, reject clients that don't present a certificate
+	// signed by one of the CAs in `CaFile`.
+	RequireClientCert bool `toml:"require_client_cert"`
+	// Client only, host name to verify the server certificate against.
+	// Defaults to the host part of the address being dialed.
+	ServerName string `toml:"server_name"`
+	// Client only, skip verification of the server certificate.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+}
+
+func (t *TlsConfig) loadCerts() (certs []tls.Certificate, err error) {
+	if t.CertFile == "" && t.KeyFile == "" {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS key pair: %s", err)
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+func (t *TlsConfig) loadCaPool() (pool *x509.CertPool, err error) {
+	if t.CaFile == "" {
+		return
+	}
+	pem, err := ioutil.ReadFile(t.CaFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading TLS CA file: %s", err)
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in TLS CA file '%s'",
+			t.CaFile)
+	}
+	return
+}
+
+// Returns the crypto/tls configuration for a listener.
+func (t *TlsConfig) ServerConfig() (config *tls.Config, err error) {
+	config = new(tls.Config)
+	if config.Certificates, err = t.loadCerts(); err != nil {
+		return nil, err
+	}
+	if len(config.Certificates) == 0 {
+		return nil, fmt.Errorf("TLS listener requires cert_file and key_file")
+	}
+	if config.ClientCAs, err = t.loadCaPool(); err != nil {
+		return nil, err
+	}
+	if t.RequireClientCert {
+		if config.ClientCAs == nil {
+			return nil, fmt.Errorf("require_client_cert needs a ca_file")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if config.ClientCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return
+}
+
+// Returns the crypto/tls configuration for a client connection.
+func (t *TlsConfig) ClientConfig() (config *tls.Config, err error) {
+	config = &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if config.Certificates, err = t.loadCerts(); err != nil {
+		return nil, err
+	}
+	if config.RootCAs, err = t.loadCaPool(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Returns the common name of the verified certificate the peer presented on
+// a TLS connection, or an empty string if there isn't one.
+func peerCommonName(conn *tls.Conn) string {
+	if err := conn.Handshake(); err != nil {
+		return ""
+	}
+	return stateCommonName(conn.ConnectionState())
+}
+
+// Returns the common name of a TLS connection's verified client certificate,
+// or an empty string if there isn't one.
+func stateCommonName(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
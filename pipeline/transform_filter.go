@@ -23,7 +23,7 @@ import (
 	"time"
 )
 
-var varMatcher *regexp.Regexp
+var varMatcher = regexp.MustCompile(`@(\w+)`)
 
 type MatchSet map[string]string
 
@@ -197,6 +197,29 @@ func InterpolateString(formatRegexp string, matchParts MatchSet) (newString stri
 		})
 }
 
+// Returns the values InterpolateString can use from a message: its Type,
+// Logger, Hostname, Severity, Pid and Uuid headers and the first value of
+// each of its fields.
+func messageMatchSet(msg *Message) MatchSet {
+	parts := MatchSet{
+		"Type":     msg.GetType(),
+		"Logger":   msg.GetLogger(),
+		"Hostname": msg.GetHostname(),
+		"Severity": strconv.Itoa(int(msg.GetSeverity())),
+		"Pid":      strconv.Itoa(int(msg.GetPid())),
+		"Uuid":     msg.GetUuidString(),
+	}
+	for _, field := range msg.Fields {
+		if _, ok := parts[field.GetName()]; ok {
+			continue
+		}
+		if value := field.GetValue(); value != nil {
+			parts[field.GetName()] = fmt.Sprint(value)
+		}
+	}
+	return parts
+}
+
 // Log an error in the pipeline pack during decoder processing
 func logError(err error, pipelinePack *PipelinePack) error {
 	log.Printf("Unable to properly parse message UUID: %s ERROR: %s",